@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// At most this much of a request body ends up in the access log.
+const accessLogMaxBody = 4 << 10
+
+const redacted = "[REDACTED]"
+
+// accessLogger logs one line per request, either as a JSON record through
+// slog or in the Apache combined format. Sensitive headers, query
+// parameters and body fields are redacted before anything is written.
+// Requests on the routes listed in cfg.Sampling are only logged for the
+// given fraction, except for errors (status >= 400) which are always kept.
+func accessLogger(cfg config.AccessLogConfig, logger *slog.Logger) echo.MiddlewareFunc {
+	redactHeaders := lowerSet(cfg.RedactHeaders)
+	redactFields := lowerSet(cfg.RedactFields)
+	sampling := parseSampling(cfg.Sampling)
+	combined := cfg.Format == "combined"
+	var out sync.Mutex
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+
+			var body []byte
+			if cfg.LogBody && !combined && req.Body != nil {
+				body, _ = io.ReadAll(io.LimitReader(req.Body, accessLogMaxBody))
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			}
+
+			err := next(c)
+			if err != nil {
+				// Let the error handler write the response now, so we log the
+				// status the client actually got.
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			if rate, ok := sampling[c.Path()]; ok && status < 400 && rand.Float64() >= rate {
+				return nil
+			}
+
+			if combined {
+				line := combinedLogLine(c, start)
+				out.Lock()
+				fmt.Fprintln(os.Stdout, line)
+				out.Unlock()
+				return nil
+			}
+
+			attrs := []slog.Attr{
+				slog.String("request_id", c.Response().Header().Get(echo.HeaderXRequestID)),
+				slog.String("method", req.Method),
+				slog.String("uri", redactURL(req.URL, redactFields)),
+				slog.String("route", c.Path()),
+				slog.Int("status", status),
+				slog.Int64("bytes", c.Response().Size),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_ip", c.RealIP()),
+				slog.String("user_agent", req.UserAgent()),
+			}
+			if cfg.LogHeaders {
+				headers := make(map[string]string, len(req.Header))
+				for name, values := range req.Header {
+					value := strings.Join(values, ", ")
+					if redactHeaders[strings.ToLower(name)] {
+						value = redacted
+					}
+					headers[name] = value
+				}
+				attrs = append(attrs, slog.Any("headers", headers))
+			}
+			if len(body) > 0 {
+				attrs = append(attrs, slog.String("body", redactBody(req.Header.Get(echo.HeaderContentType), body, redactFields)))
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(context.Background(), level, "request", attrs...)
+			return nil
+		}
+	}
+}
+
+// combinedLogLine formats the request in the Apache/NCSA combined log
+// format:
+//
+//	host - user [time] "request line" status bytes "referer" "user agent"
+func combinedLogLine(c echo.Context, start time.Time) string {
+	req := c.Request()
+	user := "-"
+	if u, _, ok := req.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	size := "-"
+	if c.Response().Size > 0 {
+		size = strconv.FormatInt(c.Response().Size, 10)
+	}
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+	// The query string is left out: it may hold secrets and this format
+	// leaves no room to redact them.
+	requestLine := req.Method + " " + req.URL.EscapedPath() + " " + req.Proto
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s",
+		c.RealIP(), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(requestLine), c.Response().Status, size,
+		quote(req.Referer()), quote(req.UserAgent()))
+}
+
+// redactURL returns the request URI with sensitive query parameters masked.
+func redactURL(u *url.URL, fields map[string]bool) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	for name := range query {
+		if fields[strings.ToLower(name)] {
+			query.Set(name, redacted)
+		}
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// redactBody masks sensitive fields of JSON and form bodies. Other content
+// types are not logged at all, as we can't tell what they contain.
+func redactBody(contentType string, body []byte, fields map[string]bool) string {
+	switch {
+	case strings.HasPrefix(contentType, echo.MIMEApplicationJSON):
+		var data interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			return "[unparsable JSON]"
+		}
+		out, _ := json.Marshal(redactJSON(data, fields))
+		return string(out)
+	case strings.HasPrefix(contentType, echo.MIMEApplicationForm):
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "[unparsable form]"
+		}
+		for name := range values {
+			if fields[strings.ToLower(name)] {
+				values.Set(name, redacted)
+			}
+		}
+		return values.Encode()
+	}
+	return "[" + strconv.Itoa(len(body)) + " bytes]"
+}
+
+func redactJSON(data interface{}, fields map[string]bool) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if fields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(value, fields)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value, fields)
+		}
+	}
+	return data
+}
+
+// parseSampling reads "route=rate" pairs, e.g. "/api/books=0.1" to log one
+// request out of ten on GET /api/books.
+func parseSampling(entries []string) map[string]float64 {
+	rates := map[string]float64{}
+	for _, entry := range entries {
+		route, value, ok := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || rate < 0 || rate > 1 {
+			slog.Warn("ignoring invalid access log sampling entry", "entry", entry)
+			continue
+		}
+		rates[strings.TrimSpace(route)] = rate
+	}
+	return rates
+}
+
+func lowerSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[strings.ToLower(item)] = true
+	}
+	return set
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// computeCatalogStats runs a single aggregation with one $facet per metric,
+// so the dashboard costs one round-trip to MongoDB. Documents don't store a
+// creation date, but the ObjectID does: we use it for the monthly numbers.
+func computeCatalogStats(ctx context.Context, coll *mongo.Collection) (store.CatalogStats, error) {
+	yearAsInt := bson.M{"$convert": bson.M{
+		"input":   "$BookYear",
+		"to":      "int",
+		"onError": nil,
+		"onNull":  nil,
+	}}
+	pagesAsInt := bson.M{"$convert": bson.M{
+		"input":   "$BookPages",
+		"to":      "int",
+		"onError": nil,
+		"onNull":  nil,
+	}}
+	addedMonth := bson.M{"$dateToString": bson.M{
+		"format": "%Y-%m",
+		"date":   bson.M{"$toDate": "$_id"},
+	}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{
+				bson.M{"$count": "n"},
+			},
+			"authors": bson.A{
+				bson.M{"$group": bson.M{"_id": "$BookAuthor"}},
+				bson.M{"$count": "n"},
+			},
+			"years": bson.A{
+				bson.M{"$project": bson.M{"year": yearAsInt}},
+				bson.M{"$match": bson.M{"year": bson.M{"$ne": nil}}},
+				bson.M{"$group": bson.M{
+					"_id":   nil,
+					"first": bson.M{"$min": "$year"},
+					"last":  bson.M{"$max": "$year"},
+				}},
+			},
+			"perYear": bson.A{
+				bson.M{"$project": bson.M{"year": yearAsInt}},
+				bson.M{"$match": bson.M{"year": bson.M{"$ne": nil}}},
+				bson.M{"$group": bson.M{"_id": "$year", "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+				bson.M{"$project": bson.M{"_id": 0, "year": bson.M{"$toString": "$_id"}, "count": 1}},
+			},
+			"pages": bson.A{
+				bson.M{"$project": bson.M{"pages": pagesAsInt}},
+				bson.M{"$match": bson.M{"pages": bson.M{"$gt": 0}}},
+				bson.M{"$group": bson.M{"_id": nil, "avg": bson.M{"$avg": "$pages"}}},
+			},
+			"perMonth": bson.A{
+				bson.M{"$group": bson.M{"_id": addedMonth, "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"topAuthors": bson.A{
+				bson.M{"$group": bson.M{"_id": "$BookAuthor", "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": 10},
+			},
+		}}},
+	}
+
+	var facets []struct {
+		Total []struct {
+			N int `bson:"n"`
+		} `bson:"total"`
+		Authors []struct {
+			N int `bson:"n"`
+		} `bson:"authors"`
+		Years []struct {
+			First int `bson:"first"`
+			Last  int `bson:"last"`
+		} `bson:"years"`
+		PerYear []store.YearCount `bson:"perYear"`
+		Pages   []struct {
+			Avg float64 `bson:"avg"`
+		} `bson:"pages"`
+		PerMonth   []store.MonthCount  `bson:"perMonth"`
+		TopAuthors []store.AuthorCount `bson:"topAuthors"`
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline, store.AggregateOpts(ctx))
+	if err != nil {
+		return store.CatalogStats{}, err
+	}
+	if err = cursor.All(ctx, &facets); err != nil {
+		return store.CatalogStats{}, err
+	}
+
+	stats := store.CatalogStats{PerYear: []store.YearCount{}, PerMonth: []store.MonthCount{}, TopAuthors: []store.AuthorCount{}, Growth: []store.GrowthPoint{}}
+	if len(facets) == 0 {
+		return stats, nil
+	}
+	f := facets[0]
+	if len(f.Total) > 0 {
+		stats.TotalBooks = f.Total[0].N
+	}
+	if len(f.Authors) > 0 {
+		stats.TotalAuthors = f.Authors[0].N
+	}
+	if len(f.Years) > 0 {
+		stats.FirstYear = f.Years[0].First
+		stats.LastYear = f.Years[0].Last
+	}
+	if len(f.Pages) > 0 {
+		stats.AveragePages = math.Round(f.Pages[0].Avg*10) / 10
+	}
+	stats.PerYear = append(stats.PerYear, f.PerYear...)
+	stats.TopAuthors = append(stats.TopAuthors, f.TopAuthors...)
+	// The months come oldest first, for the running total
+	total := 0
+	for _, m := range f.PerMonth {
+		total += m.Count
+		stats.Growth = append(stats.Growth, store.GrowthPoint{Month: m.Month, Added: m.Count, Total: total})
+	}
+	for i := len(f.PerMonth) - 1; i >= 0 && len(stats.PerMonth) < 12; i-- {
+		stats.PerMonth = append(stats.PerMonth, f.PerMonth[i])
+	}
+	return stats, nil
+}
+
+// cachedCatalogStats returns computeCatalogStats through the catalog cache,
+// so the dashboard and GET /api/stats only run the aggregation once per
+// write.
+func cachedCatalogStats(ctx context.Context, catalog *ttlCache, repo guardedBooks) (store.CatalogStats, error) {
+	return cached(ctx, catalog, "stats", func(ctx context.Context) (store.CatalogStats, error) {
+		return guardedQuery(ctx, repo, func(coll *mongo.Collection) (store.CatalogStats, error) {
+			return computeCatalogStats(ctx, coll)
+		})
+	})
+}
+
+// registerAdminRoutes mounts the operator pages on the given group.
+func registerAdminRoutes(g *echo.Group, coll *mongo.Collection, repo guardedBooks, catalog *ttlCache, searcher searchBackend, files fileStore, profiles *importProfiles) {
+	g.GET("", func(c echo.Context) error {
+		stats, err := cachedCatalogStats(c.Request().Context(), catalog, repo)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return render.Page(c, http.StatusOK, "admin", stats)
+	})
+
+	// GET /admin/lint scans the catalog for data quality problems, like
+	// the lint command.
+	g.GET("/lint", func(c echo.Context) error {
+		report, err := lintCatalog(c.Request().Context(), coll, files)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not check the catalog")
+		}
+		return c.JSON(http.StatusOK, report)
+	})
+
+	// POST /admin/import loads an uploaded file, like the import command.
+	// The format comes from the "format" field or the file extension, and
+	// the columns of a CSV file from the import profile named in the
+	// "profile" field, if any (see importprofiles.go).
+	g.POST("/import", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		file, err := c.FormFile("file")
+		if err != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "Missing file")
+		}
+		var profile *ImportProfile
+		if name := c.FormValue("profile"); name != "" {
+			p, err := profiles.Get(ctx, name)
+			if errors.Is(err, errUnknownProfile) {
+				return handlers.JSONError(c, http.StatusBadRequest, "Unknown import profile "+name)
+			}
+			if err != nil {
+				return handlers.ServerError(c, err, "Database error")
+			}
+			profile = &p
+		}
+		format := c.FormValue("format")
+		if format == "" && profile != nil {
+			format = "csv"
+		}
+		if format == "" {
+			format = formatFromPath(file.Filename)
+		}
+		if !slices.Contains(importFormats(), format) {
+			return handlers.JSONError(c, http.StatusBadRequest, "Unknown format "+format)
+		}
+		r, err := file.Open()
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not read the upload")
+		}
+		defer r.Close()
+
+		summary, err := importBooks(ctx, coll, format, r, profile, func(book store.Book) {
+			searcher.Indexed(ctx, book)
+		})
+		if summary.Inserted > 0 {
+			catalog.invalidate()
+		}
+		if err != nil {
+			// The summary still tells what was imported before the error
+			body := handlers.ErrorBody(c, err.Error())
+			body["summary"] = summary
+			return c.JSON(http.StatusBadRequest, body)
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "import-summary", summary)
+		}
+		return c.JSON(http.StatusOK, summary)
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage analytics count, per day, the requests to each route, the searches
+// and the views of the books, for the Trending page. Nothing about the
+// visitors is kept: no address, user or cookie. Search terms are counted
+// under their HMAC, the term itself only being written once searched
+// minPopularSearchCount times in a day, so a one-off search for someone's
+// name is never stored. The key is secret, so the hashes can't be matched
+// against guessed terms; it doesn't change, as the Trending page adds up
+// the counts of a term over several days. Visitors sending DNT: 1 or
+// Sec-GPC: 1 are not counted, and ANALYTICS=false turns counting off.
+const usageStatsCollection = "usage_stats"
+
+// usageKeysCollection holds the key of the hashes when ANALYTICS_KEY is
+// not set, so the instances share it.
+const usageKeysCollection = "usage_keys"
+
+const (
+	// The counts are kept in memory and written this often
+	usageFlushInterval = time.Minute
+	// A search term is only shown once searched this many times
+	minPopularSearchCount = 3
+	maxSearchTermLength   = 100
+
+	defaultTrendingDays  = 7
+	maxTrendingDays      = 90
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 50
+)
+
+// The kinds of usage counted.
+const (
+	usageRoute  = "route"
+	usageSearch = "search"
+	usageView   = "view"
+)
+
+type usageKey struct {
+	day  time.Time
+	kind string
+	// The route, the search term or the ID of the book. The term is only
+	// hashed when written.
+	key string
+}
+
+// usageRecorder counts the usage in memory, until it is written to
+// usageStatsCollection.
+type usageRecorder struct {
+	stats *mongo.Collection
+	keys  *mongo.Collection
+	// The key of the hashes of the search terms, loaded on the first
+	// write when not configured
+	hashKey []byte
+
+	mu     sync.Mutex
+	counts map[usageKey]int
+}
+
+func newUsageRecorder(db *mongo.Database, hashKey string) *usageRecorder {
+	r := &usageRecorder{
+		stats:  db.Collection(usageStatsCollection),
+		keys:   db.Collection(usageKeysCollection),
+		counts: map[usageKey]int{},
+	}
+	if hashKey != "" {
+		r.hashKey = []byte(hashKey)
+	}
+	return r
+}
+
+func (r *usageRecorder) add(kind, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	r.counts[usageKey{day, kind, key}]++
+}
+
+// normalizeSearchTerm lowercases the term and collapses its spaces. Terms
+// looking like an email address are dropped.
+func normalizeSearchTerm(q string) string {
+	term := strings.Join(strings.Fields(strings.ToLower(q)), " ")
+	if strings.Contains(term, "@") {
+		return ""
+	}
+	if runes := []rune(term); len(runes) > maxSearchTermLength {
+		term = string(runes[:maxSearchTermLength])
+	}
+	return term
+}
+
+// searchTermHash is the HMAC-SHA256 of the term, truncated to 128 bits.
+func searchTermHash(key []byte, term string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(term))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// loadHashKey returns the key of the hashes, creating a random one in
+// usageKeysCollection the first time.
+func (r *usageRecorder) loadHashKey(ctx context.Context) ([]byte, error) {
+	if r.hashKey != nil {
+		return r.hashKey, nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Key []byte `bson:"key"`
+	}
+	// Only the first instance to get here sets it
+	err := r.keys.FindOneAndUpdate(ctx, bson.M{"_id": "search"},
+		bson.M{"$setOnInsert": bson.M{"key": random}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		err = r.keys.FindOne(ctx, bson.M{"_id": "search"}).Decode(&doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.hashKey = doc.Key
+	return r.hashKey, nil
+}
+
+// flush writes the counts so far, adding them to those of the database.
+// They are dropped if that fails: analytics aren't worth retrying for.
+func (r *usageRecorder) flush(ctx context.Context) {
+	r.mu.Lock()
+	counts := r.counts
+	r.counts = map[usageKey]int{}
+	r.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	hashKey, err := r.loadHashKey(ctx)
+	if err != nil {
+		slog.Warn("failed to load the key of the search hashes", "error", err)
+		return
+	}
+	models := make([]mongo.WriteModel, 0, len(counts))
+	// The terms are only written once searched minPopularSearchCount times
+	// that day, the others staying a hash
+	var named []mongo.WriteModel
+	for k, n := range counts {
+		key := k.key
+		if k.kind == usageSearch {
+			key = searchTermHash(hashKey, k.key)
+		}
+		filter := bson.M{"kind": k.kind, "day": k.day, "key": key}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$inc": bson.M{"count": n}}).
+			SetUpsert(true))
+		if k.kind == usageSearch {
+			named = append(named, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{
+					"kind":  k.kind,
+					"day":   k.day,
+					"key":   key,
+					"count": bson.M{"$gte": minPopularSearchCount},
+					"term":  bson.M{"$exists": false},
+				}).
+				SetUpdate(bson.M{"$set": bson.M{"term": k.key}}))
+		}
+	}
+	if _, err := r.stats.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		slog.Warn("failed to write usage stats", "entries", len(models), "error", err)
+		return
+	}
+	if len(named) == 0 {
+		return
+	}
+	if _, err := r.stats.BulkWrite(ctx, named, options.BulkWrite().SetOrdered(false)); err != nil {
+		slog.Warn("failed to name popular searches", "entries", len(named), "error", err)
+	}
+}
+
+// Run writes the counts every usageFlushInterval, and a last time once ctx
+// is done.
+func (r *usageRecorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			r.flush(ctx)
+			cancel()
+			return
+		case <-ticker.C:
+			r.flush(ctx)
+		}
+	}
+}
+
+// countUsage counts the requests handled: the route of every one, and the
+// search terms and the books viewed of the successful ones.
+func countUsage(r *usageRecorder) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			req := c.Request()
+			if err != nil || c.Path() == "" || req.Header.Get("DNT") == "1" || req.Header.Get("Sec-GPC") == "1" {
+				return err
+			}
+			r.add(usageRoute, req.Method+" "+c.Path())
+			if req.Method != http.MethodGet || c.Response().Status != http.StatusOK {
+				return nil
+			}
+			switch c.Path() {
+			case "/search/results", "/api/books/search":
+				if term := normalizeSearchTerm(c.QueryParam("q")); term != "" {
+					r.add(usageSearch, term)
+				}
+			case "/books/:id":
+				r.add(usageView, c.Param("id"))
+			}
+			return nil
+		}
+	}
+}
+
+// usageCount is the total of a key over the days asked for. Term is empty
+// for the searches never popular on a single day.
+type usageCount struct {
+	Key   string `bson:"_id"`
+	Term  string `bson:"term"`
+	Count int    `bson:"count"`
+}
+
+// top returns the keys of kind counted the most since the given day, with
+// at least atLeast counts.
+func (r *usageRecorder) top(ctx context.Context, kind string, since time.Time, atLeast, limit int) ([]usageCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"kind": kind, "day": bson.M{"$gte": since}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$key",
+			"count": bson.M{"$sum": "$count"},
+			"term":  bson.M{"$max": "$term"},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gte": atLeast}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := r.stats.Aggregate(ctx, pipeline, store.AggregateOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	counts := []usageCount{}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// SearchCount is a search term with how many times it was searched.
+type SearchCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// ViewCount is a book with how many times its page was viewed.
+type ViewCount struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Views  int    `json:"views"`
+}
+
+// Trending is the data passed to the "trending" block, over the last Days
+// days.
+type Trending struct {
+	Days     int
+	Searches []SearchCount
+	Books    []ViewCount
+}
+
+func (r *usageRecorder) popularSearches(ctx context.Context, since time.Time, limit int) ([]SearchCount, error) {
+	counts, err := r.top(ctx, usageSearch, since, minPopularSearchCount, limit)
+	if err != nil {
+		return nil, err
+	}
+	searches := []SearchCount{}
+	for _, c := range counts {
+		if c.Term != "" {
+			searches = append(searches, SearchCount{Term: c.Term, Count: c.Count})
+		}
+	}
+	return searches, nil
+}
+
+// mostViewed returns the books viewed the most, leaving out those deleted
+// since.
+func (r *usageRecorder) mostViewed(ctx context.Context, books guardedBooks, since time.Time, limit int) ([]ViewCount, error) {
+	counts, err := r.top(ctx, usageView, since, 1, limit)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(counts))
+	for i, c := range counts {
+		ids[i] = c.Key
+	}
+	found, err := books.Find(ctx, bson.M{"ID": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]store.Book, len(found))
+	for _, b := range found {
+		byID[b.ID] = b
+	}
+	views := []ViewCount{}
+	for _, c := range counts {
+		if b, ok := byID[c.Key]; ok {
+			views = append(views, ViewCount{ID: b.ID, Title: b.BookName, Author: b.BookAuthor, Views: c.Count})
+		}
+	}
+	return views, nil
+}
+
+// trendingWindow reads ?days= and ?limit=, returning when the window
+// starts.
+func trendingWindow(c echo.Context) (days int, since time.Time, limit int) {
+	days, err := strconv.Atoi(c.QueryParam("days"))
+	if err != nil || days <= 0 || days > maxTrendingDays {
+		days = defaultTrendingDays
+	}
+	limit, err = strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > maxTrendingLimit {
+		limit = defaultTrendingLimit
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	return days, today.AddDate(0, 0, 1-days), limit
+}
+
+// registerUsageRoutes mounts GET /api/stats/popular-searches and
+// /api/stats/most-viewed, the Trending page at /trending, and the counts
+// per route at /admin/usage when there is an admin area.
+func registerUsageRoutes(e *echo.Echo, admin *echo.Group, r *usageRecorder, books guardedBooks) {
+	e.GET("/api/stats/popular-searches", func(c echo.Context) error {
+		days, since, limit := trendingWindow(c)
+		searches, err := r.popularSearches(c.Request().Context(), since, limit)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"days": days, "searches": searches})
+	})
+
+	e.GET("/api/stats/most-viewed", func(c echo.Context) error {
+		days, since, limit := trendingWindow(c)
+		views, err := r.mostViewed(c.Request().Context(), books, since, limit)
+		if err != nil {
+			return handlers.Error(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"days": days, "books": views})
+	})
+
+	e.GET("/trending", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		days, since, limit := trendingWindow(c)
+		trending := Trending{Days: days}
+		var err error
+		if trending.Searches, err = r.popularSearches(ctx, since, limit); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if trending.Books, err = r.mostViewed(ctx, books, since, limit); err != nil {
+			return handlers.Error(c, err, "Database error")
+		}
+		return render.Page(c, http.StatusOK, "trending", trending)
+	})
+
+	if admin == nil {
+		return
+	}
+	admin.GET("/usage", func(c echo.Context) error {
+		days, since, _ := trendingWindow(c)
+		counts, err := r.top(c.Request().Context(), usageRoute, since, 1, maxTrendingLimit)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		routes := make([]map[string]interface{}, len(counts))
+		for i, count := range counts {
+			routes[i] = map[string]interface{}{"route": count.Key, "count": count.Count}
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"days": days, "routes": routes})
+	})
+}
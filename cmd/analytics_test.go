@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSearchTermHash(t *testing.T) {
+	key, other := []byte("key"), []byte("other key")
+	if searchTermHash(key, "dracula") != searchTermHash(key, "dracula") {
+		t.Error("the same term and key hash differently")
+	}
+	if searchTermHash(key, "dracula") == searchTermHash(other, "dracula") {
+		t.Error("the hash doesn't depend on the key")
+	}
+	// Not the plain hash, which anyone could compute for a guessed term
+	plain := sha256.Sum256([]byte("dracula"))
+	if searchTermHash(key, "dracula") == hex.EncodeToString(plain[:16]) {
+		t.Error("the hash isn't keyed")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The clients of the API may send a key the admins gave them, in the
+// X-Api-Key header. Their requests are then counted against the daily and
+// monthly quotas of the key instead of RATE_LIMIT, and every answer tells
+// where they stand in X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset, for the quota closest to running out.
+
+// apiKeysCollection holds the keys, by the SHA-256 of their secret.
+const apiKeysCollection = "api_keys"
+
+// apiKeyUsageCollection holds the counts of the requests per key and
+// period when REDIS_URL isn't set.
+const apiKeyUsageCollection = "api_key_usage"
+
+const apiKeyHeader = "X-Api-Key"
+
+// The secrets start with it, so they are easy to spot, e.g. in a leak.
+const apiKeyPrefix = "bk_"
+
+// apiKeyContextKey holds the ID of the key of the request, for rateLimit.
+const apiKeyContextKey = "apiKey"
+
+const maxAPIKeyNameLength = 100
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// APIKey is a key of the API. The secret itself is only returned once,
+// when the key is made.
+type APIKey struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name string             `bson:"name" json:"name"`
+	// The start of the secret, to tell the keys apart
+	Prefix string `bson:"prefix" json:"prefix"`
+	Hash   string `bson:"hash" json:"-"`
+	// Requests allowed per day and month, in UTC; 0 is no limit
+	DailyQuota   int64     `bson:"dailyQuota" json:"dailyQuota"`
+	MonthlyQuota int64     `bson:"monthlyQuota" json:"monthlyQuota"`
+	CreatedAt    time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// APIKeyUsage is a key with the requests it made in the current day and
+// month, for GET /admin/api-keys.
+type APIKeyUsage struct {
+	APIKey
+	Today     int64 `json:"today"`
+	ThisMonth int64 `json:"thisMonth"`
+}
+
+type apiKeyInput struct {
+	Name         string `json:"name"`
+	DailyQuota   int64  `json:"dailyQuota"`
+	MonthlyQuota int64  `json:"monthlyQuota"`
+}
+
+func (in *apiKeyInput) validate() string {
+	in.Name = strings.TrimSpace(in.Name)
+	switch {
+	case in.Name == "":
+		return "name is required"
+	case len(in.Name) > maxAPIKeyNameLength:
+		return "name is too long"
+	case in.DailyQuota < 0 || in.MonthlyQuota < 0:
+		return "Quotas can't be negative"
+	}
+	return ""
+}
+
+// quotaCounters count the requests of the keys, in Redis when REDIS_URL is
+// set and otherwise in MongoDB, so the quotas hold across the instances
+// and their restarts.
+type quotaCounters interface {
+	// Incr adds one to the counter under key and returns the new value. A
+	// new counter expires after ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Count(ctx context.Context, key string) (int64, error)
+}
+
+// sharedCounters keeps the counts in Redis, where they are strings.
+type sharedCounters struct {
+	sharedStore
+}
+
+func (s sharedCounters) Count(ctx context.Context, key string) (int64, error) {
+	value, ok, err := s.Get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+// mongoCounters keeps the counts in a collection, MongoDB removing them
+// once expired.
+type mongoCounters struct {
+	coll *mongo.Collection
+}
+
+func (m mongoCounters) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var doc struct {
+		Count int64 `bson:"count"`
+	}
+	err := m.coll.FindOneAndUpdate(ctx, bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"expiresAt": time.Now().Add(ttl)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	return doc.Count, err
+}
+
+func (m mongoCounters) Count(ctx context.Context, key string) (int64, error) {
+	var doc struct {
+		Count int64 `bson:"count"`
+	}
+	err := m.coll.FindOne(ctx, bson.M{"_id": key}, store.FindOneOpts(ctx)).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return doc.Count, err
+}
+
+// apiKeys are the keys of the API and the counts of their requests.
+type apiKeys struct {
+	keys     *mongo.Collection
+	counters quotaCounters
+}
+
+// newAPIKeys keeps the keys in db, and the counts in shared when set.
+func newAPIKeys(db *mongo.Database, shared sharedStore) *apiKeys {
+	var counters quotaCounters = mongoCounters{db.Collection(apiKeyUsageCollection)}
+	if shared != nil {
+		counters = sharedCounters{shared}
+	}
+	return &apiKeys{keys: db.Collection(apiKeysCollection), counters: counters}
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup finds the key of the secret, or fails with errUnknownAPIKey.
+func (k *apiKeys) lookup(ctx context.Context, secret string) (APIKey, error) {
+	var key APIKey
+	err := k.keys.FindOne(ctx, bson.M{"hash": hashAPIKey(secret)}, store.FindOneOpts(ctx)).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return key, errUnknownAPIKey
+	}
+	return key, err
+}
+
+// quotaPeriod is a day or a month, in UTC, the requests of the keys are
+// counted in.
+type quotaPeriod struct {
+	name       string
+	start, end time.Time
+}
+
+func quotaPeriods(now time.Time) []quotaPeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []quotaPeriod{
+		{name: "day", start: day, end: day.AddDate(0, 0, 1)},
+		{name: "month", start: month, end: month.AddDate(0, 1, 0)},
+	}
+}
+
+func (p quotaPeriod) counter(key APIKey) string {
+	return "apikey:" + key.ID.Hex() + ":" + p.name + ":" + p.start.Format("20060102")
+}
+
+// quota returns the requests the key may make in the period, 0 for as
+// many as it wants.
+func (p quotaPeriod) quota(key APIKey) int64 {
+	if p.name == "day" {
+		return key.DailyQuota
+	}
+	return key.MonthlyQuota
+}
+
+// quotaState is where a key stands in one of its quotas.
+type quotaState struct {
+	limit, count int64
+	reset        time.Time
+}
+
+func (q quotaState) remaining() int64 {
+	return max(q.limit-q.count, 0)
+}
+
+// hitQuotas counts a request of the key in every period, and returns
+// where it stands in the quota closest to running out, the one ending last
+// among those that did. ok is false when the key has no quota.
+func hitQuotas(ctx context.Context, counters quotaCounters, key APIKey, now time.Time) (state quotaState, ok bool, err error) {
+	for _, p := range quotaPeriods(now) {
+		count, err := counters.Incr(ctx, p.counter(key), p.end.Sub(now))
+		if err != nil {
+			return state, false, err
+		}
+		limit := p.quota(key)
+		if limit <= 0 {
+			continue
+		}
+		q := quotaState{limit: limit, count: count, reset: p.end}
+		if !ok || q.remaining() < state.remaining() || q.remaining() == state.remaining() && q.reset.After(state.reset) {
+			state, ok = q, true
+		}
+	}
+	return state, ok, nil
+}
+
+// usage returns the requests the key made in the current day and month.
+func (k *apiKeys) usage(ctx context.Context, key APIKey, now time.Time) (APIKeyUsage, error) {
+	usage := APIKeyUsage{APIKey: key}
+	periods := quotaPeriods(now)
+	var err error
+	if usage.Today, err = k.counters.Count(ctx, periods[0].counter(key)); err != nil {
+		return usage, err
+	}
+	usage.ThisMonth, err = k.counters.Count(ctx, periods[1].counter(key))
+	return usage, err
+}
+
+// apiKeyQuotas checks the key of the requests to the API sending one, with
+// lookup, and counts them against its quotas. Unknown keys are refused, as
+// are the requests over a quota until it resets.
+func apiKeyQuotas(lookup func(ctx context.Context, secret string) (APIKey, error), counters quotaCounters) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			secret := c.Request().Header.Get(apiKeyHeader)
+			if secret == "" || !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+			key, err := lookup(ctx, secret)
+			if errors.Is(err, errUnknownAPIKey) {
+				return handlers.JSONError(c, http.StatusUnauthorized, "Invalid API key")
+			}
+			if err != nil {
+				return handlers.ServerError(c, err, "Database error")
+			}
+			c.Set(apiKeyContextKey, key.ID.Hex())
+
+			now := time.Now()
+			quota, limited, err := hitQuotas(ctx, counters, key, now)
+			if err != nil {
+				// Like the rate limit, we'd rather serve than lock the
+				// clients out
+				slog.WarnContext(ctx, "API key quota counters unavailable, letting the request through", "error", err)
+				return next(c)
+			}
+			if !limited {
+				return next(c)
+			}
+			h := c.Response().Header()
+			h.Set("X-RateLimit-Limit", strconv.FormatInt(quota.limit, 10))
+			h.Set("X-RateLimit-Remaining", strconv.FormatInt(quota.remaining(), 10))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(quota.reset.Unix(), 10))
+			if quota.count > quota.limit {
+				h.Set("Retry-After", strconv.Itoa(int(quota.reset.Sub(now).Seconds())+1))
+				return handlers.JSONError(c, http.StatusTooManyRequests, "API key quota exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// registerAPIKeyRoutes mounts the management of the keys on the admin
+// group: GET /admin/api-keys lists them with their usage, POST makes one
+// and DELETE /admin/api-keys/:id revokes one.
+func registerAPIKeyRoutes(admin *echo.Group, k *apiKeys) {
+	admin.GET("/api-keys", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		cursor, err := k.keys.Find(ctx, bson.D{}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		var keys []APIKey
+		if err := cursor.All(ctx, &keys); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		now := time.Now()
+		usage := make([]APIKeyUsage, len(keys))
+		for i, key := range keys {
+			if usage[i], err = k.usage(ctx, key, now); err != nil {
+				return handlers.ServerError(c, err, "Could not read the usage of the API keys")
+			}
+		}
+		return c.JSON(http.StatusOK, usage)
+	})
+
+	admin.POST("/api-keys", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var in apiKeyInput
+		if err := c.Bind(&in); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		if msg := in.validate(); msg != "" {
+			return handlers.JSONError(c, http.StatusBadRequest, msg)
+		}
+		secret := apiKeyPrefix + newToken()
+		key := APIKey{
+			Name:         in.Name,
+			Prefix:       secret[:len(apiKeyPrefix)+8],
+			Hash:         hashAPIKey(secret),
+			DailyQuota:   in.DailyQuota,
+			MonthlyQuota: in.MonthlyQuota,
+			CreatedAt:    time.Now().UTC(),
+		}
+		res, err := k.keys.InsertOne(ctx, key, store.InsertOneOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not save the API key")
+		}
+		key.ID = res.InsertedID.(primitive.ObjectID)
+		return c.JSON(http.StatusCreated, struct {
+			APIKey
+			Key string `json:"key"`
+		}{key, secret})
+	})
+
+	admin.DELETE("/api-keys/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusNotFound, "API key not found")
+		}
+		res, err := k.keys.DeleteOne(ctx, bson.M{"_id": id}, store.DeleteOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if res.DeletedCount == 0 {
+			return handlers.JSONError(c, http.StatusNotFound, "API key not found")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
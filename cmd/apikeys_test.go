@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAPIKeyQuotas(t *testing.T) {
+	keys := map[string]APIKey{
+		"bk_limited":   {ID: primitive.NewObjectID(), DailyQuota: 2, MonthlyQuota: 10},
+		"bk_unlimited": {ID: primitive.NewObjectID()},
+	}
+	lookup := func(ctx context.Context, secret string) (APIKey, error) {
+		key, ok := keys[secret]
+		if !ok {
+			return key, errUnknownAPIKey
+		}
+		return key, nil
+	}
+	counters := newMemoryStore()
+	e := echo.New()
+	e.Use(apiKeyQuotas(lookup, sharedCounters{counters}))
+	// One request per IP, which the keys don't count against
+	e.Use(rateLimit(config.RateLimitConfig{Requests: 1, Window: time.Hour}, counters))
+	e.GET("/api/books", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	tomorrow := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	for _, remaining := range []string{"1", "0"} {
+		res := send("bk_limited")
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+		}
+		h := res.Header()
+		if h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != remaining {
+			t.Errorf("got limit %q and remaining %q, want the daily quota with %s left", h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), remaining)
+		}
+		if reset := h.Get("X-RateLimit-Reset"); reset != strconv.FormatInt(tomorrow.Unix(), 10) {
+			t.Errorf("got reset %q, want the end of the day", reset)
+		}
+	}
+	res := send("bk_limited")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d and Retry-After %q over the quota", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	for range 3 {
+		res := send("bk_unlimited")
+		if res.Code != http.StatusOK || res.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("got status %d and limit %q for a key without quotas", res.Code, res.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+	if res := send("bk_unknown"); res.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for an unknown key, want %d", res.Code, http.StatusUnauthorized)
+	}
+
+	// Without a key, the IP rate limit applies
+	if res := send(""); res.Code != http.StatusOK || res.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("got status %d and limit %q without a key", res.Code, res.Header().Get("X-RateLimit-Limit"))
+	}
+	if res := send(""); res.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d over the rate limit, want %d", res.Code, http.StatusTooManyRequests)
+	}
+}
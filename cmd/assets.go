@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// Hashed file names never change content, so browsers and CDNs may keep
+// them for as long as they like.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// asset is a static file, fingerprinted when the server starts.
+type asset struct {
+	file    string
+	hash    string // hex SHA-256 of the content
+	modTime time.Time
+	// The precompressed copies of the file next to it, by encoding
+	encoded map[string]string
+}
+
+// precompressed are the extensions of the precompressed copies of the
+// files, e.g. index.css.br, by encoding, in order of preference. The
+// Dockerfile makes them, so the stylesheets aren't compressed on every
+// request (see compress.go).
+var precompressed = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// assetStore serves the files of a directory with caching headers: an ETag
+// made from the content and Last-Modified, so unchanged files are answered
+// with 304 Not Modified, and a Cache-Control max-age.
+//
+// Files with a precompressed copy, made with brotli or gzip, are sent
+// compressed to the browsers accepting it.
+//
+// With hashed file names, templates link to e.g. /css/index.1a2b3c4d.css
+// (see the "asset" template function). Those URLs change whenever the
+// content does, so they are cached forever. Files are fingerprinted once at
+// startup: restart the server after changing them.
+type assetStore struct {
+	prefix string
+	hashed bool
+	maxAge time.Duration
+	files  map[string]asset // by name relative to the directory
+}
+
+func newAssetStore(dir, prefix string, cfg config.StaticConfig) (*assetStore, error) {
+	store := &assetStore{
+		prefix: prefix,
+		hashed: cfg.HashFilenames,
+		maxAge: cfg.MaxAge,
+		files:  map[string]asset{},
+	}
+	var compressed []string
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		for _, p := range precompressed {
+			if strings.HasSuffix(file, p.ext) {
+				compressed = append(compressed, file)
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, file)
+		store.files[filepath.ToSlash(name)] = asset{file: file, hash: hash, modTime: info.ModTime()}
+		return nil
+	})
+	// Copies of files which aren't there are ignored
+	for _, file := range compressed {
+		name, _ := filepath.Rel(dir, file)
+		ext := filepath.Ext(name)
+		a, ok := store.files[filepath.ToSlash(strings.TrimSuffix(name, ext))]
+		if !ok {
+			continue
+		}
+		if a.encoded == nil {
+			a.encoded = map[string]string{}
+		}
+		for _, p := range precompressed {
+			if p.ext == ext {
+				a.encoded[p.encoding] = file
+			}
+		}
+		store.files[filepath.ToSlash(strings.TrimSuffix(name, ext))] = a
+	}
+	return store, err
+}
+
+// encoding picks the precompressed copy of a to send, given the
+// Accept-Encoding of the request: its encoding and file, or none.
+func (a asset) encoding(accept string) (string, string) {
+	for _, p := range precompressed {
+		file, ok := a.encoded[p.encoding]
+		if ok && acceptsEncoding(accept, p.encoding) {
+			return p.encoding, file
+		}
+	}
+	return "", ""
+}
+
+// acceptsEncoding tells if an Accept-Encoding lists encoding, without
+// q=0.
+func acceptsEncoding(accept, encoding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		q, err := strconv.ParseFloat(value, 64)
+		return key != "q" || err != nil || q > 0
+	}
+	return false
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// URL returns the URL to link to for a static file, given by its unhashed
+// URL (e.g. "/css/index.css").
+func (s *assetStore) URL(url string) string {
+	a, ok := s.files[strings.TrimPrefix(url, s.prefix+"/")]
+	if !s.hashed || !ok {
+		return url
+	}
+	ext := path.Ext(url)
+	return strings.TrimSuffix(url, ext) + "." + a.hash[:8] + ext
+}
+
+// lookup finds the file behind a requested name, which may carry a hash.
+// immutable tells whether the hash matches the current content.
+func (s *assetStore) lookup(name string) (a asset, immutable, ok bool) {
+	if a, ok := s.files[name]; ok {
+		return a, false, true
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dot := strings.LastIndexByte(base, '.')
+	if dot < 0 {
+		return asset{}, false, false
+	}
+	a, ok = s.files[base[:dot]+ext]
+	// An outdated hash, e.g. from a page cached before a deploy, still gets
+	// the current file, just not cached for good. So does a name with an
+	// empty or shorter one, which no page links to.
+	hash := base[dot+1:]
+	return a, ok && len(hash) == 8 && strings.HasPrefix(a.hash, hash), ok
+}
+
+// handler serves the files under the store's prefix.
+func (s *assetStore) handler(c echo.Context) error {
+	a, immutable, ok := s.lookup(c.Param("*"))
+	if !ok {
+		return echo.ErrNotFound
+	}
+	h := c.Response().Header()
+	file, etag := a.file, a.hash
+	if len(a.encoded) > 0 {
+		h.Add("Vary", echo.HeaderAcceptEncoding)
+		if encoding, compressed := a.encoding(c.Request().Header.Get(echo.HeaderAcceptEncoding)); encoding != "" {
+			h.Set(echo.HeaderContentEncoding, encoding)
+			file, etag = compressed, a.hash+"-"+encoding
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	defer f.Close()
+
+	h.Set("ETag", `"`+etag+`"`)
+	if immutable {
+		h.Set(echo.HeaderCacheControl, immutableCacheControl)
+	} else {
+		h.Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(s.maxAge.Seconds())))
+	}
+	// ServeContent sets Content-Type, from the name of the uncompressed
+	// file, and Last-Modified, and answers If-None-Match /
+	// If-Modified-Since with 304 Not Modified.
+	http.ServeContent(c.Response(), c.Request(), a.file, a.modTime, f)
+	return nil
+}
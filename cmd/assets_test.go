@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAssetLookup(t *testing.T) {
+	s := &assetStore{files: map[string]asset{"index.css": {hash: "1a2b3c4d5e6f"}}}
+	tests := []struct {
+		name          string
+		immutable, ok bool
+	}{
+		{"index.css", false, true},
+		{"index.1a2b3c4d.css", true, true},
+		// An outdated hash still gets the file
+		{"index.99999999.css", false, true},
+		{"index..css", false, true},
+		{"index.1a.css", false, true},
+		{"other.1a2b3c4d.css", false, false},
+	}
+	for _, tt := range tests {
+		_, immutable, ok := s.lookup(tt.name)
+		if immutable != tt.immutable || ok != tt.ok {
+			t.Errorf("%s: got immutable %v and ok %v, want %v and %v", tt.name, immutable, ok, tt.immutable, tt.ok)
+		}
+	}
+}
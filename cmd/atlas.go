@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// atlasSearchDefinition is the Atlas Search index we query. Titles are
+// analyzed as English (stemming), authors with the standard analyzer, and
+// both can be autocompleted. atlasSearch creates the index, or updates it
+// when this definition changes.
+var atlasSearchDefinition = bson.M{
+	"mappings": bson.M{
+		"dynamic": false,
+		"fields": bson.M{
+			"BookName": bson.A{
+				bson.M{"type": "string", "analyzer": "lucene.english"},
+				bson.M{"type": "autocomplete", "tokenization": "edgeGram", "minGrams": 2, "maxGrams": 15, "foldDiacritics": true},
+			},
+			"BookAuthor": bson.A{
+				bson.M{"type": "string", "analyzer": "lucene.standard"},
+				bson.M{"type": "autocomplete", "tokenization": "edgeGram", "minGrams": 2, "maxGrams": 15, "foldDiacritics": true},
+			},
+		},
+	},
+}
+
+// atlasSearch runs $search pipelines against MongoDB Atlas. Atlas keeps the
+// index in sync with the collection by itself, so Indexed and Removed have
+// nothing to do.
+type atlasSearch struct {
+	coll  *mongo.Collection
+	index string
+}
+
+func newAtlasSearch(ctx context.Context, coll *mongo.Collection, index string) (*atlasSearch, error) {
+	s := &atlasSearch{coll: coll, index: index}
+	if err := s.ensureIndex(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ensureIndex creates the search index, or updates it if its definition
+// differs from ours. Atlas builds it in the background: until it is ready,
+// searches return nothing.
+func (s *atlasSearch) ensureIndex(ctx context.Context) error {
+	view := s.coll.SearchIndexes()
+	cursor, err := view.List(ctx, options.SearchIndexes().SetName(s.index))
+	if err != nil {
+		return err
+	}
+	var existing []struct {
+		LatestDefinition bson.M `bson:"latestDefinition"`
+	}
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		slog.Info("creating the Atlas Search index", "index", s.index)
+		_, err := view.CreateOne(ctx, mongo.SearchIndexModel{
+			Definition: atlasSearchDefinition,
+			Options:    options.SearchIndexes().SetName(s.index),
+		})
+		return err
+	}
+	if !sameDefinition(existing[0].LatestDefinition, atlasSearchDefinition) {
+		slog.Info("updating the Atlas Search index", "index", s.index)
+		return view.UpdateOne(ctx, s.index, atlasSearchDefinition)
+	}
+	return nil
+}
+
+// sameDefinition compares index definitions through JSON, so BSON types
+// (int32 vs int64, bson.A vs []interface{}) don't make them differ.
+func sameDefinition(a, b bson.M) bool {
+	var x, y interface{}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	json.Unmarshal(ja, &x)
+	json.Unmarshal(jb, &y)
+	return reflect.DeepEqual(x, y)
+}
+
+// atlasHighlight is an element of $meta: "searchHighlights".
+type atlasHighlight struct {
+	Path  string `bson:"path"`
+	Texts []struct {
+		Value string `bson:"value"`
+		Type  string `bson:"type"` // "hit" or "text"
+	} `bson:"texts"`
+}
+
+// html renders the highlight with the hits wrapped in <mark>.
+func (h atlasHighlight) html() template.HTML {
+	var b strings.Builder
+	for _, t := range h.Texts {
+		if t.Type == "hit" {
+			b.WriteString("<mark>" + template.HTMLEscapeString(t.Value) + "</mark>")
+		} else {
+			b.WriteString(template.HTMLEscapeString(t.Value))
+		}
+	}
+	return template.HTML(b.String())
+}
+
+// Search looks for the query in titles (weighing double) and authors,
+// allowing up to two typos per word. Scores are scaled so the best hit
+// gets 1.
+func (s *atlasSearch) Search(ctx context.Context, q string) ([]store.SearchResult, error) {
+	if strings.TrimSpace(q) == "" {
+		return nil, nil
+	}
+	text := func(path string, boost float64) bson.M {
+		return bson.M{"text": bson.M{
+			"query": q,
+			"path":  path,
+			"fuzzy": bson.M{"maxEdits": 2, "prefixLength": 1},
+			"score": bson.M{"boost": bson.M{"value": boost}},
+		}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: bson.M{
+			"index": s.index,
+			"compound": bson.M{
+				"should":             bson.A{text("BookName", 2), text("BookAuthor", 1)},
+				"minimumShouldMatch": 1,
+			},
+			"highlight": bson.M{"path": bson.A{"BookName", "BookAuthor"}},
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"score":      bson.M{"$meta": "searchScore"},
+			"highlights": bson.M{"$meta": "searchHighlights"},
+		}}},
+	}
+	cursor, err := s.coll.Aggregate(ctx, pipeline, store.AggregateOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var hits []struct {
+		store.Book `bson:",inline"`
+		Score      float64          `bson:"score"`
+		Highlights []atlasHighlight `bson:"highlights"`
+	}
+	if err := cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+
+	var results []store.SearchResult
+	for _, hit := range hits {
+		result := store.SearchResult{Book: hit.Book, Score: roundScore(hit.Score / hits[0].Score)}
+		for _, h := range hit.Highlights {
+			field := map[string]string{"BookName": "title", "BookAuthor": "author"}[h.Path]
+			if _, ok := result.Highlights[field]; field == "" || ok {
+				continue
+			}
+			if result.Highlights == nil {
+				result.Highlights = map[string]template.HTML{}
+			}
+			result.Highlights[field] = h.html()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Suggest autocompletes titles and authors.
+func (s *atlasSearch) Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error) {
+	if len([]rune(prefix)) < minSuggestPrefix {
+		return []store.Suggestion{}, nil
+	}
+	suggestions := []store.Suggestion{}
+	seen := map[string]bool{}
+	for _, path := range []string{"BookName", "BookAuthor"} {
+		pipeline := mongo.Pipeline{
+			{{Key: "$search", Value: bson.M{
+				"index":        s.index,
+				"autocomplete": bson.M{"query": prefix, "path": path},
+			}}},
+			{{Key: "$limit", Value: limit}},
+		}
+		cursor, err := s.coll.Aggregate(ctx, pipeline, store.AggregateOpts(ctx))
+		if err != nil {
+			return nil, err
+		}
+		var books []store.Book
+		if err := cursor.All(ctx, &books); err != nil {
+			return nil, err
+		}
+		for _, book := range books {
+			if path == "BookName" {
+				suggestions = append(suggestions, store.Suggestion{Value: book.BookName, Type: "title", ID: book.ID})
+			} else if !seen[book.BookAuthor] {
+				seen[book.BookAuthor] = true
+				suggestions = append(suggestions, store.Suggestion{Value: book.BookAuthor, Type: "author"})
+			}
+		}
+	}
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+func (s *atlasSearch) Indexed(context.Context, store.Book) {}
+func (s *atlasSearch) Removed(context.Context, string)     {}
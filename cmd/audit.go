@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Every change to the books is recorded in the audit log, from the change
+// feed (see changes.go), so writes from the CLI or another instance show up
+// too. Like the webhooks, it needs a replica set.
+const auditLogCollection = "audit_log"
+
+const (
+	defaultActivityLimit = 20
+	maxActivityLimit     = 100
+)
+
+// apiActor attributes the requests to "api", until requireRole knows
+// better. The API itself has no accounts.
+func apiActor() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.SetRequest(c.Request().WithContext(store.WithActor(c.Request().Context(), "api")))
+			return next(c)
+		}
+	}
+}
+
+// AuditEntry is one change to a book.
+type AuditEntry struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// The change stream resume token, so the instances all watching the
+	// collection record the change once
+	ChangeID string    `bson:"changeId" json:"-"`
+	Type     string    `bson:"type" json:"type"` // created, updated or deleted
+	At       time.Time `bson:"at" json:"at"`
+	MongoID  string    `bson:"mongoId" json:"-"`
+	BookID   string    `bson:"bookId" json:"bookId"`
+	Title    string    `bson:"title,omitempty" json:"title,omitempty"`
+	// Who made the change, when known. Deletes are not attributed: the
+	// book, and its updatedBy field, are gone.
+	By string `bson:"by,omitempty" json:"by,omitempty"`
+	// The fields an update changed, by their JSON name
+	Fields []string `bson:"fields,omitempty" json:"fields,omitempty"`
+}
+
+var auditTypes = map[string]string{
+	"insert":  "created",
+	"update":  "updated",
+	"replace": "updated",
+	"delete":  "deleted",
+}
+
+type auditLog struct {
+	entries *mongo.Collection
+}
+
+func newAuditLog(db *mongo.Database) *auditLog {
+	return &auditLog{entries: db.Collection(auditLogCollection)}
+}
+
+// Record is the change feed subscriber writing the audit log.
+func (a *auditLog) Record(ctx context.Context, change bookChange) {
+	entryType, ok := auditTypes[change.Operation]
+	if !ok {
+		return
+	}
+	entry := AuditEntry{
+		ChangeID: change.Token.Data,
+		Type:     entryType,
+		At:       time.Unix(int64(change.ClusterTime.T), 0).UTC(),
+		MongoID:  change.Key.MongoID.Hex(),
+	}
+	if change.ClusterTime.T == 0 {
+		entry.At = time.Now().UTC()
+	}
+	switch {
+	case change.Book != nil:
+		entry.BookID = change.Book.ID
+		entry.Title = change.Book.BookName
+		entry.By = change.Book.UpdatedBy
+	case change.Before != nil:
+		entry.BookID = change.Before.ID
+		entry.Title = change.Before.BookName
+	default:
+		// A delete without the book before it: the previous entries of
+		// the book still tell which one it was
+		var previous AuditEntry
+		opts := store.FindOneOpts(ctx).SetSort(bson.D{{Key: "_id", Value: -1}})
+		if err := a.entries.FindOne(ctx, bson.M{"mongoId": entry.MongoID}, opts).Decode(&previous); err == nil {
+			entry.BookID = previous.BookID
+			entry.Title = previous.Title
+		}
+	}
+	for field := range change.Update.Fields {
+		if name, ok := store.JSONFields[field]; ok {
+			entry.Fields = append(entry.Fields, name)
+		}
+	}
+	slices.Sort(entry.Fields)
+
+	_, err := a.entries.InsertOne(ctx, entry)
+	// Another instance recorded it already
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		slog.Warn("could not record the change in the audit log", "book", entry.BookID, "error", err)
+	}
+}
+
+// Activity is a page of the activity feed. Next is the value of ?before=
+// for the following page, empty on the last one.
+type Activity struct {
+	Entries []AuditEntry `json:"entries"`
+	Next    string       `json:"next,omitempty"`
+}
+
+// errInvalidCursor is returned for a ?before= that isn't an entry ID.
+var errInvalidCursor = errors.New("invalid before")
+
+// find returns the latest entries, older than the entry before when it is
+// given.
+func (a *auditLog) find(ctx context.Context, before string, limit int) (Activity, error) {
+	filter := bson.M{}
+	if before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			return Activity{}, errInvalidCursor
+		}
+		filter["_id"] = bson.M{"$lt": id}
+	}
+	// One more than asked, to know if there is a next page
+	opts := store.FindOpts(ctx).SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit + 1))
+	cursor, err := a.entries.Find(ctx, filter, opts)
+	if err != nil {
+		return Activity{}, err
+	}
+	activity := Activity{Entries: []AuditEntry{}}
+	if err := cursor.All(ctx, &activity.Entries); err != nil {
+		return Activity{}, err
+	}
+	if len(activity.Entries) > limit {
+		activity.Entries = activity.Entries[:limit]
+		activity.Next = activity.Entries[limit-1].ID.Hex()
+	}
+	return activity, nil
+}
+
+// catalogModified is the last time the catalog changed: the last book
+// added or changed, or the last one deleted, which only the audit log
+// knows of. Without change streams deletes go unnoticed.
+func catalogModified(ctx context.Context, booksModified func(context.Context) (time.Time, error), audit *auditLog) (time.Time, error) {
+	latest, err := booksModified(ctx)
+	if err != nil {
+		return latest, err
+	}
+	var deleted AuditEntry
+	opts := store.FindOneOpts(ctx).SetSort(bson.D{{Key: "_id", Value: -1}})
+	err = audit.entries.FindOne(ctx, bson.M{"type": "deleted"}, opts).Decode(&deleted)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return latest, nil
+	}
+	if err != nil {
+		return latest, err
+	}
+	if deleted.At.After(latest) {
+		latest = deleted.At
+	}
+	return latest, nil
+}
+
+// registerActivityRoutes mounts GET /api/activity, the latest changes as
+// JSON, and GET /activity, the same as a page. Both take ?before= and
+// ?limit= to page through older changes, and link to the first and the
+// next page in Link headers too. The pages being cut by cursor, there is
+// no previous or last page to link to.
+func registerActivityRoutes(e *echo.Echo, audit *auditLog) {
+	activity := func(c echo.Context) (Activity, error) {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxActivityLimit {
+			limit = defaultActivityLimit
+		}
+		page, err := audit.find(c.Request().Context(), c.QueryParam("before"), limit)
+		if err != nil {
+			return page, err
+		}
+		handlers.PageLink(c, "first", map[string]string{"before": ""})
+		if page.Next != "" {
+			handlers.PageLink(c, "next", map[string]string{"before": page.Next})
+		}
+		return page, nil
+	}
+
+	e.GET("/api/activity", func(c echo.Context) error {
+		page, err := activity(c)
+		if errors.Is(err, errInvalidCursor) {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid before")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+
+	e.GET("/activity", func(c echo.Context) error {
+		page, err := activity(c)
+		if errors.Is(err, errInvalidCursor) {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid before")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return render.Page(c, http.StatusOK, "activity", page)
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// roleAdmin gives access to the admin area and the /debug endpoints.
+const roleAdmin = "admin"
+
+// anyRole lets in every user the provider knows, whatever their roles,
+// e.g. for their own reading lists.
+const anyRole = ""
+
+// userKey is where requireRole keeps the name of the user in the echo
+// context.
+const userKey = "user"
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// authProvider checks a user name and password, and returns the roles of
+// the user. AUTH_PROVIDER picks the local admin account (default) or an
+// LDAP / Active Directory server.
+type authProvider interface {
+	Authenticate(ctx context.Context, user, password string) ([]string, error)
+}
+
+// newAuthProvider returns nil when no credentials are configured, which
+// disables the admin area.
+func newAuthProvider(cfg config.AuthConfig) (authProvider, error) {
+	switch cfg.Provider {
+	case "", "local":
+		if cfg.AdminPassword == "" {
+			return nil, nil
+		}
+		return localAuth{user: cfg.AdminUser, password: cfg.AdminPassword}, nil
+	case "ldap":
+		return newLDAPAuth(cfg.LDAP)
+	}
+	return nil, fmt.Errorf("unknown auth provider %q", cfg.Provider)
+}
+
+// localAuth is the single admin account of ADMIN_USER and ADMIN_PASSWORD.
+type localAuth struct {
+	user, password string
+}
+
+func (l localAuth) Authenticate(ctx context.Context, user, password string) ([]string, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(l.user)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(l.password)) == 1
+	if !userOK || !passOK {
+		return nil, errInvalidCredentials
+	}
+	return []string{roleAdmin}, nil
+}
+
+// requireRole protects routes with HTTP basic auth, letting in the users
+// the provider knows that have the given role, or any of them for anyRole.
+func requireRole(provider authProvider, role string) echo.MiddlewareFunc {
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: "admin",
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			ctx := c.Request().Context()
+			roles, err := provider.Authenticate(ctx, user, password)
+			if errors.Is(err, errInvalidCredentials) {
+				return false, nil
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "authentication failed", "user", user, "error", err)
+				return false, echo.NewHTTPError(http.StatusServiceUnavailable, "Authentication unavailable")
+			}
+			actor := role
+			if role == anyRole {
+				actor = "user"
+			} else if !slices.Contains(roles, role) {
+				return false, nil
+			}
+			c.SetRequest(c.Request().WithContext(store.WithActor(ctx, actor+":"+user)))
+			c.Set(userKey, user)
+			return true, nil
+		},
+	})
+}
+
+// ldapTimeout bounds every exchange with the LDAP server.
+const ldapTimeout = 5 * time.Second
+
+// ldapAuth looks the user up with the service account, binds as the user
+// to check the password, and maps the groups of the user to roles.
+type ldapAuth struct {
+	cfg config.LDAPConfig
+	// Group DN to role, from AUTH_LDAP_GROUP_ROLES
+	groupRoles map[string]string
+
+	// Successful logins are remembered for cfg.CacheTTL, as basic auth
+	// sends the credentials with every request.
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]ldapLogin
+}
+
+type ldapLogin struct {
+	roles   []string
+	expires time.Time
+}
+
+func newLDAPAuth(cfg config.LDAPConfig) (*ldapAuth, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("AUTH_LDAP_URL and AUTH_LDAP_BASE_DN are required for the ldap auth provider")
+	}
+	if !strings.Contains(cfg.UserFilter, "%s") {
+		return nil, errors.New("AUTH_LDAP_USER_FILTER must contain %s, replaced by the user name")
+	}
+	// Entries are "role=group DN"; the DN has '=' of its own, so we cut at
+	// the first one.
+	groupRoles := map[string]string{}
+	for _, entry := range strings.Split(cfg.GroupRoles, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		role, dn, ok := strings.Cut(entry, "=")
+		if !ok || role == "" || dn == "" {
+			return nil, fmt.Errorf("invalid AUTH_LDAP_GROUP_ROLES entry %q, expected role=group DN", entry)
+		}
+		groupRoles[strings.ToLower(strings.TrimSpace(dn))] = strings.TrimSpace(role)
+	}
+	return &ldapAuth{cfg: cfg, groupRoles: groupRoles, cache: map[[sha256.Size]byte]ldapLogin{}}, nil
+}
+
+func (a *ldapAuth) Authenticate(ctx context.Context, user, password string) ([]string, error) {
+	// An empty password would be an unauthenticated bind, which LDAP
+	// servers accept for any DN.
+	if user == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	login, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(login.expires) {
+		return login.roles, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("could not bind as %s: %w", a.cfg.BindDN, err)
+		}
+	}
+	search := ldap.NewSearchRequest(a.cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(user)),
+		[]string{a.cfg.GroupAttribute}, nil)
+	res, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("could not look up user: %w", err)
+	}
+	// Unknown, or ambiguous because the filter matches several entries
+	if res == nil || len(res.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errInvalidCredentials
+		}
+		return nil, fmt.Errorf("could not bind as %s: %w", entry.DN, err)
+	}
+
+	roles := []string{}
+	for _, group := range entry.GetAttributeValues(a.cfg.GroupAttribute) {
+		if role, ok := a.groupRoles[strings.ToLower(group)]; ok && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	if a.cfg.CacheTTL > 0 {
+		a.mu.Lock()
+		// Expired logins are dropped along the way, the map stays as small
+		// as the number of recent users.
+		for k, l := range a.cache {
+			if time.Now().After(l.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.cache[key] = ldapLogin{roles: roles, expires: time.Now().Add(a.cfg.CacheTTL)}
+		a.mu.Unlock()
+	}
+	return roles, nil
+}
+
+func (a *ldapAuth) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LDAP: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if a.cfg.StartTLS {
+		host := ""
+		if u, err := url.Parse(a.cfg.URL); err == nil {
+			host = u.Hostname()
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start TLS: %w", err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/simple"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// bleveSearch keeps an in-memory Bleve index of titles and authors. Titles
+// are analyzed as English, so "cats" finds "The Black Cat"; authors are
+// only lowercased, names don't stem well. Suggestions use a copy of the
+// titles analyzed the same way, where "the" isn't dropped as a stop word. The index is built from the
+// collection on startup and updated on every write through the API; books
+// changed by other means (another instance, the import command) show up
+// after a restart.
+type bleveSearch struct {
+	index bleve.Index
+
+	// The books by ID, to return them whole without storing every field in
+	// the index.
+	mu    sync.RWMutex
+	books map[string]store.Book
+}
+
+func newBleveSearch(ctx context.Context, coll *mongo.Collection) (*bleveSearch, error) {
+	books, err := store.NewBooks(coll).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := buildBleveSearch(books)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("built the search index", "books", len(books))
+	return s, nil
+}
+
+func buildBleveSearch(books []store.Book) (*bleveSearch, error) {
+	title := bleve.NewTextFieldMapping()
+	title.Analyzer = en.AnalyzerName
+	title.IncludeTermVectors = true
+	titleWords := bleve.NewTextFieldMapping()
+	titleWords.Name = "title_words"
+	titleWords.Analyzer = simple.Name
+	author := bleve.NewTextFieldMapping()
+	author.Analyzer = simple.Name
+	author.IncludeTermVectors = true
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("title", title, titleWords)
+	doc.AddFieldMappingsAt("author", author)
+	mapping := bleve.NewIndexMapping()
+	mapping.DefaultMapping = doc
+
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		return nil, err
+	}
+	s := &bleveSearch{index: index, books: map[string]store.Book{}}
+	batch := index.NewBatch()
+	for _, book := range books {
+		if err := batch.Index(book.ID, bleveDocument(book)); err != nil {
+			return nil, err
+		}
+		s.books[book.ID] = book
+	}
+	return s, index.Batch(batch)
+}
+
+func bleveDocument(book store.Book) map[string]interface{} {
+	return map[string]interface{}{"title": book.BookName, "author": book.BookAuthor}
+}
+
+func (s *bleveSearch) Indexed(ctx context.Context, book store.Book) {
+	s.mu.Lock()
+	s.books[book.ID] = book
+	s.mu.Unlock()
+	if err := s.index.Index(book.ID, bleveDocument(book)); err != nil {
+		slog.ErrorContext(ctx, "failed to index book", "id", book.ID, "error", err)
+	}
+}
+
+func (s *bleveSearch) Removed(ctx context.Context, id string) {
+	s.mu.Lock()
+	delete(s.books, id)
+	s.mu.Unlock()
+	if err := s.index.Delete(id); err != nil {
+		slog.ErrorContext(ctx, "failed to remove book from the index", "id", id, "error", err)
+	}
+}
+
+// Search matches the words of the query against titles (weighing double)
+// and authors, allowing typos: one per word, two in words longer than 5
+// letters. Scores are scaled so the best hit gets 1.
+func (s *bleveSearch) Search(ctx context.Context, q string) ([]store.SearchResult, error) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	var disjuncts []query.Query
+	for _, term := range terms {
+		fuzziness := 1
+		if len([]rune(term)) > 5 {
+			fuzziness = 2
+		}
+		title := bleve.NewMatchQuery(term)
+		title.SetField("title")
+		title.SetFuzziness(fuzziness)
+		title.SetBoost(2)
+		author := bleve.NewMatchQuery(term)
+		author.SetField("author")
+		author.SetFuzziness(fuzziness)
+		disjuncts = append(disjuncts, title, author)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewDisjunctionQuery(disjuncts...), s.size(), 0, false)
+	req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	res, err := s.index.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []store.SearchResult
+	for _, hit := range res.Hits {
+		book, ok := s.books[hit.ID]
+		if !ok {
+			continue
+		}
+		result := store.SearchResult{Book: book, Score: roundScore(hit.Score / res.MaxScore)}
+		for field, fragments := range hit.Fragments {
+			if len(fragments) > 0 {
+				if result.Highlights == nil {
+					result.Highlights = map[string]template.HTML{}
+				}
+				// The fragments are escaped by Bleve, bar the <mark> tags
+				result.Highlights[field] = template.HTML(fragments[0])
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Suggest completes the last word being typed, the previous ones having to
+// match as they are.
+func (s *bleveSearch) Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error) {
+	words := strings.Fields(strings.ToLower(prefix))
+	if len([]rune(prefix)) < minSuggestPrefix || len(words) == 0 {
+		return []store.Suggestion{}, nil
+	}
+	fieldQuery := func(field string) query.Query {
+		conjuncts := []query.Query{}
+		if len(words) > 1 {
+			match := bleve.NewMatchQuery(strings.Join(words[:len(words)-1], " "))
+			match.SetField(field)
+			match.Analyzer = simple.Name
+			match.SetOperator(query.MatchQueryOperatorAnd)
+			conjuncts = append(conjuncts, match)
+		}
+		last := bleve.NewPrefixQuery(words[len(words)-1])
+		last.SetField(field)
+		return bleve.NewConjunctionQuery(append(conjuncts, last)...)
+	}
+
+	suggestions := []store.Suggestion{}
+	seen := map[string]bool{}
+	for _, field := range []string{"title_words", "author"} {
+		req := bleve.NewSearchRequestOptions(fieldQuery(field), limit, 0, false)
+		res, err := s.index.SearchInContext(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		for _, hit := range res.Hits {
+			book, ok := s.books[hit.ID]
+			if !ok {
+				continue
+			}
+			if field == "title_words" {
+				suggestions = append(suggestions, store.Suggestion{Value: book.BookName, Type: "title", ID: book.ID})
+			} else if !seen[book.BookAuthor] {
+				seen[book.BookAuthor] = true
+				suggestions = append(suggestions, store.Suggestion{Value: book.BookAuthor, Type: "author"})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+func (s *bleveSearch) size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return max(len(s.books), 1)
+}
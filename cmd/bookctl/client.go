@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// client calls the API of the server, with the credentials of the config
+// when there are some.
+type client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func newClient(cfg Config) *client {
+	return &client{cfg: cfg, http: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// apiError is an error answer of the server, e.g. a 400 with the fields at
+// fault.
+type apiError struct {
+	Status  int               `json:"-"`
+	Message string            `json:"error"`
+	Fields  map[string]string `json:"fields"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Status, e.Message)
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg += fmt.Sprintf("\n  %s: %s", name, e.Fields[name])
+	}
+	return msg
+}
+
+// do sends a request to path and decodes the JSON answer into v, unless v
+// is nil.
+func (cl *client) do(method, path, contentType string, body io.Reader, v interface{}) error {
+	res, err := cl.send(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: invalid answer: %w", method, path, err)
+	}
+	return nil
+}
+
+// send returns the answer of the server when it is a success, the caller
+// closing its body, or an *apiError.
+func (cl *client) send(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(cl.cfg.Server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if cl.cfg.User != "" {
+		req.SetBasicAuth(cl.cfg.User, cl.cfg.Password)
+	}
+	res, err := cl.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 400 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	apiErr := &apiError{Status: res.StatusCode}
+	if json.NewDecoder(res.Body).Decode(apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = http.StatusText(res.StatusCode)
+	}
+	return nil, apiErr
+}
+
+func (cl *client) sendJSON(method, path string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return cl.do(method, path, "application/json", bytes.NewReader(data), v)
+}
+
+func (cl *client) listBooks(query string) ([]store.Book, error) {
+	path := "/api/books"
+	if query != "" {
+		path += "?q=" + url.QueryEscape(query)
+	}
+	var books []store.Book
+	err := cl.do(http.MethodGet, path, "", nil, &books)
+	return books, err
+}
+
+// getBook finds a book with the exact ID through the query language, as
+// the API has no endpoint for a single book.
+func (cl *client) getBook(id string) (store.Book, error) {
+	if strings.Contains(id, `"`) {
+		return store.Book{}, fmt.Errorf("%q: IDs with quotes can't be looked up", id)
+	}
+	books, err := cl.listBooks(`id="` + id + `"`)
+	if err != nil {
+		return store.Book{}, err
+	}
+	if len(books) == 0 {
+		return store.Book{}, &apiError{Status: http.StatusNotFound, Message: "Book not found"}
+	}
+	return books[0], nil
+}
+
+func (cl *client) addBook(book interface{}, enrich bool) (map[string]interface{}, error) {
+	path := "/api/books"
+	if enrich {
+		path += "?enrich=true"
+	}
+	var res map[string]interface{}
+	err := cl.sendJSON(http.MethodPost, path, book, &res)
+	return res, err
+}
+
+func (cl *client) updateBook(id string, fields map[string]string) (map[string]interface{}, error) {
+	var res map[string]interface{}
+	err := cl.sendJSON(http.MethodPut, "/api/books/"+url.PathEscape(id), fields, &res)
+	return res, err
+}
+
+func (cl *client) deleteBook(id string) (map[string]interface{}, error) {
+	var res map[string]interface{}
+	err := cl.do(http.MethodDelete, "/api/books/"+url.PathEscape(id), "", nil, &res)
+	return res, err
+}
+
+// importBooks uploads the file to POST /admin/import.
+func (cl *client) importBooks(path, format string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if format != "" {
+		if err := mw.WriteField("format", format); err != nil {
+			return nil, err
+		}
+	}
+	part, err := mw.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	var summary map[string]interface{}
+	err = cl.do(http.MethodPost, "/admin/import", mw.FormDataContentType(), &body, &summary)
+	return summary, err
+}
+
+// exportJob is the part of an export job of POST /api/exports read here.
+type exportJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	URL    string `json:"url"`
+	Error  string `json:"error"`
+}
+
+// exportPollInterval is how often export asks how its job is going.
+const exportPollInterval = 2 * time.Second
+
+// export queues an export of the catalog with POST /api/exports, waits
+// for it to be done and copies the file to w. The jobs are for the admins:
+// others get the catalog streamed by GET /api/export. The download may
+// take longer than the timeout of the other calls.
+func (cl *client) export(format string, w io.Writer) error {
+	var job exportJob
+	err := cl.do(http.MethodPost, "/api/exports?format="+url.QueryEscape(format), "", nil, &job)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusNotFound) {
+		return cl.download("/api/export?format="+url.QueryEscape(format), w)
+	}
+	if err != nil {
+		return err
+	}
+	for job.Status == "queued" || job.Status == "running" {
+		time.Sleep(exportPollInterval)
+		if err := cl.do(http.MethodGet, "/api/exports/"+url.PathEscape(job.ID), "", nil, &job); err != nil {
+			return err
+		}
+	}
+	if job.Status != "done" {
+		return fmt.Errorf("export %s: %s %s", job.ID, job.Status, job.Error)
+	}
+	// A signed /files/ link, which may redirect to the S3 storage
+	return cl.download(job.URL, w)
+}
+
+// download copies the answer to GET path to w, without a timeout.
+func (cl *client) download(path string, w io.Writer) error {
+	saved := cl.http.Timeout
+	cl.http.Timeout = 0
+	defer func() { cl.http.Timeout = saved }()
+	res, err := cl.send(http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// defaultTimeout bounds the calls to the API but export.
+const defaultTimeout = 30 * time.Second
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config tells bookctl which server to talk to and how. It comes from a
+// YAML file, by default bookctl/config.yaml in the user's config directory
+// (~/.config on Linux), e.g.
+//
+//	server: https://books.example.org
+//	user: admin
+//	password: secret
+//
+// then BOOKCTL_SERVER, BOOKCTL_USER and BOOKCTL_PASSWORD, then the flags.
+// The password has no flag, so it doesn't end up in the shell history.
+type Config struct {
+	Server   string        `yaml:"server"`
+	User     string        `yaml:"user"`
+	Password string        `yaml:"password"`
+	Output   string        `yaml:"output"` // table or json
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bookctl", "config.yaml")
+}
+
+// loadConfig reads the config and the global flags, and returns the
+// remaining arguments, the command and its own flags.
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := Config{Server: "http://localhost:3030", Output: "table", Timeout: defaultTimeout}
+
+	set := flag.NewFlagSet("bookctl", flag.ContinueOnError)
+	path := set.String("config", defaultConfigPath(), "config file")
+	server := set.String("server", "", "URL of the server")
+	user := set.String("user", "", "user to log in as")
+	output := set.String("o", "", "output: table or json")
+	timeout := set.Duration("timeout", 0, "timeout of the calls")
+	set.Usage = func() {
+		fmt.Fprintln(set.Output(), "usage: bookctl [flags] <command> [command flags]\n\nFlags:")
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !flagSet(set, "config"):
+			// No config file is fine, unless one was asked for
+		case err != nil:
+			return cfg, nil, err
+		default:
+			if err := yaml.Unmarshal(data, &cfg); err != nil {
+				return cfg, nil, fmt.Errorf("%s: %w", *path, err)
+			}
+		}
+	}
+
+	for env, field := range map[string]*string{
+		"BOOKCTL_SERVER":   &cfg.Server,
+		"BOOKCTL_USER":     &cfg.User,
+		"BOOKCTL_PASSWORD": &cfg.Password,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+
+	set.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			cfg.Server = *server
+		case "user":
+			cfg.User = *user
+		case "o":
+			cfg.Output = *output
+		case "timeout":
+			cfg.Timeout = *timeout
+		}
+	})
+	if cfg.Output != "table" && cfg.Output != "json" {
+		return cfg, nil, fmt.Errorf("unknown output %q, expected table or json", cfg.Output)
+	}
+	return cfg, set.Args(), nil
+}
+
+func flagSet(set *flag.FlagSet, name string) bool {
+	found := false
+	set.Visit(func(f *flag.Flag) {
+		found = found || f.Name == name
+	})
+	return found
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// The console is a full-screen view over the same API calls as the
+// commands, to browse, search and edit the catalog from a terminal where
+// no browser is available, e.g. over SSH on the server. It is a Bubble Tea
+// program: the calls to the API run as commands and their answers come
+// back as messages, so the screen doesn't freeze on a slow server.
+
+// consoleMode is what the console shows and how it takes the keys.
+type consoleMode int
+
+const (
+	browsing consoleMode = iota
+	searching
+	showing
+	editing
+	confirming
+)
+
+// consoleKeys are the keys of each mode, shown at the bottom.
+var consoleKeys = map[consoleMode]string{
+	browsing:   "↑/↓ move • enter show • / search • e edit • a add • d delete • r reload • q quit",
+	searching:  "enter search • esc cancel",
+	showing:    "e edit • d delete • esc back",
+	editing:    "tab/↓ next • shift+tab/↑ previous • enter next or save • ctrl+s save • esc cancel",
+	confirming: "y delete • any other key cancels",
+}
+
+var (
+	titleStyle  = lipgloss.NewStyle().Bold(true)
+	labelStyle  = lipgloss.NewStyle().Bold(true).Width(10)
+	statusStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	errorStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	keysStyle   = lipgloss.NewStyle().Faint(true)
+)
+
+// editedFields are the fields of the form, in order: their JSON name,
+// their label and their value.
+var editedFields = []struct {
+	name, label string
+	value       func(store.Book) string
+}{
+	{"title", "Title", func(b store.Book) string { return b.BookName }},
+	{"author", "Author", func(b store.Book) string { return b.BookAuthor }},
+	{"edition", "Edition", func(b store.Book) string { return b.BookEdition }},
+	{"pages", "Pages", func(b store.Book) string { return b.BookPages }},
+	{"year", "Year", func(b store.Book) string { return b.BookYear }},
+	{"shelf", "Shelf", func(b store.Book) string { return b.BookShelf }},
+}
+
+// The answers of the API, as messages.
+type (
+	booksLoaded struct {
+		books []store.Book
+		err   error
+	}
+	// bookLoaded is a book fetched again before it is shown, edited or
+	// deleted, as the list may be stale.
+	bookLoaded struct {
+		book store.Book
+		next consoleMode
+		err  error
+	}
+	bookChanged struct {
+		status string
+		err    error
+	}
+)
+
+type console struct {
+	cl     *client
+	server string
+	mode   consoleMode
+
+	table  table.Model
+	search textinput.Model
+	// The filter of the list, in the query language of the API
+	query string
+	books []store.Book
+
+	// The book shown, edited or about to be deleted; a new one has no ID
+	book store.Book
+	// The fields of the form: the ID first when adding a book, then
+	// editedFields
+	inputs []textinput.Model
+	focus  int
+
+	status string
+	err    error
+}
+
+func runConsole(cl *client, out *output, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: bookctl console")
+	}
+	_, err := tea.NewProgram(newConsole(cl), tea.WithAltScreen(), tea.WithOutput(out.w)).Run()
+	return err
+}
+
+func newConsole(cl *client) *console {
+	keys := table.DefaultKeyMap()
+	// d deletes a book, it doesn't scroll
+	keys.HalfPageDown.SetKeys("ctrl+d")
+	keys.HalfPageUp.SetKeys("ctrl+u")
+	search := textinput.New()
+	search.Prompt = "Search: "
+	search.Placeholder = `author:"Poe" year>=1840`
+	return &console{
+		cl:     cl,
+		server: cl.cfg.Server,
+		table: table.New(
+			table.WithColumns(bookColumns(80)),
+			table.WithKeyMap(keys),
+			table.WithFocused(true),
+		),
+		search: search,
+	}
+}
+
+// bookColumns share the width of the screen, the title and the author
+// taking what the other columns leave.
+func bookColumns(width int) []table.Column {
+	rest := max(width-14-6-12-10, 20)
+	return []table.Column{
+		{Title: "ID", Width: 14},
+		{Title: "Title", Width: rest / 2},
+		{Title: "Author", Width: rest - rest/2},
+		{Title: "Year", Width: 6},
+		{Title: "Shelf", Width: 12},
+	}
+}
+
+func (con *console) Init() tea.Cmd {
+	return con.load()
+}
+
+// load lists the books matching the query.
+func (con *console) load() tea.Cmd {
+	query := con.query
+	return func() tea.Msg {
+		books, err := con.cl.listBooks(query)
+		return booksLoaded{books, err}
+	}
+}
+
+// open fetches the book selected in the list, for the mode next.
+func (con *console) open(next consoleMode) tea.Cmd {
+	i := con.table.Cursor()
+	if i < 0 || i >= len(con.books) {
+		return nil
+	}
+	id := con.books[i].ID
+	return func() tea.Msg {
+		book, err := con.cl.getBook(id)
+		return bookLoaded{book, next, err}
+	}
+}
+
+// change makes a call to the API changing the catalog.
+func (con *console) change(call func() (map[string]interface{}, error)) tea.Cmd {
+	return func() tea.Msg {
+		res, err := call()
+		if err != nil {
+			return bookChanged{err: err}
+		}
+		return bookChanged{status: fmt.Sprint(res["status"])}
+	}
+}
+
+func (con *console) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		con.table.SetColumns(bookColumns(msg.Width))
+		// The title, the status and the keys take a line each
+		con.table.SetHeight(max(msg.Height-4, 3))
+		return con, nil
+	case booksLoaded:
+		if msg.err != nil {
+			con.report("", msg.err)
+			return con, nil
+		}
+		con.books = msg.books
+		rows := make([]table.Row, len(msg.books))
+		for i, b := range msg.books {
+			rows[i] = table.Row{b.ID, b.BookName, b.BookAuthor, b.BookYear, b.BookShelf}
+		}
+		con.table.SetRows(rows)
+		con.table.SetCursor(min(con.table.Cursor(), max(len(rows)-1, 0)))
+		return con, nil
+	case bookLoaded:
+		if msg.err != nil {
+			con.report("", msg.err)
+			return con, nil
+		}
+		con.book = msg.book
+		if msg.next == editing {
+			return con, con.edit(msg.book)
+		}
+		con.mode = msg.next
+		return con, nil
+	case bookChanged:
+		con.report(msg.status, msg.err)
+		if msg.err != nil {
+			return con, nil
+		}
+		con.mode = browsing
+		return con, con.load()
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return con, tea.Quit
+		}
+		// The outcome of the last call stays until the next key
+		con.report("", nil)
+		switch con.mode {
+		case browsing:
+			return con.browse(msg)
+		case searching:
+			return con.typeSearch(msg)
+		case showing:
+			return con.show(msg)
+		case editing:
+			return con.typeForm(msg)
+		case confirming:
+			return con.confirm(msg)
+		}
+	}
+	return con, nil
+}
+
+// report shows the outcome of a call, until the next one.
+func (con *console) report(status string, err error) {
+	con.status, con.err = status, err
+}
+
+func (con *console) browse(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "q", "esc":
+		return con, tea.Quit
+	case "enter":
+		return con, con.open(showing)
+	case "e":
+		return con, con.open(editing)
+	case "d":
+		return con, con.open(confirming)
+	case "a":
+		return con, con.edit(store.Book{})
+	case "r":
+		return con, con.load()
+	case "/":
+		con.mode = searching
+		con.search.SetValue(con.query)
+		con.search.CursorEnd()
+		return con, con.search.Focus()
+	}
+	var cmd tea.Cmd
+	con.table, cmd = con.table.Update(msg)
+	return con, cmd
+}
+
+func (con *console) typeSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		con.mode = browsing
+		con.search.Blur()
+		return con, nil
+	case "enter":
+		con.mode = browsing
+		con.search.Blur()
+		con.query = strings.TrimSpace(con.search.Value())
+		con.table.SetCursor(0)
+		return con, con.load()
+	}
+	var cmd tea.Cmd
+	con.search, cmd = con.search.Update(msg)
+	return con, cmd
+}
+
+func (con *console) show(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "q", "backspace":
+		con.mode = browsing
+	case "e":
+		return con, con.edit(con.book)
+	case "d":
+		con.mode = confirming
+	}
+	return con, nil
+}
+
+func (con *console) confirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	con.mode = browsing
+	if msg.String() != "y" && msg.String() != "Y" {
+		return con, nil
+	}
+	id := con.book.ID
+	return con, con.change(func() (map[string]interface{}, error) { return con.cl.deleteBook(id) })
+}
+
+// edit opens the form on the book, or on a new one when it has no ID.
+func (con *console) edit(book store.Book) tea.Cmd {
+	con.mode, con.book, con.focus = editing, book, 0
+	con.inputs = con.inputs[:0]
+	if book.ID == "" {
+		con.inputs = append(con.inputs, formInput("ID", ""))
+	}
+	for _, f := range editedFields {
+		con.inputs = append(con.inputs, formInput(f.label, f.value(book)))
+	}
+	return con.inputs[0].Focus()
+}
+
+func formInput(label, value string) textinput.Model {
+	in := textinput.New()
+	in.Prompt = labelStyle.Render(label + ":")
+	in.SetValue(value)
+	return in
+}
+
+func (con *console) typeForm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		con.mode = browsing
+		return con, nil
+	case "ctrl+s":
+		return con, con.save()
+	case "enter":
+		if con.focus == len(con.inputs)-1 {
+			return con, con.save()
+		}
+		return con, con.move(1)
+	case "tab", "down":
+		return con, con.move(1)
+	case "shift+tab", "up":
+		return con, con.move(-1)
+	}
+	var cmd tea.Cmd
+	con.inputs[con.focus], cmd = con.inputs[con.focus].Update(msg)
+	return con, cmd
+}
+
+// move focuses the field by steps from the current one, wrapping around.
+func (con *console) move(by int) tea.Cmd {
+	con.inputs[con.focus].Blur()
+	con.focus = (con.focus + by + len(con.inputs)) % len(con.inputs)
+	return con.inputs[con.focus].Focus()
+}
+
+// save adds the book of the form, or sends the fields changed in it.
+func (con *console) save() tea.Cmd {
+	values := make([]string, len(con.inputs))
+	for i, in := range con.inputs {
+		values[i] = strings.TrimSpace(in.Value())
+	}
+	if con.book.ID == "" {
+		book := map[string]string{"id": values[0]}
+		for i, f := range editedFields {
+			if v := values[i+1]; v != "" {
+				book[f.name] = v
+			}
+		}
+		return con.change(func() (map[string]interface{}, error) { return con.cl.addBook(book, false) })
+	}
+	fields := map[string]string{}
+	for i, f := range editedFields {
+		if v := values[i]; v != "" && v != f.value(con.book) {
+			fields[f.name] = v
+		}
+	}
+	if len(fields) == 0 {
+		con.mode = browsing
+		con.report("Nothing changed.", nil)
+		return nil
+	}
+	id := con.book.ID
+	return con.change(func() (map[string]interface{}, error) { return con.cl.updateBook(id, fields) })
+}
+
+func (con *console) View() string {
+	var b strings.Builder
+	title := fmt.Sprintf("Catalog at %s — %d books", con.server, len(con.books))
+	if con.query != "" {
+		title += " matching " + con.query
+	}
+	if con.mode == searching {
+		// In place of the title, for the list to keep its height
+		title = con.search.View()
+	} else {
+		title = titleStyle.Render(title)
+	}
+	b.WriteString(title + "\n")
+
+	switch con.mode {
+	case browsing, searching:
+		b.WriteString(con.table.View())
+	case showing:
+		b.WriteString(con.bookView())
+	case editing:
+		heading := "New book"
+		if con.book.ID != "" {
+			heading = "Editing " + con.book.ID + ", an empty field keeps its value"
+		}
+		b.WriteString(heading + "\n\n")
+		for _, in := range con.inputs {
+			b.WriteString(in.View() + "\n")
+		}
+	case confirming:
+		fmt.Fprintf(&b, "Delete %q by %s? [y/N]", con.book.BookName, con.book.BookAuthor)
+	}
+
+	b.WriteString("\n")
+	switch {
+	case con.err != nil:
+		b.WriteString(errorStyle.Render("Error: " + con.err.Error()))
+	case con.status != "":
+		b.WriteString(statusStyle.Render(con.status))
+	}
+	b.WriteString("\n" + keysStyle.Render(consoleKeys[con.mode]))
+	return b.String()
+}
+
+// bookView lists the fields of the book shown that have a value.
+func (con *console) bookView() string {
+	book := con.book
+	var b strings.Builder
+	for _, row := range [][2]string{
+		{"ID", book.ID}, {"Title", book.BookName}, {"Author", book.BookAuthor},
+		{"Edition", book.BookEdition}, {"Pages", book.BookPages}, {"Year", book.BookYear},
+		{"Shelf", book.BookShelf}, {"Subjects", strings.Join(book.BookSubjects, ", ")},
+		{"Tags", strings.Join(book.BookTags, ", ")},
+	} {
+		if row[1] != "" {
+			b.WriteString(labelStyle.Render(row[0]+":") + " " + row[1] + "\n")
+		}
+	}
+	return b.String()
+}
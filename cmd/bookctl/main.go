@@ -0,0 +1,296 @@
+// Command bookctl manages the catalog over its HTTP API, for scripts and
+// admins, e.g.
+//
+//	bookctl list -q 'author:"Mary Shelley"'
+//	bookctl add -title Frankenstein -author "Mary Shelley" -year 1818
+//	bookctl -o json get example1
+//	bookctl export -format csv -out books.csv
+//
+// The server and the credentials come from the config file, the
+// environment and the flags, in that order (see config.go).
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// command is one of the operations of bookctl. Its flags go after its
+// name, the global ones before.
+type command struct {
+	usage string
+	run   func(cl *client, out *output, args []string) error
+}
+
+var commands = map[string]command{
+	"list":    {"list the books, filtered with -q in the query language of the API", runList},
+	"get":     {"show a book: get ID", runGet},
+	"add":     {"add a book from flags, or from the JSON of -f", runAdd},
+	"update":  {"change fields of a book: update ID field=value...", runUpdate},
+	"delete":  {"remove a book: delete ID", runDelete},
+	"import":  {"load books from a file, like the import command (needs admin credentials)", runImport},
+	"export":  {"dump the catalog in a format of the export command", runExport},
+	"console": {"browse, search and edit the catalog interactively", runConsole},
+}
+
+func main() {
+	cfg, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printCommands()
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		printCommands()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		printCommands()
+		os.Exit(2)
+	}
+	out := &output{w: os.Stdout, json: cfg.Output == "json"}
+	if err := cmd.run(newClient(cfg), out, args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "bookctl:", err)
+		os.Exit(1)
+	}
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "usage: bookctl [flags] <command> [command flags]\n\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+// output prints the books as a table, or as the JSON of the API with
+// -o json.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func (o *output) books(books []store.Book) error {
+	if o.json {
+		return o.value(books)
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tAUTHOR\tYEAR\tSHELF")
+	for _, b := range books {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.ID, b.BookName, b.BookAuthor, b.BookYear, b.BookShelf)
+	}
+	return tw.Flush()
+}
+
+func (o *output) book(b store.Book) error {
+	if o.json {
+		return o.value(b)
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	for _, row := range [][2]string{
+		{"ID", b.ID}, {"Title", b.BookName}, {"Author", b.BookAuthor},
+		{"Edition", b.BookEdition}, {"Pages", b.BookPages}, {"Year", b.BookYear},
+		{"Shelf", b.BookShelf}, {"Subjects", strings.Join(b.BookSubjects, ", ")},
+		{"Tags", strings.Join(b.BookTags, ", ")},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", row[0], row[1])
+		}
+	}
+	return tw.Flush()
+}
+
+// status prints the answer of a change, e.g. "Book created".
+func (o *output) status(v map[string]interface{}) error {
+	if o.json {
+		return o.value(v)
+	}
+	_, err := fmt.Fprintln(o.w, v["status"])
+	return err
+}
+
+func (o *output) value(v interface{}) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// oneID parses the flags of a command taking a single book ID.
+func oneID(name string, args []string) (string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("usage: bookctl %s ID", name)
+	}
+	return fs.Arg(0), nil
+}
+
+func runList(cl *client, out *output, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	query := fs.String("q", "", `filter, e.g. author:"Poe" year>=1840`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	books, err := cl.listBooks(*query)
+	if err != nil {
+		return err
+	}
+	return out.books(books)
+}
+
+func runGet(cl *client, out *output, args []string) error {
+	id, err := oneID("get", args)
+	if err != nil {
+		return err
+	}
+	book, err := cl.getBook(id)
+	if err != nil {
+		return err
+	}
+	return out.book(book)
+}
+
+func runAdd(cl *client, out *output, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	var book store.Book
+	fs.StringVar(&book.ID, "id", "", "ID of the book")
+	fs.StringVar(&book.BookName, "title", "", "title")
+	fs.StringVar(&book.BookAuthor, "author", "", "author")
+	fs.StringVar(&book.BookEdition, "edition", "", "edition, usually the ISBN")
+	fs.StringVar(&book.BookPages, "pages", "", "number of pages")
+	fs.StringVar(&book.BookYear, "year", "", "year of publication")
+	fs.StringVar(&book.BookShelf, "shelf", "", "shelf the book stands on")
+	file := fs.String("f", "", "JSON file of the book, - for stdin, instead of the flags")
+	enrich := fs.Bool("enrich", false, "fill in the missing fields from the ISBN")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var body interface{} = book
+	if *file != "" {
+		data, err := readFile(*file)
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+		body = raw
+	}
+	res, err := cl.addBook(body, *enrich)
+	if err != nil {
+		return err
+	}
+	return out.status(res)
+}
+
+func runUpdate(cl *client, out *output, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("usage: bookctl update ID field=value...")
+	}
+	fields := map[string]string{}
+	for _, arg := range fs.Args()[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("%q: expected field=value, e.g. year=1818", arg)
+		}
+		fields[name] = value
+	}
+	res, err := cl.updateBook(fs.Arg(0), fields)
+	if err != nil {
+		return err
+	}
+	return out.status(res)
+}
+
+func runDelete(cl *client, out *output, args []string) error {
+	id, err := oneID("delete", args)
+	if err != nil {
+		return err
+	}
+	res, err := cl.deleteBook(id)
+	if err != nil {
+		return err
+	}
+	return out.status(res)
+}
+
+func runImport(cl *client, out *output, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "format of the file, from its extension by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: bookctl import [-format FORMAT] FILE")
+	}
+	summary, err := cl.importBooks(fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.value(summary)
+	}
+	keys := make([]string, 0, len(summary))
+	for k := range summary {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(out.w, "%s: %v\n", k, summary[k])
+	}
+	return nil
+}
+
+func runExport(cl *client, out *output, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "json", "json, ndjson, csv, marc, marcxml, bibtex or csl-json")
+	path := fs.String("out", "", "file to write, stdout by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	w := out.w
+	if *path != "" {
+		f, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return cl.export(*format, w)
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
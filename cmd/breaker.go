@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// When MongoDB goes down, every request would wait for the driver to give
+// up on it. Instead, after a few timeouts or network errors in a row the
+// repository of the books stops calling it for a while (the circuit is
+// open) and fails at once with store.ErrUnavailable. The cached reads then
+// answer with the last value they loaded, with a Warning header telling
+// it may be stale, and the writes answer 503. Once the cooldown is over,
+// a single call tries MongoDB again, closing the circuit if it succeeds.
+
+// circuitBreaker counts the failures of the database in a row. A nil
+// *circuitBreaker never opens.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	// A call is trying the database after the cooldown
+	probing bool
+}
+
+func newCircuitBreaker(cfg config.DatabaseConfig) *circuitBreaker {
+	if cfg.BreakerFailures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{failures: cfg.BreakerFailures, cooldown: cfg.BreakerCooldown}
+}
+
+// databaseUnavailable tells if err means the database can't be reached, as
+// opposed to e.g. an unknown book or a duplicate.
+func databaseUnavailable(err error) bool {
+	return errors.Is(err, store.ErrUnavailable) || mongo.IsTimeout(err) || mongo.IsNetworkError(err)
+}
+
+// breakerCall tells record which kind of call it counts the outcome of.
+type breakerCall int
+
+const (
+	// Let through while the circuit was closed
+	normalCall breakerCall = iota
+	// Trying the database after the cooldown
+	probeCall
+)
+
+// allow returns a *store.UnavailableError while the circuit is open. After
+// the cooldown, one call at a time is let through to try the database: the
+// probe.
+func (b *circuitBreaker) allow() (breakerCall, error) {
+	if b == nil {
+		return normalCall, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive < b.failures {
+		return normalCall, nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+		return normalCall, &store.UnavailableError{RetryAfter: max(wait, time.Second)}
+	}
+	b.probing = true
+	return probeCall, nil
+}
+
+// record counts the outcome of a call let through. Once the circuit is
+// open only the probe's counts: the calls let through before it opened
+// tell nothing of whether the database is back.
+func (b *circuitBreaker) record(call breakerCall, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if call == probeCall {
+		b.probing = false
+	} else if b.consecutive >= b.failures {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which tells nothing of the database: the
+		// next call tries it instead
+		return
+	}
+	if err != nil && databaseUnavailable(err) {
+		b.consecutive++
+		if b.consecutive >= b.failures {
+			if b.consecutive == b.failures {
+				slog.Warn("database unavailable, failing fast", "failures", b.consecutive, "cooldown", b.cooldown, "error", err)
+			}
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+		return
+	}
+	if b.consecutive >= b.failures {
+		slog.Info("database available again")
+	}
+	b.consecutive = 0
+}
+
+// guard runs call unless the circuit is open.
+func guard[T any](b *circuitBreaker, call func() (T, error)) (T, error) {
+	kind, err := b.allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	value, err := call()
+	b.record(kind, err)
+	return value, err
+}
+
+// guardedBooks is the repository of the books behind the circuit breaker,
+// for the handlers and the cached reads. A call tried again (see retry.go)
+// counts once.
+type guardedBooks struct {
+	retryingBooks
+	breaker *circuitBreaker
+}
+
+func (g guardedBooks) All(ctx context.Context) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.All(ctx) })
+}
+
+func (g guardedBooks) Find(ctx context.Context, filter interface{}) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.Find(ctx, filter) })
+}
+
+func (g guardedBooks) Authors(ctx context.Context) ([]string, error) {
+	return guard(g.breaker, func() ([]string, error) { return g.retryingBooks.Authors(ctx) })
+}
+
+func (g guardedBooks) ByID(ctx context.Context, id string) (store.Book, error) {
+	return guard(g.breaker, func() (store.Book, error) { return g.retryingBooks.ByID(ctx, id) })
+}
+
+func (g guardedBooks) Random(ctx context.Context) (store.Book, error) {
+	return guard(g.breaker, func() (store.Book, error) { return g.retryingBooks.Random(ctx) })
+}
+
+func (g guardedBooks) ByAuthor(ctx context.Context, author string, sortKey string, desc bool) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.ByAuthor(ctx, author, sortKey, desc) })
+}
+
+func (g guardedBooks) YearsByDecade(ctx context.Context) ([]store.DecadeGroup, error) {
+	return guard(g.breaker, func() ([]store.DecadeGroup, error) { return g.retryingBooks.YearsByDecade(ctx) })
+}
+
+func (g guardedBooks) ByYear(ctx context.Context, year string) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.ByYear(ctx, year) })
+}
+
+func (g guardedBooks) Shelves(ctx context.Context) ([]store.ShelfCount, error) {
+	return guard(g.breaker, func() ([]store.ShelfCount, error) { return g.retryingBooks.Shelves(ctx) })
+}
+
+func (g guardedBooks) ByShelf(ctx context.Context, shelf string) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.ByShelf(ctx, shelf) })
+}
+
+func (g guardedBooks) Recent(ctx context.Context, limit int64) ([]store.Book, error) {
+	return guard(g.breaker, func() ([]store.Book, error) { return g.retryingBooks.Recent(ctx, limit) })
+}
+
+func (g guardedBooks) Changes(ctx context.Context, since time.Time, limit int) (store.Changes, error) {
+	return guard(g.breaker, func() (store.Changes, error) { return g.retryingBooks.Changes(ctx, since, limit) })
+}
+
+func (g guardedBooks) LastModified(ctx context.Context) (time.Time, error) {
+	return guard(g.breaker, func() (time.Time, error) { return g.retryingBooks.LastModified(ctx) })
+}
+
+func (g guardedBooks) Insert(ctx context.Context, book store.Book) error {
+	_, err := guard(g.breaker, func() (struct{}, error) { return struct{}{}, g.retryingBooks.Insert(ctx, book) })
+	return err
+}
+
+func (g guardedBooks) Update(ctx context.Context, id string, fields bson.M) error {
+	_, err := guard(g.breaker, func() (struct{}, error) { return struct{}{}, g.retryingBooks.Update(ctx, id, fields) })
+	return err
+}
+
+func (g guardedBooks) Delete(ctx context.Context, id string) error {
+	_, err := guard(g.breaker, func() (struct{}, error) { return struct{}{}, g.retryingBooks.Delete(ctx, id) })
+	return err
+}
+
+// guardedQuery runs a query of the collection of the books the repository
+// has no method for, e.g. an aggregation, behind the circuit breaker and
+// tried again like the reads. The query must be idempotent.
+func guardedQuery[T any](ctx context.Context, g guardedBooks, query func(coll *mongo.Collection) (T, error)) (T, error) {
+	return guard(g.breaker, func() (T, error) {
+		return retry(ctx, g.retrier, func() (T, error) { return query(g.Collection()) })
+	})
+}
+
+type staleKey struct{}
+
+// staleWarning lets the cached reads mark the response as stale, when they
+// answer with the last value loaded (see cache.go).
+func staleWarning() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var once sync.Once
+			mark := func() {
+				once.Do(func() {
+					c.Response().Header().Add("Warning", `110 - "Response is Stale"`)
+				})
+			}
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), staleKey{}, mark)))
+			return next(c)
+		}
+	}
+}
+
+// markStale marks the response of the request of ctx as stale.
+func markStale(ctx context.Context) {
+	if mark, ok := ctx.Value(staleKey{}).(func()); ok {
+		mark()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	down := fmt.Errorf("ping: %w", store.ErrUnavailable)
+	b := newCircuitBreaker(config.DatabaseConfig{BreakerFailures: 2, BreakerCooldown: time.Hour})
+	call := func(err error) error {
+		_, err = guard(b, func() (struct{}, error) { return struct{}{}, err })
+		return err
+	}
+
+	// Other errors don't count
+	for _, err := range []error{down, store.ErrNotFound, down} {
+		if got := call(err); got != err {
+			t.Fatalf("got %v, want %v", got, err)
+		}
+	}
+	if err := call(down); err != down {
+		t.Fatalf("after 1 failure in a row: got %v", err)
+	}
+	var ue *store.UnavailableError
+	if err := call(nil); !errors.As(err, &ue) {
+		t.Fatalf("after 2 failures in a row: got %v, want the circuit open", err)
+	}
+
+	// After the cooldown, a probe cancelled by its caller tells nothing
+	b.openUntil = time.Now()
+	if err := call(context.Canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("probe: got %v", err)
+	}
+	if b.consecutive != 2 {
+		t.Errorf("a cancelled probe reset the failures to %d", b.consecutive)
+	}
+
+	// Nor does a call let through before the circuit opened: only the
+	// probe closes it
+	probe, err := b.allow()
+	if probe != probeCall || err != nil {
+		t.Fatalf("probe after a cancelled one: got %v, %v", probe, err)
+	}
+	b.record(normalCall, nil)
+	if b.consecutive != 2 || !b.probing {
+		t.Errorf("an earlier call closed the circuit: %d failures, probing %v", b.consecutive, b.probing)
+	}
+	if err := call(nil); !errors.As(err, &ue) {
+		t.Fatalf("while probing: got %v, want the circuit open", err)
+	}
+	b.record(probe, nil)
+	if b.consecutive != 0 || b.probing {
+		t.Errorf("a successful probe left %d failures, probing %v", b.consecutive, b.probing)
+	}
+	if err := call(nil); err != nil {
+		t.Fatalf("after a successful probe: got %v", err)
+	}
+
+	// A nil breaker never opens
+	var none *circuitBreaker
+	for range 3 {
+		if _, err := guard(none, func() (struct{}, error) { return struct{}{}, down }); err != down {
+			t.Fatalf("nil breaker: got %v", err)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every bulk edit is recorded in this collection, with the values it
+// overwrote, so it can be undone for a while. Records are kept a week (see
+// 006_bulk_edit_indexes).
+const bulkEditsCollection = "bulk_edits"
+
+const (
+	// How long after a bulk edit it can be undone
+	bulkUndoWindow = 15 * time.Minute
+	// Edits touching more books are refused: the overwritten values have
+	// to fit in a single document
+	maxBulkEditBooks = 5000
+	// Books listed in the preview
+	bulkPreviewSamples = 10
+)
+
+// The fields a bulk edit may change, by their JSON name, as in PUT
+// /api/books/:id.
+var bulkEditFields = map[string]string{
+	"title":   "BookName",
+	"author":  "BookAuthor",
+	"edition": "BookEdition",
+	"pages":   "BookPages",
+	"year":    "BookYear",
+	"shelf":   "BookShelf",
+}
+
+// BulkEditRequest selects books with the query language of GET /api/books
+// (see store/query.go) and tells the values to give to their fields.
+type BulkEditRequest struct {
+	Query string            `json:"q"`
+	Set   map[string]string `json:"set"`
+}
+
+// bindBulkEdit reads the request from JSON or from the form of the bulk edit
+// page, where the fields left empty are not changed.
+func bindBulkEdit(c echo.Context) (BulkEditRequest, error) {
+	req := BulkEditRequest{Set: map[string]string{}}
+	if render.IsBrowserSubmission(c) {
+		req.Query = c.FormValue("q")
+		for field := range bulkEditFields {
+			if v := strings.TrimSpace(c.FormValue(field)); v != "" {
+				req.Set[field] = v
+			}
+		}
+		return req, nil
+	}
+	err := c.Bind(&req)
+	return req, err
+}
+
+// bookField returns the value of a field of the book, by its BSON name.
+func bookField(book store.Book, field string) string {
+	switch field {
+	case "BookName":
+		return book.BookName
+	case "BookAuthor":
+		return book.BookAuthor
+	case "BookEdition":
+		return book.BookEdition
+	case "BookPages":
+		return book.BookPages
+	case "BookYear":
+		return book.BookYear
+	case "BookShelf":
+		return book.BookShelf
+	}
+	return ""
+}
+
+// BulkFieldChange is a field of a book the edit changes.
+type BulkFieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// BulkSample is a book of the preview, with what would change.
+type BulkSample struct {
+	ID      string            `json:"id"`
+	Title   string            `json:"title"`
+	Changes []BulkFieldChange `json:"changes"`
+}
+
+// BulkPreview is the data of POST /admin/bulk/preview. Count only includes
+// the books the edit actually changes, not those that already have the new
+// values.
+type BulkPreview struct {
+	Query   string            `json:"q"`
+	Set     map[string]string `json:"set"`
+	Count   int               `json:"count"`
+	Samples []BulkSample      `json:"samples"`
+}
+
+// bulkPlan is what a bulk edit will do: the books it changes, each with
+// the changed fields and their current values.
+type bulkPlan struct {
+	set   bson.M
+	books []store.Book
+	// Per book, the current value of each field the edit changes
+	before []bson.M
+}
+
+// bulkEditError is an invalid bulk edit, with the fields at fault if any.
+type bulkEditError struct {
+	msg    string
+	fields store.FieldErrors
+}
+
+func (e *bulkEditError) Error() string { return e.msg }
+
+// planBulkEdit checks the request and finds the books it changes. Invalid
+// requests return a *store.QueryError or a *bulkEditError.
+func planBulkEdit(ctx context.Context, coll *mongo.Collection, req BulkEditRequest) (bulkPlan, error) {
+	if strings.TrimSpace(req.Query) == "" {
+		// Editing the whole catalog by mistake is too easy otherwise
+		return bulkPlan{}, &store.QueryError{Pos: 0, Msg: "a filter is required"}
+	}
+	filter, err := store.ParseQuery(req.Query)
+	if err != nil {
+		return bulkPlan{}, err
+	}
+
+	plan := bulkPlan{set: bson.M{}}
+	errs := store.FieldErrors{}
+	for name, value := range req.Set {
+		field, ok := bulkEditFields[name]
+		if !ok {
+			errs[name] = "This field can't be bulk edited"
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if msg := store.ValidateBookField(field, value); msg != "" {
+			errs[field] = msg
+			continue
+		}
+		plan.set[field] = value
+	}
+	if len(errs) > 0 {
+		return bulkPlan{}, &bulkEditError{msg: "Invalid bulk edit", fields: errs}
+	}
+	if len(plan.set) == 0 {
+		return bulkPlan{}, &bulkEditError{msg: "No fields to change"}
+	}
+
+	// Books that already have every new value are left out
+	different := bson.A{}
+	for field, value := range plan.set {
+		different = append(different, bson.M{field: bson.M{"$ne": value}})
+	}
+	filter = bson.M{"$and": bson.A{filter, bson.M{"$or": different}}}
+	opts := store.FindOpts(ctx).SetSort(bson.D{{Key: "ID", Value: 1}}).SetLimit(maxBulkEditBooks + 1)
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return bulkPlan{}, err
+	}
+	if err := cursor.All(ctx, &plan.books); err != nil {
+		return bulkPlan{}, err
+	}
+	if len(plan.books) > maxBulkEditBooks {
+		return bulkPlan{}, &bulkEditError{msg: fmt.Sprintf("The filter matches more than %d books, narrow it down", maxBulkEditBooks)}
+	}
+	for _, book := range plan.books {
+		before := bson.M{}
+		for field, value := range plan.set {
+			if current := bookField(book, field); current != value {
+				before[field] = current
+			}
+		}
+		plan.before = append(plan.before, before)
+	}
+	return plan, nil
+}
+
+func (p bulkPlan) preview(req BulkEditRequest) BulkPreview {
+	preview := BulkPreview{Query: req.Query, Set: req.Set, Count: len(p.books), Samples: []BulkSample{}}
+	for i, book := range p.books[:min(len(p.books), bulkPreviewSamples)] {
+		sample := BulkSample{ID: book.ID, Title: book.BookName}
+		for field, value := range p.before[i] {
+			sample.Changes = append(sample.Changes, BulkFieldChange{
+				Field:  store.JSONFields[field],
+				Before: value.(string),
+				After:  p.set[field].(string),
+			})
+		}
+		sort.Slice(sample.Changes, func(a, b int) bool { return sample.Changes[a].Field < sample.Changes[b].Field })
+		preview.Samples = append(preview.Samples, sample)
+	}
+	return preview
+}
+
+// BulkEdit is the record of an applied bulk edit.
+type BulkEdit struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Query     string             `bson:"q" json:"q"`
+	Set       bson.M             `bson:"set" json:"set"`
+	At        time.Time          `bson:"at" json:"at"`
+	UndoUntil time.Time          `bson:"undoUntil" json:"undoUntil"`
+	UndoneAt  *time.Time         `bson:"undoneAt,omitempty" json:"undoneAt,omitempty"`
+	Books     []BulkEditBook     `bson:"books" json:"-"`
+	Modified  int                `bson:"modified" json:"modified"`
+	// Set by an undo: books reverted, and books left alone because they
+	// were edited again since
+	Reverted int `bson:"reverted,omitempty" json:"reverted,omitempty"`
+	Skipped  int `bson:"skipped,omitempty" json:"skipped,omitempty"`
+}
+
+// BulkEditBook is a book a bulk edit changed, with the values it had.
+type BulkEditBook struct {
+	MongoID primitive.ObjectID `bson:"_id"`
+	Before  bson.M             `bson:"before"`
+}
+
+// Undoable tells if the edit can still be undone.
+func (e BulkEdit) Undoable() bool {
+	return e.UndoneAt == nil && time.Now().Before(e.UndoUntil)
+}
+
+// applyBulkEdit records the edit, then changes the books. The record comes
+// first so that an edit interrupted half way can still be undone.
+func applyBulkEdit(ctx context.Context, coll *mongo.Collection, req BulkEditRequest, plan bulkPlan) (BulkEdit, error) {
+	now := time.Now().UTC()
+	edit := BulkEdit{
+		ID:        primitive.NewObjectID(),
+		Query:     req.Query,
+		Set:       plan.set,
+		At:        now,
+		UndoUntil: now.Add(bulkUndoWindow),
+		Books:     make([]BulkEditBook, 0, len(plan.books)),
+	}
+	ids := make(bson.A, 0, len(plan.books))
+	for i, book := range plan.books {
+		edit.Books = append(edit.Books, BulkEditBook{MongoID: book.MongoID, Before: plan.before[i]})
+		ids = append(ids, book.MongoID)
+	}
+	edits := coll.Database().Collection(bulkEditsCollection)
+	if _, err := edits.InsertOne(ctx, edit, store.InsertOneOpts(ctx)); err != nil {
+		return edit, err
+	}
+
+	set := bson.M{"updatedAt": now, "updatedBy": store.ActorFromContext(ctx)}
+	for field, value := range plan.set {
+		set[field] = value
+	}
+	res, err := coll.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": set}, store.UpdateOpts(ctx))
+	if err != nil {
+		return edit, err
+	}
+	edit.Modified = int(res.ModifiedCount)
+	_, err = edits.UpdateByID(ctx, edit.ID, bson.M{"$set": bson.M{"modified": edit.Modified}}, store.UpdateOpts(ctx))
+	return edit, err
+}
+
+// errUndoExpired is returned when undoing an edit that was already undone,
+// or whose undo window has closed.
+var errUndoExpired = errors.New("this edit can no longer be undone")
+
+// undoBulkEdit puts back the values a bulk edit overwrote. A book edited
+// again since is left alone, rather than losing the later edit.
+func undoBulkEdit(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID) (BulkEdit, error) {
+	edits := coll.Database().Collection(bulkEditsCollection)
+	now := time.Now().UTC()
+	// Claimed in one step, so two undos of the same edit can't both run
+	var edit BulkEdit
+	err := edits.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "undoneAt": nil, "undoUntil": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"undoneAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&edit)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if err := edits.FindOne(ctx, bson.M{"_id": id}, store.FindOneOpts(ctx)).Err(); err != nil {
+			return edit, err
+		}
+		return edit, errUndoExpired
+	}
+	if err != nil {
+		return edit, err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(edit.Books))
+	for _, book := range edit.Books {
+		// Only if the fields still hold the values the edit gave them
+		filter := bson.M{"_id": book.MongoID}
+		for field := range book.Before {
+			filter[field] = edit.Set[field]
+		}
+		set := bson.M{"updatedAt": now, "updatedBy": store.ActorFromContext(ctx)}
+		for field, value := range book.Before {
+			set[field] = value
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.M{"$set": set}))
+	}
+	if len(models) > 0 {
+		res, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return edit, err
+		}
+		edit.Reverted = int(res.ModifiedCount)
+		edit.Skipped = len(models) - int(res.MatchedCount)
+	}
+	_, err = edits.UpdateByID(ctx, edit.ID, bson.M{"$set": bson.M{"reverted": edit.Reverted, "skipped": edit.Skipped}}, store.UpdateOpts(ctx))
+	return edit, err
+}
+
+// BulkEditPage is the data passed to the "bulk-edit" block.
+type BulkEditPage struct {
+	Recent []BulkEdit
+	Window time.Duration
+}
+
+// registerBulkEditRoutes mounts the bulk edit of the catalog: GET
+// /admin/bulk shows the form, POST /admin/bulk/preview tells which books an
+// edit changes, POST /admin/bulk applies it and POST /admin/bulk/:id/undo
+// reverts it within bulkUndoWindow.
+func registerBulkEditRoutes(admin *echo.Group, coll *mongo.Collection, catalog *ttlCache, searcher searchBackend) {
+	edits := coll.Database().Collection(bulkEditsCollection)
+
+	// invalid answers the errors of planBulkEdit, or returns nil for the
+	// others. The page gets them with a 422, which it swaps in (see the
+	// htmx:beforeSwap handler in index.html).
+	invalid := func(c echo.Context, err error) error {
+		body := handlers.ErrorBody(c, err.Error())
+		var qe *store.QueryError
+		var be *bulkEditError
+		switch {
+		case errors.As(err, &qe):
+			body["position"] = qe.Pos
+		case errors.As(err, &be):
+			if len(be.fields) > 0 {
+				body["fields"] = be.fields.JSON()
+			}
+		default:
+			return nil
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusUnprocessableEntity, "bulk-error", body)
+		}
+		return c.JSON(http.StatusBadRequest, body)
+	}
+
+	admin.GET("/bulk", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := store.FindOpts(ctx).SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(10).
+			SetProjection(bson.M{"books": 0})
+		cursor, err := edits.Find(ctx, bson.D{}, opts)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		page := BulkEditPage{Recent: []BulkEdit{}, Window: bulkUndoWindow}
+		if err := cursor.All(ctx, &page.Recent); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if render.WantsHTML(c) {
+			return render.Page(c, http.StatusOK, "bulk-edit", page)
+		}
+		return c.JSON(http.StatusOK, page.Recent)
+	})
+
+	admin.POST("/bulk/preview", func(c echo.Context) error {
+		req, err := bindBulkEdit(c)
+		if err != nil {
+			return handlers.InvalidBody(c, err, "Invalid bulk edit")
+		}
+		plan, err := planBulkEdit(c.Request().Context(), coll, req)
+		if err != nil {
+			if resp := invalid(c, err); resp != nil {
+				return resp
+			}
+			return handlers.ServerError(c, err, "Database error")
+		}
+		preview := plan.preview(req)
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "bulk-preview", preview)
+		}
+		return c.JSON(http.StatusOK, preview)
+	})
+
+	// The books are looked up again rather than taken from the preview, so
+	// the edit applies to the catalog as it is now.
+	admin.POST("/bulk", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		req, err := bindBulkEdit(c)
+		if err != nil {
+			return handlers.InvalidBody(c, err, "Invalid bulk edit")
+		}
+		plan, err := planBulkEdit(ctx, coll, req)
+		if err != nil {
+			if resp := invalid(c, err); resp != nil {
+				return resp
+			}
+			return handlers.ServerError(c, err, "Database error")
+		}
+		edit, err := applyBulkEdit(ctx, coll, req, plan)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not update books")
+		}
+		catalog.invalidate()
+		for _, book := range plan.books {
+			reindexBook(ctx, searcher, coll, book.ID)
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "bulk-applied", edit)
+		}
+		return c.JSON(http.StatusOK, edit)
+	})
+
+	admin.POST("/bulk/:id/undo", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusNotFound, "Bulk edit not found")
+		}
+		edit, err := undoBulkEdit(ctx, coll, id)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return handlers.JSONError(c, http.StatusNotFound, "Bulk edit not found")
+		case errors.Is(err, errUndoExpired):
+			return handlers.JSONError(c, http.StatusConflict, "This edit was already undone, or is too old to be undone")
+		case err != nil:
+			return handlers.ServerError(c, err, "Could not undo the edit")
+		}
+		catalog.invalidate()
+		ids := make(bson.A, 0, len(edit.Books))
+		for _, book := range edit.Books {
+			ids = append(ids, book.MongoID)
+		}
+		if books, err := store.NewBooks(coll).Find(ctx, bson.M{"_id": bson.M{"$in": ids}}); err == nil {
+			for _, book := range books {
+				searcher.Indexed(ctx, book)
+			}
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "bulk-undone", edit)
+		}
+		return c.JSON(http.StatusOK, edit)
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/singleflight"
+)
+
+// Hits, misses, coalesced loads, stale answers and invalidations of the
+// catalog cache, published in /debug/vars.
+var cacheStats = expvar.NewMap("cache")
+
+// ttlCache keeps the results of the full-collection reads behind /books,
+// /api/books, /authors and /years for a little while, so reloading a page
+// doesn't scan the whole collection every time. Entries expire after ttl
+// and the whole cache is dropped whenever the books change. A zero ttl
+// disables it.
+//
+// Entries live in memory, or in the shared store (Redis) when there is one,
+// so that a write on one instance clears the cache of all of them.
+type ttlCache struct {
+	ttl    time.Duration
+	shared sharedStore
+
+	// Concurrent loads of the same key are collapsed into one query.
+	loads singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// The last value loaded for each key, kept past expiry and
+	// invalidation, for when the database is unavailable (see breaker.go)
+	lastKnown map[string]interface{}
+	// Bumped by invalidate, so that loads started before a write neither
+	// store their result nor get joined by requests made after it.
+	generation uint64
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, shared sharedStore) *ttlCache {
+	return &ttlCache{ttl: ttl, shared: shared, entries: map[string]cacheEntry{}, lastKnown: map[string]interface{}{}}
+}
+
+const cacheKeyPrefix = "cache:"
+
+// How long a coalesced load may take. It no longer follows the deadline of
+// the request that started it, as other requests wait for it too.
+const coalescedLoadTimeout = 10 * time.Second
+
+// cached returns the value stored under key, or calls load and stores its
+// result if there is none or it expired. Errors are not cached. Callers
+// share the returned value and must not modify it.
+//
+// When many requests miss at once, e.g. right after a write, only one of
+// them runs load and the others wait for its result instead of all hitting
+// MongoDB with the same query. This also holds with the cache disabled, as
+// does the fallback to the last value loaded while MongoDB is unavailable.
+func cached[T any](ctx context.Context, c *ttlCache, key string, load func(context.Context) (T, error)) (T, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+
+	load = coalesce(c, key+"#"+strconv.FormatUint(generation, 10), load)
+	load = withLastKnown(c, key, load)
+	if c.ttl <= 0 {
+		return load(ctx)
+	}
+	if c.shared != nil {
+		return cachedShared(ctx, c, key, generation, load)
+	}
+
+	if ok && time.Now().Before(entry.expires) {
+		cacheStats.Add("hits", 1)
+		return entry.value.(T), nil
+	}
+
+	cacheStats.Add("misses", 1)
+	value, err := load(ctx)
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// cachedShared is cached for the shared store, where values are stored as
+// BSON, like in MongoDB: JSON would lose the fields the API hides, e.g.
+// the MongoID the books are dated by. The store being down only costs us
+// the cache.
+func cachedShared[T any](ctx context.Context, c *ttlCache, key string, generation uint64, load func(context.Context) (T, error)) (T, error) {
+	storeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	data, ok, err := c.shared.Get(storeCtx, cacheKeyPrefix+key)
+	if err != nil {
+		slog.Warn("cache unavailable", "key", key, "error", err)
+	}
+	var stored sharedValue[T]
+	if ok && bson.Unmarshal(data, &stored) == nil {
+		cacheStats.Add("hits", 1)
+		return stored.Value, nil
+	}
+
+	cacheStats.Add("misses", 1)
+	value, err := load(ctx)
+	if err != nil {
+		return value, err
+	}
+	if data, err := bson.Marshal(sharedValue[T]{value}); err == nil && c.currentGeneration() == generation {
+		if err := c.shared.Set(storeCtx, cacheKeyPrefix+key, data, c.ttl); err != nil {
+			slog.Warn("cache unavailable", "key", key, "error", err)
+		}
+	}
+	return value, nil
+}
+
+// sharedValue wraps the values of the shared store, as BSON documents
+// can't be a list or a date.
+type sharedValue[T any] struct {
+	Value T `bson:"v"`
+}
+
+func (c *ttlCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// coalesce wraps load so that concurrent calls for the same key share a
+// single run. The run keeps the values of the first caller's context (request
+// ID, trace) but not its cancellation; each caller still stops waiting when
+// its own context is done.
+func coalesce[T any](c *ttlCache, key string, load func(context.Context) (T, error)) func(context.Context) (T, error) {
+	return func(ctx context.Context) (T, error) {
+		ch := c.loads.DoChan(key, func() (interface{}, error) {
+			loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), coalescedLoadTimeout)
+			defer cancel()
+			return load(loadCtx)
+		})
+		select {
+		case res := <-ch:
+			if res.Shared {
+				cacheStats.Add("coalesced", 1)
+			}
+			value, _ := res.Val.(T)
+			return value, res.Err
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// withLastKnown wraps load to remember the values it returns, and to return
+// the last one instead of failing while the database is unavailable, the
+// response being marked stale (see breaker.go).
+func withLastKnown[T any](c *ttlCache, key string, load func(context.Context) (T, error)) func(context.Context) (T, error) {
+	return func(ctx context.Context) (T, error) {
+		value, err := load(ctx)
+		if err == nil {
+			c.mu.Lock()
+			c.lastKnown[key] = value
+			c.mu.Unlock()
+			return value, nil
+		}
+		if !databaseUnavailable(err) {
+			return value, err
+		}
+		c.mu.Lock()
+		last, ok := c.lastKnown[key]
+		c.mu.Unlock()
+		if !ok {
+			return value, err
+		}
+		cacheStats.Add("stale", 1)
+		markStale(ctx)
+		return last.(T), nil
+	}
+}
+
+// invalidate drops every entry. Any write can change all the cached views,
+// so there is no point in being more selective.
+func (c *ttlCache) invalidate() {
+	if c.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := c.shared.DeletePrefix(ctx, cacheKeyPrefix); err != nil {
+			slog.Warn("failed to clear the cache", "error", err)
+		}
+	}
+	c.mu.Lock()
+	clear(c.entries)
+	c.generation++
+	c.mu.Unlock()
+	cacheStats.Add("invalidations", 1)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCachedSharedKeepsMongoID(t *testing.T) {
+	ctx := context.Background()
+	added := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	book := store.Book{MongoID: primitive.NewObjectIDFromTimestamp(added), ID: "example1", BookName: "Frankenstein"}
+	loads := 0
+	load := func(context.Context) ([]store.Book, error) {
+		loads++
+		return []store.Book{book}, nil
+	}
+
+	c := newTTLCache(time.Minute, newMemoryStore())
+	for range 2 {
+		books, err := cached(ctx, c, "books", load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(books) != 1 || books[0].MongoID != book.MongoID || !books[0].AddedAt().Equal(added) {
+			t.Fatalf("got %+v, want %+v", books, book)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want the second read from the shared store", loads)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bookChange is a write to the collection, as reported by its change stream.
+type bookChange struct {
+	// The resume token, unique to the change
+	Token struct {
+		Data string `bson:"_data"`
+	} `bson:"_id"`
+	// insert, update, replace or delete
+	Operation string `bson:"operationType"`
+	Key       struct {
+		MongoID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	// The book after the change, missing on deletes
+	Book *store.Book `bson:"fullDocument"`
+	// The book before the change, only when the collection has
+	// changeStreamPreAndPostImages enabled (MongoDB 6+)
+	Before *store.Book `bson:"fullDocumentBeforeChange"`
+	// When the change happened
+	ClusterTime primitive.Timestamp `bson:"clusterTime"`
+	// The fields an update set, with their new values
+	Update struct {
+		Fields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// changeFeed watches the collection once and hands every change to its
+// subscribers: the cache drops its entries (cache.go) and the event
+// publisher forwards them to the message bus (events.go). Writes from any
+// instance or from the CLI commands show up, not only those going through
+// this process.
+type changeFeed struct {
+	coll *mongo.Collection
+
+	mu          sync.Mutex
+	subscribers []func(context.Context, bookChange)
+}
+
+func newChangeFeed(coll *mongo.Collection) *changeFeed {
+	return &changeFeed{coll: coll}
+}
+
+// Subscribe registers fn, which is called for every change, one at a time
+// and in order. Subscribe before calling Run.
+func (f *changeFeed) Subscribe(fn func(context.Context, bookChange)) {
+	f.mu.Lock()
+	f.subscribers = append(f.subscribers, fn)
+	f.mu.Unlock()
+}
+
+// Run watches the collection until ctx is cancelled. Change streams need a
+// replica set; on a standalone server it logs why and returns right away.
+func (f *changeFeed) Run(ctx context.Context) {
+	f.mu.Lock()
+	subscribers := f.subscribers
+	f.mu.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	stream, err := f.coll.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		slog.Info("change streams unavailable, cached pages expire after the TTL and no events are published", "error", err)
+		return
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change bookChange
+		if err := stream.Decode(&change); err != nil {
+			slog.Warn("could not decode change", "error", err)
+			continue
+		}
+		for _, fn := range subscribers {
+			fn(ctx, change)
+		}
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		slog.Warn("change stream stopped", "error", err)
+	}
+}
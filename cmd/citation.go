@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// Citation formats, so books can be cited from LaTeX (BibTeX) or imported
+// into reference managers such as Zotero (CSL-JSON).
+
+// cslItem is a book in CSL-JSON, see
+// https://citeproc-js.readthedocs.io/en/latest/csl-json/markup.html
+type cslItem struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Title         string    `json:"title"`
+	Author        []cslName `json:"author,omitempty"`
+	Issued        *cslDate  `json:"issued,omitempty"`
+	Edition       string    `json:"edition,omitempty"`
+	ISBN          string    `json:"ISBN,omitempty"`
+	NumberOfPages string    `json:"number-of-pages,omitempty"`
+	Keyword       string    `json:"keyword,omitempty"`
+}
+
+type cslName struct {
+	Family  string `json:"family,omitempty"`
+	Given   string `json:"given,omitempty"`
+	Literal string `json:"literal,omitempty"`
+}
+
+type cslDate struct {
+	DateParts [][]int `json:"date-parts"`
+}
+
+// splitName guesses the family and given names of an author: "Shelley,
+// Mary" or "Mary Shelley". A single word is returned as the family name.
+func splitName(name string) (family, given string) {
+	name = strings.TrimSpace(name)
+	if f, g, ok := strings.Cut(name, ","); ok {
+		return strings.TrimSpace(f), strings.TrimSpace(g)
+	}
+	if i := strings.LastIndex(name, " "); i > 0 {
+		return name[i+1:], name[:i]
+	}
+	return name, ""
+}
+
+func bookToCSL(b store.Book) cslItem {
+	item := cslItem{
+		ID:            b.ID,
+		Type:          "book",
+		Title:         b.BookName,
+		NumberOfPages: b.BookPages,
+		Keyword:       strings.Join(b.BookSubjects, ", "),
+	}
+	if b.BookAuthor != "" {
+		family, given := splitName(b.BookAuthor)
+		if given == "" {
+			item.Author = []cslName{{Literal: family}}
+		} else {
+			item.Author = []cslName{{Family: family, Given: given}}
+		}
+	}
+	if year, err := strconv.Atoi(b.BookYear); err == nil {
+		item.Issued = &cslDate{DateParts: [][]int{{year}}}
+	}
+	if isbn := normalizeISBN(b.BookEdition); isbn != "" {
+		item.ISBN = isbn
+	} else {
+		item.Edition = b.BookEdition
+	}
+	return item
+}
+
+// Citation keys may only hold a few characters; we derive them from the ID.
+var bibtexKeyPattern = regexp.MustCompile(`[^A-Za-z0-9_:.-]+`)
+
+var bibtexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	`^`, `\^{}`,
+	`~`, `\~{}`,
+)
+
+// bookToBibTeX formats the book as a @book entry. Names go in the "Family,
+// Given" form BibTeX parses best; pagetotal and isbn are biblatex fields
+// that plain BibTeX ignores.
+func bookToBibTeX(b store.Book) string {
+	var sb strings.Builder
+	key := bibtexKeyPattern.ReplaceAllString(b.ID, "-")
+	fmt.Fprintf(&sb, "@book{%s,\n", key)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sb, "  %s = {%s},\n", name, bibtexEscaper.Replace(value))
+		}
+	}
+
+	field("title", b.BookName)
+	if family, given := splitName(b.BookAuthor); given != "" {
+		field("author", family+", "+given)
+	} else {
+		field("author", family)
+	}
+	field("year", b.BookYear)
+	if isbn := normalizeISBN(b.BookEdition); isbn != "" {
+		field("isbn", isbn)
+	} else {
+		field("edition", b.BookEdition)
+	}
+	field("pagetotal", b.BookPages)
+	field("keywords", strings.Join(b.BookSubjects, ", "))
+	sb.WriteString("}\n")
+	return sb.String()
+}
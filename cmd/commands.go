@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// command is one of the operations the binary can run, e.g.
+//
+//	exercise-2 [flags] seed
+//	exercise-2 [flags] export --format csv --out books.csv
+//
+// Global flags (see internal/config) go before the command name, the
+// command's own flags after it.
+type command struct {
+	usage string
+	run   func(cfg config.Config, logger *slog.Logger, args []string) error
+}
+
+var commands = map[string]command{
+	"serve":   {"run the web server (default)", runServe},
+	"seed":    {"insert the example books", runSeed},
+	"migrate": {"apply pending database migrations", runMigrate},
+	"export":  {"dump the catalog (json, ndjson, csv, MARC21, BibTeX or CSL-JSON)", runExport},
+	"import":  {"load books from a file (json, ndjson, csv, MARC21 or a Goodreads export)", runImport},
+	"lint":    {"report data quality problems in the catalog", runLint},
+	"version": {"print version and build information", runVersion},
+}
+
+func main() {
+	// Settings come from defaults, an optional YAML file, the environment
+	// and the command line, in that order (see internal/config)
+	cfg, opts, args, err := config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printCommands()
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// All logs are written as JSON lines. Level debug also logs every
+	// MongoDB command with its duration.
+	logger := newLogger(cfg.Logging.Level)
+	slog.SetDefault(logger)
+
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		printCommands()
+		os.Exit(2)
+	}
+	if err := cmd.run(cfg, logger, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		logFatal(name+" failed", "error", err)
+	}
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+// connectDatabase connects to MongoDB and makes sure the books collection
+// exists. Callers must call disconnectDatabase when done.
+func connectDatabase(cfg config.Config, logger *slog.Logger) (*mongo.Client, *mongo.Collection, error) {
+	// Such defer keywords are used once the local context returns; for this
+	// case, the local context is this function. By using defer, we make sure
+	// we release the timer even if we return early.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// TODO: make sure to pass the proper username, password, and port
+	uri := cfg.Database.URI
+	if len(uri) == 0 {
+		return nil, nil, errors.New("missing database URI, set DATABASE_URI or database.uri in the config file")
+	}
+
+	monitor := mongoMonitors(mongoMonitor(logger), tracingMonitor(), errorTrackingMonitor())
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(monitor))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client for MongoDB: %w", err)
+	}
+
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		disconnectDatabase(client)
+		return nil, nil, fmt.Errorf("failed to connect to MongoDB, please make sure the database is running: %w", err)
+	}
+
+	// You can use such name for the database and collection, or come up with
+	// one by yourself!
+	coll, err := store.Prepare(client, cfg.Database.Name, cfg.Database.Collection)
+	if err != nil {
+		disconnectDatabase(client)
+		return nil, nil, fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	return client, coll, nil
+}
+
+func disconnectDatabase(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Disconnect(ctx); err != nil {
+		slog.Error("failed to disconnect from MongoDB", "error", err)
+	}
+}
+
+// runSeed inserts the example books, or the demo books with --demo,
+// skipping those already present.
+func runSeed(cfg config.Config, logger *slog.Logger, args []string) error {
+	client, coll, err := connectDatabase(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer disconnectDatabase(client)
+
+	summary, err := seedCatalog(context.Background(), store.NewBooks(coll), cfg.Features.Demo)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d books inserted, %d already present\n", summary.Inserted, summary.Existing)
+	return nil
+}
+
+// runMigrate applies the migrations that haven't run yet on this database.
+// Use --list to only show their status.
+func runMigrate(cfg config.Config, logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	list := fs.Bool("list", false, "only list migrations and whether they were applied")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, coll, err := connectDatabase(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer disconnectDatabase(client)
+
+	ctx := context.Background()
+	if *list {
+		applied, err := appliedMigrations(ctx, coll.Database())
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if at, ok := applied[m.name]; ok {
+				status = "applied " + at.Format(time.RFC3339)
+			}
+			fmt.Printf("%-30s %s\n", m.name, status)
+		}
+		return nil
+	}
+	return migrate(ctx, coll)
+}
+
+// runExport writes the whole catalog to a file, or to stdout.
+func runExport(cfg config.Config, logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "json", "output format: "+strings.Join(exportFormats(), ", "))
+	out := fs.String("out", "-", "output file, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, coll, err := connectDatabase(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer disconnectDatabase(client)
+
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := exportBooks(context.Background(), coll, *format, w)
+	if err != nil {
+		return err
+	}
+	slog.Info("export done", "books", n, "format", *format, "out", *out)
+	return nil
+}
+
+// runImport loads books from a file, or from stdin. Books identical to an
+// existing one are skipped, like on POST /api/books.
+func runImport(cfg config.Config, logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "input format: "+strings.Join(importFormats(), ", ")+" (default: from the file extension)")
+	profileName := fs.String("profile", "", "import profile mapping the columns of a CSV file, saved on the admin dashboard")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [--format FORMAT] [--profile NAME] FILE (- for stdin)")
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = formatFromPath(path)
+	}
+
+	r := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	client, coll, err := connectDatabase(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer disconnectDatabase(client)
+
+	ctx := store.WithActor(context.Background(), "cli")
+	var profile *ImportProfile
+	if *profileName != "" {
+		p, err := newImportProfiles(coll.Database()).Get(ctx, *profileName)
+		if err != nil {
+			return err
+		}
+		profile = &p
+	}
+	summary, err := importBooks(ctx, coll, *format, r, profile, nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("import done", "read", summary.Read, "inserted", summary.Inserted,
+		"duplicates", summary.Duplicates, "invalid", summary.Invalid)
+	return nil
+}
+
+// runLint prints the data quality problems of the catalog, as text or, with
+// --json, like GET /admin/lint. It exits with an error when it finds any.
+func runLint(cfg config.Config, logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, coll, err := connectDatabase(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer disconnectDatabase(client)
+
+	ctx := context.Background()
+	files, err := newFileStore(ctx, cfg.Files, coll.Database())
+	if err != nil {
+		return err
+	}
+	report, err := lintCatalog(ctx, coll, files)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%d books checked\n", report.Books)
+		for _, issue := range report.Issues {
+			fmt.Printf("%-15s %5d  %s: %s\n", issue.Check, issue.Count, issue.Description, strings.Join(issue.Samples, ", "))
+		}
+	}
+	if len(report.Issues) > 0 {
+		return fmt.Errorf("%d kinds of problems found", len(report.Issues))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Books are compared side by side, e.g. the editions of a title, with
+// GET /api/books/compare?ids=a,b,c or the comparison page at
+// /books/compare?ids=a,b,c.
+const (
+	minCompare = 2
+	maxCompare = 5
+)
+
+// comparedFields are the rows of a comparison, in order: the JSON name of
+// the field, its label on the page and its value.
+var comparedFields = []struct {
+	name, label string
+	value       func(store.Book) string
+}{
+	{"title", "Title", func(b store.Book) string { return b.BookName }},
+	{"author", "Author", func(b store.Book) string { return b.BookAuthor }},
+	{"edition", "Edition", func(b store.Book) string { return b.BookEdition }},
+	{"pages", "Pages", func(b store.Book) string { return b.BookPages }},
+	{"year", "Year", func(b store.Book) string { return b.BookYear }},
+	{"shelf", "Shelf", func(b store.Book) string { return b.BookShelf }},
+	{"subjects", "Subjects", func(b store.Book) string { return strings.Join(b.BookSubjects, ", ") }},
+	{"tags", "Tags", func(b store.Book) string { return strings.Join(b.BookTags, ", ") }},
+}
+
+// Comparison holds the books in the order asked for, and their fields
+// lined up row by row.
+type Comparison struct {
+	Books []store.Book    `json:"books"`
+	Rows  []ComparedField `json:"rows"`
+}
+
+// ComparedField is a row of a comparison: the value of a field for each
+// book, in the order of the books.
+type ComparedField struct {
+	Field  string   `json:"field"`
+	Label  string   `json:"-"`
+	Values []string `json:"values"`
+	// Whether the books don't all have the same value
+	Differs bool `json:"differs"`
+}
+
+// compareIDs reads the books to compare from the ids parameter, given
+// either comma separated or repeated, as the form of the book list does.
+func compareIDs(c echo.Context) []string {
+	var ids []string
+	for _, param := range c.QueryParams()["ids"] {
+		for _, id := range strings.Split(param, ",") {
+			if id = strings.TrimSpace(id); id != "" && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// compareBooks lines up the books with the given IDs. Unknown IDs are
+// returned rather than compared.
+func compareBooks(ctx context.Context, repo *store.Books, ids []string) (Comparison, []string, error) {
+	found, err := repo.Find(ctx, bson.M{"ID": bson.M{"$in": ids}})
+	if err != nil {
+		return Comparison{}, nil, err
+	}
+	cmp := Comparison{Books: make([]store.Book, 0, len(ids))}
+	var unknown []string
+	for _, id := range ids {
+		if i := slices.IndexFunc(found, func(b store.Book) bool { return b.ID == id }); i >= 0 {
+			cmp.Books = append(cmp.Books, found[i])
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		return Comparison{}, unknown, nil
+	}
+	for _, f := range comparedFields {
+		row := ComparedField{Field: f.name, Label: f.label, Values: make([]string, len(cmp.Books))}
+		for i, b := range cmp.Books {
+			row.Values[i] = f.value(b)
+			row.Differs = row.Differs || row.Values[i] != row.Values[0]
+		}
+		cmp.Rows = append(cmp.Rows, row)
+	}
+	return cmp, nil, nil
+}
+
+// registerCompareRoutes mounts the comparison of books, as JSON and as a
+// page.
+func registerCompareRoutes(e *echo.Echo, repo *store.Books, links *urlSigner) {
+	// comparison answers 400 or 404 itself when the books can't be
+	// compared.
+	comparison := func(c echo.Context) (Comparison, bool, error) {
+		ids := compareIDs(c)
+		if len(ids) < minCompare || len(ids) > maxCompare {
+			msg := fmt.Sprintf("Give between %d and %d books to compare in ids", minCompare, maxCompare)
+			return Comparison{}, false, handlers.JSONError(c, http.StatusBadRequest, msg)
+		}
+		cmp, unknown, err := compareBooks(c.Request().Context(), repo, ids)
+		if err != nil {
+			return cmp, false, handlers.ServerError(c, err, "Database error")
+		}
+		if len(unknown) > 0 {
+			return cmp, false, handlers.JSONError(c, http.StatusNotFound, "Unknown books: "+strings.Join(unknown, ", "))
+		}
+		cmp.Books = links.SignBooks(cmp.Books)
+		return cmp, true, nil
+	}
+
+	e.GET("/api/books/compare", func(c echo.Context) error {
+		cmp, ok, err := comparison(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, cmp)
+	})
+
+	e.GET("/books/compare", func(c echo.Context) error {
+		cmp, ok, err := comparison(c)
+		if !ok {
+			return err
+		}
+		return render.Page(c, http.StatusOK, "compare", cmp)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCompressResponses(t *testing.T) {
+	page := strings.Repeat("<p>Frankenstein</p>", 100)
+	e := echo.New()
+	e.Use(compressResponses())
+	e.GET("/page", func(c echo.Context) error { return c.HTML(http.StatusOK, page) })
+	e.GET("/small", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentLength, "2")
+		return c.JSONBlob(http.StatusOK, []byte("[]"))
+	})
+	e.GET("/text", func(c echo.Context) error { return c.String(http.StatusOK, page) })
+
+	tests := []struct {
+		name, path, accept, rangeHeader string
+		encoding                        string
+	}{
+		{"brotli first", "/page", "gzip, br", "", "br"},
+		{"gzip", "/page", "gzip", "", "gzip"},
+		{"brotli refused", "/page", "br;q=0, gzip", "", "gzip"},
+		{"not accepted", "/page", "", "", ""},
+		{"range", "/page", "br", "bytes=0-10", ""},
+		{"too small", "/small", "br", "", ""},
+		{"other type", "/text", "br", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set(echo.HeaderAcceptEncoding, tt.accept)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, req)
+			if got := res.Header().Get(echo.HeaderContentEncoding); got != tt.encoding {
+				t.Fatalf("got encoding %q, want %q", got, tt.encoding)
+			}
+			var body io.Reader = res.Body
+			switch tt.encoding {
+			case "br":
+				body = brotli.NewReader(body)
+			case "gzip":
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.path == "/page" && string(data) != page {
+				t.Errorf("got %d bytes back, want the page", len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/mongotest"
+	"github.com/CAPS-Cloud/exercises/internal/openapitest"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// TestContract checks api/openapi.yaml against the whole server, over a
+// real MongoDB (see internal/mongotest):
+//
+//	go test -tags integration ./cmd/
+//
+// The spec must document every route of the API the server mounts, with
+// all the optional ones on, and nothing else, and every documented
+// operation is called once, its answer matching the spec.
+func TestContract(t *testing.T) {
+	// The views and the stylesheets are read from the root of the repo
+	t.Chdir("..")
+	spec, err := openapitest.Load("api/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, stop, err := mongotest.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	client, err := mongotest.Connect(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnectDatabase(client)
+	dbName := mongotest.DatabaseName()
+	defer client.Database(dbName).Drop(context.Background())
+	coll, err := store.Prepare(client, dbName, "information")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.NewBooks(coll).Seed(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Auth.AdminPassword = "secret"
+	cfg.Mail.SMTPHost = "localhost"
+	cfg.Features.Analytics = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	e, closeServer, err := newServer(ctx, cfg, logger, coll, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer()
+
+	if routed, documented := openapitest.Routes(e), spec.Operations(); !slices.Equal(routed, documented) {
+		t.Errorf("routes and spec differ:\nrouted:     %v\ndocumented: %v", routed, documented)
+	}
+
+	// send makes a request as the admin, who may use every route, and
+	// checks the answer has the status code wanted, when not 0, and
+	// matches the spec. It returns the answer, decoded if it is a JSON
+	// object.
+	send := func(method, target, ctype, body string, code int) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if ctype != "" {
+			req.Header.Set(echo.HeaderContentType, ctype)
+		}
+		req.SetBasicAuth(cfg.Auth.AdminUser, cfg.Auth.AdminPassword)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if code != 0 && res.Code != code {
+			t.Errorf("%s %s: got status %d, want %d: %s", method, target, res.Code, code, res.Body)
+		}
+		spec.Check(t, req, body, res)
+		var answer map[string]interface{}
+		json.Unmarshal(res.Body.Bytes(), &answer)
+		return answer
+	}
+	const js = echo.MIMEApplicationJSON
+
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 2, 3))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog
+	send(http.MethodGet, "/api/version", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/random", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/recent", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/shelves", "", "", http.StatusOK)
+	send(http.MethodPost, "/api/books", js, `{"id": "contract1", "title": "Dracula", "author": "Bram Stoker", "year": "1897"}`, http.StatusCreated)
+	send(http.MethodPut, "/api/books/contract1", js, `{"pages": "488"}`, http.StatusOK)
+	// Without an ISBN, so nothing is looked up
+	send(http.MethodPost, "/api/books/contract1/enrich", "", "", http.StatusUnprocessableEntity)
+	send(http.MethodPut, "/api/books/contract1/cover", "image/png", cover.String(), http.StatusOK)
+	send(http.MethodPost, "/api/books/contract1/cover", js, `{"url": "ftp://example.com/cover.png"}`, http.StatusBadRequest)
+	send(http.MethodGet, "/api/books/contract1/export?format=bibtex", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/search?q=dracula", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/suggest?q=dra", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/compare?ids=example1,contract1", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/contract1/similar", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/books/popular", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/stats", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/stats/popular-searches", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/stats/most-viewed", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/activity", "", "", http.StatusOK)
+	send(http.MethodPost, "/api/isbn/validate", js, `{"isbns": ["978-3-649-64609-9"]}`, http.StatusOK)
+	// The providers are elsewhere, only what is refused upfront is checked
+	send(http.MethodGet, "/api/lookup?provider=none", "", "", http.StatusBadRequest)
+	send(http.MethodGet, "/api/export?format=json", "", "", http.StatusOK)
+
+	// Notes and reading lists, of the admin
+	note := send(http.MethodPost, "/api/books/example2/notes", js, `{"text": "Read it"}`, http.StatusCreated)
+	send(http.MethodGet, "/api/books/example2/notes", "", "", http.StatusOK)
+	send(http.MethodDelete, "/api/books/example2/notes/"+stringField(note, "id"), "", "", http.StatusNoContent)
+	send(http.MethodDelete, "/api/books/example2/notes", "", "", http.StatusNoContent)
+	list := send(http.MethodPost, "/api/lists", js, `{"name": "Gothic", "books": ["example2", "contract1"]}`, http.StatusCreated)
+	listPath := "/api/lists/" + stringField(list, "id")
+	send(http.MethodGet, "/api/lists", "", "", http.StatusOK)
+	send(http.MethodGet, listPath, "", "", http.StatusOK)
+	send(http.MethodPut, listPath, js, `{"name": "Gothic novels", "books": ["example2"]}`, http.StatusOK)
+	shared := send(http.MethodPost, listPath+"/share", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/lists/shared/"+path.Base(stringField(shared, "shareUrl")), "", "", http.StatusOK)
+	send(http.MethodGet, "/api/users/me/export", "", "", http.StatusOK)
+	send(http.MethodDelete, listPath, "", "", http.StatusNoContent)
+
+	// Exports of the whole catalog, which may still be running when
+	// removed
+	job := send(http.MethodPost, "/api/exports?format=json", "", "", http.StatusAccepted)
+	send(http.MethodGet, "/api/exports", "", "", http.StatusOK)
+	send(http.MethodGet, "/api/exports/"+stringField(job, "id"), "", "", http.StatusOK)
+	send(http.MethodDelete, "/api/exports/"+stringField(job, "id"), "", "", 0)
+
+	send(http.MethodDelete, "/api/books/contract1", "", "", http.StatusOK)
+
+	if unchecked := spec.Unchecked(); len(unchecked) > 0 {
+		t.Errorf("documented but never called: %v", unchecked)
+	}
+}
+
+// stringField is the string at key in a JSON object, or "".
+func stringField(v map[string]interface{}, key string) string {
+	s, _ := v[key].(string)
+	return s
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Covers are stored under the hash of their content, covers/<sha256>.<ext>,
+// so the same image uploaded for several editions is stored once and
+// shared by their books. A cover is deleted once no book links to it
+// anymore: the books linking to a file are its reference count, counted
+// when a book lets go of it rather than kept alongside, so it can't drift.
+
+// contentAddressedCover matches the names of the covers stored by hash, as
+// opposed to those stored per book before.
+var contentAddressedCover = regexp.MustCompile(`^covers/[0-9a-f]{64}\.[a-z]+$`)
+
+// coverName is the name a cover image is stored under.
+func coverName(image []byte, ext string) string {
+	sum := sha256.Sum256(image)
+	return "covers/" + hex.EncodeToString(sum[:]) + ext
+}
+
+// storeCover stores the image and its thumbnails, unless the same image
+// already is, and returns its name.
+func storeCover(ctx context.Context, files fileStore, image []byte, contentType, ext string) (string, error) {
+	name := coverName(image, ext)
+	existing, err := files.List(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(existing, name) {
+		return name, nil
+	}
+	// The thumbnails first, so a stored cover always has them
+	if err := storeThumbnails(ctx, files, name, image); err != nil {
+		return "", err
+	}
+	return name, files.Put(ctx, name, contentType, bytes.NewReader(image), int64(len(image)))
+}
+
+// releaseCover deletes the stored cover a book linked to, and its
+// thumbnails, once no book links to it. Links to anything but a stored
+// file are ignored.
+//
+// A book may link to the cover while it is deleted: the image is read
+// first, and stored again if a link turned up in the meantime. The
+// linking side stores the cover again once it linked to it (see
+// linkCover), so whichever goes second puts it back.
+func releaseCover(ctx context.Context, coll *mongo.Collection, files fileStore, link string) error {
+	name, ok := strings.CutPrefix(link, filesPrefix)
+	if !ok || !strings.HasPrefix(name, "covers/") {
+		return nil
+	}
+	linked := func() (bool, error) {
+		refs, err := coll.CountDocuments(ctx, bson.M{"BookCover": link}, options.Count().SetLimit(1))
+		return refs > 0, err
+	}
+	if ok, err := linked(); err != nil || ok {
+		return err
+	}
+
+	r, contentType, err := files.Open(ctx, name)
+	if errors.Is(err, errFileNotFound) {
+		// Only the thumbnails may be left
+		return deleteCover(ctx, files, name)
+	}
+	if err != nil {
+		return err
+	}
+	image, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := deleteCover(ctx, files, name); err != nil {
+		return err
+	}
+
+	if ok, err := linked(); err != nil || !ok {
+		return err
+	}
+	if contentType == "" {
+		contentType = coverContentType(name)
+	}
+	_, err = storeCover(ctx, files, image, contentType, path.Ext(name))
+	return err
+}
+
+// releaseCovers releases the covers of books deleted, logging the failures
+// rather than failing the deletion, which went through already.
+func releaseCovers(ctx context.Context, coll *mongo.Collection, files fileStore, books ...store.Book) {
+	released := map[string]bool{}
+	for _, b := range books {
+		if b.BookCover == "" || released[b.BookCover] {
+			continue
+		}
+		released[b.BookCover] = true
+		if err := releaseCover(ctx, coll, files, b.BookCover); err != nil {
+			slog.WarnContext(ctx, "could not delete the cover", "cover", b.BookCover, "error", err)
+		}
+	}
+}
+
+// linkCover links the book with the given ID to the stored cover name,
+// setting the other fields of set along, and checks the cover is still
+// stored once it is linked, in case it was released meanwhile.
+func linkCover(ctx context.Context, repo guardedBooks, files fileStore, id string, set bson.M, image []byte, contentType, name string) error {
+	set["BookCover"] = filesPrefix + name
+	if err := repo.Update(ctx, id, set); err != nil {
+		return err
+	}
+	_, err := storeCover(ctx, files, image, contentType, path.Ext(name))
+	return err
+}
+
+// bookCovers stores the covers of the books in the file storage, for the
+// cover routes of the API (see internal/handlers/covers.go).
+type bookCovers struct {
+	repo  guardedBooks
+	files fileStore
+}
+
+// Set stores the image under its hash, so a new cover gets a new URL and
+// browsers never show a stale one, then lets go of the previous cover when
+// it was uploaded too and no other book shares it.
+func (bc bookCovers) Set(ctx context.Context, book store.Book, image []byte, contentType string) (store.Book, error) {
+	ext, ok := coverTypes[contentType]
+	if !ok {
+		return book, &handlers.CoverError{Status: http.StatusUnsupportedMediaType, Msg: "The cover must be a JPEG, PNG, GIF or WebP image"}
+	}
+	name, err := storeCover(ctx, bc.files, image, contentType, ext)
+	if err != nil {
+		return book, err
+	}
+	previous := book.BookCover
+	now := time.Now().UTC()
+	book.BookCover = filesPrefix + name
+	book.UpdatedAt = &now
+	set := bson.M{"updatedAt": now, "updatedBy": store.ActorFromContext(ctx)}
+	if err := linkCover(ctx, bc.repo, bc.files, book.ID, set, image, contentType, name); err != nil {
+		return book, err
+	}
+	if previous != book.BookCover {
+		if err := releaseCover(ctx, bc.repo.Collection(), bc.files, previous); err != nil {
+			slog.WarnContext(ctx, "could not delete the previous cover", "cover", previous, "error", err)
+		}
+	}
+	return book, nil
+}
+
+// Fetch downloads a cover (see remotecovers.go), telling the client what
+// is wrong with those refused.
+func (bc bookCovers) Fetch(ctx context.Context, url string) ([]byte, string, error) {
+	image, contentType, err := fetchCover(ctx, url)
+	switch {
+	case errors.Is(err, errCoverURL), errors.Is(err, errCoverAddress):
+		return nil, "", &handlers.CoverError{Status: http.StatusBadRequest, Msg: "Invalid cover URL: " + err.Error()}
+	case errors.Is(err, errCoverTooLarge):
+		return nil, "", &handlers.CoverError{Status: http.StatusRequestEntityTooLarge, Msg: "Cover too large: " + err.Error()}
+	case errors.Is(err, errCoverType):
+		return nil, "", &handlers.CoverError{Status: http.StatusUnsupportedMediaType, Msg: "The cover must be a JPEG, PNG or GIF image"}
+	}
+	return image, contentType, err
+}
+
+// deleteCover deletes the stored cover name and its thumbnails.
+func deleteCover(ctx context.Context, files fileStore, name string) error {
+	for _, variant := range coverVariants(name) {
+		if err := files.Delete(ctx, variant); err != nil {
+			return err
+		}
+	}
+	return files.Delete(ctx, name)
+}
+
+// migrateCovers moves the covers stored per book, covers/<id>-<hash>.<ext>,
+// to their content hash, merging the duplicates, then deletes the old
+// files. Covers whose file is gone are left alone, lint reports them.
+func migrateCovers(ctx context.Context, coll *mongo.Collection, files fileStore) error {
+	cursor, err := coll.Find(ctx,
+		bson.M{"BookCover": bson.M{"$regex": "^" + regexp.QuoteMeta(filesPrefix+"covers/")}},
+		options.Find().SetProjection(bson.M{"BookCover": 1}))
+	if err != nil {
+		return err
+	}
+	var books []struct {
+		MongoID   interface{} `bson:"_id"`
+		BookCover string      `bson:"BookCover"`
+	}
+	if err := cursor.All(ctx, &books); err != nil {
+		return err
+	}
+
+	// Old name to new one, each file being read once
+	moved := map[string]string{}
+	for _, book := range books {
+		old := strings.TrimPrefix(book.BookCover, filesPrefix)
+		if contentAddressedCover.MatchString(old) {
+			continue
+		}
+		name, ok := moved[old]
+		if !ok {
+			name, err = rehashCover(ctx, files, old)
+			if errors.Is(err, errFileNotFound) {
+				slog.WarnContext(ctx, "cover file missing, left as is", "name", old)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", old, err)
+			}
+			moved[old] = name
+		}
+		_, err := coll.UpdateOne(ctx, bson.M{"_id": book.MongoID}, bson.M{"$set": bson.M{"BookCover": filesPrefix + name}})
+		if err != nil {
+			return err
+		}
+	}
+	for old := range moved {
+		if err := files.Delete(ctx, old); err != nil {
+			return fmt.Errorf("%s: %w", old, err)
+		}
+	}
+	if len(moved) > 0 {
+		slog.InfoContext(ctx, "covers stored by content", "files", len(moved))
+	}
+	return nil
+}
+
+// rehashCover copies the stored cover old to its content addressed name.
+func rehashCover(ctx context.Context, files fileStore, old string) (string, error) {
+	r, contentType, err := files.Open(ctx, old)
+	if err != nil {
+		return "", err
+	}
+	image, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = coverContentType(old)
+	}
+	return storeCover(ctx, files, image, contentType, path.Ext(old))
+}
+
+// coverContentType is the type of a cover from the extension of its name.
+func coverContentType(name string) string {
+	for contentType, ext := range coverTypes {
+		if ext == path.Ext(name) {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
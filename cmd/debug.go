@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Used to report the uptime in /debug/runtime
+var startTime = time.Now()
+
+// RuntimeStats is the body of GET /debug/runtime.
+type RuntimeStats struct {
+	Uptime       string  `json:"uptime"`
+	GoVersion    string  `json:"goVersion"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	NumCPU       int     `json:"numCPU"`
+	Goroutines   int     `json:"goroutines"`
+	HeapAlloc    uint64  `json:"heapAllocBytes"`
+	HeapSys      uint64  `json:"heapSysBytes"`
+	HeapObjects  uint64  `json:"heapObjects"`
+	TotalAlloc   uint64  `json:"totalAllocBytes"`
+	Sys          uint64  `json:"sysBytes"`
+	NumGC        uint32  `json:"numGC"`
+	LastGC       string  `json:"lastGC,omitempty"`
+	PauseTotal   string  `json:"gcPauseTotal"`
+	GCCPUPercent float64 `json:"gcCPUPercent"`
+}
+
+func readRuntimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := RuntimeStats{
+		Uptime:       time.Since(startTime).Round(time.Second).String(),
+		GoVersion:    runtime.Version(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapSys:      m.HeapSys,
+		HeapObjects:  m.HeapObjects,
+		TotalAlloc:   m.TotalAlloc,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		PauseTotal:   time.Duration(m.PauseTotalNs).String(),
+		GCCPUPercent: m.GCCPUFraction * 100,
+	}
+	if m.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339)
+	}
+	return stats
+}
+
+// registerDebugRoutes mounts net/http/pprof, expvar and our runtime stats on
+// the given group. These endpoints expose internals of the process and can
+// be expensive (e.g. a 30s CPU profile), so they are off unless
+// DEBUG_ENDPOINTS=true, and always behind the admin credentials.
+func registerDebugRoutes(g *echo.Group) {
+	g.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// Index also serves the named profiles: heap, goroutine, allocs, ...
+	g.GET("/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+
+	g.GET("/vars", echo.WrapHandler(expvar.Handler()))
+
+	g.GET("/runtime", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, readRuntimeStats())
+	})
+
+	// Forces a garbage collection, handy to tell leaks from garbage that
+	// simply wasn't collected yet.
+	g.POST("/gc", func(c echo.Context) error {
+		runtime.GC()
+		return c.JSON(http.StatusOK, readRuntimeStats())
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The decisions taken on candidate pairs, so dismissed pairs are not shown
+// again. One document per pair, with the pair key as _id.
+const dedupDecisionsCollection = "dedup_decisions"
+
+const (
+	// Titles of the same author at least this similar make a candidate
+	minDuplicateScore = 0.85
+	// Pairs shown on the review page at once
+	duplicatePairsLimit = 50
+)
+
+// DuplicatePair is two books that may be the same one. Left is the oldest.
+type DuplicatePair struct {
+	Key    string     `json:"key"`
+	Left   store.Book `json:"left"`
+	Right  store.Book `json:"right"`
+	Score  float64    `json:"score"`
+	Reason string     `json:"reason"`
+}
+
+// DedupDecision records what an operator did with a pair.
+type DedupDecision struct {
+	Key string `bson:"_id" json:"key"`
+	// dismissed or merged
+	Decision string    `bson:"decision" json:"decision"`
+	At       time.Time `bson:"at" json:"at"`
+	// The MongoID of the book kept on a merge
+	Kept string `bson:"kept,omitempty" json:"kept,omitempty"`
+}
+
+// pairKey identifies a pair whatever the order of its books.
+func pairKey(a, b primitive.ObjectID) string {
+	x, y := a.Hex(), b.Hex()
+	if x > y {
+		x, y = y, x
+	}
+	return x + "-" + y
+}
+
+// titleSimilarity compares two titles word by word, with the typo tolerant
+// similarity of the search (see search.go), in both directions so that a
+// title is not a duplicate of a longer one starting the same way.
+func titleSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	oneWay := func(from, to []string) float64 {
+		total := 0.0
+		for _, term := range from {
+			total += bestSimilarity(term, to)
+		}
+		return total / float64(len(from))
+	}
+	return min(oneWay(a, b), oneWay(b, a))
+}
+
+// findDuplicatePairs looks for books sharing an ISBN, or by the same author
+// with (nearly) the same title. Comparing every pair would not scale, so
+// only books sharing an ISBN or an author are compared. Books with two
+// different ISBNs are different editions, not duplicates.
+func findDuplicatePairs(books []store.Book, dismissed map[string]bool) []DuplicatePair {
+	blocks := map[string][]int{}
+	isbns := make([]string, len(books))
+	titles := make([][]string, len(books))
+	for i, book := range books {
+		isbns[i] = normalizeISBN(book.BookEdition)
+		titles[i] = searchTerms(book.BookName)
+		if isbns[i] != "" {
+			blocks["isbn:"+isbns[i]] = append(blocks["isbn:"+isbns[i]], i)
+		}
+		if author := strings.Join(searchTerms(book.BookAuthor), " "); author != "" {
+			blocks["author:"+author] = append(blocks["author:"+author], i)
+		}
+	}
+
+	seen := map[string]bool{}
+	pairs := []DuplicatePair{}
+	for _, members := range blocks {
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				i, j := members[x], members[y]
+				key := pairKey(books[i].MongoID, books[j].MongoID)
+				if seen[key] || dismissed[key] {
+					continue
+				}
+				seen[key] = true
+
+				pair := DuplicatePair{Key: key, Left: books[i], Right: books[j]}
+				switch {
+				case isbns[i] != "" && isbns[i] == isbns[j]:
+					pair.Score, pair.Reason = 1, "Same ISBN"
+				case isbns[i] != "" && isbns[j] != "":
+					continue
+				default:
+					pair.Score = roundScore(titleSimilarity(titles[i], titles[j]))
+					if pair.Score < minDuplicateScore {
+						continue
+					}
+					pair.Reason = "Same author, similar title"
+					if pair.Score == 1 {
+						pair.Reason = "Same author and title"
+					}
+				}
+				if pair.Right.MongoID.Timestamp().Before(pair.Left.MongoID.Timestamp()) {
+					pair.Left, pair.Right = pair.Right, pair.Left
+				}
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Score != pairs[j].Score {
+			return pairs[i].Score > pairs[j].Score
+		}
+		return pairs[i].Key < pairs[j].Key
+	})
+	return pairs
+}
+
+// mergeBooks fills the empty fields of keep with those of remove, and
+// combines their subjects and tags.
+func mergeBooks(keep, remove store.Book) bson.M {
+	set := bson.M{}
+	fill := func(field string, have *string, other string) {
+		if strings.TrimSpace(*have) == "" && other != "" {
+			*have = other
+			set[field] = other
+		}
+	}
+	fill("BookName", &keep.BookName, remove.BookName)
+	fill("BookAuthor", &keep.BookAuthor, remove.BookAuthor)
+	fill("BookEdition", &keep.BookEdition, remove.BookEdition)
+	fill("BookPages", &keep.BookPages, remove.BookPages)
+	fill("BookYear", &keep.BookYear, remove.BookYear)
+	fill("BookCover", &keep.BookCover, remove.BookCover)
+
+	union := func(field string, have, other []string) {
+		merged := slices.Clone(have)
+		for _, v := range other {
+			if !slices.Contains(merged, v) {
+				merged = append(merged, v)
+			}
+		}
+		if len(merged) > len(have) {
+			set[field] = merged
+		}
+	}
+	union("BookSubjects", keep.BookSubjects, remove.BookSubjects)
+	union("BookTags", keep.BookTags, remove.BookTags)
+	return set
+}
+
+// DuplicatesPage is the data passed to the "duplicates" block.
+type DuplicatesPage struct {
+	Pairs []DuplicatePair `json:"pairs"`
+	// Candidates found, Pairs only holds the first ones
+	Total int `json:"total"`
+}
+
+// registerDedupRoutes mounts the review of the candidate duplicates:
+// GET /admin/duplicates lists them, and each pair can be merged into one of
+// its books or dismissed.
+func registerDedupRoutes(admin *echo.Group, coll *mongo.Collection, files fileStore, catalog *ttlCache, searcher searchBackend) {
+	decisions := coll.Database().Collection(dedupDecisionsCollection)
+
+	admin.GET("/duplicates", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		// Straight from the database: the cached books may lack their
+		// MongoID, which tells apart books sharing an ID.
+		books, err := store.NewBooks(coll).All(ctx)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		cursor, err := decisions.Find(ctx, bson.M{"decision": "dismissed"}, store.FindOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		var dismissedPairs []DedupDecision
+		if err := cursor.All(ctx, &dismissedPairs); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		dismissed := make(map[string]bool, len(dismissedPairs))
+		for _, d := range dismissedPairs {
+			dismissed[d.Key] = true
+		}
+
+		pairs := findDuplicatePairs(books, dismissed)
+		page := DuplicatesPage{Pairs: pairs[:min(len(pairs), duplicatePairsLimit)], Total: len(pairs)}
+		if render.WantsHTML(c) {
+			return render.Page(c, http.StatusOK, "duplicates", page)
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+
+	// resolved answers a decision: the "pair-resolved" block replaces the
+	// pair on the page, API clients get the decision.
+	resolved := func(c echo.Context, decision DedupDecision) error {
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "pair-resolved", decision)
+		}
+		return c.JSON(http.StatusOK, decision)
+	}
+	record := func(ctx context.Context, decision DedupDecision) error {
+		_, err := decisions.ReplaceOne(ctx, bson.M{"_id": decision.Key}, decision, options.Replace().SetUpsert(true))
+		return err
+	}
+
+	// POST /admin/duplicates/:key/dismiss marks the pair as not duplicates.
+	admin.POST("/duplicates/:key/dismiss", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		a, b, ok := strings.Cut(c.Param("key"), "-")
+		aID, errA := primitive.ObjectIDFromHex(a)
+		bID, errB := primitive.ObjectIDFromHex(b)
+		if !ok || errA != nil || errB != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid pair")
+		}
+		decision := DedupDecision{Key: pairKey(aID, bID), Decision: "dismissed", At: time.Now().UTC()}
+		if err := record(ctx, decision); err != nil {
+			return handlers.ServerError(c, err, "Could not save the decision")
+		}
+		return resolved(c, decision)
+	})
+
+	// POST /admin/duplicates/:key/merge?keep=<MongoID> keeps one book of
+	// the pair, completed with the details of the other, which is deleted.
+	admin.POST("/duplicates/:key/merge", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		a, b, ok := strings.Cut(c.Param("key"), "-")
+		aID, errA := primitive.ObjectIDFromHex(a)
+		bID, errB := primitive.ObjectIDFromHex(b)
+		if !ok || errA != nil || errB != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid pair")
+		}
+		keepID, removeID := aID, bID
+		switch c.QueryParam("keep") {
+		case a:
+		case b:
+			keepID, removeID = bID, aID
+		default:
+			return handlers.JSONError(c, http.StatusBadRequest, "keep must be one of the books of the pair")
+		}
+
+		var keep, remove store.Book
+		for id, book := range map[primitive.ObjectID]*store.Book{keepID: &keep, removeID: &remove} {
+			err := coll.FindOne(ctx, bson.M{"_id": id}, store.FindOneOpts(ctx)).Decode(book)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return handlers.JSONError(c, http.StatusNotFound, "Book not found, it may have been merged already")
+			}
+			if err != nil {
+				return handlers.ServerError(c, err, "Database error")
+			}
+		}
+
+		if set := mergeBooks(keep, remove); len(set) > 0 {
+			set["updatedAt"] = time.Now().UTC()
+			set["updatedBy"] = store.ActorFromContext(ctx)
+			if _, err := coll.UpdateByID(ctx, keepID, bson.M{"$set": set}, store.UpdateOpts(ctx)); err != nil {
+				return handlers.ServerError(c, err, "Could not update book")
+			}
+		}
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": removeID}, store.DeleteOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Could not delete book")
+		}
+		// The cover of the book deleted, unless the merge kept it
+		releaseCovers(ctx, coll, files, remove)
+		catalog.invalidate()
+		searcher.Removed(ctx, remove.ID)
+		// After Removed, in case both books had the same ID
+		reindexBook(ctx, searcher, coll, keep.ID)
+
+		decision := DedupDecision{Key: pairKey(keepID, removeID), Decision: "merged", At: time.Now().UTC(), Kept: keepID.Hex()}
+		if err := record(ctx, decision); err != nil {
+			return handlers.ServerError(c, err, "Could not save the decision")
+		}
+		return resolved(c, decision)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// In demo mode (DEMO=true), a public instance starts with the demo catalog
+// and is reset to it on the demo-reset schedule (TASKS_DEMO_RESET, hourly
+// by default), so whatever visitors add, change or delete doesn't last.
+
+// seedCatalog inserts the example books, or the demo books in demo mode,
+// leaving those already present alone.
+func seedCatalog(ctx context.Context, repo *store.Books, demo bool) (store.SeedSummary, error) {
+	if demo {
+		return repo.SeedBooks(ctx, store.DemoBooks())
+	}
+	return repo.Seed(ctx)
+}
+
+// demoResetTask restores the demo catalog, and brings the cache and the
+// search index of this instance up to date. The covers uploaded by the
+// visitors go with their books. A read-only instance leaves it to the
+// others.
+func demoResetTask(schedule string, repo *store.Books, files fileStore, catalog *ttlCache, searcher searchBackend) *task {
+	return &task{
+		name:        "demo-reset",
+		description: "Restores the demo catalog, undoing the changes of the visitors",
+		schedule:    schedule,
+		writes:      true,
+		run: func(ctx context.Context) (string, error) {
+			old, err := repo.All(ctx)
+			if err != nil {
+				return "", err
+			}
+			books := store.DemoBooks()
+			deleted, err := repo.Reset(ctx, books)
+			catalog.invalidate()
+			for _, b := range old {
+				searcher.Removed(ctx, b.ID)
+			}
+			if err != nil {
+				return "", err
+			}
+			releaseCovers(ctx, repo.Collection(), files, old...)
+			for _, b := range books {
+				searcher.Indexed(ctx, b)
+			}
+			return fmt.Sprintf("Deleted %d books, restored %d", deleted, len(books)), nil
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/requestid"
+	"github.com/getsentry/sentry-go"
+	sentryecho "github.com/getsentry/sentry-go/echo"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// setupErrorTracking initializes the Sentry client when a DSN is configured.
+// Any Sentry compatible service works (e.g. GlitchTip). Events are tagged
+// with the application version as release, so regressions can be traced to
+// a deployment. It returns whether error tracking is enabled and a function
+// that flushes pending events, to be called on exit.
+func setupErrorTracking(cfg config.ErrorTrackingConfig) (bool, func(), error) {
+	if cfg.DSN == "" {
+		return false, func() {}, nil
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              cfg.DSN,
+		Release:          buildInfo.Version,
+		Environment:      cfg.Environment,
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return true, func() { sentry.Flush(2 * time.Second) }, nil
+}
+
+// errorTracking returns the middleware reporting panics to Sentry. It must be
+// installed inside middleware.Recover, as it re-panics once reported. The
+// hub is also put in the request context, so errors raised further down
+// (e.g. by the MongoDB driver) are reported with the request attached.
+func errorTracking() []echo.MiddlewareFunc {
+	return []echo.MiddlewareFunc{
+		sentryecho.New(sentryecho.Options{Repanic: true}),
+		func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				if hub := sentryecho.GetHubFromContext(c); hub != nil {
+					ctx := c.Request().Context()
+					if id := requestid.FromContext(ctx); id != "" {
+						hub.Scope().SetTag("request_id", id)
+					}
+					c.SetRequest(c.Request().WithContext(sentry.SetHubOnContext(ctx, hub)))
+				}
+				return next(c)
+			}
+		},
+	}
+}
+
+// errorTrackingMonitor reports failed MongoDB commands.
+func errorTrackingMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			hub := sentry.GetHubFromContext(ctx)
+			if hub == nil {
+				hub = sentry.CurrentHub()
+			}
+			hub.WithScope(func(scope *sentry.Scope) {
+				scope.SetTag("mongo.command", e.CommandName)
+				scope.SetTag("mongo.database", e.DatabaseName)
+				scope.SetExtra("duration", e.Duration.String())
+				hub.CaptureException(errors.New("mongo " + e.CommandName + ": " + e.Failure))
+			})
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Published and failed events are reported under "events" in /debug/vars.
+var eventStats = expvar.NewMap("events")
+
+// bookEventSchemaVersion changes whenever BookEvent changes in a way
+// consumers must know about.
+const bookEventSchemaVersion = 1
+
+// BookEvent is the message published for every write to the catalog.
+type BookEvent struct {
+	SchemaVersion int `json:"schemaVersion"`
+	// Unique, so consumers can drop the duplicates a retry may cause
+	ID   string    `json:"id"`
+	Type string    `json:"type"` // book.created, book.updated or book.deleted
+	Time time.Time `json:"time"`
+
+	// BookID is missing on deletes when the collection doesn't keep the
+	// documents before the change; MongoID identifies the book anyway.
+	BookID  string      `json:"bookId,omitempty"`
+	MongoID string      `json:"mongoId"`
+	Book    *store.Book `json:"book,omitempty"`
+}
+
+var bookEventTypes = map[string]string{
+	"insert":  "book.created",
+	"update":  "book.updated",
+	"replace": "book.updated",
+	"delete":  "book.deleted",
+}
+
+// bookEventFromChange returns false for the changes that aren't about a
+// book, e.g. the collection being dropped.
+func bookEventFromChange(change bookChange) (BookEvent, bool) {
+	eventType, ok := bookEventTypes[change.Operation]
+	if !ok {
+		return BookEvent{}, false
+	}
+	event := BookEvent{
+		SchemaVersion: bookEventSchemaVersion,
+		ID:            primitive.NewObjectID().Hex(),
+		Type:          eventType,
+		Time:          time.Now().UTC(),
+		MongoID:       change.Key.MongoID.Hex(),
+		Book:          change.Book,
+	}
+	switch {
+	case change.Book != nil:
+		event.BookID = change.Book.ID
+	case change.Before != nil:
+		event.BookID = change.Before.ID
+	}
+	return event, true
+}
+
+// eventPublisher sends events to the message bus picked by EVENTS_BACKEND.
+type eventPublisher interface {
+	Publish(ctx context.Context, event BookEvent, payload []byte) error
+	Close() error
+}
+
+// newEventPublisher returns nil when publishing is disabled.
+func newEventPublisher(cfg config.EventsConfig) (eventPublisher, error) {
+	switch cfg.Backend {
+	case "", "none":
+		return nil, nil
+	case "kafka":
+		if len(cfg.KafkaBrokers) == 0 {
+			return nil, fmt.Errorf("EVENTS_KAFKA_BROKERS is required to publish to Kafka")
+		}
+		return newKafkaPublisher(cfg.KafkaBrokers, cfg.KafkaTopic), nil
+	case "nats":
+		return newNATSPublisher(cfg.NATSURL, cfg.NATSSubject)
+	}
+	return nil, fmt.Errorf("unknown events backend %q", cfg.Backend)
+}
+
+// publishEvents returns the change feed subscriber forwarding changes to
+// pub. Delivery is at most once: an event that still fails after the
+// client's own retries is logged and dropped, and changes made while the
+// app is down are not published.
+func publishEvents(pub eventPublisher) func(context.Context, bookChange) {
+	return func(ctx context.Context, change bookChange) {
+		event, ok := bookEventFromChange(change)
+		if !ok {
+			return
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("could not encode event", "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := pub.Publish(ctx, event, payload); err != nil {
+			eventStats.Add("failed", 1)
+			slog.Warn("could not publish event", "type", event.Type, "book", event.BookID, "error", err)
+			return
+		}
+		eventStats.Add("published", 1)
+	}
+}
+
+// kafkaPublisher writes every event to one topic, keyed by the book so the
+// events of a book stay in order within its partition.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Events are written one at a time, don't wait for a batch to fill
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, event BookEvent, payload []byte) error {
+	key := event.BookID
+	if key == "" {
+		key = event.MongoID
+	}
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(key),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(event.Type)},
+			{Key: "schemaVersion", Value: []byte(strconv.Itoa(event.SchemaVersion))},
+		},
+	})
+}
+
+func (k *kafkaPublisher) Close() error { return k.writer.Close() }
+
+// natsPublisher publishes on one subject per event type, e.g.
+// bookstore.books.created, so consumers can subscribe to what they need
+// (or to bookstore.books.> for everything).
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(url, subject string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("bookstore"))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, event BookEvent, payload []byte) error {
+	action := strings.TrimPrefix(event.Type, "book.")
+	return n.conn.Publish(n.subject+"."+action, payload)
+}
+
+// Close flushes the pending messages before disconnecting.
+func (n *natsPublisher) Close() error { return n.conn.Drain() }
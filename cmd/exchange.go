@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Columns of the CSV format, named like the keys of the JSON API.
+var csvColumns = []string{"id", "title", "author", "edition", "pages", "year", "createdAt", "updatedAt", "shelf"}
+
+func exportFormats() []string {
+	return []string{"json", "ndjson", "csv", "marc", "marcxml", "bibtex", "csl-json"}
+}
+func importFormats() []string {
+	return []string{"json", "ndjson", "csv", "goodreads", "marc", "marcxml", "onix"}
+}
+
+// formatFromPath guesses the format from the file extension, defaulting to
+// JSON.
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".mrc", ".marc":
+		return "marc"
+	case ".xml":
+		return "marcxml"
+	case ".onix":
+		return "onix"
+	case ".bib":
+		return "bibtex"
+	}
+	return "json"
+}
+
+// exportBooks streams every book to w in the given format, oldest first, and
+// returns how many were written.
+func exportBooks(ctx context.Context, coll *mongo.Collection, format string, w io.Writer) (int, error) {
+	write, finish, err := newBookWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := coll.Find(ctx, bson.D{}, store.FindOpts(ctx).SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var book store.Book
+		if err := cursor.Decode(&book); err != nil {
+			return n, err
+		}
+		if err := write(book); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	return n, finish()
+}
+
+// exportContentTypes gives the media type and file extension of every
+// export format, for the export endpoints.
+var exportContentTypes = map[string][2]string{
+	"json":     {"application/json", ".json"},
+	"ndjson":   {"application/x-ndjson", ".ndjson"},
+	"csv":      {"text/csv; charset=utf-8", ".csv"},
+	"marc":     {"application/marc", ".mrc"},
+	"marcxml":  {"application/marcxml+xml", ".xml"},
+	"bibtex":   {"application/x-bibtex; charset=utf-8", ".bib"},
+	"csl-json": {"application/vnd.citationstyles.csl+json", ".json"},
+}
+
+// bookExports are the export formats, for downloading a single book from
+// the API (see internal/handlers/export.go).
+func bookExports() map[string]handlers.ExportFormat {
+	exports := map[string]handlers.ExportFormat{}
+	for format, contentType := range exportContentTypes {
+		exports[format] = handlers.ExportFormat{
+			ContentType: contentType[0],
+			Ext:         contentType[1],
+			Write: func(w io.Writer, book store.Book) error {
+				write, finish, err := newBookWriter(format, w)
+				if err != nil {
+					return err
+				}
+				if err := write(book); err != nil {
+					return err
+				}
+				return finish()
+			},
+		}
+	}
+	return exports
+}
+
+// newBookWriter returns write, to call for every book, and finish, to call
+// once after the last one, to produce the given format on w.
+func newBookWriter(format string, w io.Writer) (write func(store.Book) error, finish func() error, err error) {
+	none := func() error { return nil }
+
+	// JSON arrays are written element by element, so large catalogs don't
+	// need to fit in memory.
+	jsonArray := func(item func(store.Book) interface{}) (func(store.Book) error, func() error, error) {
+		if _, err := io.WriteString(w, "["); err != nil {
+			return nil, nil, err
+		}
+		n := 0
+		write := func(b store.Book) error {
+			if n > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			n++
+			out, err := json.Marshal(item(b))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(out)
+			return err
+		}
+		finish := func() error {
+			_, err := io.WriteString(w, "]\n")
+			return err
+		}
+		return write, finish, nil
+	}
+
+	switch format {
+	case "json":
+		return jsonArray(func(b store.Book) interface{} { return b })
+	case "csl-json":
+		return jsonArray(func(b store.Book) interface{} { return bookToCSL(b) })
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		return func(b store.Book) error { return enc.Encode(b) }, none, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return nil, nil, err
+		}
+		write = func(b store.Book) error { return cw.Write(bookToCSV(b)) }
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		return write, finish, nil
+	case "bibtex":
+		return func(b store.Book) error {
+			_, err := io.WriteString(w, bookToBibTeX(b)+"\n")
+			return err
+		}, none, nil
+	case "marc":
+		write = func(b store.Book) error {
+			record, err := encodeMARC(bookToMARC(b))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(record)
+			return err
+		}
+		return write, none, nil
+	case "marcxml":
+		if _, err := io.WriteString(w, xml.Header+`<collection xmlns="`+marcXMLNamespace+`">`+"\n"); err != nil {
+			return nil, nil, err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("  ", "  ")
+		write = func(b store.Book) error {
+			if err := enc.Encode(bookToMARC(b)); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		}
+		finish = func() error {
+			_, err := io.WriteString(w, "</collection>\n")
+			return err
+		}
+		return write, finish, nil
+	}
+	return nil, nil, fmt.Errorf("unknown export format %q", format)
+}
+
+func bookToCSV(b store.Book) []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return []string{b.ID, b.BookName, b.BookAuthor, b.BookEdition, b.BookPages, b.BookYear,
+		formatTime(b.CreatedAt), formatTime(b.UpdatedAt), b.BookShelf}
+}
+
+// ImportSummary reports the outcome of an import.
+type ImportSummary struct {
+	Read       int      `json:"read"`
+	Inserted   int      `json:"inserted"`
+	Duplicates int      `json:"duplicates"`
+	Invalid    int      `json:"invalid"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Only the first errors are kept in the summary, a broken file could
+// otherwise produce one per line.
+const maxImportErrors = 20
+
+func (s *ImportSummary) addError(msg string) {
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, msg)
+	}
+}
+
+// importBooks reads books in the given format and inserts the valid ones,
+// calling inserted (when not nil) for each. Like POST /api/books, a book
+// identical to an existing one is skipped. A CSV file can be read with an
+// import profile (see importprofiles.go), mapping its columns.
+func importBooks(ctx context.Context, coll *mongo.Collection, format string, r io.Reader, profile *ImportProfile, inserted func(store.Book)) (ImportSummary, error) {
+	var summary ImportSummary
+	if profile != nil && format != "csv" {
+		return summary, fmt.Errorf("import profiles only apply to CSV files, not %s", format)
+	}
+	insert := func(book store.Book) error {
+		summary.Read++
+		if errs := store.ValidateBook(book); len(errs) > 0 {
+			summary.Invalid++
+			for field, msg := range errs.JSON() {
+				summary.addError(fmt.Sprintf("record %d: %s: %s", summary.Read, field, msg))
+			}
+			return nil
+		}
+		if err := coll.FindOne(ctx, store.DuplicateFilter(book), store.FindOneOpts(ctx)).Err(); err == nil {
+			summary.Duplicates++
+			return nil
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		now := time.Now().UTC()
+		book.MongoID = primitive.NilObjectID
+		book.CreatedAt = &now
+		book.UpdatedAt = nil
+		book.UpdatedBy = store.ActorFromContext(ctx)
+		if _, err := coll.InsertOne(ctx, book, store.InsertOneOpts(ctx)); err != nil {
+			return err
+		}
+		summary.Inserted++
+		if inserted != nil {
+			inserted(book)
+		}
+		return nil
+	}
+
+	switch format {
+	case "json", "ndjson":
+		// json.Decoder handles both a top-level array and a stream of
+		// objects separated by newlines.
+		dec := json.NewDecoder(r)
+		array := false
+		if format == "json" {
+			tok, err := dec.Token()
+			if err != nil {
+				return summary, err
+			}
+			if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+				return summary, errors.New("expected a JSON array of books")
+			}
+			array = true
+		}
+		for dec.More() {
+			var book store.Book
+			if err := dec.Decode(&book); err != nil {
+				return summary, fmt.Errorf("record %d: %w", summary.Read+1, err)
+			}
+			if err := insert(book); err != nil {
+				return summary, err
+			}
+		}
+		if array {
+			if _, err := dec.Token(); err != nil {
+				return summary, err
+			}
+		}
+	case "csv", "goodreads":
+		cr := csv.NewReader(r)
+		if profile != nil {
+			cr.Comma = profile.delimiter()
+		}
+		header, err := cr.Read()
+		if err != nil {
+			return summary, err
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.TrimSpace(name)] = i
+		}
+		// Goodreads exports are recognized by their header, so they can be
+		// imported as plain CSV files too.
+		toBook := func(columns map[string]int, record []string) (store.Book, error) {
+			return bookFromCSV(columns, record), nil
+		}
+		switch {
+		case profile != nil:
+			if toBook, err = profile.bookMapper(); err != nil {
+				return summary, err
+			}
+		case format == "goodreads" || isGoodreadsHeader(columns):
+			toBook = func(columns map[string]int, record []string) (store.Book, error) {
+				return bookFromGoodreads(columns, record), nil
+			}
+		}
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return summary, err
+			}
+			book, err := toBook(columns, record)
+			if err != nil {
+				summary.Read++
+				summary.Invalid++
+				summary.addError(fmt.Sprintf("record %d: %v", summary.Read, err))
+				continue
+			}
+			if err := insert(book); err != nil {
+				return summary, err
+			}
+		}
+	case "marc":
+		records := &marcReader{r: bufio.NewReader(r)}
+		for {
+			record, err := records.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return summary, fmt.Errorf("record %d: %w", summary.Read+1, err)
+			}
+			if err := insert(bookFromMARC(record)); err != nil {
+				return summary, err
+			}
+		}
+	case "marcxml":
+		// .xml files may be ONIX messages as well
+		br := bufio.NewReader(r)
+		if head, _ := br.Peek(1024); isONIX(head) {
+			return importBooks(ctx, coll, "onix", br, nil, inserted)
+		}
+		err := readMARCXML(br, func(record marcRecord) error {
+			return insert(bookFromMARC(record))
+		})
+		if err != nil {
+			return summary, err
+		}
+	case "onix":
+		err := readONIX(r, func(product onixNode) error {
+			return insert(bookFromONIX(product))
+		})
+		if err != nil {
+			return summary, err
+		}
+	default:
+		return summary, fmt.Errorf("unknown import format %q", format)
+	}
+	return summary, nil
+}
+
+// csvField returns a getter for the columns of record, by name.
+func csvField(columns map[string]int, record []string) func(string) string {
+	return func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+}
+
+func bookFromCSV(columns map[string]int, record []string) store.Book {
+	get := csvField(columns, record)
+	return store.Book{
+		ID:          get("id"),
+		BookName:    get("title"),
+		BookAuthor:  get("author"),
+		BookEdition: get("edition"),
+		BookPages:   get("pages"),
+		BookYear:    get("year"),
+		BookShelf:   get("shelf"),
+	}
+}
+
+// isGoodreadsHeader tells if the columns are those of a Goodreads library
+// export ("My Books" > "Import and export").
+func isGoodreadsHeader(columns map[string]int) bool {
+	for _, name := range []string{"Book Id", "Title", "Author", "Exclusive Shelf"} {
+		if _, ok := columns[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// bookFromGoodreads maps a row of a Goodreads export to a book. The
+// Goodreads ID becomes ours, prefixed so it can't clash with existing
+// ones, and the shelves become tags. Ratings and reviews are left out: the
+// catalog has no place for them.
+func bookFromGoodreads(columns map[string]int, record []string) store.Book {
+	get := csvField(columns, record)
+
+	// ISBNs are written as ="0451526538" so spreadsheets keep the
+	// leading zeros.
+	isbn := func(name string) string {
+		return strings.Trim(get(name), `="`)
+	}
+	edition := isbn("ISBN13")
+	if edition == "" {
+		edition = isbn("ISBN")
+	}
+	year := get("Original Publication Year")
+	if year == "" {
+		year = get("Year Published")
+	}
+
+	var tags []string
+	seen := map[string]bool{}
+	shelves := append(strings.Split(get("Bookshelves"), ","), get("Exclusive Shelf"))
+	for _, shelf := range shelves {
+		shelf = strings.TrimSpace(shelf)
+		if shelf != "" && !seen[shelf] {
+			seen[shelf] = true
+			tags = append(tags, shelf)
+		}
+	}
+
+	book := store.Book{
+		BookName:    get("Title"),
+		BookAuthor:  get("Author"),
+		BookEdition: edition,
+		BookPages:   get("Number of Pages"),
+		BookYear:    year,
+		BookTags:    tags,
+	}
+	if id := get("Book Id"); id != "" {
+		book.ID = "goodreads-" + id
+	}
+	return book
+}
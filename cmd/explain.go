@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// explainCommand builds the command behind one of the queries of the app,
+// from the query parameters of the page or endpoint running it. The
+// commands mirror the functions named in explainQueries, keep them in sync.
+type explainCommand func(c echo.Context, coll *mongo.Collection) (bson.D, error)
+
+var explainQueries = map[string]explainCommand{
+	// GET /api/books?q=, see store.Books.Find
+	"books": func(c echo.Context, coll *mongo.Collection) (bson.D, error) {
+		filter, err := store.ParseQuery(c.QueryParam("q"))
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "find", Value: coll.Name()}, {Key: "filter", Value: filter}}, nil
+	},
+	// GET /authors/:name?sort=&order=, see store.Books.ByAuthor. The author is
+	// given as ?name=
+	"author": func(c echo.Context, coll *mongo.Collection) (bson.D, error) {
+		field, ok := store.SortFields[c.QueryParam("sort")]
+		if !ok {
+			field = store.SortFields["title"]
+		}
+		direction := 1
+		if strings.ToLower(c.QueryParam("order")) == "desc" {
+			direction = -1
+		}
+		return bson.D{
+			{Key: "find", Value: coll.Name()},
+			{Key: "filter", Value: bson.M{"BookAuthor": c.QueryParam("name")}},
+			{Key: "sort", Value: bson.D{{Key: field, Value: direction}}},
+			{Key: "collation", Value: store.NumericCollation},
+		}, nil
+	},
+	// GET /years/:year, see store.Books.ByYear. The year is given as ?year=
+	"year": func(c echo.Context, coll *mongo.Collection) (bson.D, error) {
+		return bson.D{
+			{Key: "find", Value: coll.Name()},
+			{Key: "filter", Value: bson.M{"BookYear": c.QueryParam("year")}},
+			{Key: "sort", Value: bson.D{{Key: "BookName", Value: 1}}},
+		}, nil
+	},
+	// GET /feed.xml, see store.Books.Recent
+	"recent": func(c echo.Context, coll *mongo.Collection) (bson.D, error) {
+		return bson.D{
+			{Key: "find", Value: coll.Name()},
+			{Key: "filter", Value: bson.D{}},
+			{Key: "sort", Value: bson.D{{Key: "_id", Value: -1}}},
+			{Key: "limit", Value: feedSize},
+		}, nil
+	},
+	// GET /api/books/suggest?q=&limit= with the default search backend, see
+	// findSuggestions
+	"suggest": func(c echo.Context, coll *mongo.Collection) (bson.D, error) {
+		return bson.D{
+			{Key: "aggregate", Value: coll.Name()},
+			{Key: "pipeline", Value: suggestPipeline(c.QueryParam("q"), handlers.SuggestLimit(c))},
+			{Key: "cursor", Value: bson.M{}},
+		}, nil
+	},
+}
+
+// ExplainReport sums up how MongoDB ran a query.
+type ExplainReport struct {
+	Query string `json:"query"`
+	// The stages of the winning plan, outermost first, e.g.
+	// ["FETCH", "IXSCAN"]. A COLLSCAN means no index was used.
+	WinningPlan []string `json:"winningPlan"`
+	Indexes     []string `json:"indexes"`
+	// From the execution stats
+	Returned     int64 `json:"returned"`
+	DocsExamined int64 `json:"docsExamined"`
+	KeysExamined int64 `json:"keysExamined"`
+	Millis       int64 `json:"millis"`
+	// The whole output of explain, with ?raw=true
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// explainQuery runs command with explain and sums up its output.
+func explainQuery(c echo.Context, coll *mongo.Collection, command bson.D) (ExplainReport, error) {
+	ctx := c.Request().Context()
+	var out bson.M
+	err := coll.Database().RunCommand(ctx, bson.D{
+		{Key: "explain", Value: command},
+		{Key: "verbosity", Value: "executionStats"},
+	}).Decode(&out)
+	if err != nil {
+		return ExplainReport{}, err
+	}
+
+	report := ExplainReport{WinningPlan: []string{}, Indexes: []string{}}
+	planner, stats := out, out
+	// Aggregations not run entirely by the query layer nest the
+	// explanation of their first stage
+	if _, ok := out["queryPlanner"]; !ok {
+		if stages, ok := out["stages"].(bson.A); ok && len(stages) > 0 {
+			if first, ok := stages[0].(bson.M); ok {
+				if cursor, ok := first["$cursor"].(bson.M); ok {
+					planner, stats = cursor, cursor
+				}
+			}
+		}
+	}
+	if qp, ok := planner["queryPlanner"].(bson.M); ok {
+		plan, _ := qp["winningPlan"].(bson.M)
+		// Plans run by the slot based engine wrap the classic plan
+		if inner, ok := plan["queryPlan"].(bson.M); ok {
+			plan = inner
+		}
+		walkPlan(plan, &report)
+	}
+	if es, ok := stats["executionStats"].(bson.M); ok {
+		report.Returned = explainNumber(es["nReturned"])
+		report.DocsExamined = explainNumber(es["totalDocsExamined"])
+		report.KeysExamined = explainNumber(es["totalKeysExamined"])
+		report.Millis = explainNumber(es["executionTimeMillis"])
+	}
+
+	if c.QueryParam("raw") == "true" {
+		raw, err := bson.MarshalExtJSON(out, false, false)
+		if err != nil {
+			return ExplainReport{}, err
+		}
+		report.Raw = raw
+	}
+	return report, nil
+}
+
+// walkPlan collects the stages and the indexes of a plan, following its
+// input stages.
+func walkPlan(plan bson.M, report *ExplainReport) {
+	if plan == nil {
+		return
+	}
+	if stage, ok := plan["stage"].(string); ok {
+		report.WinningPlan = append(report.WinningPlan, stage)
+	}
+	if index, ok := plan["indexName"].(string); ok {
+		report.Indexes = append(report.Indexes, index)
+	}
+	if input, ok := plan["inputStage"].(bson.M); ok {
+		walkPlan(input, report)
+	}
+	if inputs, ok := plan["inputStages"].(bson.A); ok {
+		for _, input := range inputs {
+			if input, ok := input.(bson.M); ok {
+				walkPlan(input, report)
+			}
+		}
+	}
+}
+
+// explainNumber reads a number of the explain output, which MongoDB
+// encodes as an int32, an int64 or a double depending on its size.
+func explainNumber(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// registerExplainRoutes mounts GET /admin/explain/:query, which runs one
+// of the queries in explainQueries with explain and tells whether it uses
+// an index, e.g. /admin/explain/author?name=Mary%20Shelley&sort=year. The
+// query takes the parameters of the page running it.
+func registerExplainRoutes(admin *echo.Group, coll *mongo.Collection) {
+	admin.GET("/explain/:query", func(c echo.Context) error {
+		build, ok := explainQueries[c.Param("query")]
+		if !ok {
+			return handlers.JSONError(c, http.StatusNotFound, "Unknown query")
+		}
+		command, err := build(c, coll)
+		if err != nil {
+			body := handlers.ErrorBody(c, err.Error())
+			var qe *store.QueryError
+			if errors.As(err, &qe) {
+				body["position"] = qe.Pos
+			}
+			return c.JSON(http.StatusBadRequest, body)
+		}
+		report, err := explainQuery(c, coll, command)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not explain the query")
+		}
+		report.Query = c.Param("query")
+		return c.JSON(http.StatusOK, report)
+	})
+}
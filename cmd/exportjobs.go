@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Exporting a large catalog takes longer than a request should, so
+// POST /api/exports only queues an export job and answers 202 at once.
+// Any instance then runs the job, storing the file in the file storage
+// (see files.go), where it is kept for FILES_EXPORT_TTL. GET /api/exports
+// lists the past exports and GET /api/exports/:id tells how one is going,
+// both with a signed link to the file once it is ready. The jobs are for
+// the admins only.
+const exportJobsCollection = "export_jobs"
+
+const (
+	exportJobPollInterval = 5 * time.Second
+	// A job running for longer is given up
+	exportJobTimeout = 10 * time.Minute
+	// and one still running after this is taken over by another instance,
+	// its own having gone away. Longer than exportJobTimeout, so a job is
+	// never run twice at once.
+	exportJobTakeover = exportJobTimeout + 5*time.Minute
+
+	defaultExportJobsLimit = 20
+	maxExportJobsLimit     = 100
+)
+
+// ExportJob is an export asked for through the API.
+type ExportJob struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Format string             `bson:"format" json:"format"`
+	// queued, running, done, failed, or expired once the file is deleted
+	Status     string     `bson:"status" json:"status"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	StartedAt  *time.Time `bson:"startedAt,omitempty" json:"startedAt,omitempty"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	ExpiresAt  *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	Books      int        `bson:"books,omitempty" json:"books,omitempty"`
+	// The name of the file in the file storage
+	File  string `bson:"file,omitempty" json:"-"`
+	Error string `bson:"error,omitempty" json:"error,omitempty"`
+	// The signed link to the file, once done
+	URL string `bson:"-" json:"url,omitempty"`
+}
+
+type exportJobs struct {
+	jobs  *mongo.Collection
+	books *mongo.Collection
+	files fileStore
+	ttl   time.Duration
+	wake  chan struct{}
+}
+
+func newExportJobs(books *mongo.Collection, files fileStore, ttl time.Duration) *exportJobs {
+	return &exportJobs{
+		jobs:  books.Database().Collection(exportJobsCollection),
+		books: books,
+		files: files,
+		ttl:   ttl,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Enqueue queues an export of the catalog in format.
+func (x *exportJobs) Enqueue(ctx context.Context, format string) (ExportJob, error) {
+	job := ExportJob{
+		ID:        primitive.NewObjectID(),
+		Format:    format,
+		Status:    "queued",
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := x.jobs.InsertOne(ctx, job); err != nil {
+		return ExportJob{}, err
+	}
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Run runs the queued jobs, and deletes the expired files, until ctx is
+// cancelled.
+func (x *exportJobs) Run(ctx context.Context) {
+	ticker := time.NewTicker(exportJobPollInterval)
+	defer ticker.Stop()
+	for {
+		for x.runNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.expire(ctx)
+		case <-x.wake:
+		}
+	}
+}
+
+// runNext claims and runs one job, and tells if there was one.
+func (x *exportJobs) runNext(ctx context.Context) bool {
+	now := time.Now().UTC()
+	var job ExportJob
+	err := x.jobs.FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": "queued"},
+			bson.M{"status": "running", "startedAt": bson.M{"$lt": now.Add(-exportJobTakeover)}},
+		}},
+		bson.M{"$set": bson.M{"status": "running", "startedAt": now}},
+		options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			slog.Warn("could not read the export jobs", "error", err)
+		}
+		return false
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, exportJobTimeout)
+	name, count, err := storeExport(runCtx, x.books, x.files, job.Format)
+	cancel()
+	finished := time.Now().UTC()
+	set := bson.M{"finishedAt": finished}
+	if err != nil {
+		slog.Warn("export job failed", "job", job.ID.Hex(), "format", job.Format, "error", err)
+		set["status"] = "failed"
+		set["error"] = err.Error()
+	} else {
+		set["status"] = "done"
+		set["file"] = name
+		set["books"] = count
+		set["expiresAt"] = finished.Add(x.ttl)
+	}
+	// Unless another instance took it over in the meantime
+	res, err := x.jobs.UpdateOne(ctx, bson.M{"_id": job.ID, "startedAt": now}, bson.M{"$set": set})
+	if err != nil {
+		slog.Warn("could not update the export job", "job", job.ID.Hex(), "error", err)
+	} else if res.MatchedCount == 0 && name != "" {
+		x.files.Delete(ctx, name)
+	}
+	return true
+}
+
+// expire deletes the files of the jobs past their expiry.
+func (x *exportJobs) expire(ctx context.Context) {
+	cursor, err := x.jobs.Find(ctx, bson.M{"status": "done", "expiresAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return
+	}
+	var jobs []ExportJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return
+	}
+	for _, job := range jobs {
+		// The backup task may have deleted it already
+		if err := x.files.Delete(ctx, job.File); err != nil {
+			slog.Debug("could not delete an expired export", "file", job.File, "error", err)
+		}
+		x.jobs.UpdateByID(ctx, job.ID, bson.M{"$set": bson.M{"status": "expired"}, "$unset": bson.M{"file": ""}})
+	}
+}
+
+// registerExportJobRoutes mounts POST and GET /api/exports, GET and
+// DELETE /api/exports/:id, and GET /api/export, which used to stream the
+// catalog and now queues an export too.
+func registerExportJobRoutes(e *echo.Echo, auth echo.MiddlewareFunc, x *exportJobs, links *urlSigner, unknownFormat string) {
+	// GET /api/export?format= streams the whole catalog as it is read,
+	// so it can't be resumed. It holds a connection, and a database
+	// cursor, for as long as the client takes to read it: the headers of
+	// RFC 9745 point to POST /api/exports, its successor.
+	e.GET("/api/export", func(c echo.Context) error {
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "json"
+		}
+		contentType, ok := exportContentTypes[format]
+		if !ok {
+			return handlers.JSONError(c, http.StatusBadRequest, unknownFormat)
+		}
+		res := c.Response()
+		res.Header().Set("Deprecation", "true")
+		res.Header().Set("Link", `</api/exports>; rel="successor-version"`)
+		res.Header().Set("Accept-Ranges", "none")
+		res.Header().Set(echo.HeaderContentType, contentType[0])
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="books`+contentType[1]+`"`)
+		res.WriteHeader(http.StatusOK)
+		// Once streaming has started, errors can only be logged
+		if _, err := exportBooks(c.Request().Context(), x.books, format, res); err != nil {
+			slog.ErrorContext(c.Request().Context(), "export failed", "format", format, "error", err)
+		}
+		return nil
+	})
+
+	// The jobs fill the file storage and list links to the whole catalog,
+	// so they are for the admins only
+	if auth == nil {
+		return
+	}
+	exports := e.Group("/api/exports", auth)
+
+	withURL := func(job ExportJob) ExportJob {
+		if job.Status == "done" {
+			job.URL = links.Sign(filesPrefix + job.File)
+		}
+		return job
+	}
+	byID := func(c echo.Context) (ExportJob, error) {
+		var job ExportJob
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return job, mongo.ErrNoDocuments
+		}
+		err = x.jobs.FindOne(c.Request().Context(), bson.M{"_id": id}).Decode(&job)
+		return job, err
+	}
+
+	// POST /api/exports?format= queues an export of the whole catalog,
+	// to poll at the Location answered.
+	exports.POST("", func(c echo.Context) error {
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "json"
+		}
+		if _, ok := exportContentTypes[format]; !ok {
+			return handlers.JSONError(c, http.StatusBadRequest, unknownFormat)
+		}
+		job, err := x.Enqueue(c.Request().Context(), format)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		c.Response().Header().Set(echo.HeaderLocation, "/api/exports/"+job.ID.Hex())
+		return c.JSON(http.StatusAccepted, job)
+	})
+
+	// GET /api/exports?limit= lists the exports, latest first.
+	exports.GET("", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxExportJobsLimit {
+			limit = defaultExportJobsLimit
+		}
+		opts := store.FindOpts(ctx).SetSort(bson.M{"createdAt": -1}).SetLimit(int64(limit))
+		cursor, err := x.jobs.Find(ctx, bson.M{}, opts)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		jobs := []ExportJob{}
+		if err := cursor.All(ctx, &jobs); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		for i := range jobs {
+			jobs[i] = withURL(jobs[i])
+		}
+		return c.JSON(http.StatusOK, jobs)
+	})
+
+	exports.GET("/:id", func(c echo.Context) error {
+		job, err := byID(c)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return handlers.JSONError(c, http.StatusNotFound, "Export not found")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, withURL(job))
+	})
+
+	// DELETE /api/exports/:id deletes the export and its file, unless it
+	// is running.
+	exports.DELETE("/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		job, err := byID(c)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return handlers.JSONError(c, http.StatusNotFound, "Export not found")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		// Unless an instance started running it in the meantime
+		res, err := x.jobs.DeleteOne(ctx, bson.M{"_id": job.ID, "status": bson.M{"$ne": "running"}})
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if res.DeletedCount == 0 {
+			return handlers.JSONError(c, http.StatusConflict, "The export is running")
+		}
+		if job.File != "" {
+			if err := x.files.Delete(ctx, job.File); err != nil {
+				return handlers.ServerError(c, err, "Could not delete the export file")
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
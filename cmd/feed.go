@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/url"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// Number of entries in /feed.xml
+const feedSize = 20
+
+// The structs below map to the elements of an Atom document (RFC 4287).
+// encoding/xml uses the tags to know how to write each field.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Link      atomLink   `xml:"link"`
+	Author    atomPerson `xml:"author"`
+	Summary   string     `xml:"summary,omitempty"`
+}
+
+// buildAtomFeed renders the given books as an Atom feed. Every entry links
+// to the detail page of the book.
+func buildAtomFeed(base string, books []store.Book) []byte {
+	feed := atomFeed{
+		Title: "Book Store - New arrivals",
+		ID:    base + "/feed.xml",
+		Links: []atomLink{
+			{Href: base + "/feed.xml", Rel: "self", Type: "application/atom+xml"},
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+		},
+	}
+
+	updated := time.Time{}
+	for _, book := range books {
+		link := base + "/books/" + url.PathEscape(book.ID)
+		summary := book.BookName + " by " + book.BookAuthor
+		if book.BookYear != "" {
+			summary += " (" + book.BookYear + ")"
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     book.BookName,
+			ID:        link,
+			Updated:   book.LastModified().UTC().Format(time.RFC3339),
+			Published: book.AddedAt().UTC().Format(time.RFC3339),
+			Link:      atomLink{Href: link, Rel: "alternate", Type: "text/html"},
+			Author:    atomPerson{Name: book.BookAuthor},
+			Summary:   summary,
+		})
+		if book.LastModified().After(updated) {
+			updated = book.LastModified()
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	out, _ := xml.MarshalIndent(feed, "", "  ")
+	return append([]byte(xml.Header), out...)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errFileNotFound = errors.New("file not found")
+
+// fileStore keeps the uploaded covers and the stored exports. FILES_BACKEND
+// picks GridFS, inside the database (default), or an S3 compatible object
+// storage such as AWS S3 or MinIO. Files are linked as /files/<name>
+// whatever the backend, see registerFileRoutes.
+type fileStore interface {
+	// Put stores r under name, replacing any previous file. size is -1
+	// when unknown.
+	Put(ctx context.Context, name, contentType string, r io.Reader, size int64) error
+	// DownloadURL returns a short-lived URL the client can download name
+	// from directly, or an empty string when the file must be served
+	// through Open.
+	DownloadURL(ctx context.Context, name string) (string, error)
+	// Open returns the file, seekable for Range requests, and its content
+	// type.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, string, error)
+	Delete(ctx context.Context, name string) error
+	// List returns the names starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+func newFileStore(ctx context.Context, cfg config.FilesConfig, db *mongo.Database) (fileStore, error) {
+	switch cfg.Backend {
+	case "", "gridfs":
+		return &gridFSStore{db: db}, nil
+	case "s3":
+		return newS3Store(ctx, cfg)
+	}
+	return nil, fmt.Errorf("unknown files backend %q", cfg.Backend)
+}
+
+// gridFSStore keeps files in the "files" GridFS bucket.
+type gridFSStore struct {
+	db *mongo.Database
+}
+
+// bucket returns a bucket bound to the deadline of ctx. Buckets are cheap,
+// and their deadline is shared by every operation, so each operation gets
+// its own.
+func (g *gridFSStore) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(g.db, options.GridFSBucket().SetName("files"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetReadDeadline(deadline)
+		bucket.SetWriteDeadline(deadline)
+	}
+	return bucket, nil
+}
+
+func (g *gridFSStore) Put(ctx context.Context, name, contentType string, r io.Reader, size int64) error {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := bucket.UploadFromStream(name, r,
+		options.GridFSUpload().SetMetadata(bson.M{"contentType": contentType}))
+	if err != nil {
+		return err
+	}
+	// GridFS keeps every revision of a name, drop the older ones. Only
+	// those older: two uploads of the same name at once would otherwise
+	// delete each other.
+	return g.deleteWhere(ctx, bucket, bson.M{"filename": name, "_id": bson.M{"$lt": id}})
+}
+
+func (g *gridFSStore) DownloadURL(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
+
+func (g *gridFSStore) Open(ctx context.Context, name string) (io.ReadSeekCloser, string, error) {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := bucket.OpenDownloadStreamByName(name)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, "", errFileNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	file := stream.GetFile()
+	var metadata struct {
+		ContentType string `bson:"contentType"`
+	}
+	if file.Metadata != nil {
+		bson.Unmarshal(file.Metadata, &metadata)
+	}
+	return &gridFSFile{bucket: bucket, id: file.ID, size: file.Length, stream: stream}, metadata.ContentType, nil
+}
+
+// gridFSFile makes a GridFS download stream seekable: seeking forward
+// skips the bytes in between, seeking back opens the file again. Seeks
+// only move the position, the stream catches up on the next Read.
+type gridFSFile struct {
+	bucket *gridfs.Bucket
+	id     interface{}
+	size   int64
+
+	stream    *gridfs.DownloadStream
+	streamPos int64 // where the stream is
+	pos       int64 // where the reader is
+}
+
+func (f *gridFSFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	if f.streamPos > f.pos {
+		f.stream.Close()
+		stream, err := f.bucket.OpenDownloadStream(f.id)
+		if err != nil {
+			return 0, err
+		}
+		f.stream, f.streamPos = stream, 0
+	}
+	if f.streamPos < f.pos {
+		skipped, err := f.stream.Skip(f.pos - f.streamPos)
+		f.streamPos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.stream.Read(p)
+	f.pos += int64(n)
+	f.streamPos = f.pos
+	return n, err
+}
+
+func (f *gridFSFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return f.pos, errors.New("seek before the start of the file")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *gridFSFile) Close() error {
+	return f.stream.Close()
+}
+
+func (g *gridFSStore) Delete(ctx context.Context, name string) error {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	return g.deleteWhere(ctx, bucket, bson.M{"filename": name})
+}
+
+func (g *gridFSStore) List(ctx context.Context, prefix string) ([]string, error) {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	cursor, err := bucket.FindContext(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		Name string `bson:"filename"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		// Revisions share the name
+		if !slices.Contains(names, f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+func (g *gridFSStore) deleteWhere(ctx context.Context, bucket *gridfs.Bucket, filter bson.M) error {
+	cursor, err := bucket.FindContext(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := bucket.DeleteContext(ctx, f.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Store keeps files in a bucket, under a prefix. Downloads go straight to
+// the object storage through presigned URLs.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	expiry time.Duration
+}
+
+func newS3Store(ctx context.Context, cfg config.FilesConfig) (*s3Store, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, errors.New("FILES_S3_ENDPOINT and FILES_S3_BUCKET are required for the s3 files backend")
+	}
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ok, err := client.BucketExists(ctx, cfg.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the object storage: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("bucket %q does not exist", cfg.S3Bucket)
+	}
+	prefix := strings.Trim(cfg.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{client: client, bucket: cfg.S3Bucket, prefix: prefix, expiry: cfg.PresignExpiry}, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, name, contentType string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+name, r, size,
+		minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *s3Store) DownloadURL(ctx context.Context, name string) (string, error) {
+	if _, err := s.client.StatObject(ctx, s.bucket, s.prefix+name, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", errFileNotFound
+		}
+		return "", err
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.prefix+name, s.expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *s3Store) Open(ctx context.Context, name string) (io.ReadSeekCloser, string, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, "", errFileNotFound
+		}
+		return nil, "", err
+	}
+	return obj, info.ContentType, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return names, nil
+}
+
+// Stored exports are named exportsPrefix + "books-" + the time + the
+// extension of the format, so they sort by date.
+const (
+	exportsPrefix    = "exports/"
+	exportTimeLayout = "20060102T150405.000Z"
+)
+
+// storeExport exports the whole catalog to the file storage, and returns
+// the name of the file and the number of books.
+func storeExport(ctx context.Context, coll *mongo.Collection, files fileStore, format string) (string, int, error) {
+	contentType := exportContentTypes[format]
+	name := exportsPrefix + "books-" + time.Now().UTC().Format(exportTimeLayout) + contentType[1]
+
+	pr, pw := io.Pipe()
+	var count int
+	go func() {
+		n, err := exportBooks(ctx, coll, format, pw)
+		count = n
+		pw.CloseWithError(err)
+	}()
+	if err := files.Put(ctx, name, contentType[0], pr, -1); err != nil {
+		pr.CloseWithError(err)
+		files.Delete(ctx, name)
+		return "", 0, err
+	}
+	return name, count, nil
+}
+
+// purgeExports deletes the stored exports older than maxAge, and returns
+// how many.
+func purgeExports(ctx context.Context, files fileStore, maxAge time.Duration) (int, error) {
+	names, err := files.List(ctx, exportsPrefix)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	deleted := 0
+	for _, name := range names {
+		stamp := strings.TrimPrefix(name, exportsPrefix+"books-")
+		if len(stamp) < len(exportTimeLayout) {
+			continue
+		}
+		at, err := time.Parse(exportTimeLayout, stamp[:len(exportTimeLayout)])
+		if err != nil || at.After(cutoff) {
+			continue
+		}
+		if err := files.Delete(ctx, name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// coverTypes are the image types accepted as covers, with their extension.
+var coverTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// filesPrefix is where stored files are linked from.
+const filesPrefix = "/files/"
+
+// registerFileRoutes serves GET /files/<name>: a redirect to a presigned URL
+// when the store has one, the file itself otherwise, with Range support
+// either way. Names never change
+// content (they carry a hash or a timestamp), so they are cached for long,
+// or until the link expires when links are signed (see signedurl.go).
+// Covers take ?size=small, medium or large for their thumbnails (see
+// thumbnails.go).
+func registerFileRoutes(e *echo.Echo, files fileStore, links *urlSigner) {
+	// serve answers with the file name, or returns errFileNotFound
+	// without answering.
+	serve := func(c echo.Context, name string) error {
+		ctx := c.Request().Context()
+		url, err := files.DownloadURL(ctx, name)
+		if errors.Is(err, errFileNotFound) {
+			return err
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not read file")
+		}
+		if url != "" {
+			return c.Redirect(http.StatusFound, url)
+		}
+
+		r, contentType, err := files.Open(ctx, name)
+		if errors.Is(err, errFileNotFound) {
+			return err
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not read file")
+		}
+		defer r.Close()
+		if contentType == "" {
+			contentType = echo.MIMEOctetStream
+		}
+		h := c.Response().Header()
+		h.Set(echo.HeaderContentType, contentType)
+		h.Set("Cache-Control", links.cacheControl(c.QueryParams()))
+		// Names never change content, so they tag it too, for If-Range
+		sum := sha256.Sum256([]byte(name))
+		h.Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		if strings.HasPrefix(name, exportsPrefix) {
+			h.Set(echo.HeaderContentDisposition, `attachment; filename="`+path.Base(name)+`"`)
+		}
+		// Answers Range requests, so large exports can be resumed, and
+		// If-None-Match with 304s
+		http.ServeContent(c.Response(), c.Request(), name, time.Time{}, r)
+		return nil
+	}
+
+	e.GET(filesPrefix+"*", func(c echo.Context) error {
+		name := c.Param("*")
+		if name == "" || strings.Contains(name, "..") {
+			return handlers.JSONError(c, http.StatusNotFound, "File not found")
+		}
+		if !links.Valid(name, c.QueryParams()) {
+			return handlers.JSONError(c, http.StatusForbidden, "Invalid or expired link")
+		}
+		if size := c.QueryParam("size"); size != "" {
+			variant, ok := coverVariant(name, size)
+			if !ok {
+				return handlers.JSONError(c, http.StatusBadRequest, "Unknown size, expected small, medium or large")
+			}
+			// Covers narrower than the size have no variant
+			if err := serve(c, variant); !errors.Is(err, errFileNotFound) {
+				return err
+			}
+		}
+		err := serve(c, name)
+		if errors.Is(err, errFileNotFound) {
+			return handlers.JSONError(c, http.StatusNotFound, "File not found")
+		}
+		return err
+	})
+}
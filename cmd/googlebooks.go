@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// googleBooks queries the Google Books API, see
+// https://developers.google.com/books/docs/v1/using. The API key is
+// optional, but requests without one share a small anonymous quota.
+type googleBooks struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func newGoogleBooks(baseURL, apiKey string) *googleBooks {
+	return &googleBooks{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type googleVolumes struct {
+	Items []struct {
+		VolumeInfo struct {
+			Title               string   `json:"title"`
+			Subtitle            string   `json:"subtitle"`
+			Authors             []string `json:"authors"`
+			PublishedDate       string   `json:"publishedDate"`
+			PageCount           int      `json:"pageCount"`
+			Categories          []string `json:"categories"`
+			IndustryIdentifiers []struct {
+				Type       string `json:"type"`
+				Identifier string `json:"identifier"`
+			} `json:"industryIdentifiers"`
+			ImageLinks struct {
+				Thumbnail string `json:"thumbnail"`
+			} `json:"imageLinks"`
+		} `json:"volumeInfo"`
+	} `json:"items"`
+}
+
+// Lookup finds the volumes with the given ISBN, or else matching title and
+// author (either may be empty).
+func (g *googleBooks) Lookup(ctx context.Context, isbn, title, author string) ([]LookupCandidate, error) {
+	var terms []string
+	if isbn != "" {
+		terms = append(terms, "isbn:"+isbn)
+	} else {
+		if title != "" {
+			terms = append(terms, "intitle:"+title)
+		}
+		if author != "" {
+			terms = append(terms, "inauthor:"+author)
+		}
+	}
+	query := url.Values{
+		"q":          {strings.Join(terms, " ")},
+		"maxResults": {strconv.Itoa(lookupLimit)},
+		"printType":  {"books"},
+	}
+	if g.apiKey != "" {
+		query.Set("key", g.apiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.baseURL+"/books/v1/volumes?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		// The error holds the URL, and with it the API key
+		return nil, fmt.Errorf("google books: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google books: %s", resp.Status)
+	}
+	var volumes googleVolumes
+	if err := json.NewDecoder(resp.Body).Decode(&volumes); err != nil {
+		return nil, fmt.Errorf("google books: %w", err)
+	}
+
+	candidates := make([]LookupCandidate, 0, len(volumes.Items))
+	for _, item := range volumes.Items {
+		info := item.VolumeInfo
+		c := LookupCandidate{
+			Title:    info.Title,
+			Author:   strings.Join(info.Authors, ", "),
+			Year:     publishYearPattern.FindString(info.PublishedDate),
+			Subjects: info.Categories,
+			// Google serves the covers over plain HTTP by default
+			Cover: strings.Replace(info.ImageLinks.Thumbnail, "http://", "https://", 1),
+		}
+		if info.Subtitle != "" {
+			c.Title += ": " + info.Subtitle
+		}
+		if info.PageCount > 0 {
+			c.Pages = strconv.Itoa(info.PageCount)
+		}
+		// The edition field holds the ISBN, the 13 digit one if known
+		for _, id := range info.IndustryIdentifiers {
+			if id.Type == "ISBN_13" || (id.Type == "ISBN_10" && c.Edition == "") {
+				c.Edition = id.Identifier
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// LookupISBN makes Google Books usable as a metadata provider too
+// (METADATA_PROVIDER=google).
+func (g *googleBooks) LookupISBN(ctx context.Context, isbn string) (BookMetadata, error) {
+	candidates, err := g.Lookup(ctx, isbn, "", "")
+	if err != nil {
+		return BookMetadata{}, err
+	}
+	if len(candidates) == 0 {
+		return BookMetadata{}, errMetadataNotFound
+	}
+	c := candidates[0]
+	return BookMetadata{Pages: c.Pages, Year: c.Year, CoverURL: c.Cover, Subjects: c.Subjects}, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Vendors deliver CSV files with their own columns, every time the same.
+// An import profile, saved once by an admin, tells which column holds
+// which field of the books, and how to clean up the values, e.g.
+//
+//	{
+//	  "columns": {"Titel": "title", "Verfasser": "author", "ISBN": "edition", "Erschienen": "year"},
+//	  "transforms": {"edition": "isbn", "year": "date:DD.MM.YYYY"},
+//	  "delimiter": ";"
+//	}
+//
+// Then imports of their files name the profile, on the admin dashboard or
+// with the import command (--profile).
+const importProfilesCollection = "import_profiles"
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ImportProfile maps the columns of a CSV file to the fields of the books.
+type ImportProfile struct {
+	Name string `bson:"_id" json:"name"`
+	// The field of each column, by column name. Fields are named like in
+	// the JSON API: id, title, author, edition, pages, year, shelf, tags
+	// and subjects, the last two taking a comma separated list.
+	Columns map[string]string `bson:"columns" json:"columns"`
+	// How the values of a field are transformed, by field, e.g.
+	// "trim:=\"|isbn". See parseTransform.
+	Transforms map[string]string `bson:"transforms,omitempty" json:"transforms,omitempty"`
+	// The column separator, a comma by default
+	Delimiter string    `bson:"delimiter,omitempty" json:"delimiter,omitempty"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// profileFields set the fields of a book a profile can map to.
+var profileFields = map[string]func(*store.Book, string){
+	"id":       func(b *store.Book, v string) { b.ID = v },
+	"title":    func(b *store.Book, v string) { b.BookName = v },
+	"author":   func(b *store.Book, v string) { b.BookAuthor = v },
+	"edition":  func(b *store.Book, v string) { b.BookEdition = v },
+	"pages":    func(b *store.Book, v string) { b.BookPages = v },
+	"year":     func(b *store.Book, v string) { b.BookYear = v },
+	"shelf":    func(b *store.Book, v string) { b.BookShelf = v },
+	"tags":     func(b *store.Book, v string) { b.BookTags = appendList(b.BookTags, v) },
+	"subjects": func(b *store.Book, v string) { b.BookSubjects = appendList(b.BookSubjects, v) },
+}
+
+// appendList appends the comma separated items of v.
+func appendList(list []string, v string) []string {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" && !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// dateTokens turn the date patterns of the profiles, e.g. DD/MM/YYYY, into
+// the layouts of the time package. Longer tokens come first.
+var dateTokens = strings.NewReplacer("YYYY", "2006", "YY", "06", "MMM", "Jan", "MM", "01", "M", "1", "DD", "02", "D", "2")
+
+// parseTransform parses the transforms of a field, separated by "|" and
+// applied in turn:
+//
+//	trim:CHARS     removes CHARS from both ends, e.g. trim:=" for ="0451526538"
+//	lower, upper   changes the case
+//	isbn           removes the hyphens and spaces of an ISBN
+//	prefix:TEXT    prepends TEXT to the values, e.g. to tell the IDs of a vendor apart
+//	date:PATTERN   keeps the year of a date, e.g. date:DD/MM/YYYY or date:MMM D, YYYY
+func parseTransform(spec string) (func(string) (string, error), error) {
+	var steps []func(string) (string, error)
+	for _, step := range strings.Split(spec, "|") {
+		name, arg, _ := strings.Cut(step, ":")
+		switch name {
+		case "trim":
+			steps = append(steps, func(v string) (string, error) { return strings.Trim(v, arg), nil })
+		case "lower":
+			steps = append(steps, func(v string) (string, error) { return strings.ToLower(v), nil })
+		case "upper":
+			steps = append(steps, func(v string) (string, error) { return strings.ToUpper(v), nil })
+		case "isbn":
+			steps = append(steps, func(v string) (string, error) {
+				return strings.NewReplacer("-", "", " ", "").Replace(v), nil
+			})
+		case "prefix":
+			steps = append(steps, func(v string) (string, error) {
+				if v == "" {
+					return "", nil
+				}
+				return arg + v, nil
+			})
+		case "date":
+			if !strings.Contains(arg, "YY") {
+				return nil, fmt.Errorf("%s: the pattern has no year", step)
+			}
+			layout := dateTokens.Replace(arg)
+			steps = append(steps, func(v string) (string, error) {
+				if v == "" {
+					return "", nil
+				}
+				t, err := time.Parse(layout, v)
+				if err != nil {
+					return "", fmt.Errorf("%q is not a date like %s", v, arg)
+				}
+				return t.Format("2006"), nil
+			})
+		default:
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return func(v string) (string, error) {
+		var err error
+		for _, step := range steps {
+			if v, err = step(v); err != nil {
+				return "", err
+			}
+		}
+		return v, nil
+	}, nil
+}
+
+// validate tells what is wrong with the profile, if anything.
+func (p ImportProfile) validate() error {
+	if !profileNamePattern.MatchString(p.Name) {
+		return errors.New("the name takes lowercase letters, digits, - and _")
+	}
+	if len(p.Columns) == 0 {
+		return errors.New("map at least one column")
+	}
+	mapped := map[string]string{}
+	for column, field := range p.Columns {
+		if _, ok := profileFields[field]; !ok {
+			return fmt.Errorf("column %q: unknown field %q", column, field)
+		}
+		if other, ok := mapped[field]; ok && field != "tags" && field != "subjects" {
+			return fmt.Errorf("columns %q and %q both map to %s", other, column, field)
+		}
+		mapped[field] = column
+	}
+	for field, spec := range p.Transforms {
+		if _, ok := mapped[field]; !ok {
+			return fmt.Errorf("transforms: no column maps to %s", field)
+		}
+		if _, err := parseTransform(spec); err != nil {
+			return fmt.Errorf("transforms: %s: %w", field, err)
+		}
+	}
+	if p.Delimiter != "" && (utf8.RuneCountInString(p.Delimiter) != 1 || p.Delimiter == `"` || p.Delimiter == "\n") {
+		return errors.New("the delimiter is a single character")
+	}
+	return nil
+}
+
+// delimiter returns the column separator of the CSV files.
+func (p ImportProfile) delimiter() rune {
+	if p.Delimiter == "" {
+		return ','
+	}
+	r, _ := utf8.DecodeRuneInString(p.Delimiter)
+	return r
+}
+
+// bookMapper returns the function making a book of a row of the CSV file,
+// given the index of each column.
+func (p ImportProfile) bookMapper() (func(columns map[string]int, record []string) (store.Book, error), error) {
+	transforms := map[string]func(string) (string, error){}
+	for field, spec := range p.Transforms {
+		transform, err := parseTransform(spec)
+		if err != nil {
+			return nil, err
+		}
+		transforms[field] = transform
+	}
+	return func(columns map[string]int, record []string) (store.Book, error) {
+		get := csvField(columns, record)
+		var book store.Book
+		for column, field := range p.Columns {
+			value := get(column)
+			if transform, ok := transforms[field]; ok {
+				var err error
+				if value, err = transform(value); err != nil {
+					return book, fmt.Errorf("%s: %w", field, err)
+				}
+			}
+			profileFields[field](&book, value)
+		}
+		return book, nil
+	}, nil
+}
+
+type importProfiles struct {
+	profiles *mongo.Collection
+}
+
+func newImportProfiles(db *mongo.Database) *importProfiles {
+	return &importProfiles{profiles: db.Collection(importProfilesCollection)}
+}
+
+// errUnknownProfile is returned for a profile not saved.
+var errUnknownProfile = errors.New("unknown import profile")
+
+func (ip *importProfiles) Get(ctx context.Context, name string) (ImportProfile, error) {
+	var p ImportProfile
+	err := ip.profiles.FindOne(ctx, bson.M{"_id": name}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return p, fmt.Errorf("%w %q", errUnknownProfile, name)
+	}
+	return p, err
+}
+
+func (ip *importProfiles) List(ctx context.Context) ([]ImportProfile, error) {
+	cursor, err := ip.profiles.Find(ctx, bson.M{}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	profiles := []ImportProfile{}
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Put saves the profile, replacing the one with the same name.
+func (ip *importProfiles) Put(ctx context.Context, p ImportProfile) error {
+	_, err := ip.profiles.ReplaceOne(ctx, bson.M{"_id": p.Name}, p, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Delete deletes the profile, and tells if there was one.
+func (ip *importProfiles) Delete(ctx context.Context, name string) (bool, error) {
+	res, err := ip.profiles.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// registerImportProfileRoutes mounts the import profiles under
+// /admin/import/profiles: GET lists them, as the options of the profile
+// select of the dashboard to our pages, and PUT and DELETE /:name save and
+// delete one.
+func registerImportProfileRoutes(admin *echo.Group, ip *importProfiles) {
+	admin.GET("/import/profiles", func(c echo.Context) error {
+		profiles, err := ip.List(c.Request().Context())
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if render.WantsHTML(c) {
+			return c.Render(http.StatusOK, "import-profile-options", profiles)
+		}
+		return c.JSON(http.StatusOK, profiles)
+	})
+
+	admin.GET("/import/profiles/:name", func(c echo.Context) error {
+		p, err := ip.Get(c.Request().Context(), c.Param("name"))
+		if errors.Is(err, errUnknownProfile) {
+			return handlers.JSONError(c, http.StatusNotFound, "Import profile not found")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, p)
+	})
+
+	admin.PUT("/import/profiles/:name", func(c echo.Context) error {
+		var p ImportProfile
+		if err := c.Bind(&p); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		p.Name = c.Param("name")
+		if err := p.validate(); err != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid import profile: "+err.Error())
+		}
+		p.UpdatedAt = time.Now().UTC()
+		if err := ip.Put(c.Request().Context(), p); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, p)
+	})
+
+	admin.DELETE("/import/profiles/:name", func(c echo.Context) error {
+		deleted, err := ip.Delete(c.Request().Context(), c.Param("name"))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if !deleted {
+			return handlers.JSONError(c, http.StatusNotFound, "Import profile not found")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
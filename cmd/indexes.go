@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// expectedIndexes are the indexes the app relies on, per collection: those
+// the migrations create. When a migration adds an index, add it here too,
+// so POST /admin/indexes can bring back indexes dropped or changed by hand.
+func expectedIndexes(coll *mongo.Collection) map[string][]mongo.IndexModel {
+	return map[string][]mongo.IndexModel{
+		coll.Name(): {
+			// 001_books_indexes
+			{Keys: bson.D{{Key: "ID", Value: 1}}},
+			{Keys: bson.D{{Key: "BookAuthor", Value: 1}, {Key: "BookName", Value: 1}}},
+			{Keys: bson.D{{Key: "BookYear", Value: 1}}},
+			// 003_timestamp_indexes
+			{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "updatedAt", Value: -1}}, Options: options.Index().SetSparse(true)},
+			// 008_shelf_index
+			{Keys: bson.D{{Key: "BookShelf", Value: 1}, {Key: "BookName", Value: 1}}},
+			// 011_content_addressed_covers
+			{Keys: bson.D{{Key: "BookCover", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		// 004_notification_indexes
+		notificationPreferencesCollection: {
+			{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "newBooks", Value: 1}, {Key: "lastDigestAt", Value: 1}}},
+		},
+		mailOutboxCollection: {
+			{Keys: bson.D{{Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "sentAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		},
+		// 005_webhook_indexes
+		webhookDeliveriesCollection: {
+			{Keys: bson.D{{Key: "subscriptionId", Value: 1}, {Key: "changeId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		},
+		// 006_bulk_edit_indexes
+		bulkEditsCollection: {
+			{Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600)},
+		},
+		// 007_audit_log_indexes
+		auditLogCollection: {
+			{Keys: bson.D{{Key: "changeId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "mongoId", Value: 1}, {Key: "_id", Value: -1}}},
+		},
+		// 009_reading_list_indexes
+		readingListsCollection: {
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		// 010_book_note_indexes
+		bookNotesCollection: {
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "book", Value: 1}, {Key: "_id", Value: 1}}},
+		},
+		// 012_usage_stats_indexes
+		usageStatsCollection: {
+			{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "day", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "day", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(maxTrendingDays * 24 * 3600)},
+		},
+		// 014_export_job_indexes
+		exportJobsCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		},
+		// 018_api_key_indexes
+		apiKeysCollection: {
+			{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		apiKeyUsageCollection: {
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+}
+
+// IndexInfo describes an index, as it exists in the database or as the app
+// expects it.
+type IndexInfo struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	Keys       string `json:"keys"`
+	Unique     bool   `json:"unique,omitempty"`
+	Sparse     bool   `json:"sparse,omitempty"`
+	// TTL of the documents, in seconds
+	ExpireAfterSeconds *int32 `json:"expireAfterSeconds,omitempty"`
+
+	// Usage since the index was created or the server restarted, from
+	// $indexStats
+	Ops   int64      `json:"ops"`
+	Since *time.Time `json:"since,omitempty"`
+
+	// ok, missing (expected but absent), changed (its options differ
+	// from the expected ones), or extra (not expected by the app)
+	Status string `json:"status"`
+}
+
+// IndexReport is the data of GET and POST /admin/indexes. Created lists the
+// indexes a POST created or rebuilt.
+type IndexReport struct {
+	Indexes []IndexInfo `json:"indexes"`
+	Created []string    `json:"created,omitempty"`
+}
+
+// Drifted tells if an index is missing or changed.
+func (r IndexReport) Drifted() bool {
+	return slices.ContainsFunc(r.Indexes, func(i IndexInfo) bool {
+		return i.Status == "missing" || i.Status == "changed"
+	})
+}
+
+// indexName is the name MongoDB gives to an index by default, e.g.
+// BookAuthor_1_BookName_1.
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func expectedIndexInfo(collection string, model mongo.IndexModel) IndexInfo {
+	keys := model.Keys.(bson.D)
+	info := IndexInfo{Collection: collection, Name: indexName(keys), Keys: indexName(keys)}
+	if opts := model.Options; opts != nil {
+		info.Unique = opts.Unique != nil && *opts.Unique
+		info.Sparse = opts.Sparse != nil && *opts.Sparse
+		info.ExpireAfterSeconds = opts.ExpireAfterSeconds
+	}
+	return info
+}
+
+// sameOptions tells if two indexes with the same name behave alike.
+func (i IndexInfo) sameOptions(other IndexInfo) bool {
+	ttl := func(p *int32) int32 {
+		if p == nil {
+			return -1
+		}
+		return *p
+	}
+	return i.Keys == other.Keys && i.Unique == other.Unique && i.Sparse == other.Sparse &&
+		ttl(i.ExpireAfterSeconds) == ttl(other.ExpireAfterSeconds)
+}
+
+// listIndexes returns the indexes of a collection with their usage. A
+// collection that doesn't exist yet has none.
+func listIndexes(ctx context.Context, coll *mongo.Collection) ([]IndexInfo, error) {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Name == "NamespaceNotFound" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var specs []struct {
+		Name               string `bson:"name"`
+		Key                bson.D `bson:"key"`
+		Unique             bool   `bson:"unique"`
+		Sparse             bool   `bson:"sparse"`
+		ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]struct {
+		Ops   int64
+		Since time.Time
+	}{}
+	cursor, err = coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$indexStats", Value: bson.M{}}}}, store.AggregateOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var usage []struct {
+		Name     string `bson:"name"`
+		Accesses struct {
+			Ops   int64     `bson:"ops"`
+			Since time.Time `bson:"since"`
+		} `bson:"accesses"`
+	}
+	if err := cursor.All(ctx, &usage); err != nil {
+		return nil, err
+	}
+	// With several replica set members there is one entry per member
+	for _, u := range usage {
+		s := stats[u.Name]
+		s.Ops += u.Accesses.Ops
+		if s.Since.IsZero() || u.Accesses.Since.Before(s.Since) {
+			s.Since = u.Accesses.Since
+		}
+		stats[u.Name] = s
+	}
+
+	infos := make([]IndexInfo, 0, len(specs))
+	for _, spec := range specs {
+		info := IndexInfo{
+			Collection:         coll.Name(),
+			Name:               spec.Name,
+			Keys:               indexName(spec.Key),
+			Unique:             spec.Unique,
+			Sparse:             spec.Sparse,
+			ExpireAfterSeconds: spec.ExpireAfterSeconds,
+		}
+		if s, ok := stats[spec.Name]; ok {
+			info.Ops = s.Ops
+			info.Since = &s.Since
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// indexReport compares the indexes of every collection the app uses with
+// the expected ones.
+func indexReport(ctx context.Context, coll *mongo.Collection) (IndexReport, error) {
+	db := coll.Database()
+	expected := expectedIndexes(coll)
+	collections := make([]string, 0, len(expected))
+	for name := range expected {
+		collections = append(collections, name)
+	}
+	slices.Sort(collections)
+
+	report := IndexReport{Indexes: []IndexInfo{}}
+	for _, name := range collections {
+		existing, err := listIndexes(ctx, db.Collection(name))
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", name, err)
+		}
+		found := map[string]bool{}
+		for _, model := range expected[name] {
+			want := expectedIndexInfo(name, model)
+			want.Status = "missing"
+			for _, have := range existing {
+				if have.Name == want.Name {
+					found[have.Name] = true
+					want = have
+					want.Status = "ok"
+					if !have.sameOptions(expectedIndexInfo(name, model)) {
+						want.Status = "changed"
+					}
+				}
+			}
+			report.Indexes = append(report.Indexes, want)
+		}
+		for _, have := range existing {
+			if !found[have.Name] {
+				// _id is always there, not worth flagging
+				have.Status = "extra"
+				if have.Name == "_id_" {
+					have.Status = "ok"
+				}
+				report.Indexes = append(report.Indexes, have)
+			}
+		}
+	}
+	return report, nil
+}
+
+// repairIndexes creates the missing indexes and rebuilds the changed ones,
+// and returns their names. Extra indexes are left alone: they may have
+// been added on purpose.
+func repairIndexes(ctx context.Context, coll *mongo.Collection) ([]string, error) {
+	report, err := indexReport(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+	db := coll.Database()
+	var created []string
+	for name, models := range expectedIndexes(coll) {
+		for _, model := range models {
+			want := expectedIndexInfo(name, model)
+			i := slices.IndexFunc(report.Indexes, func(i IndexInfo) bool {
+				return i.Collection == name && i.Name == want.Name
+			})
+			indexes := db.Collection(name).Indexes()
+			switch report.Indexes[i].Status {
+			case "ok":
+				continue
+			case "changed":
+				// An index can't be altered in place
+				if _, err := indexes.DropOne(ctx, want.Name); err != nil {
+					return created, fmt.Errorf("could not drop %s.%s: %w", name, want.Name, err)
+				}
+			}
+			if _, err := indexes.CreateOne(ctx, model); err != nil {
+				return created, fmt.Errorf("could not create %s.%s: %w", name, want.Name, err)
+			}
+			created = append(created, name+"."+want.Name)
+		}
+	}
+	slices.Sort(created)
+	return created, nil
+}
+
+// registerIndexRoutes mounts GET /admin/indexes, which lists the indexes
+// with their usage and drift, and POST /admin/indexes, which repairs the
+// drift. Browsers get the "indexes" page, API clients JSON.
+func registerIndexRoutes(admin *echo.Group, coll *mongo.Collection) {
+	respond := func(c echo.Context, report IndexReport) error {
+		if render.WantsHTML(c) {
+			return render.Page(c, http.StatusOK, "indexes", report)
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+
+	admin.GET("/indexes", func(c echo.Context) error {
+		report, err := indexReport(c.Request().Context(), coll)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not list indexes")
+		}
+		return respond(c, report)
+	})
+
+	admin.POST("/indexes", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		created, err := repairIndexes(ctx, coll)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not create indexes")
+		}
+		report, err := indexReport(ctx, coll)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not list indexes")
+		}
+		report.Created = created
+		return respond(c, report)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// POST /api/isbn/validate checks a list of ISBNs before an import: which
+// are valid, their ISBN-13, and which the catalog already has, whether its
+// books have them as ISBN-10 or 13, with hyphens or without.
+
+// At most this many ISBNs are checked at once.
+const maxISBNValidate = 1000
+
+// ISBNCheck is the outcome for one of the ISBNs of POST /api/isbn/validate.
+type ISBNCheck struct {
+	Input string `json:"input"`
+	Valid bool   `json:"valid"`
+	// Why it isn't valid
+	Error  string `json:"error,omitempty"`
+	ISBN13 string `json:"isbn13,omitempty"`
+	Exists bool   `json:"exists"`
+	// The IDs of the books with this ISBN
+	Books []string `json:"books,omitempty"`
+}
+
+// toISBN13 returns the ISBN-13 of a normalized ISBN, converting an ISBN-10
+// to the 978 prefix, or an empty string when its check digit is wrong.
+func toISBN13(isbn string) string {
+	if !validISBNChecksum(isbn) {
+		return ""
+	}
+	if len(isbn) == 13 {
+		return isbn
+	}
+	isbn = "978" + isbn[:9]
+	sum := 0
+	for i, r := range isbn {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(r-'0')
+	}
+	return isbn + strconv.Itoa((10-sum%10)%10)
+}
+
+// checkISBNs validates the ISBNs against the books of the catalog.
+func checkISBNs(isbns []string, books []store.Book) []ISBNCheck {
+	byISBN := map[string][]string{}
+	for _, book := range books {
+		if isbn := toISBN13(normalizeISBN(book.BookEdition)); isbn != "" {
+			byISBN[isbn] = append(byISBN[isbn], book.ID)
+		}
+	}
+	checks := make([]ISBNCheck, len(isbns))
+	for i, input := range isbns {
+		check := ISBNCheck{Input: input}
+		isbn := normalizeISBN(input)
+		switch {
+		case isbn == "":
+			check.Error = "Not an ISBN-10 or ISBN-13"
+		case toISBN13(isbn) == "":
+			check.Error = "Wrong check digit"
+		default:
+			check.Valid = true
+			check.ISBN13 = toISBN13(isbn)
+			check.Books = byISBN[check.ISBN13]
+			check.Exists = len(check.Books) > 0
+		}
+		checks[i] = check
+	}
+	return checks
+}
+
+// registerISBNRoutes mounts POST /api/isbn/validate, taking
+// {"isbns": ["..."]} and answering {"results": [...]}, one ISBNCheck per
+// ISBN in the same order.
+func registerISBNRoutes(e *echo.Echo, allBooks func(context.Context) ([]store.Book, error)) {
+	e.POST("/api/isbn/validate", func(c echo.Context) error {
+		var in struct {
+			ISBNs []string `json:"isbns"`
+		}
+		if err := c.Bind(&in); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		if len(in.ISBNs) == 0 || len(in.ISBNs) > maxISBNValidate {
+			return handlers.JSONError(c, http.StatusBadRequest, fmt.Sprintf("Give between 1 and %d ISBNs in isbns", maxISBNValidate))
+		}
+		books, err := allBooks(c.Request().Context())
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"results": checkISBNs(in.ISBNs, books)})
+	})
+}
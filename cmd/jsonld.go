@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// ISBNs may come with hyphens or spaces; once removed we expect 10 digits
+// (the last one may be an X) or 13 digits.
+var isbnPattern = regexp.MustCompile(`^([0-9]{9}[0-9Xx]|[0-9]{13})$`)
+
+// Structured data for search engines, see https://schema.org/Book
+type schemaBook struct {
+	Context       string       `json:"@context"`
+	Type          string       `json:"@type"`
+	Name          string       `json:"name"`
+	AlternateName []string     `json:"alternateName,omitempty"`
+	URL           string       `json:"url,omitempty"`
+	Author        schemaPerson `json:"author"`
+	ISBN          string       `json:"isbn,omitempty"`
+	BookEdition   string       `json:"bookEdition,omitempty"`
+	NumberOfPages int          `json:"numberOfPages,omitempty"`
+	DatePublished string       `json:"datePublished,omitempty"`
+	Image         string       `json:"image,omitempty"`
+	About         []string     `json:"about,omitempty"`
+}
+
+type schemaPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// normalizeISBN strips separators from s and returns it if the result looks
+// like an ISBN-10 or ISBN-13, or an empty string otherwise.
+func normalizeISBN(s string) string {
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	if !isbnPattern.MatchString(s) {
+		return ""
+	}
+	return strings.ToUpper(s)
+}
+
+// bookJSONLD describes the book as a schema.org Book. The edition field is
+// free text: when it holds an ISBN we publish it as such, otherwise as the
+// edition name.
+func bookJSONLD(book store.Book, base string) template.JS {
+	data := schemaBook{
+		Context: "https://schema.org",
+		Type:    "Book",
+		Name:    book.BookName,
+		URL:     base + "/books/" + url.PathEscape(book.ID),
+		Author:  schemaPerson{Type: "Person", Name: book.BookAuthor},
+	}
+	if isbn := normalizeISBN(book.BookEdition); isbn != "" {
+		data.ISBN = isbn
+	} else {
+		data.BookEdition = book.BookEdition
+	}
+	if pages, err := strconv.Atoi(book.BookPages); err == nil && pages > 0 {
+		data.NumberOfPages = pages
+	}
+	if book.BookYear != "" && store.ValidateBookField("BookYear", book.BookYear) == "" {
+		data.DatePublished = book.BookYear
+	}
+	data.Image = book.BookCover
+	data.About = book.BookSubjects
+	for _, lang := range slices.Sorted(maps.Keys(book.BookTitles)) {
+		data.AlternateName = append(data.AlternateName, book.BookTitles[lang])
+	}
+
+	// json.Marshal escapes <, > and &, so the output is safe to embed in a
+	// <script> element.
+	out, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+	return template.JS(out)
+}
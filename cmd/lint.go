@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Only the first IDs of each problem are listed in the report.
+const lintSamples = 10
+
+// lintChecks describes the problems looked for, in the order of the report.
+var lintChecks = []struct{ name, description string }{
+	{"missing_title", "Books without a title"},
+	{"missing_author", "Books without an author"},
+	{"invalid_id", "Missing IDs, or IDs with spaces or slashes"},
+	{"duplicate_id", "IDs shared by several books"},
+	{"invalid_year", "Years that are not a number of at most 4 digits"},
+	{"invalid_pages", "Page counts that are not a positive number"},
+	{"invalid_isbn", "Editions that look like an ISBN but fail its check digit"},
+	{"missing_cover", "Uploaded covers that are no longer in the file storage"},
+	{"orphaned_cover", "Covers in the file storage that no book uses"},
+}
+
+// LintIssue is one kind of problem, with how many books (or files) have it.
+type LintIssue struct {
+	Check       string   `json:"check"`
+	Description string   `json:"description"`
+	Count       int      `json:"count"`
+	Samples     []string `json:"samples"`
+}
+
+// LintReport is the outcome of lintCatalog. Issues only lists the checks
+// that found something.
+type LintReport struct {
+	Books     int         `json:"books"`
+	CheckedAt time.Time   `json:"checkedAt"`
+	Issues    []LintIssue `json:"issues"`
+}
+
+// An edition looks like an ISBN when it is made of 10 or 13 digits (the
+// last of an ISBN-10 may be an X), possibly grouped with hyphens or spaces.
+var isbnLikePattern = regexp.MustCompile(`^[0-9][0-9 -]{8,15}[0-9Xx]$`)
+
+// validISBNChecksum checks the check digit of a normalized ISBN-10 or 13.
+func validISBNChecksum(isbn string) bool {
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			d := int(r - '0')
+			if r == 'X' && i == 9 {
+				d = 10
+			}
+			sum += (10 - i) * d
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, r := range isbn {
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(r-'0')
+		}
+		return sum%10 == 0
+	}
+	return false
+}
+
+// lintCatalog scans every book for data quality problems. files may be nil,
+// which skips the cover checks.
+func lintCatalog(ctx context.Context, coll *mongo.Collection, files fileStore) (LintReport, error) {
+	report := LintReport{CheckedAt: time.Now().UTC(), Issues: []LintIssue{}}
+	found := map[string]*LintIssue{}
+	for _, check := range lintChecks {
+		found[check.name] = &LintIssue{Check: check.name, Description: check.description, Samples: []string{}}
+	}
+	flag := func(check, id string) {
+		issue := found[check]
+		issue.Count++
+		if len(issue.Samples) < lintSamples {
+			issue.Samples = append(issue.Samples, id)
+		}
+	}
+
+	var stored map[string]bool
+	if files != nil {
+		names, err := files.List(ctx, "covers/")
+		if err != nil {
+			return report, err
+		}
+		stored = make(map[string]bool, len(names))
+		for _, name := range names {
+			stored[name] = true
+		}
+	}
+
+	projection := bson.M{"ID": 1, "BookName": 1, "BookAuthor": 1, "BookEdition": 1, "BookPages": 1, "BookYear": 1, "BookCover": 1}
+	cursor, err := coll.Find(ctx, bson.D{}, store.FindOpts(ctx).SetProjection(projection))
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+
+	ids := map[string]int{}
+	usedCovers := map[string]bool{}
+	for cursor.Next(ctx) {
+		var book store.Book
+		if err := cursor.Decode(&book); err != nil {
+			return report, err
+		}
+		report.Books++
+		id := book.ID
+		if id == "" {
+			id = book.MongoID.Hex()
+		}
+		// Counted once per ID, not once per book sharing it
+		ids[book.ID]++
+		if ids[book.ID] == 2 && book.ID != "" {
+			flag("duplicate_id", book.ID)
+		}
+
+		if strings.TrimSpace(book.BookName) == "" {
+			flag("missing_title", id)
+		}
+		if strings.TrimSpace(book.BookAuthor) == "" {
+			flag("missing_author", id)
+		}
+		if store.ValidateBookField("ID", book.ID) != "" {
+			flag("invalid_id", id)
+		}
+		if store.ValidateBookField("BookYear", book.BookYear) != "" {
+			flag("invalid_year", id)
+		}
+		if store.ValidateBookField("BookPages", book.BookPages) != "" {
+			flag("invalid_pages", id)
+		}
+		if isbnLikePattern.MatchString(strings.TrimSpace(book.BookEdition)) {
+			if isbn := normalizeISBN(book.BookEdition); isbn == "" || !validISBNChecksum(isbn) {
+				flag("invalid_isbn", id)
+			}
+		}
+		if name, ok := strings.CutPrefix(book.BookCover, filesPrefix); ok && stored != nil {
+			usedCovers[name] = true
+			for _, variant := range coverVariants(name) {
+				usedCovers[variant] = true
+			}
+			if !stored[name] {
+				flag("missing_cover", id)
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return report, err
+	}
+	orphans := []string{}
+	for name := range stored {
+		if !usedCovers[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	slices.Sort(orphans)
+	for _, name := range orphans {
+		flag("orphaned_cover", name)
+	}
+
+	for _, check := range lintChecks {
+		if issue := found[check.name]; issue.Count > 0 {
+			report.Issues = append(report.Issues, *issue)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Reading lists are named lists of books put together by the users who log
+// in (see auth.go), each seeing only their own under /api/lists. A list is
+// shared through the unguessable token in its public URL, /lists/:token,
+// which anyone can read; sharing again gives a new token, so the old link
+// stops working.
+const readingListsCollection = "reading_lists"
+
+const (
+	maxListBooks      = 500
+	maxListNameLength = 200
+)
+
+// ReadingList is a list of books, by ID, in the order chosen by its owner.
+type ReadingList struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Owner       string             `bson:"owner" json:"-"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Books       []string           `bson:"books" json:"books"`
+	Token       string             `bson:"token" json:"-"`
+	// The public URL, from Token
+	ShareURL  string     `bson:"-" json:"shareUrl"`
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// SharedList is what the public URL of a list shows: no owner or token,
+// and the books themselves. Books deleted since they were added are left
+// out.
+type SharedList struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Books       []store.Book `json:"books"`
+}
+
+// listInput is the body of POST /api/lists and PUT /api/lists/:id.
+type listInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Books       []string `json:"books"`
+}
+
+type readingLists struct {
+	lists *mongo.Collection
+	books *mongo.Collection
+}
+
+func newReadingLists(books *mongo.Collection) *readingLists {
+	return &readingLists{
+		lists: books.Database().Collection(readingListsCollection),
+		books: books,
+	}
+}
+
+// validate checks the input and returns what is wrong with it by field,
+// unknown books included.
+func (l *readingLists) validate(ctx context.Context, in *listInput) (store.FieldErrors, error) {
+	errs := store.FieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	switch {
+	case in.Name == "":
+		errs["name"] = "Name is required"
+	case len(in.Name) > maxListNameLength:
+		errs["name"] = "Name is too long"
+	}
+	// A book is listed once, where it was first put
+	books := []string{}
+	for _, id := range in.Books {
+		if id = strings.TrimSpace(id); id != "" && !slices.Contains(books, id) {
+			books = append(books, id)
+		}
+	}
+	in.Books = books
+	if len(in.Books) > maxListBooks {
+		errs["books"] = fmt.Sprintf("A list can't have more than %d books", maxListBooks)
+		return errs, nil
+	}
+	var found []string
+	if len(in.Books) > 0 {
+		cursor, err := l.books.Find(ctx, bson.M{"ID": bson.M{"$in": in.Books}},
+			store.FindOpts(ctx).SetProjection(bson.M{"ID": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var books []store.Book
+		if err := cursor.All(ctx, &books); err != nil {
+			return nil, err
+		}
+		for _, b := range books {
+			found = append(found, b.ID)
+		}
+	}
+	var unknown []string
+	for _, id := range in.Books {
+		if !slices.Contains(found, id) {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		errs["books"] = "Unknown books: " + strings.Join(unknown, ", ")
+	}
+	return errs, nil
+}
+
+// shared resolves the books of the list with the given token.
+func (l *readingLists) shared(ctx context.Context, token string) (SharedList, error) {
+	var list ReadingList
+	err := l.lists.FindOne(ctx, bson.M{"token": token}, store.FindOneOpts(ctx)).Decode(&list)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return SharedList{}, store.ErrNotFound
+	}
+	if err != nil {
+		return SharedList{}, err
+	}
+	shared := SharedList{Name: list.Name, Description: list.Description, Books: []store.Book{}}
+	if len(list.Books) == 0 {
+		return shared, nil
+	}
+	books, err := store.NewBooks(l.books).Find(ctx, bson.M{"ID": bson.M{"$in": list.Books}})
+	if err != nil {
+		return SharedList{}, err
+	}
+	for _, id := range list.Books {
+		if i := slices.IndexFunc(books, func(b store.Book) bool { return b.ID == id }); i >= 0 {
+			shared.Books = append(shared.Books, books[i])
+		}
+	}
+	return shared, nil
+}
+
+func shareURL(c echo.Context, token string) string {
+	return handlers.BaseURL(c) + "/lists/" + token
+}
+
+// registerListRoutes mounts the public views of the shared lists on e, and
+// the management of the lists under /api/lists, behind auth. Without auth,
+// no one can log in to manage lists, only the shared ones are served.
+func registerListRoutes(e *echo.Echo, auth echo.MiddlewareFunc, l *readingLists, links *urlSigner) {
+	sharedList := func(c echo.Context) (SharedList, bool, error) {
+		list, err := l.shared(c.Request().Context(), c.Param("token"))
+		if errors.Is(err, store.ErrNotFound) {
+			return list, false, handlers.JSONError(c, http.StatusNotFound, "List not found")
+		}
+		if err != nil {
+			return list, false, handlers.ServerError(c, err, "Database error")
+		}
+		list.Books = links.SignBooks(list.Books)
+		return list, true, nil
+	}
+	e.GET("/lists/:token", func(c echo.Context) error {
+		list, ok, err := sharedList(c)
+		if !ok {
+			return err
+		}
+		return render.Page(c, http.StatusOK, "reading-list", list)
+	})
+	e.GET("/api/lists/shared/:token", func(c echo.Context) error {
+		list, ok, err := sharedList(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	if auth == nil {
+		return
+	}
+	g := e.Group("/api/lists", auth)
+
+	// findList answers 404 itself when the list is unknown, or someone
+	// else's.
+	findList := func(c echo.Context) (ReadingList, bool, error) {
+		var list ReadingList
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return list, false, handlers.JSONError(c, http.StatusNotFound, "List not found")
+		}
+		ctx := c.Request().Context()
+		filter := bson.M{"_id": id, "owner": c.Get(userKey)}
+		err = l.lists.FindOne(ctx, filter, store.FindOneOpts(ctx)).Decode(&list)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return list, false, handlers.JSONError(c, http.StatusNotFound, "List not found")
+		}
+		if err != nil {
+			return list, false, handlers.ServerError(c, err, "Database error")
+		}
+		list.ShareURL = shareURL(c, list.Token)
+		return list, true, nil
+	}
+	// bindList answers 400 itself when the input is invalid.
+	bindList := func(c echo.Context) (listInput, bool, error) {
+		var in listInput
+		if err := c.Bind(&in); err != nil {
+			return in, false, handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		errs, err := l.validate(c.Request().Context(), &in)
+		if err != nil {
+			return in, false, handlers.ServerError(c, err, "Database error")
+		}
+		if len(errs) > 0 {
+			body := handlers.ErrorBody(c, "Invalid list")
+			body["fields"] = errs
+			return in, false, c.JSON(http.StatusBadRequest, body)
+		}
+		return in, true, nil
+	}
+
+	g.GET("", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		cursor, err := l.lists.Find(ctx, bson.M{"owner": c.Get(userKey)}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		lists := []ReadingList{}
+		if err := cursor.All(ctx, &lists); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		for i := range lists {
+			lists[i].ShareURL = shareURL(c, lists[i].Token)
+		}
+		return c.JSON(http.StatusOK, lists)
+	})
+
+	g.POST("", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		in, ok, err := bindList(c)
+		if !ok {
+			return err
+		}
+		list := ReadingList{
+			Owner:       c.Get(userKey).(string),
+			Name:        in.Name,
+			Description: strings.TrimSpace(in.Description),
+			Books:       in.Books,
+			Token:       newToken(),
+			CreatedAt:   time.Now().UTC(),
+		}
+		res, err := l.lists.InsertOne(ctx, list, store.InsertOneOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not save list")
+		}
+		list.ID = res.InsertedID.(primitive.ObjectID)
+		list.ShareURL = shareURL(c, list.Token)
+		return c.JSON(http.StatusCreated, list)
+	})
+
+	g.GET("/:id", func(c echo.Context) error {
+		list, ok, err := findList(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	// PUT /api/lists/:id replaces the name, description and books.
+	g.PUT("/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		list, ok, err := findList(c)
+		if !ok {
+			return err
+		}
+		in, ok, err := bindList(c)
+		if !ok {
+			return err
+		}
+		now := time.Now().UTC()
+		list.Name, list.Description, list.Books, list.UpdatedAt = in.Name, strings.TrimSpace(in.Description), in.Books, &now
+		set := bson.M{"name": list.Name, "description": list.Description, "books": list.Books, "updatedAt": now}
+		if _, err := l.lists.UpdateByID(ctx, list.ID, bson.M{"$set": set}, store.UpdateOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Could not save list")
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	// POST /api/lists/:id/share gives the list a new public URL; the
+	// previous one stops working.
+	g.POST("/:id/share", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		list, ok, err := findList(c)
+		if !ok {
+			return err
+		}
+		list.Token = newToken()
+		if _, err := l.lists.UpdateByID(ctx, list.ID, bson.M{"$set": bson.M{"token": list.Token}}, store.UpdateOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Could not save list")
+		}
+		list.ShareURL = shareURL(c, list.Token)
+		return c.JSON(http.StatusOK, list)
+	})
+
+	g.DELETE("/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		list, ok, err := findList(c)
+		if !ok {
+			return err
+		}
+		if _, err := l.lists.DeleteOne(ctx, bson.M{"_id": list.ID}, store.DeleteOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// newLogger creates the JSON logger used across the application. The level
+// is one of debug, info, warn or error (info if empty or unknown).
+func newLogger(level string) *slog.Logger {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: parseLogLevel(level)})
+	return slog.New(contextHandler{handler}).With("version", buildInfo.Version)
+}
+
+func parseLogLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// mongoMonitor logs every command sent to MongoDB together with how long it
+// took. Successful commands are logged at debug level, failures as warnings.
+func mongoMonitor(logger *slog.Logger) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			logger.LogAttrs(ctx, slog.LevelDebug, "mongo command",
+				slog.String("command", e.CommandName),
+				slog.String("database", e.DatabaseName),
+				slog.Duration("duration", e.Duration),
+			)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			logger.LogAttrs(ctx, slog.LevelWarn, "mongo command failed",
+				slog.String("command", e.CommandName),
+				slog.String("database", e.DatabaseName),
+				slog.Duration("duration", e.Duration),
+				slog.String("error", e.Failure),
+			)
+		},
+	}
+}
+
+// logFatal logs the error and terminates the program, like log.Fatal.
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+// LookupCandidate is a book found by GET /api/lookup, with the fields named
+// like in the books API so the create form can be filled in from it.
+type LookupCandidate struct {
+	Title    string   `json:"title"`
+	Author   string   `json:"author"`
+	Edition  string   `json:"edition,omitempty"`
+	Pages    string   `json:"pages,omitempty"`
+	Year     string   `json:"year,omitempty"`
+	Cover    string   `json:"cover,omitempty"`
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// The providers answer with dozens of books, a handful is enough to pick
+// from.
+const lookupLimit = 10
+
+// bookLookup finds the books with an ISBN, or else matching a title and an
+// author (either may be empty). Google Books (googlebooks.go), OpenLibrary
+// (metadata.go) and the SRU server of a library (sru.go) implement it.
+type bookLookup interface {
+	Lookup(ctx context.Context, isbn, title, author string) ([]LookupCandidate, error)
+}
+
+// newBookLookups returns the lookups by name: google and openlibrary, and
+// sru when METADATA_SRU_URL is set.
+func newBookLookups(cfg config.MetadataConfig) map[string]bookLookup {
+	lookups := map[string]bookLookup{
+		"google":      newGoogleBooks(cfg.GoogleBooksURL, cfg.GoogleBooksKey),
+		"openlibrary": newOpenLibrary(cfg.OpenLibraryURL, cfg.Interval),
+	}
+	if cfg.SRUURL != "" {
+		lookups["sru"] = newSRU(cfg.SRUURL, cfg.Interval)
+	}
+	return lookups
+}
+
+// lookupHandler answers ?isbn= (or ?title=&author=) with the books found
+// by the lookup named by ?provider=, fallback by default.
+func lookupHandler(lookups map[string]bookLookup, fallback string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		name := c.QueryParam("provider")
+		if name == "" {
+			name = fallback
+		}
+		lookup, ok := lookups[name]
+		if !ok {
+			return handlers.JSONError(c, http.StatusBadRequest, "Unknown provider "+name)
+		}
+		isbn := c.QueryParam("isbn")
+		title := strings.TrimSpace(c.QueryParam("title"))
+		author := strings.TrimSpace(c.QueryParam("author"))
+		if isbn != "" {
+			if isbn = normalizeISBN(isbn); isbn == "" {
+				return handlers.JSONError(c, http.StatusBadRequest, "Invalid ISBN")
+			}
+		} else if title == "" && author == "" {
+			return handlers.JSONError(c, http.StatusBadRequest, "Give an isbn, or a title and/or an author")
+		}
+
+		candidates, err := lookup.Lookup(ctx, isbn, title, author)
+		if err != nil {
+			slog.WarnContext(ctx, "book lookup failed", "provider", name, "error", err)
+			return handlers.JSONError(c, http.StatusBadGateway, "Book lookup unavailable")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"candidates": candidates})
+	}
+}
+
+// registerLookupRoutes mounts GET /api/lookup, finding the book on Google
+// Books or OpenLibrary (?provider=openlibrary) so the create form can be
+// filled in instead of typed, and GET /admin/lookup, which searches the
+// catalog of the library behind METADATA_SRU_URL by default. That one is
+// kept to the admins, the servers of libraries not being meant for the
+// traffic of a public site. It tells if that one was mounted.
+func registerLookupRoutes(e *echo.Echo, admin *echo.Group, lookups map[string]bookLookup) bool {
+	public := map[string]bookLookup{}
+	for name, lookup := range lookups {
+		if name != "sru" {
+			public[name] = lookup
+		}
+	}
+	e.GET("/api/lookup", lookupHandler(public, "google"))
+
+	if admin == nil || lookups["sru"] == nil {
+		return false
+	}
+	admin.GET("/lookup", lookupHandler(lookups, "sru"))
+	return true
+}
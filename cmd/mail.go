@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Emails are not sent right away: they are queued in the outbox collection
+// and a background sender delivers them, retrying with a growing delay when
+// the SMTP server fails. Queued emails survive restarts, and with several
+// instances each email is claimed by a single one.
+const mailOutboxCollection = "mail_outbox"
+
+const (
+	maxMailAttempts = 6
+	// How long a claimed email is left to its sender before another
+	// instance may try it
+	mailClaimTimeout = 5 * time.Minute
+	mailPollInterval = 30 * time.Second
+)
+
+// outboxMail is a queued email.
+type outboxMail struct {
+	MongoID       primitive.ObjectID `bson:"_id,omitempty"`
+	To            string             `bson:"to"`
+	Subject       string             `bson:"subject"`
+	Body          string             `bson:"body"`
+	CreatedAt     time.Time          `bson:"createdAt"`
+	Attempts      int                `bson:"attempts"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt"`
+	SentAt        *time.Time         `bson:"sentAt,omitempty"`
+	LastError     string             `bson:"lastError,omitempty"`
+}
+
+// mailer renders the templates of views/mail.txt and queues the result.
+type mailer struct {
+	cfg    config.MailConfig
+	outbox *mongo.Collection
+	tmpl   *template.Template
+}
+
+func newMailer(cfg config.MailConfig, db *mongo.Database) *mailer {
+	funcs := template.FuncMap{"pathEscape": url.PathEscape}
+	return &mailer{
+		cfg:    cfg,
+		outbox: db.Collection(mailOutboxCollection),
+		tmpl:   template.Must(template.New("mail").Funcs(funcs).ParseFiles("views/mail.txt")),
+	}
+}
+
+// Enqueue renders the template name with data and queues the email for to.
+func (m *mailer) Enqueue(ctx context.Context, to, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := m.tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	subject, body, ok := strings.Cut(buf.String(), "\n\n")
+	if !ok {
+		return fmt.Errorf("mail template %s has no subject line", name)
+	}
+	now := time.Now().UTC()
+	_, err := m.outbox.InsertOne(ctx, outboxMail{
+		To:            to,
+		Subject:       strings.TrimSpace(subject),
+		Body:          strings.TrimSpace(body) + "\n",
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}, store.InsertOneOpts(ctx))
+	return err
+}
+
+// RunSender delivers queued emails until ctx is cancelled.
+func (m *mailer) RunSender(ctx context.Context) {
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+	for {
+		for m.sendNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendNext claims and sends one due email, and tells if there was one.
+func (m *mailer) sendNext(ctx context.Context) bool {
+	now := time.Now().UTC()
+	var mail outboxMail
+	err := m.outbox.FindOneAndUpdate(ctx,
+		bson.M{
+			"sentAt":        bson.M{"$exists": false},
+			"attempts":      bson.M{"$lt": maxMailAttempts},
+			"nextAttemptAt": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(mailClaimTimeout)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After),
+	).Decode(&mail)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			slog.Warn("could not read the mail outbox", "error", err)
+		}
+		return false
+	}
+
+	update := bson.M{"$set": bson.M{"sentAt": time.Now().UTC()}}
+	if err := m.send(mail); err != nil {
+		// 2, 4, 8... minutes between attempts
+		retry := time.Now().UTC().Add(time.Minute << mail.Attempts)
+		update = bson.M{"$set": bson.M{"nextAttemptAt": retry, "lastError": err.Error()}}
+		if mail.Attempts >= maxMailAttempts {
+			slog.Error("giving up sending email", "to", mail.To, "subject", mail.Subject, "error", err)
+		} else {
+			slog.Warn("could not send email, will retry", "to", mail.To, "attempt", mail.Attempts, "retry_at", retry, "error", err)
+		}
+	}
+	if _, err := m.outbox.UpdateByID(ctx, mail.MongoID, update); err != nil {
+		slog.Warn("could not update the mail outbox", "error", err)
+	}
+	return true
+}
+
+// send delivers the email over SMTP, with STARTTLS when the server offers
+// it (net/smtp refuses to send credentials otherwise).
+func (m *mailer) send(mail outboxMail) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.SMTPHost)
+	}
+	// The envelope takes the bare address of "Name <address>"
+	from, err := netmail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	addr := net.JoinHostPort(m.cfg.SMTPHost, strconv.Itoa(m.cfg.SMTPPort))
+	return smtp.SendMail(addr, auth, from.Address, []string{mail.To}, msg.Bytes())
+}
@@ -2,229 +2,229 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"slices"
+	"strings"
 	"time"
-	"os"
 
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/server"
+	"github.com/CAPS-Cloud/exercises/internal/store"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
-// Defines a "model" that we can use to communicate with the
-// frontend or the database
-// More on these "tags" like `bson:"_id,omitempty"`: https://go.dev/wiki/Well-known-struct-tags
-// BookStore represents a book record in MongoDB and in JSON API responses.
-type BookStore struct {
-	MongoID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
-	ID          string             `bson:"ID" form:"ID" json:"id"`
-	BookName    string             `bson:"BookName" form:"BookName" json:"title"`
-	BookAuthor  string             `bson:"BookAuthor" form:"BookAuthor" json:"author"`
-	BookEdition string             `bson:"BookEdition,omitempty" form:"BookEdition" json:"edition,omitempty"`
-	BookPages   string             `bson:"BookPages,omitempty" form:"BookPages" json:"pages,omitempty"`
-	BookYear    string             `bson:"BookYear,omitempty" form:"BookYear" json:"year,omitempty"`
-}
-
-// Wraps the "Template" struct to associate a necessary method
-// to determine the rendering procedure
-type Template struct {
-	tmpl *template.Template
-}
-
-// Preload the available templates for the view folder.
-// This builds a local "database" of all available "blocks"
-// to render upon request, i.e., replace the respective
-// variable or expression.
-// For more on templating, visit https://jinja.palletsprojects.com/en/3.0.x/templates/
-// to get to know more about templating
-// You can also read Golang's documentation on their templating
-// https://pkg.go.dev/text/template
-func loadTemplates() *Template {
-	return &Template{
-		tmpl: template.Must(template.ParseGlob("views/*.html")),
+// runServe connects to the database and serves the website and the API
+// until the process is stopped. It is the default command.
+func runServe(cfg config.Config, logger *slog.Logger, args []string) error {
+	// Traces are exported via OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
 	}
-}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	}()
 
-// Method definition of the required "Render" to be passed for the Rendering
-// engine.
-// Contraire to method declaration, such syntax defines methods for a given
-// struct. "Interfaces" and "structs" can have methods associated with it.
-// The difference lies that interfaces declare methods whether struct only
-// implement them, i.e., only define them. Such differentiation is important
-// for a compiler to ensure types provide implementations of such methods.
-func (t *Template) Render(w io.Writer, name string, data interface{}, ctx echo.Context) error {
-	return t.tmpl.ExecuteTemplate(w, name, data)
-}
+	// Errors and panics are reported to Sentry when a DSN is configured
+	trackErrors, flushErrors, err := setupErrorTracking(cfg.ErrorTracking)
+	if err != nil {
+		return fmt.Errorf("failed to set up error tracking: %w", err)
+	}
+	defer flushErrors()
 
-// Here we make sure the connection to the database is correct and initial
-// configurations exists. Otherwise, we create the proper database and collection
-// we will store the data.
-// To ensure correct management of the collection, we create a return a
-// reference to the collection to always be used. Make sure if you create other
-// files, that you pass the proper value to ensure communication with the
-// database
-// More on what bson means: https://www.mongodb.com/docs/drivers/go/current/fundamentals/bson/
-func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*mongo.Collection, error) {
-	db := client.Database(dbName)
-
-	names, err := db.ListCollectionNames(context.TODO(), bson.D{{}})
+	client, coll, err := connectDatabase(cfg, logger)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !slices.Contains(names, collecName) {
-		cmd := bson.D{{"create", collecName}}
-		var result bson.M
-		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
-			log.Fatal(err)
-			return nil, err
+	defer disconnectDatabase(client)
+
+	// The demo catalog in demo mode (see demo.go). A mirror gets its books
+	// from the deployment it mirrors.
+	if !cfg.Features.ReadOnly {
+		seeded, err := seedCatalog(context.Background(), store.NewBooks(coll), cfg.Features.Demo)
+		if err != nil {
+			return fmt.Errorf("failed to seed the database: %w", err)
 		}
+		slog.Info("seeded example books", "inserted", seeded.Inserted, "existing", seeded.Existing)
 	}
 
-	coll := db.Collection(collecName)
-	return coll, nil
-}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	e, closeServer, err := newServer(ctx, cfg, logger, coll, trackErrors)
+	if err != nil {
+		return err
+	}
+	defer closeServer()
 
-// Here we prepare some fictional data and we insert it into the database
-// the first time we connect to it. Otherwise, we check if it already exists.
-func prepareData(client *mongo.Client, coll *mongo.Collection) {
-	startData := []BookStore{
-		{
-			ID:          "example1",
-			BookName:    "The Vortex",
-			BookAuthor:  "José Eustasio Rivera",
-			BookEdition: "958-30-0804-4",
-			BookPages:   "292",
-			BookYear:    "1924",
-		},
-		{
-			ID:          "example2",
-			BookName:    "Frankenstein",
-			BookAuthor:  "Mary Shelley",
-			BookEdition: "978-3-649-64609-9",
-			BookPages:   "280",
-			BookYear:    "1818",
-		},
-		{
-			ID:          "example3",
-			BookName:    "The Black Cat",
-			BookAuthor:  "Edgar Allan Poe",
-			BookEdition: "978-3-99168-238-7",
-			BookPages:   "280",
-			BookYear:    "1843",
-		},
+	// We start the server and bind it to port 3030 by default. For future references, this
+	// is the application's port and not the external one. For this first exercise,
+	// they could be the same if you use a Cloud Provider. If you use ngrok or similar,
+	// they might differ.
+	// In the submission website for this exercise, you will have to provide the internet-reachable
+	// endpoint: http://<host>:<external-port>
+	// Set TLS_CERT_FILE and TLS_KEY_FILE, or TLS_AUTOCERT_HOSTS, to serve
+	// HTTPS instead (see server/tls.go), and SERVER_ADDRESS to a Unix socket
+	// or to "systemd" to run behind a reverse proxy (see server/listen.go).
+	slog.Info("starting server", "address", cfg.Server.Address)
+	if err := server.Start(e, cfg.Server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server stopped: %w", err)
 	}
+	return nil
+}
 
-	// This syntax helps us iterate over arrays. It behaves similar to Python
-	// However, range always returns a tuple: (idx, elem). You can ignore the idx
-	// by using _.
-	// In the topic of function returns: sadly, there is no standard on return types from function. Most functions
-	// return a tuple with (res, err), but this is not granted. Some functions
-	// might return a ret value that includes res and the err, others might have
-	// an out parameter.
-	for _, book := range startData {
-		cursor, err := coll.Find(context.TODO(), book)
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			panic(err)
-		}
-		if len(results) > 1 {
-			log.Fatal("more records were found")
-		} else if len(results) == 0 {
-			result, err := coll.InsertOne(context.TODO(), book)
-			if err != nil {
-				panic(err)
-			} else {
-				fmt.Printf("%+v\n", result)
-			}
-
-		} else {
-			for _, res := range results {
-				cursor.Decode(&res)
-				fmt.Printf("%+v\n", res)
-			}
+// newServer composes the website and the API over the books of coll: every
+// middleware and route, and the jobs running in the background until ctx is
+// done. The func returned releases the connections it opened, once the
+// server stopped.
+func newServer(ctx context.Context, cfg config.Config, logger *slog.Logger, coll *mongo.Collection, trackErrors bool) (_ *echo.Echo, _ func(), err error) {
+	var closers []func() error
+	closeAll := func() {
+		for _, c := range slices.Backward(closers) {
+			c()
 		}
 	}
-}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	repo := store.NewBooks(coll)
+	// The reads and writes of the pages and the API fail fast while MongoDB
+	// is down, instead of waiting for the driver (see breaker.go), and the
+	// idempotent ones are retried on transient errors (see retry.go)
+	guarded := guardedBooks{retryingBooks{repo, newRetrier(cfg.Database)}, newCircuitBreaker(cfg.Database)}
 
-// Generic method to perform "SELECT * FROM BOOKS" (if this was SQL, which
-// it is not :D ), and then we convert it into an array of map. In Golang, you
-// define a map by writing map[<key type>]<value type>{<key>:<value>}.
-// interface{} is a special type in Golang, basically a wildcard...
-// findAllBooks retrieves all books from the collection.
-func findAllBooks(coll *mongo.Collection) []BookStore {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+	// Changes are refused on a mirror, or once an admin says so (see
+	// readonly.go)
+	readOnly := newReadOnlyMode(cfg.Features.ReadOnly)
+
+	// Cache and rate limit counters are kept in Redis when REDIS_URL is set,
+	// so they are shared by all instances (see shared.go)
+	shared, err := newSharedStore(cfg.Redis)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+	if shared != nil {
+		closers = append(closers, shared.Close)
 	}
-	return results
-}
 
-func main() {
-	// Connect to the database. Such defer keywords are used once the local
-	// context returns; for this case, the local context is the main function
-	// By user defer function, we make sure we don't leave connections
-	// dangling despite the program crashing. Isn't this nice? :D
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// The full-collection reads are cached for a short while and dropped on
+	// every write (see cache.go)
+	catalog := newTTLCache(cfg.Cache.TTL, shared)
 
-	// TODO: make sure to pass the proper username, password, and port
-	uri := os.Getenv("DATABASE_URI")
-	if len(uri) == 0 {
-		fmt.Printf("failure to load env variable\n")
-		os.Exit(1)
+	// Changes to the collection, from this instance or any other, drop the
+	// cache, are sent to the webhooks and are published as events when
+	// EVENTS_BACKEND is set (see changes.go, webhooks.go and events.go)
+	feed := newChangeFeed(coll)
+	if cfg.Cache.TTL > 0 {
+		feed.Subscribe(func(context.Context, bookChange) { catalog.invalidate() })
 	}
-
-	// TODO: make sure to pass the proper username, password, and port
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	publisher, err := newEventPublisher(cfg.Events)
 	if err != nil {
-		fmt.Printf("failed to create client for MongoDB\n")
-		os.Exit(1)
+		return nil, nil, err
+	}
+	if publisher != nil {
+		closers = append(closers, publisher.Close)
+		feed.Subscribe(publishEvents(publisher))
+	}
+	hooks := newWebhooks(coll.Database())
+	feed.Subscribe(hooks.Queue)
+	audit := newAuditLog(coll.Database())
+	feed.Subscribe(audit.Record)
+	go feed.Run(ctx)
+	go hooks.RunSender(ctx)
+	allBooks := func(ctx context.Context) ([]store.Book, error) {
+		return cached(ctx, catalog, "books", func(ctx context.Context) ([]store.Book, error) {
+			return guarded.All(ctx)
+		})
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
+	assets, err := newAssetStore("css", "/css", cfg.Static)
 	if err != nil {
-		fmt.Printf("failed to connect to MongoDB, please make sure the database is running\n")
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("failed to read static files: %w", err)
 	}
 
-	// This is another way to specify the call of a function. You can define inline
-	// functions (or anonymous functions, similar to the behavior in Python)
-	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
-			panic(err)
-		}
-	}()
-
-	// You can use such name for the database and collection, or come up with
-	// one by yourself!
-	coll, err := prepareDatabase(client, "exercise-2", "information")
-
-	prepareData(client, coll)
+	// Whether the create form offers the lookup in the library catalog,
+	// once its route is mounted
+	libraryLookup := false
+
+	// Here we prepare the server, with our custom renderer
+	e := server.New(render.New("views/*.html", template.FuncMap{
+		"asset":         assets.URL,
+		"coverSize":     coverSizeURL,
+		"readOnly":      readOnly.enabled,
+		"libraryLookup": func() bool { return libraryLookup },
+	}))
+	// The client of a request is the address connected from, or the one
+	// forwarded by a trusted proxy (see server/proxies.go)
+	if err := server.TrustProxies(e, cfg.Server.TrustedProxies); err != nil {
+		return nil, nil, err
+	}
 
-	// Here we prepare the server
-	e := echo.New()
+	// Trace and tag every request with an ID (see server/requestid.go), then
+	// log it. Please have a look at echo's documentation on more middleware
+	e.Use(otelecho.Middleware(serviceName))
+	e.Use(server.RequestID())
+	e.Use(apiActor())
+	e.Use(accessLogger(cfg.AccessLog, logger))
+	e.Use(versionHeader())
+	e.Use(staleWarning())
+
+	// Turn panics into 500s instead of dropping the connection, reporting
+	// them first if error tracking is on
+	e.Use(middleware.Recover())
+	if trackErrors {
+		e.Use(errorTracking()...)
+	}
+	e.Use(rejectWrites(readOnly))
+
+	// Cap request bodies and how long a request may take, so oversized
+	// uploads or slow clients can't exhaust the server (see server/limits.go)
+	server.ApplyLimits(e, cfg.Server)
+	// Clients with an API key have quotas of their own instead of the
+	// rate limit (see apikeys.go)
+	apiKeys := newAPIKeys(coll.Database(), shared)
+	e.Use(apiKeyQuotas(apiKeys.lookup, apiKeys.counters))
+	if cfg.RateLimit.Requests > 0 {
+		counters := shared
+		if counters == nil {
+			counters = newMemoryStore()
+		}
+		e.Use(rateLimit(cfg.RateLimit, counters))
+	}
 
-	// Define our custom renderer
-	e.Renderer = loadTemplates()
+	// HTML and JSON answers compressed with Brotli or gzip (see compress.go)
+	e.Use(compressResponses())
+	// Answers of the API reshaped on demand with ?transform= (see transform.go)
+	e.Use(transformResponses())
 
-	// Log the requests. Please have a look at echo's documentation on more
-	// middleware
-	e.Use(middleware.Logger())
+	// Stylesheets are served with caching headers (see assets.go)
+	e.GET("/css/*", assets.handler)
 
-	e.Static("/css", "css")
+	// Users log in when ADMIN_PASSWORD (and optionally ADMIN_USER), or
+	// AUTH_PROVIDER=ldap, is set (see auth.go). Admins get the dashboard,
+	// everyone their reading lists and notes.
+	accounts, err := newAuthProvider(cfg.Auth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up authentication: %w", err)
+	}
+	var anyUser echo.MiddlewareFunc
+	if accounts != nil {
+		anyUser = requireRole(accounts, anyRole)
+	}
 
 	// Endpoint definition. Here, we divided into two groups: top-level routes
 	// starting with /, which usually serve webpages. For our RESTful endpoints,
@@ -234,140 +234,227 @@ func main() {
 		return c.Render(200, "index", nil)
 	})
 
-	e.GET("/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.Render(200, "book-table", books)
-	})
+	// Links to the stored covers and exports are signed, and expire, when
+	// FILES_SIGNING_KEY is set (see signedurl.go)
+	links := newURLSigner(cfg.Files)
 
-	// AUTHORS view
-	e.GET("/authors", func(c echo.Context) error {
-		cursor, err := coll.Find(context.TODO(), bson.D{})
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-		}
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Cursor error"})
-		}
-
-		authorsMap := make(map[string]bool)
-		var authors []string
-		for _, book := range results {
-			if !authorsMap[book.BookAuthor] {
-				authorsMap[book.BookAuthor] = true
-				authors = append(authors, book.BookAuthor)
-			}
-		}
-		return c.Render(http.StatusOK, "authors", authors)
-	})
-
-	// YEARS view
-	e.GET("/years", func(c echo.Context) error {
-		cursor, err := coll.Find(context.TODO(), bson.D{})
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-		}
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Cursor error"})
-		}
+	// OAI-PMH provider for library aggregators (see oai.go)
+	if cfg.Features.OAIAdminEmail != "" {
+		registerOAIRoutes(e, coll, cfg.Features.OAIAdminEmail)
+	}
 
-		yearsMap := make(map[string]bool)
-		var years []string
-		for _, book := range results {
-			if !yearsMap[book.BookYear] {
-				yearsMap[book.BookYear] = true
-				years = append(years, book.BookYear)
-			}
-		}
-		return c.Render(http.StatusOK, "years", years)
+	e.GET("/robots.txt", func(c echo.Context) error {
+		return c.String(http.StatusOK, buildRobots(handlers.BaseURL(c), cfg.Features))
 	})
 
 	e.GET("/search", func(c echo.Context) error {
 		return c.Render(200, "search-bar", nil)
 	})
 
-	e.GET("/create", func(c echo.Context) error {
-		return c.Render(http.StatusOK, "create-form", nil)
-	})
-
-	// POST /api/books
-	e.POST("/api/books", func(c echo.Context) error {
-		var newBook BookStore
-		if err := c.Bind(&newBook); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
-		}
+	// Search and suggestions come from the backend set by SEARCH_BACKEND
+	// (see searchbackend.go)
+	searcher, err := newSearchBackend(context.Background(), cfg.Search, coll, allBooks)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up search: %w", err)
+	}
+	// One client per upstream, shared by the lookups of the create form
+	// and the metadata enrichment, so its rate limit holds for both
+	lookups := newBookLookups(cfg.Metadata)
+	metadata, err := newMetadataProvider(cfg.Metadata.Provider, lookups)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Check for duplicate
-		filter := bson.M{
-			"ID":          newBook.ID,
-			"BookName":    newBook.BookName,
-			"BookAuthor":  newBook.BookAuthor,
-			"BookEdition": newBook.BookEdition,
-			"BookPages":   newBook.BookPages,
-			"BookYear":    newBook.BookYear,
-		}
-		existing := coll.FindOne(context.TODO(), filter)
-		if existing.Err() == nil {
-			return c.JSON(http.StatusConflict, map[string]string{"error": "Book already exists"})
+	// Uploaded covers and stored exports, in GridFS or S3 depending on
+	// FILES_BACKEND (see files.go)
+	files, err := newFileStore(context.Background(), cfg.Files, coll.Database())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up file storage: %w", err)
+	}
+	registerFileRoutes(e, files, links)
+
+	// Browsing the catalog and the CRUD API of the books (see
+	// internal/handlers). The full-catalog reads go through the cache.
+	bookHandler := handlers.NewBookHandler(guarded, logger, cfg)
+	bookHandler.Books = allBooks
+	bookHandler.Authors = func(ctx context.Context) ([]string, error) {
+		return cached(ctx, catalog, "authors", guarded.Authors)
+	}
+	bookHandler.Years = func(ctx context.Context) ([]store.DecadeGroup, error) {
+		return cached(ctx, catalog, "years", guarded.YearsByDecade)
+	}
+	bookHandler.LastModified = func(ctx context.Context) (time.Time, error) {
+		modified, err := cached(ctx, catalog, "lastModified", func(ctx context.Context) (time.Time, error) {
+			return catalogModified(ctx, guarded.LastModified, audit)
+		})
+		return links.Dated(modified), err
+	}
+	// Filling in the details of a book from its ISBN (see metadata.go)
+	bookHandler.Enrich = func(ctx context.Context, book *store.Book) (bson.M, error) {
+		return enrichBook(ctx, metadata, book)
+	}
+	// Covers stored by content (see covers.go) and fetched from elsewhere
+	// (see remotecovers.go)
+	bookHandler.Covers = bookCovers{repo: guarded, files: files}
+	// A single book in any format of the export command, e.g. bibtex to
+	// cite it from LaTeX. The whole catalog is exported through a job
+	// (see exportjobs.go).
+	bookHandler.Exports = bookExports()
+	bookHandler.Links = links.SignBooks
+	bookHandler.Dated = links.Dated
+	// The book pages, with the books to read next (see similar.go) and
+	// structured data for search engines (see jsonld.go)
+	bookHandler.Similar = func(ctx context.Context, book store.Book) ([]store.SimilarBook, error) {
+		return findSimilarBooks(ctx, guarded, book, similarLimit)
+	}
+	bookHandler.JSONLD = bookJSONLD
+	bookHandler.Notes = anyUser != nil
+	// Search and suggestions from the backend set by SEARCH_BACKEND, with
+	// counts per author and year to narrow it down (see facets.go)
+	bookHandler.Search = searcher
+	bookHandler.Facets = func(ctx context.Context, ids []string) (map[string][]store.FacetCount, error) {
+		return findSearchFacets(ctx, guarded, ids)
+	}
+	// Atom feed of the latest additions (see feed.go), sitemap for search
+	// engines (see sitemap.go) and the printable catalog (see report.go)
+	bookHandler.Feed = func(ctx context.Context, base string) ([]byte, error) {
+		books, err := guarded.Recent(ctx, feedSize)
+		if err != nil {
+			return nil, err
 		}
-
-		_, err := coll.InsertOne(context.TODO(), newBook)
+		return buildAtomFeed(base, books), nil
+	}
+	bookHandler.Sitemap = func(ctx context.Context, base string) ([]byte, error) {
+		return buildSitemap(ctx, guarded, base)
+	}
+	bookHandler.Report = func(ctx context.Context, filter store.ReportFilter) ([]byte, error) {
+		books, err := findBooksForReport(ctx, guarded, filter)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not insert book"})
+			return nil, err
 		}
-		return c.JSON(http.StatusCreated, map[string]string{"status": "Book created"})
-	})
+		return buildCatalogReport(books, filter, time.Now()), nil
+	}
+	// GET /api/stats returns the figures of the admin dashboard, e.g. for
+	// external reporting (see admin.go)
+	bookHandler.Stats = func(ctx context.Context) (store.CatalogStats, error) {
+		return cachedCatalogStats(ctx, catalog, guarded)
+	}
+	bookHandler.Hooks = handlers.Hooks{
+		Invalidate: catalog.invalidate,
+		Index:      searcher,
+		Deleted: func(ctx context.Context, book store.Book) {
+			releaseCovers(ctx, coll, files, book)
+		},
+	}
+	bookHandler.RegisterRoutes(e)
+
+	// The hot entries of the cache are loaded in the background, GET
+	// /readyz answering 503 until they are (see warmup.go)
+	warmLoads := cacheLoads{
+		"books":        cacheLoad(allBooks),
+		"authors":      cacheLoad(bookHandler.Authors),
+		"years":        cacheLoad(bookHandler.Years),
+		"lastModified": cacheLoad(bookHandler.LastModified),
+		"stats":        cacheLoad(bookHandler.Stats),
+	}
+	startupLoads := warmLoads
+	if cfg.Cache.TTL <= 0 {
+		startupLoads = nil
+	}
+	e.GET("/readyz", warmOnStartup(ctx, startupLoads).handler)
 
-	// PUT /api/books/:id
-	e.PUT("/api/books/:id", func(c echo.Context) error {
-		id := c.Param("id")
-		var data map[string]interface{}
-		if err := c.Bind(&data); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid update data"})
-		}
+	// What changed in the catalog, and who changed it (see audit.go)
+	registerActivityRoutes(e, audit)
 
-		// Build BSON update document from allowed JSON fields
-		updateFields := bson.M{}
-		if v, ok := data["title"].(string); ok {
-			updateFields["BookName"] = v
-		}
-		if v, ok := data["author"].(string); ok {
-			updateFields["BookAuthor"] = v
-		}
-		if v, ok := data["edition"].(string); ok {
-			updateFields["BookEdition"] = v
-		}
-		if v, ok := data["pages"].(string); ok {
-			updateFields["BookPages"] = v
-		}
-		if v, ok := data["year"].(string); ok {
-			updateFields["BookYear"] = v
+	// Recurring jobs, e.g. the nightly backup, scheduled in the tasks
+	// section of the config file or with TASKS_* (see tasks.go)
+	sched := newScheduler(ctx, coll.Database(), readOnly)
+	if err := addCatalogTasks(sched, cfg.Tasks, coll, files, hooks, warmLoads); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Features.Demo {
+		if err := sched.Add(demoResetTask(cfg.Tasks.DemoReset, repo, files, catalog, searcher)); err != nil {
+			return nil, nil, err
 		}
-		if len(updateFields) == 0 {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No valid fields to update"})
+	}
+	go sched.Run()
+
+	// ADMIN dashboard. The same credentials guard the /debug endpoints,
+	// which also need DEBUG_ENDPOINTS=true.
+	var admin *echo.Group
+	var adminAuth echo.MiddlewareFunc
+	if accounts != nil {
+		adminAuth = requireRole(accounts, roleAdmin)
+		admin = e.Group("/admin", adminAuth)
+		profiles := newImportProfiles(coll.Database())
+		registerAdminRoutes(admin, coll, guarded, catalog, searcher, files, profiles)
+		registerImportProfileRoutes(admin, profiles)
+		registerReadOnlyRoutes(admin, readOnly)
+		registerWebhookRoutes(admin, hooks)
+		registerAPIKeyRoutes(admin, apiKeys)
+		registerIndexRoutes(admin, coll)
+		registerDedupRoutes(admin, coll, files, catalog, searcher)
+		registerBulkEditRoutes(admin, coll, catalog, searcher)
+		registerTaskRoutes(admin, sched)
+		registerExplainRoutes(admin, coll)
+		if cfg.Features.DebugEndpoints {
+			registerDebugRoutes(e.Group("/debug", adminAuth))
 		}
+	} else {
+		slog.Warn("ADMIN_PASSWORD not set, the admin area is disabled")
+	}
 
-		res, err := coll.UpdateOne(context.TODO(), bson.M{"ID": id}, bson.M{"$set": updateFields})
+	// Anonymous counts of the requests, searches and book views, behind the
+	// Trending page (see analytics.go)
+	usage := newUsageRecorder(coll.Database(), cfg.Features.AnalyticsKey)
+	if cfg.Features.Analytics {
+		e.Use(countUsage(usage))
+		go usage.Run(ctx)
+	}
+	registerUsageRoutes(e, admin, usage, guarded)
+	registerPopularRoutes(e, usage, guarded)
+
+	// Reading lists of the users, shared through a public URL (see
+	// lists.go)
+	lists := newReadingLists(coll)
+	registerListRoutes(e, anyUser, lists, links)
+
+	// Private notes of the users on the books (see notes.go)
+	notes := newBookNotes(coll)
+	registerNoteRoutes(e, anyUser, notes)
+
+	// Everything about the user logged in, as a zip (see takeout.go)
+	registerTakeoutRoutes(e, anyUser, notes, lists)
+
+	// Notification emails, when SMTP_HOST is set (see mail.go and
+	// notifications.go). Emails are queued in MongoDB and sent in the
+	// background.
+	if cfg.Mail.SMTPHost != "" {
+		m := newMailer(cfg.Mail, coll.Database())
+		n := newNotifier(coll, m, strings.TrimSuffix(cfg.Mail.BaseURL, "/"))
+		registerNotificationRoutes(e, admin, n)
+		go m.RunSender(ctx)
+		go n.RunDigests(ctx)
+	}
+
+	// Telegram bot, when TELEGRAM_BOT_TOKEN is set (see telegram.go)
+	if cfg.Telegram.Token != "" {
+		bot, err := newTelegramBot(cfg.Telegram, guarded, readOnly, catalog, searcher)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not update book"})
-		}
-		if res.MatchedCount == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
+			return nil, nil, err
 		}
-		return c.JSON(http.StatusOK, map[string]string{"status": "Book updated"})
-	})
+		go bot.Run(ctx)
+	}
 
-	// DELETE /api/books/:id
-	e.DELETE("/api/books/:id", func(c echo.Context) error {
-		id := c.Param("id")
-		filter := bson.M{"ID": id}
-		res, err := coll.DeleteOne(context.TODO(), filter)
-		if err != nil || res.DeletedCount == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found or already deleted"})
-		}
-		return c.JSON(http.StatusOK, map[string]string{"status": "Book deleted"})
-	})
+	// Side by side comparison, e.g. GET /api/books/compare?ids=a,b (see
+	// compare.go)
+	registerCompareRoutes(e, repo, links)
+
+	// POST /api/isbn/validate checks ISBNs before an import (see isbn.go)
+	registerISBNRoutes(e, allBooks)
+
+	// Finding the book elsewhere, to fill in the create form (see lookup.go)
+	libraryLookup = registerLookupRoutes(e, admin, lookups)
 
 	// You will have to expand on the allowed methods for the path
 	// `/api/route`, following the common standard.
@@ -375,16 +462,17 @@ func main() {
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Methods
 	// It specifies the expected returned codes for each type of request
 	// method.
-	e.GET("/api/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.JSON(http.StatusOK, books)
-	})
+	e.GET("/api/version", versionHandler)
 
-	// We start the server and bind it to port 3030. For future references, this
-	// is the application's port and not the external one. For this first exercise,
-	// they could be the same if you use a Cloud Provider. If you use ngrok or similar,
-	// they might differ.
-	// In the submission website for this exercise, you will have to provide the internet-reachable
-	// endpoint: http://<host>:<external-port>
-	e.Logger.Fatal(e.Start(":3030"))
+	unknownFormat := "Unknown format, expected one of " + strings.Join(exportFormats(), ", ")
+
+	// POST /api/exports?format= queues an export of the whole catalog to
+	// the file storage, for catalogs too large to download in one request,
+	// and GET /api/exports lists them with the links to fetch them from,
+	// for the admins. GET /api/export streams it (see exportjobs.go).
+	exports := newExportJobs(coll, files, cfg.Files.ExportTTL)
+	go exports.Run(ctx)
+	registerExportJobRoutes(e, adminAuth, exports, links, unknownFormat)
+
+	return e, closeAll, nil
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// MARC21 is the record format of library systems, see
+// https://www.loc.gov/marc/bibliographic/. We read and write it in its
+// binary form (ISO 2709, .mrc files, UTF-8 encoded) and as MARCXML. Only
+// the core bibliographic fields are mapped:
+//
+//	001     control number     id
+//	020 $a  ISBN               edition, when it holds an ISBN
+//	250 $a  edition statement  edition, otherwise
+//	100 $a  main entry         author
+//	245 $ab title, subtitle    title
+//	264 $c  publication date   year (260 $c in older records)
+//	300 $a  physical extent    pages, e.g. "320 p."
+//	650 $a  topical subject    subjects
+//	653 $a  uncontrolled term  tags
+type marcRecord struct {
+	XMLName xml.Name        `xml:"record"`
+	Leader  string          `xml:"leader"`
+	Control []marcControl   `xml:"controlfield"`
+	Data    []marcDataField `xml:"datafield"`
+}
+
+type marcControl struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+const marcXMLNamespace = "http://www.loc.gov/MARC21/slim"
+
+// Delimiters of the binary format
+const (
+	marcSubfieldDelimiter = 0x1F
+	marcFieldTerminator   = 0x1E
+	marcRecordTerminator  = 0x1D
+)
+
+// subfield returns the first subfield code of the first field tag.
+func (r marcRecord) subfield(tag, code string) string {
+	for _, f := range r.Data {
+		if f.Tag != tag {
+			continue
+		}
+		for _, s := range f.Subfields {
+			if s.Code == code {
+				return strings.TrimSpace(s.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// subfields returns subfield code of every field tag.
+func (r marcRecord) subfields(tag, code string) []string {
+	var values []string
+	for _, f := range r.Data {
+		if f.Tag != tag {
+			continue
+		}
+		for _, s := range f.Subfields {
+			if s.Code == code {
+				values = append(values, trimISBD(s.Value))
+			}
+		}
+	}
+	return values
+}
+
+// trimISBD removes the punctuation cataloguers end subfields with, e.g.
+// "Shelley, Mary," or "Frankenstein /".
+func trimISBD(s string) string {
+	return strings.TrimRight(strings.TrimSpace(s), " ,/:;=.")
+}
+
+// Dates come as "1818", "c1994." or "[2003?]"
+var (
+	marcNumberPattern = regexp.MustCompile(`[0-9]+`)
+	marcYearPattern   = regexp.MustCompile(`[0-9]{4}`)
+)
+
+func bookFromMARC(r marcRecord) store.Book {
+	book := store.Book{
+		BookAuthor:   trimISBD(r.subfield("100", "a")),
+		BookName:     trimISBD(r.subfield("245", "a")),
+		BookPages:    marcNumberPattern.FindString(r.subfield("300", "a")),
+		BookSubjects: r.subfields("650", "a"),
+		BookTags:     r.subfields("653", "a"),
+	}
+	for _, c := range r.Control {
+		if c.Tag == "001" {
+			book.ID = strings.TrimSpace(c.Value)
+		}
+	}
+	if subtitle := trimISBD(r.subfield("245", "b")); subtitle != "" {
+		book.BookName += ": " + subtitle
+	}
+
+	// 020 $a may be followed by a qualifier, e.g. "0486282112 (pbk.)"
+	isbn, _, _ := strings.Cut(r.subfield("020", "a"), " ")
+	if isbn = normalizeISBN(isbn); isbn != "" {
+		book.BookEdition = isbn
+	} else {
+		book.BookEdition = trimISBD(r.subfield("250", "a"))
+	}
+	date := r.subfield("264", "c")
+	if date == "" {
+		date = r.subfield("260", "c")
+	}
+	book.BookYear = marcYearPattern.FindString(date)
+	return book
+}
+
+func bookToMARC(b store.Book) marcRecord {
+	field := func(tag, ind1, ind2 string, subfields ...string) marcDataField {
+		f := marcDataField{Tag: tag, Ind1: ind1, Ind2: ind2}
+		for i := 0; i+1 < len(subfields); i += 2 {
+			f.Subfields = append(f.Subfields, marcSubfield{Code: subfields[i], Value: subfields[i+1]})
+		}
+		return f
+	}
+
+	// Language material, monograph, UTF-8. Lengths and addresses are
+	// filled in by the binary encoder.
+	r := marcRecord{Leader: "00000nam a2200000 i 4500"}
+	r.Control = append(r.Control, marcControl{Tag: "001", Value: b.ID})
+	if isbn := normalizeISBN(b.BookEdition); isbn != "" {
+		r.Data = append(r.Data, field("020", " ", " ", "a", isbn))
+	}
+	r.Data = append(r.Data, field("100", "1", " ", "a", b.BookAuthor))
+	r.Data = append(r.Data, field("245", "1", "0", "a", b.BookName))
+	if b.BookEdition != "" && normalizeISBN(b.BookEdition) == "" {
+		r.Data = append(r.Data, field("250", " ", " ", "a", b.BookEdition))
+	}
+	if b.BookYear != "" {
+		r.Data = append(r.Data, field("264", " ", "1", "c", b.BookYear))
+	}
+	if b.BookPages != "" {
+		r.Data = append(r.Data, field("300", " ", " ", "a", b.BookPages+" pages"))
+	}
+	for _, s := range b.BookSubjects {
+		r.Data = append(r.Data, field("650", " ", "4", "a", s))
+	}
+	for _, t := range b.BookTags {
+		r.Data = append(r.Data, field("653", " ", " ", "a", t))
+	}
+	return r
+}
+
+// encodeMARC writes r in the binary format: a 24 byte leader, a directory
+// with the tag, length and offset of every field, then the fields.
+func encodeMARC(r marcRecord) ([]byte, error) {
+	var directory, fields bytes.Buffer
+	add := func(tag string, data []byte) {
+		data = append(data, marcFieldTerminator)
+		fmt.Fprintf(&directory, "%s%04d%05d", tag, len(data), fields.Len())
+		fields.Write(data)
+	}
+	for _, c := range r.Control {
+		add(c.Tag, []byte(c.Value))
+	}
+	for _, f := range r.Data {
+		data := []byte(marcIndicator(f.Ind1) + marcIndicator(f.Ind2))
+		for _, s := range f.Subfields {
+			data = append(data, marcSubfieldDelimiter)
+			data = append(data, s.Code...)
+			data = append(data, s.Value...)
+		}
+		add(f.Tag, data)
+	}
+	directory.WriteByte(marcFieldTerminator)
+
+	base := 24 + directory.Len()
+	length := base + fields.Len() + 1
+	if length > 99999 {
+		return nil, fmt.Errorf("record %s is too long for MARC21", r.Control[0].Value)
+	}
+	leader := []byte(r.Leader)
+	if len(leader) != 24 {
+		leader = []byte("00000nam a2200000 i 4500")
+	}
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+
+	out := make([]byte, 0, length)
+	out = append(out, leader...)
+	out = append(out, directory.Bytes()...)
+	out = append(out, fields.Bytes()...)
+	return append(out, marcRecordTerminator), nil
+}
+
+func marcIndicator(ind string) string {
+	if ind == "" {
+		return " "
+	}
+	return ind[:1]
+}
+
+// marcReader reads binary records one by one.
+type marcReader struct {
+	r *bufio.Reader
+}
+
+// Next returns io.EOF when there are no more records.
+func (m *marcReader) Next() (marcRecord, error) {
+	// Files often end with a newline after the last record
+	for {
+		b, err := m.r.ReadByte()
+		if err != nil {
+			return marcRecord{}, err
+		}
+		if b != '\n' && b != '\r' {
+			m.r.UnreadByte()
+			break
+		}
+	}
+
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(m.r, head); err != nil {
+		return marcRecord{}, errors.New("truncated MARC record")
+	}
+	length, err := strconv.Atoi(string(head))
+	if err != nil || length < 25 {
+		return marcRecord{}, fmt.Errorf("invalid MARC record length %q", head)
+	}
+	record := make([]byte, length)
+	copy(record, head)
+	if _, err := io.ReadFull(m.r, record[5:]); err != nil {
+		return marcRecord{}, errors.New("truncated MARC record")
+	}
+	return decodeMARC(record)
+}
+
+func decodeMARC(record []byte) (marcRecord, error) {
+	var r marcRecord
+	if len(record) < 25 || record[len(record)-1] != marcRecordTerminator {
+		return r, errors.New("MARC record without terminator")
+	}
+	r.Leader = string(record[:24])
+	base, err := strconv.Atoi(string(record[12:17]))
+	if err != nil || base < 25 || base > len(record) {
+		return r, fmt.Errorf("invalid MARC base address %q", record[12:17])
+	}
+
+	directory := record[24 : base-1]
+	for len(directory) >= 12 {
+		entry := directory[:12]
+		directory = directory[12:]
+		tag := string(entry[:3])
+		length, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil || start < 0 || length <= 0 || base+start+length > len(record) {
+			return r, fmt.Errorf("invalid MARC directory entry %q", entry)
+		}
+		data := bytes.TrimSuffix(record[base+start:base+start+length], []byte{marcFieldTerminator})
+
+		// Fields 001 to 009 hold plain data, the others indicators and
+		// subfields
+		if strings.HasPrefix(tag, "00") {
+			r.Control = append(r.Control, marcControl{Tag: tag, Value: string(data)})
+			continue
+		}
+		f := marcDataField{Tag: tag, Ind1: " ", Ind2: " "}
+		if len(data) >= 2 {
+			f.Ind1, f.Ind2 = string(data[0]), string(data[1])
+			data = data[2:]
+		}
+		for _, sub := range bytes.Split(data, []byte{marcSubfieldDelimiter}) {
+			if len(sub) == 0 {
+				continue
+			}
+			f.Subfields = append(f.Subfields, marcSubfield{Code: string(sub[0]), Value: string(sub[1:])})
+		}
+		r.Data = append(r.Data, f)
+	}
+	return r, nil
+}
+
+// readMARCXML calls fn for every record of a MARCXML collection (or a
+// lone record), streaming so large files don't need to fit in memory.
+func readMARCXML(r io.Reader, fn func(marcRecord) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+		var record marcRecord
+		if err := dec.DecodeElement(&record, &start); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+func TestMARCRoundTrip(t *testing.T) {
+	books := []store.Book{
+		{
+			ID:           "frankenstein",
+			BookName:     "Frankenstein",
+			BookAuthor:   "Mary Shelley",
+			BookEdition:  "9780486282114",
+			BookPages:    "166",
+			BookYear:     "1818",
+			BookSubjects: []string{"Monsters", "Scientists"},
+			BookTags:     []string{"horror"},
+		},
+		{ID: "dracula", BookName: "Dracula", BookAuthor: "Bram Stoker", BookEdition: "First edition"},
+		{ID: "unicode", BookName: "Les Misérables", BookAuthor: "Victor Hugo"},
+	}
+	var file bytes.Buffer
+	for _, b := range books {
+		data, err := encodeMARC(bookToMARC(b))
+		if err != nil {
+			t.Fatalf("%s: %v", b.ID, err)
+		}
+		file.Write(data)
+		file.WriteString("\n")
+	}
+
+	reader := &marcReader{r: bufio.NewReader(&file)}
+	for _, want := range books {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", want.ID, err)
+		}
+		if got := bookFromMARC(record); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("after the last record: got %v, want EOF", err)
+	}
+}
+
+func TestBookFromMARCXML(t *testing.T) {
+	const collection = `<?xml version="1.0" encoding="UTF-8"?>
+<collection xmlns="http://www.loc.gov/MARC21/slim">
+  <record>
+    <leader>00000cam a2200000 i 4500</leader>
+    <controlfield tag="001">ocm123</controlfield>
+    <datafield tag="020" ind1=" " ind2=" "><subfield code="a">0-486-28211-2 (pbk.)</subfield></datafield>
+    <datafield tag="100" ind1="1" ind2=" "><subfield code="a">Shelley, Mary Wollstonecraft,</subfield></datafield>
+    <datafield tag="245" ind1="1" ind2="0">
+      <subfield code="a">Frankenstein :</subfield>
+      <subfield code="b">or, The modern Prometheus /</subfield>
+    </datafield>
+    <datafield tag="260" ind1=" " ind2=" "><subfield code="c">c1994.</subfield></datafield>
+    <datafield tag="300" ind1=" " ind2=" "><subfield code="a">xii, 166 p. ;</subfield></datafield>
+    <datafield tag="650" ind1=" " ind2="0"><subfield code="a">Monsters</subfield></datafield>
+    <datafield tag="650" ind1=" " ind2="0"><subfield code="a">Scientists.</subfield></datafield>
+  </record>
+  <record>
+    <controlfield tag="001">no-isbn</controlfield>
+    <datafield tag="020" ind1=" " ind2=" "><subfield code="a">not an isbn</subfield></datafield>
+    <datafield tag="250" ind1=" " ind2=" "><subfield code="a">2nd ed.</subfield></datafield>
+    <datafield tag="245" ind1="0" ind2="0"><subfield code="a">Untitled</subfield></datafield>
+    <datafield tag="264" ind1=" " ind2="1"><subfield code="c">[2003?]</subfield></datafield>
+  </record>
+</collection>`
+	want := []store.Book{
+		{
+			ID:           "ocm123",
+			BookName:     "Frankenstein: or, The modern Prometheus",
+			BookAuthor:   "Shelley, Mary Wollstonecraft",
+			BookEdition:  "0486282112",
+			BookPages:    "166",
+			BookYear:     "1994",
+			BookSubjects: []string{"Monsters", "Scientists"},
+		},
+		{ID: "no-isbn", BookName: "Untitled", BookEdition: "2nd ed", BookYear: "2003"},
+	}
+	var got []store.Book
+	err := readMARCXML(strings.NewReader(collection), func(r marcRecord) error {
+		got = append(got, bookFromMARC(r))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeMARCInvalid(t *testing.T) {
+	valid, err := encodeMARC(bookToMARC(store.Book{ID: "x", BookName: "X", BookAuthor: "Y"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt returns valid with the bytes at offset replaced
+	corrupt := func(offset int, s string) []byte {
+		record := bytes.Clone(valid)
+		copy(record[offset:], s)
+		return record
+	}
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{"empty", nil},
+		{"short", valid[:20]},
+		{"no terminator", valid[:len(valid)-1]},
+		{"base address", corrupt(12, "abcde")},
+		{"base address too large", corrupt(12, "99999")},
+		{"negative field length", corrupt(27, "-001")},
+		{"negative field offset", corrupt(31, "-0001")},
+		{"field past the end", corrupt(27, "9999")},
+	}
+	for _, tt := range tests {
+		if _, err := decodeMARC(tt.record); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	for _, file := range []string{"abcde", "00010", "00100short"} {
+		reader := &marcReader{r: bufio.NewReader(strings.NewReader(file))}
+		if _, err := reader.Next(); err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("%q: got %v, want an error", file, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The notes of the users are written in Markdown, of which renderMarkdown
+// understands the common subset: paragraphs, headings, lists, quotes, code,
+// emphasis and links. The text is escaped as it is rendered, so a note
+// can't bring its own markup, and links must be http(s) or mailto.
+
+var (
+	headingLine   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	bulletLine    = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	orderedLine   = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+	quoteLine     = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	fenceLine     = regexp.MustCompile("^\\s{0,3}```")
+	linkSchemes   = []string{"http", "https", "mailto"}
+	escapableChar = "\\`*_[]()#+-.!>"
+)
+
+// The headings of a note start at h4, below those of the detail page.
+const noteHeadingOffset = 3
+
+func renderMarkdown(src string) template.HTML {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	renderBlocks(&b, lines)
+	return template.HTML(b.String())
+}
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>")
+			b.WriteString(renderInline(strings.Join(para, "\n")))
+			b.WriteString("</p>\n")
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+
+		case fenceLine.MatchString(line):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !fenceLine.MatchString(lines[i]); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>\n")
+
+		case headingLine.MatchString(line):
+			flush()
+			m := headingLine.FindStringSubmatch(line)
+			tag := "h" + strconv.Itoa(min(len(m[1])+noteHeadingOffset, 6))
+			b.WriteString("<" + tag + ">" + renderInline(m[2]) + "</" + tag + ">\n")
+
+		case quoteLine.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && quoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteLine.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case bulletLine.MatchString(line), orderedLine.MatchString(line):
+			flush()
+			item, tag := bulletLine, "ul"
+			if !bulletLine.MatchString(line) {
+				item, tag = orderedLine, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for i < len(lines) && item.MatchString(lines[i]) {
+				text := []string{item.FindStringSubmatch(lines[i])[1]}
+				// Indented lines continue the item
+				for i++; i < len(lines) && strings.HasPrefix(lines[i], "  ") && strings.TrimSpace(lines[i]) != ""; i++ {
+					text = append(text, strings.TrimSpace(lines[i]))
+				}
+				b.WriteString("<li>" + renderInline(strings.Join(text, "\n")) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			para = append(para, strings.TrimSpace(line))
+		}
+	}
+	flush()
+}
+
+// renderInline renders the code spans, links, emphasis and backslash
+// escapes of s, escaping the rest.
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte(escapableChar, rest[1]) >= 0:
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(rest[1:1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '[':
+			if text, href, n, ok := parseLink(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener">` + renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				b.WriteString("<strong>" + renderInline(rest[2:2+end]) + "</strong>")
+				i += end + 4
+				continue
+			}
+
+		case rest[0] == '*' || rest[0] == '_':
+			if end := strings.IndexByte(rest[1:], rest[0]); end > 0 && rest[1] != ' ' {
+				b.WriteString("<em>" + renderInline(rest[1:1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '\n':
+			b.WriteString("<br>\n")
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(rest[:1]))
+		i++
+	}
+	return b.String()
+}
+
+// parseLink reads a [text](href) link at the start of s, returning how
+// many bytes it takes. Links to other schemes than linkSchemes are left as
+// text.
+func parseLink(s string) (text, href string, n int, ok bool) {
+	mid := strings.Index(s, "](")
+	if mid < 0 {
+		return "", "", 0, false
+	}
+	end := strings.IndexByte(s[mid+2:], ')')
+	if end < 0 {
+		return "", "", 0, false
+	}
+	text, href = s[1:mid], strings.TrimSpace(s[mid+2:mid+2+end])
+	u, err := url.Parse(href)
+	if err != nil || text == "" || !slices.Contains(linkSchemes, u.Scheme) {
+		return "", "", 0, false
+	}
+	return text, href, mid + 3 + end, true
+}
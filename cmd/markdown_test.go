@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src  string
+		html string
+	}{
+		{"", ""},
+		{"line1\nline2\n\nnext", "<p>line1<br>\nline2</p>\n<p>next</p>\n"},
+		{"# Title", "<h4>Title</h4>\n"},
+		{"###### Deep ##", "<h6>Deep</h6>\n"},
+		{"**bold** and *em*, __bold__ and _em_", "<p><strong>bold</strong> and <em>em</em>, <strong>bold</strong> and <em>em</em></p>\n"},
+		{"a * b * c", "<p>a * b * c</p>\n"},
+		{`a\*b\_c`, "<p>a*b_c</p>\n"},
+		{"- one\n- two\n  continued", "<ul>\n<li>one</li>\n<li>two<br>\ncontinued</li>\n</ul>\n"},
+		{"1. a\n2) b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"> quote\n> more", "<blockquote>\n<p>quote<br>\nmore</p>\n</blockquote>\n"},
+		{"```\nfunc main() {}\n```", "<pre><code>func main() {}</code></pre>\n"},
+		{"see `x := 1`", "<p>see <code>x := 1</code></p>\n"},
+		{"[a *b*](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">a <em>b</em></a></p>` + "\n"},
+		{"[mail](mailto:a@example.com)", `<p><a href="mailto:a@example.com" rel="nofollow noopener">mail</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.html {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.html)
+		}
+	}
+}
+
+func TestRenderMarkdownEscapes(t *testing.T) {
+	tests := []struct {
+		src  string
+		html string
+	}{
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{`&amp; "q" 'a'`, "<p>&amp;amp; &#34;q&#34; &#39;a&#39;</p>\n"},
+		{"# Title <b>", "<h4>Title &lt;b&gt;</h4>\n"},
+		{"*<i>x</i>*", "<p><em>&lt;i&gt;x&lt;/i&gt;</em></p>\n"},
+		{"`<b>`", "<p><code>&lt;b&gt;</code></p>\n"},
+		{"```\n<img src=x onerror=alert(1)>\n```", "<pre><code>&lt;img src=x onerror=alert(1)&gt;</code></pre>\n"},
+		{"- <b>item</b>", "<ul>\n<li>&lt;b&gt;item&lt;/b&gt;</li>\n</ul>\n"},
+		{"> <iframe>", "<blockquote>\n<p>&lt;iframe&gt;</p>\n</blockquote>\n"},
+		{`\<b>`, "<p>\\&lt;b&gt;</p>\n"},
+		// The URL stays in its attribute
+		{`[x](http://a.b/" onclick="alert(1))`, `<p><a href="http://a.b/&#34; onclick=&#34;alert(1" rel="nofollow noopener">x</a>)</p>` + "\n"},
+		{"[<b>x</b>](https://example.com)", `<p><a href="https://example.com" rel="nofollow noopener">&lt;b&gt;x&lt;/b&gt;</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.html {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.html)
+		}
+	}
+}
+
+func TestRenderMarkdownLinkSchemes(t *testing.T) {
+	for _, href := range []string{
+		"javascript:alert(1)",
+		"JavaScript:alert(1)",
+		" javascript:alert(1)",
+		"jav\tascript:alert(1)",
+		"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==",
+		"DATA:image/svg+xml,<svg onload=alert(1)>",
+		"vbscript:msgbox(1)",
+		"file:///etc/passwd",
+		"//evil.example.com",
+		"/relative",
+	} {
+		got := string(renderMarkdown("[click](" + href + ")"))
+		if strings.Contains(got, "<a") || strings.Contains(got, "href") {
+			t.Errorf("%q: rendered as a link: %q", href, got)
+		}
+	}
+	// Nested in another link
+	if got := string(renderMarkdown("[[x](javascript:alert(1))](https://example.com)")); strings.Contains(got, "javascript:alert(1)\"") || strings.Contains(got, `href="javascript`) {
+		t.Errorf("nested link: %q", got)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/time/rate"
+)
+
+// BookMetadata is what a provider knows about an ISBN. Empty fields are
+// unknown.
+type BookMetadata struct {
+	Pages    string
+	Year     string
+	CoverURL string
+	Subjects []string
+}
+
+// The failures of enrichBook the API answers for (see
+// internal/handlers/enrich.go)
+var (
+	errNoISBN           = handlers.ErrNoISBN
+	errMetadataNotFound = handlers.ErrNoMetadata
+)
+
+// metadataProvider looks up book details by ISBN. METADATA_PROVIDER picks
+// the implementation: OpenLibrary (below), Google Books (googlebooks.go) or
+// the SRU server of a library (sru.go).
+type metadataProvider interface {
+	// LookupISBN returns errMetadataNotFound when the provider doesn't
+	// know the ISBN.
+	LookupISBN(ctx context.Context, isbn string) (BookMetadata, error)
+}
+
+// newMetadataProvider picks the provider among the lookups (see lookup.go),
+// which all implement metadataProvider too, so each upstream has a single
+// client and rate limit for both.
+func newMetadataProvider(name string, lookups map[string]bookLookup) (metadataProvider, error) {
+	if name == "" {
+		name = "openlibrary"
+	}
+	if name == "sru" && lookups["sru"] == nil {
+		return nil, errors.New("the sru metadata provider needs METADATA_SRU_URL")
+	}
+	if provider, ok := lookups[name].(metadataProvider); ok {
+		return provider, nil
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q", name)
+}
+
+// Some books have hundreds of subjects, the first ones are enough.
+const maxSubjects = 10
+
+// enrichBook looks up the ISBN held in the edition of book and fills in
+// the fields that are still empty. It returns the updated fields, by their
+// database name, ready for a $set.
+func enrichBook(ctx context.Context, provider metadataProvider, book *store.Book) (bson.M, error) {
+	isbn := normalizeISBN(book.BookEdition)
+	if isbn == "" {
+		return nil, errNoISBN
+	}
+	meta, err := provider.LookupISBN(ctx, isbn)
+	if err != nil {
+		return nil, err
+	}
+
+	filled := bson.M{}
+	if book.BookPages == "" && meta.Pages != "" {
+		book.BookPages = meta.Pages
+		filled["BookPages"] = meta.Pages
+	}
+	if book.BookYear == "" && meta.Year != "" {
+		book.BookYear = meta.Year
+		filled["BookYear"] = meta.Year
+	}
+	if book.BookCover == "" && meta.CoverURL != "" {
+		book.BookCover = meta.CoverURL
+		filled["BookCover"] = meta.CoverURL
+	}
+	if len(book.BookSubjects) == 0 && len(meta.Subjects) > 0 {
+		if len(meta.Subjects) > maxSubjects {
+			meta.Subjects = meta.Subjects[:maxSubjects]
+		}
+		book.BookSubjects = meta.Subjects
+		filled["BookSubjects"] = meta.Subjects
+	}
+	return filled, nil
+}
+
+// openLibrary queries the Books API of https://openlibrary.org. Their usage
+// policy asks to keep the request rate low, so requests wait for the
+// limiter, one every interval.
+type openLibrary struct {
+	baseURL string
+	client  *http.Client
+	limiter *rate.Limiter
+}
+
+func newOpenLibrary(baseURL string, interval time.Duration) *openLibrary {
+	limit := rate.Inf
+	if interval > 0 {
+		limit = rate.Every(interval)
+	}
+	return &openLibrary{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		limiter: rate.NewLimiter(limit, 1),
+	}
+}
+
+// openLibraryBook is the part of the "data" format we use, see
+// https://openlibrary.org/dev/docs/api/books
+type openLibraryBook struct {
+	NumberOfPages int    `json:"number_of_pages"`
+	PublishDate   string `json:"publish_date"`
+	Subjects      []struct {
+		Name string `json:"name"`
+	} `json:"subjects"`
+	Cover struct {
+		Medium string `json:"medium"`
+		Large  string `json:"large"`
+	} `json:"cover"`
+}
+
+// Publish dates are free text ("1818", "March 1, 2003", "2003-03"), we
+// only keep the year.
+var publishYearPattern = regexp.MustCompile(`\b[0-9]{4}\b`)
+
+func (o *openLibrary) LookupISBN(ctx context.Context, isbn string) (BookMetadata, error) {
+	if err := o.limiter.Wait(ctx); err != nil {
+		return BookMetadata{}, err
+	}
+
+	key := "ISBN:" + isbn
+	query := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/api/books?"+query.Encode(), nil)
+	if err != nil {
+		return BookMetadata{}, err
+	}
+	req.Header.Set("User-Agent", "bookstore/"+buildInfo.Version)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return BookMetadata{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return BookMetadata{}, fmt.Errorf("openlibrary: %s", resp.Status)
+	}
+
+	// The response maps every requested key to its book, and leaves out
+	// the unknown ones.
+	var books map[string]openLibraryBook
+	if err := json.NewDecoder(resp.Body).Decode(&books); err != nil {
+		return BookMetadata{}, fmt.Errorf("openlibrary: %w", err)
+	}
+	book, ok := books[key]
+	if !ok {
+		return BookMetadata{}, errMetadataNotFound
+	}
+
+	meta := BookMetadata{
+		Year:     publishYearPattern.FindString(book.PublishDate),
+		CoverURL: book.Cover.Large,
+	}
+	if meta.CoverURL == "" {
+		meta.CoverURL = book.Cover.Medium
+	}
+	if book.NumberOfPages > 0 {
+		meta.Pages = strconv.Itoa(book.NumberOfPages)
+	}
+	for _, s := range book.Subjects {
+		meta.Subjects = append(meta.Subjects, s.Name)
+	}
+	return meta, nil
+}
+
+// openLibrarySearch is the part of the answer of the search API we use,
+// see https://openlibrary.org/dev/docs/api/search
+type openLibrarySearch struct {
+	Docs []struct {
+		Title            string   `json:"title"`
+		Subtitle         string   `json:"subtitle"`
+		AuthorName       []string `json:"author_name"`
+		FirstPublishYear int      `json:"first_publish_year"`
+		Pages            int      `json:"number_of_pages_median"`
+		ISBN             []string `json:"isbn"`
+		Subject          []string `json:"subject"`
+		CoverID          int      `json:"cover_i"`
+	} `json:"docs"`
+}
+
+// Lookup finds the works with the given ISBN, or else matching title and
+// author (either may be empty), with the search API. Works gather every
+// edition, so the pages are their median and the year the first one.
+func (o *openLibrary) Lookup(ctx context.Context, isbn, title, author string) ([]LookupCandidate, error) {
+	if err := o.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"fields": {"title,subtitle,author_name,first_publish_year,number_of_pages_median,isbn,subject,cover_i"},
+		"limit":  {strconv.Itoa(lookupLimit)},
+	}
+	if isbn != "" {
+		query.Set("isbn", isbn)
+	} else {
+		if title != "" {
+			query.Set("title", title)
+		}
+		if author != "" {
+			query.Set("author", author)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/search.json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "bookstore/"+buildInfo.Version)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openlibrary: %s", resp.Status)
+	}
+	var found openLibrarySearch
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, fmt.Errorf("openlibrary: %w", err)
+	}
+
+	candidates := make([]LookupCandidate, 0, len(found.Docs))
+	for _, doc := range found.Docs {
+		c := LookupCandidate{
+			Title:  doc.Title,
+			Author: strings.Join(doc.AuthorName, ", "),
+			// The ISBN asked for, else one of the editions
+			Edition:  isbn,
+			Subjects: doc.Subject,
+		}
+		if doc.Subtitle != "" {
+			c.Title += ": " + doc.Subtitle
+		}
+		if doc.FirstPublishYear > 0 {
+			c.Year = strconv.Itoa(doc.FirstPublishYear)
+		}
+		if doc.Pages > 0 {
+			c.Pages = strconv.Itoa(doc.Pages)
+		}
+		if doc.CoverID > 0 {
+			c.Cover = "https://covers.openlibrary.org/b/id/" + strconv.Itoa(doc.CoverID) + "-L.jpg"
+		}
+		if c.Edition == "" && len(doc.ISBN) > 0 {
+			c.Edition = doc.ISBN[0]
+		}
+		if len(c.Subjects) > maxSubjects {
+			c.Subjects = c.Subjects[:maxSubjects]
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
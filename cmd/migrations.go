@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Applied migrations are recorded in this collection, one document per
+// migration with its name as _id.
+const migrationsCollection = "migrations"
+
+// The views of the books were once counted in this collection, they now
+// are with the usage analytics.
+const bookViewsCollection = "book_views"
+
+// migration is a one-off change to the database. Migrations run in order,
+// once per database; never rename or reorder existing ones, add new ones at
+// the end instead.
+type migration struct {
+	name string
+	up   func(ctx context.Context, coll *mongo.Collection) error
+}
+
+var migrations = []migration{
+	{"001_books_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "ID", Value: 1}}},
+			{Keys: bson.D{{Key: "BookAuthor", Value: 1}, {Key: "BookName", Value: 1}}},
+			{Keys: bson.D{{Key: "BookYear", Value: 1}}},
+		})
+		return err
+	}},
+	{"002_backfill_created_at", func(ctx context.Context, coll *mongo.Collection) error {
+		// Books inserted before we stored timestamps get the creation time
+		// of their ObjectID.
+		_, err := coll.UpdateMany(ctx,
+			bson.M{"createdAt": bson.M{"$exists": false}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{"createdAt": bson.M{"$toDate": "$_id"}}}}},
+		)
+		return err
+	}},
+	{"003_timestamp_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		// For /api/books/recent
+		_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "updatedAt", Value: -1}}, Options: options.Index().SetSparse(true)},
+		})
+		return err
+	}},
+	{"004_notification_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		db := coll.Database()
+		_, err := db.Collection(notificationPreferencesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "newBooks", Value: 1}, {Key: "lastDigestAt", Value: 1}}},
+		})
+		if err != nil {
+			return err
+		}
+		// Sent emails are kept a month, for troubleshooting
+		_, err = db.Collection(mailOutboxCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "sentAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		})
+		return err
+	}},
+	{"005_webhook_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		// Deliveries are kept a month, for the delivery log
+		_, err := coll.Database().Collection(webhookDeliveriesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "subscriptionId", Value: 1}, {Key: "changeId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		})
+		return err
+	}},
+	{"006_bulk_edit_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		// Bulk edits are kept a week, well past their undo window
+		_, err := coll.Database().Collection(bulkEditsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600)},
+		})
+		return err
+	}},
+	{"007_audit_log_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(auditLogCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "changeId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "mongoId", Value: 1}, {Key: "_id", Value: -1}}},
+		})
+		return err
+	}},
+	{"008_shelf_index", func(ctx context.Context, coll *mongo.Collection) error {
+		// For /shelves and the books of a shelf
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "BookShelf", Value: 1}, {Key: "BookName", Value: 1}},
+		})
+		return err
+	}},
+	{"009_reading_list_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(readingListsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+		})
+		return err
+	}},
+	{"010_book_note_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(bookNotesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "owner", Value: 1}, {Key: "book", Value: 1}, {Key: "_id", Value: 1}},
+		})
+		return err
+	}},
+	{"011_content_addressed_covers", func(ctx context.Context, coll *mongo.Collection) error {
+		// To count the books sharing a cover (see covers.go)
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "BookCover", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		})
+		if err != nil {
+			return err
+		}
+		// Covers were only ever uploaded to GridFS before they were stored
+		// by content
+		return migrateCovers(ctx, coll, &gridFSStore{db: coll.Database()})
+	}},
+	{"012_usage_stats_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(usageStatsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "day", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "day", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(maxTrendingDays * 24 * 3600)},
+		})
+		return err
+	}},
+	{"013_book_view_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(bookViewsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}},
+		})
+		return err
+	}},
+	{"014_export_job_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(exportJobsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600)},
+		})
+		return err
+	}},
+	{"015_drop_rare_search_terms", func(ctx context.Context, coll *mongo.Collection) error {
+		// The terms used to be stored with every count, they are now only
+		// once searched minPopularSearchCount times in a day
+		_, err := coll.Database().Collection(usageStatsCollection).UpdateMany(ctx,
+			bson.M{"kind": usageSearch, "count": bson.M{"$lt": minPopularSearchCount}, "term": bson.M{"$exists": true}},
+			bson.M{"$unset": bson.M{"term": ""}},
+		)
+		return err
+	}},
+	{"016_drop_book_views", func(ctx context.Context, coll *mongo.Collection) error {
+		return coll.Database().Collection(bookViewsCollection).Drop(ctx)
+	}},
+	{"017_drop_unkeyed_search_hashes", func(ctx context.Context, coll *mongo.Collection) error {
+		// The terms were counted under their plain SHA-256, which anyone
+		// can compute for a guessed term, and are now under an HMAC: the
+		// old counts would be apart from the new ones anyway
+		_, err := coll.Database().Collection(usageStatsCollection).DeleteMany(ctx, bson.M{"kind": usageSearch})
+		return err
+	}},
+	{"018_api_key_indexes", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.Database().Collection(apiKeysCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = coll.Database().Collection(apiKeyUsageCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		return err
+	}},
+}
+
+// appliedMigrations returns the names of the migrations already applied,
+// with the time they ran.
+func appliedMigrations(ctx context.Context, db *mongo.Database) (map[string]time.Time, error) {
+	cursor, err := db.Collection(migrationsCollection).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var records []struct {
+		Name      string    `bson:"_id"`
+		AppliedAt time.Time `bson:"appliedAt"`
+	}
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[string]time.Time, len(records))
+	for _, r := range records {
+		applied[r.Name] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// migrate runs the pending migrations on the books collection, stopping at
+// the first failure.
+func migrate(ctx context.Context, coll *mongo.Collection) error {
+	db := coll.Database()
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.name]; ok {
+			continue
+		}
+		start := time.Now()
+		if err := m.up(ctx, coll); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		_, err := db.Collection(migrationsCollection).UpdateOne(ctx,
+			bson.M{"_id": m.name},
+			bson.M{"$set": bson.M{"appliedAt": time.Now().UTC()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("recording migration %s: %w", m.name, err)
+		}
+		slog.Info("migration applied", "name", m.name, "duration", time.Since(start))
+	}
+	return nil
+}
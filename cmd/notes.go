@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Notes are what the users who log in (see auth.go) write down about a
+// book, in Markdown (see markdown.go). They are private: each user only
+// ever sees their own, under /api/books/:id/notes, and on the detail page
+// once logged in.
+const bookNotesCollection = "book_notes"
+
+const maxNoteLength = 10000
+
+// BookNote is a note of a user on a book.
+type BookNote struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Book      string             `bson:"book" json:"book"`
+	Owner     string             `bson:"owner" json:"-"`
+	Text      string             `bson:"text" json:"text"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// HTML renders the Markdown of the note.
+func (n BookNote) HTML() template.HTML {
+	return renderMarkdown(n.Text)
+}
+
+// BookNotes is the data passed to the "book-notes" block.
+type BookNotes struct {
+	Book  string
+	Notes []BookNote
+}
+
+// noteInput is the body of POST /api/books/:id/notes, or the form of the
+// detail page.
+type noteInput struct {
+	Text string `json:"text" form:"text"`
+}
+
+type bookNotes struct {
+	notes *mongo.Collection
+	books *store.Books
+}
+
+func newBookNotes(books *mongo.Collection) *bookNotes {
+	return &bookNotes{
+		notes: books.Database().Collection(bookNotesCollection),
+		books: store.NewBooks(books),
+	}
+}
+
+// registerNoteRoutes mounts the notes API under /api/books/:id/notes, and
+// the notes block of the detail page at /books/:id/notes, all behind auth.
+// Without auth, no one can log in to keep notes.
+func registerNoteRoutes(e *echo.Echo, auth echo.MiddlewareFunc, n *bookNotes) {
+	if auth == nil {
+		return
+	}
+
+	// ownNotes lists the notes of the user on the book, oldest first.
+	ownNotes := func(c echo.Context) ([]BookNote, error) {
+		ctx := c.Request().Context()
+		filter := bson.M{"owner": c.Get(userKey), "book": c.Param("id")}
+		cursor, err := n.notes.Find(ctx, filter, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+		notes := []BookNote{}
+		if err := cursor.All(ctx, &notes); err != nil {
+			return nil, err
+		}
+		return notes, nil
+	}
+	// respond answers the notes of the user, as the block of the detail
+	// page to our pages and as JSON to API clients.
+	respond := func(c echo.Context, code int) error {
+		notes, err := ownNotes(c)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "book-notes", BookNotes{Book: c.Param("id"), Notes: notes})
+		}
+		if code == http.StatusNoContent {
+			return c.NoContent(code)
+		}
+		return c.JSON(code, notes)
+	}
+
+	e.GET("/books/:id/notes", func(c echo.Context) error {
+		notes, err := ownNotes(c)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.Render(http.StatusOK, "book-notes", BookNotes{Book: c.Param("id"), Notes: notes})
+	}, auth)
+
+	g := e.Group("/api/books/:id/notes", auth)
+
+	g.GET("", func(c echo.Context) error {
+		return respond(c, http.StatusOK)
+	})
+
+	g.POST("", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var in noteInput
+		if err := c.Bind(&in); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		var problem string
+		switch text := strings.TrimSpace(in.Text); {
+		case text == "":
+			problem = "Text is required"
+		case len(text) > maxNoteLength:
+			problem = "Text is too long"
+		}
+		if problem != "" {
+			body := handlers.ErrorBody(c, "Invalid note")
+			body["fields"] = store.FieldErrors{"text": problem}
+			return c.JSON(http.StatusBadRequest, body)
+		}
+		if _, err := n.books.ByID(ctx, c.Param("id")); err != nil {
+			return handlers.Error(c, err, "Database error")
+		}
+		note := BookNote{
+			Book:      c.Param("id"),
+			Owner:     c.Get(userKey).(string),
+			Text:      strings.TrimSpace(in.Text),
+			CreatedAt: time.Now().UTC(),
+		}
+		res, err := n.notes.InsertOne(ctx, note, store.InsertOneOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not save note")
+		}
+		if render.IsBrowserSubmission(c) {
+			return respond(c, http.StatusCreated)
+		}
+		note.ID = res.InsertedID.(primitive.ObjectID)
+		return c.JSON(http.StatusCreated, note)
+	})
+
+	// DELETE /api/books/:id/notes removes all the notes of the user on the
+	// book, DELETE /api/books/:id/notes/:note just one.
+	g.DELETE("", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		filter := bson.M{"owner": c.Get(userKey), "book": c.Param("id")}
+		if _, err := n.notes.DeleteMany(ctx, filter, store.DeleteOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return respond(c, http.StatusNoContent)
+	})
+
+	g.DELETE("/:note", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id, err := primitive.ObjectIDFromHex(c.Param("note"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusNotFound, "Note not found")
+		}
+		// Someone else's note is just as unknown
+		filter := bson.M{"_id": id, "owner": c.Get(userKey), "book": c.Param("id")}
+		res, err := n.notes.DeleteOne(ctx, filter, store.DeleteOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if res.DeletedCount == 0 {
+			return handlers.JSONError(c, http.StatusNotFound, "Note not found")
+		}
+		return respond(c, http.StatusNoContent)
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notification preferences are kept per email address, there are no user
+// accounts yet. Admins manage them; every email carries a link to
+// unsubscribe without logging in.
+const notificationPreferencesCollection = "notification_preferences"
+
+// NotificationPreferences tells which emails an address receives.
+type NotificationPreferences struct {
+	Email string `bson:"_id" json:"email"`
+	// Digest of the new books: off, daily or weekly
+	NewBooks     string    `bson:"newBooks" json:"newBooks"`
+	Token        string    `bson:"token" json:"-"`
+	LastDigestAt time.Time `bson:"lastDigestAt" json:"lastDigestAt"`
+}
+
+var digestIntervals = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// At most this many books are listed in a digest.
+const digestLimit = 50
+
+// DigestMail is the data of the "new-books-digest" email.
+type DigestMail struct {
+	Books     []store.Book
+	Since     time.Time
+	Frequency string
+	BaseURL   string
+	Token     string
+}
+
+type notifier struct {
+	books   *mongo.Collection
+	prefs   *mongo.Collection
+	mailer  *mailer
+	baseURL string
+}
+
+func newNotifier(books *mongo.Collection, m *mailer, baseURL string) *notifier {
+	return &notifier{
+		books:   books,
+		prefs:   books.Database().Collection(notificationPreferencesCollection),
+		mailer:  m,
+		baseURL: baseURL,
+	}
+}
+
+// RunDigests queues the digests that are due, every hour, until ctx is
+// cancelled.
+func (n *notifier) RunDigests(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		for frequency, interval := range digestIntervals {
+			for n.queueDigest(ctx, frequency, interval) {
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queueDigest handles one subscriber whose digest is due, and tells if
+// there was one. Moving lastDigestAt forward claims the subscriber, so
+// several instances don't send the same digest.
+func (n *notifier) queueDigest(ctx context.Context, frequency string, interval time.Duration) bool {
+	now := time.Now().UTC()
+	var prefs NotificationPreferences
+	err := n.prefs.FindOneAndUpdate(ctx,
+		bson.M{"newBooks": frequency, "lastDigestAt": bson.M{"$lte": now.Add(-interval)}},
+		bson.M{"$set": bson.M{"lastDigestAt": now}},
+	).Decode(&prefs)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			slog.Warn("could not read notification preferences", "error", err)
+		}
+		return false
+	}
+
+	cursor, err := n.books.Find(ctx,
+		bson.M{"createdAt": bson.M{"$gt": prefs.LastDigestAt}},
+		options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(digestLimit))
+	var books []store.Book
+	if err == nil {
+		err = cursor.All(ctx, &books)
+	}
+	if err != nil {
+		slog.Warn("could not prepare digest", "to", prefs.Email, "error", err)
+		return true
+	}
+	if len(books) == 0 {
+		return true
+	}
+	err = n.mailer.Enqueue(ctx, prefs.Email, "new-books-digest", DigestMail{
+		Books:     books,
+		Since:     prefs.LastDigestAt,
+		Frequency: frequency,
+		BaseURL:   n.baseURL,
+		Token:     prefs.Token,
+	})
+	if err != nil {
+		slog.Warn("could not queue digest", "to", prefs.Email, "error", err)
+	}
+	return true
+}
+
+// newToken returns a random 128-bit token, in hex: the unsubscribe links,
+// the shared reading lists, the webhook secrets and the API keys use it.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// registerNotificationRoutes mounts the preferences management on the admin
+// group, and the unsubscribe link on e.
+func registerNotificationRoutes(e *echo.Echo, admin *echo.Group, n *notifier) {
+	e.GET("/notifications/unsubscribe", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		token := c.QueryParam("token")
+		if token == "" {
+			return handlers.JSONError(c, http.StatusBadRequest, "Missing token")
+		}
+		res, err := n.prefs.UpdateOne(ctx, bson.M{"token": token}, bson.M{"$set": bson.M{"newBooks": "off"}})
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if res.MatchedCount == 0 {
+			return handlers.JSONError(c, http.StatusNotFound, "Unknown token")
+		}
+		return render.Page(c, http.StatusOK, "unsubscribed", nil)
+	})
+
+	if admin == nil {
+		return
+	}
+
+	admin.GET("/notifications", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		cursor, err := n.prefs.Find(ctx, bson.D{}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		prefs := []NotificationPreferences{}
+		if err := cursor.All(ctx, &prefs); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, prefs)
+	})
+
+	// PUT /admin/notifications/:email {"newBooks": "weekly"} subscribes an
+	// address or changes its preferences. The first digest covers the
+	// books added from then on.
+	admin.PUT("/notifications/:email", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		addr, err := mail.ParseAddress(c.Param("email"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "Invalid email address")
+		}
+		var body struct {
+			NewBooks string `json:"newBooks"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		if _, ok := digestIntervals[body.NewBooks]; !ok && body.NewBooks != "off" {
+			return handlers.JSONError(c, http.StatusBadRequest, "newBooks must be off, daily or weekly")
+		}
+
+		var prefs NotificationPreferences
+		err = n.prefs.FindOneAndUpdate(ctx,
+			bson.M{"_id": addr.Address},
+			bson.M{
+				"$set":         bson.M{"newBooks": body.NewBooks},
+				"$setOnInsert": bson.M{"token": newToken(), "lastDigestAt": time.Now().UTC()},
+			},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&prefs)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not save preferences")
+		}
+		return c.JSON(http.StatusOK, prefs)
+	})
+
+	admin.DELETE("/notifications/:email", func(c echo.Context) error {
+		res, err := n.prefs.DeleteOne(c.Request().Context(), bson.M{"_id": c.Param("email")})
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if res.DeletedCount == 0 {
+			return handlers.JSONError(c, http.StatusNotFound, "Unknown email address")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
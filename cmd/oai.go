@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// /oai is an OAI-PMH 2.0 provider (https://www.openarchives.org/OAI/openarchivesprotocol.html),
+// through which library aggregators harvest the catalog as Dublin Core
+// records. Every book is a record, identified as oai:<host>:<ID>, whose
+// datestamp is its last change, so harvesters can ask for the changes
+// since their last visit with from=. There are no sets, and deletions are
+// not kept: a harvester drops the books deleted since by harvesting
+// everything again. Lists come in pages of oaiPageSize, the resumption
+// token telling where the next one starts.
+const (
+	oaiPageSize = 100
+	// The datestamps are given to the second
+	oaiGranularity = "YYYY-MM-DDThh:mm:ssZ"
+	oaiTimeFormat  = "2006-01-02T15:04:05Z"
+	oaiDayFormat   = "2006-01-02"
+
+	oaiDCPrefix = "oai_dc"
+)
+
+// The structs below map to the elements of an OAI-PMH response. The
+// prefixed names (xsi:, oai_dc:, dc:) are written as they are, declared on
+// the elements using them.
+type oaiResponse struct {
+	XMLName             xml.Name            `xml:"http://www.openarchives.org/OAI/2.0/ OAI-PMH"`
+	XSI                 string              `xml:"xmlns:xsi,attr"`
+	SchemaLocation      string              `xml:"xsi:schemaLocation,attr"`
+	ResponseDate        string              `xml:"responseDate"`
+	Request             oaiRequest          `xml:"request"`
+	Errors              []oaiError          `xml:"error"`
+	Identify            *oaiIdentify        `xml:"Identify"`
+	ListMetadataFormats *oaiMetadataFormats `xml:"ListMetadataFormats"`
+	GetRecord           *oaiRecordList      `xml:"GetRecord"`
+	ListRecords         *oaiRecordList      `xml:"ListRecords"`
+	ListIdentifiers     *oaiIdentifierList  `xml:"ListIdentifiers"`
+}
+
+// oaiRequest echoes the request. Its arguments are left out when they
+// were not valid.
+type oaiRequest struct {
+	URL             string `xml:",chardata"`
+	Verb            string `xml:"verb,attr,omitempty"`
+	Identifier      string `xml:"identifier,attr,omitempty"`
+	MetadataPrefix  string `xml:"metadataPrefix,attr,omitempty"`
+	From            string `xml:"from,attr,omitempty"`
+	Until           string `xml:"until,attr,omitempty"`
+	Set             string `xml:"set,attr,omitempty"`
+	ResumptionToken string `xml:"resumptionToken,attr,omitempty"`
+}
+
+type oaiError struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+type oaiIdentify struct {
+	RepositoryName    string `xml:"repositoryName"`
+	BaseURL           string `xml:"baseURL"`
+	ProtocolVersion   string `xml:"protocolVersion"`
+	AdminEmail        string `xml:"adminEmail"`
+	EarliestDatestamp string `xml:"earliestDatestamp"`
+	DeletedRecord     string `xml:"deletedRecord"`
+	Granularity       string `xml:"granularity"`
+}
+
+type oaiMetadataFormat struct {
+	Prefix    string `xml:"metadataPrefix"`
+	Schema    string `xml:"schema"`
+	Namespace string `xml:"metadataNamespace"`
+}
+
+type oaiMetadataFormats struct {
+	Formats []oaiMetadataFormat `xml:"metadataFormat"`
+}
+
+type oaiHeader struct {
+	Identifier string `xml:"identifier"`
+	Datestamp  string `xml:"datestamp"`
+}
+
+type oaiRecord struct {
+	Header   oaiHeader `xml:"header"`
+	Metadata struct {
+		DC oaiDC `xml:"oai_dc:dc"`
+	} `xml:"metadata"`
+}
+
+// oaiToken is written empty on the last page of a list asked for with a
+// token.
+type oaiToken struct {
+	Value string `xml:",chardata"`
+}
+
+type oaiRecordList struct {
+	Records []oaiRecord `xml:"record"`
+	Token   *oaiToken   `xml:"resumptionToken"`
+}
+
+type oaiIdentifierList struct {
+	Headers []oaiHeader `xml:"header"`
+	Token   *oaiToken   `xml:"resumptionToken"`
+}
+
+// oaiDC is a book as a simple Dublin Core record.
+type oaiDC struct {
+	OAIDC          string       `xml:"xmlns:oai_dc,attr"`
+	DC             string       `xml:"xmlns:dc,attr"`
+	XSI            string       `xml:"xmlns:xsi,attr"`
+	SchemaLocation string       `xml:"xsi:schemaLocation,attr"`
+	Titles         []oaiDCTitle `xml:"dc:title"`
+	Creator        string       `xml:"dc:creator,omitempty"`
+	Subjects       []string     `xml:"dc:subject"`
+	Date           string       `xml:"dc:date,omitempty"`
+	Type           string       `xml:"dc:type"`
+	Format         string       `xml:"dc:format,omitempty"`
+	Identifiers    []string     `xml:"dc:identifier"`
+}
+
+type oaiDCTitle struct {
+	Lang  string `xml:"xml:lang,attr,omitempty"`
+	Title string `xml:",chardata"`
+}
+
+var oaiDCFormat = oaiMetadataFormat{
+	Prefix:    oaiDCPrefix,
+	Schema:    "http://www.openarchives.org/OAI/2.0/oai_dc.xsd",
+	Namespace: "http://www.openarchives.org/OAI/2.0/oai_dc/",
+}
+
+// oaiDatestamp returns the datestamp of the book, its last change.
+func oaiDatestamp(book store.Book) string {
+	return book.LastModified().UTC().Format(oaiTimeFormat)
+}
+
+// oaiRecordOf maps the book to Dublin Core: the title and its
+// translations, the author as creator, the subjects and tags, the year, the
+// page count as format, and the detail page and ISBN as identifiers.
+func oaiRecordOf(book store.Book, identifier, base string) oaiRecord {
+	dc := oaiDC{
+		OAIDC:          oaiDCFormat.Namespace,
+		DC:             "http://purl.org/dc/elements/1.1/",
+		XSI:            "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: oaiDCFormat.Namespace + " " + oaiDCFormat.Schema,
+		Titles:         []oaiDCTitle{{Title: book.BookName}},
+		Creator:        book.BookAuthor,
+		Date:           book.BookYear,
+		Type:           "Text",
+		Identifiers:    []string{base + "/books/" + url.PathEscape(book.ID)},
+	}
+	for _, lang := range slices.Sorted(maps.Keys(book.BookTitles)) {
+		dc.Titles = append(dc.Titles, oaiDCTitle{Lang: lang, Title: book.BookTitles[lang]})
+	}
+	dc.Subjects = append(dc.Subjects, book.BookSubjects...)
+	dc.Subjects = append(dc.Subjects, book.BookTags...)
+	if book.BookPages != "" {
+		dc.Format = book.BookPages + " pages"
+	}
+	if isbn := normalizeISBN(book.BookEdition); isbn != "" {
+		dc.Identifiers = append(dc.Identifiers, "urn:isbn:"+isbn)
+	}
+	record := oaiRecord{Header: oaiHeader{Identifier: identifier, Datestamp: oaiDatestamp(book)}}
+	record.Metadata.DC = dc
+	return record
+}
+
+// oaiList is what a list asks for: the records changed since From and
+// before Until, after the record After when resuming.
+type oaiList struct {
+	From, Until time.Time
+	After       primitive.ObjectID
+	// The arguments as given, for the next tokens
+	from, until string
+}
+
+// token returns the resumption token of the page after the record last.
+func (l oaiList) token(last primitive.ObjectID) string {
+	v := url.Values{"after": {last.Hex()}}
+	if l.from != "" {
+		v.Set("from", l.from)
+	}
+	if l.until != "" {
+		v.Set("until", l.until)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(v.Encode()))
+}
+
+// parseOAIDate parses a from or until argument, telling if it was a day.
+func parseOAIDate(s string) (t time.Time, day bool, err error) {
+	if t, err = time.Parse(oaiTimeFormat, s); err == nil {
+		return t, false, nil
+	}
+	t, err = time.Parse(oaiDayFormat, s)
+	return t, true, err
+}
+
+// parseOAIList reads the range of a list, from its arguments or its
+// resumption token.
+func parseOAIList(from, until, token string) (oaiList, error) {
+	var l oaiList
+	if token != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return l, err
+		}
+		v, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return l, err
+		}
+		if l.After, err = primitive.ObjectIDFromHex(v.Get("after")); err != nil {
+			return l, err
+		}
+		from, until = v.Get("from"), v.Get("until")
+	}
+	l.from, l.until = from, until
+	var fromDay, untilDay bool
+	var err error
+	if from != "" {
+		if l.From, fromDay, err = parseOAIDate(from); err != nil {
+			return l, errors.New("from is not a date like " + oaiGranularity)
+		}
+	}
+	if until != "" {
+		if l.Until, untilDay, err = parseOAIDate(until); err != nil {
+			return l, errors.New("until is not a date like " + oaiGranularity)
+		}
+		// The whole day or second is included
+		if untilDay {
+			l.Until = l.Until.AddDate(0, 0, 1)
+		} else {
+			l.Until = l.Until.Add(time.Second)
+		}
+	}
+	if from != "" && until != "" {
+		if fromDay != untilDay {
+			return l, errors.New("from and until have different granularities")
+		}
+		if !l.From.Before(l.Until) {
+			return l, errors.New("from is after until")
+		}
+	}
+	return l, nil
+}
+
+// filter matches the books of the list. The datestamp is the first of
+// updatedAt, createdAt and the creation time of the document that is set,
+// so each is compared in turn.
+func (l oaiList) filter() bson.M {
+	inRange := func(from, until interface{}) bson.M {
+		r := bson.M{"$exists": true}
+		if !l.From.IsZero() {
+			r["$gte"] = from
+		}
+		if !l.Until.IsZero() {
+			r["$lt"] = until
+		}
+		return r
+	}
+	filter := bson.M{"$or": bson.A{
+		bson.M{"updatedAt": inRange(l.From, l.Until)},
+		bson.M{"updatedAt": nil, "createdAt": inRange(l.From, l.Until)},
+		bson.M{"updatedAt": nil, "createdAt": nil, "_id": inRange(
+			primitive.NewObjectIDFromTimestamp(l.From), primitive.NewObjectIDFromTimestamp(l.Until),
+		)},
+	}}
+	if !l.After.IsZero() {
+		filter["_id"] = bson.M{"$gt": l.After}
+	}
+	return filter
+}
+
+// page returns the next page of the list, and whether there are more.
+func (l oaiList) page(ctx context.Context, coll *mongo.Collection) ([]store.Book, bool, error) {
+	opts := store.FindOpts(ctx).SetSort(bson.M{"_id": 1}).SetLimit(oaiPageSize + 1)
+	cursor, err := coll.Find(ctx, l.filter(), opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var books []store.Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, false, err
+	}
+	if len(books) > oaiPageSize {
+		return books[:oaiPageSize], true, nil
+	}
+	return books, false, nil
+}
+
+// oaiArguments are the arguments each verb takes, true when required.
+// resumptionToken is exclusive: given, it is the only one.
+var oaiArguments = map[string]map[string]bool{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier": false},
+	"ListSets":            {"resumptionToken": false},
+	"GetRecord":           {"identifier": true, "metadataPrefix": true},
+	"ListIdentifiers":     {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+	"ListRecords":         {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+}
+
+// checkOAIArguments tells what is wrong with the arguments of the verb,
+// if anything.
+func checkOAIArguments(verb string, args url.Values) string {
+	allowed := oaiArguments[verb]
+	for name, values := range args {
+		if name == "verb" {
+			continue
+		}
+		if _, ok := allowed[name]; !ok {
+			return "Illegal argument " + name
+		}
+		if len(values) > 1 {
+			return "Repeated argument " + name
+		}
+	}
+	if args.Has("resumptionToken") {
+		if len(args) > 2 {
+			return "resumptionToken is an exclusive argument"
+		}
+		return ""
+	}
+	for name, required := range allowed {
+		if required && args.Get(name) == "" {
+			return "Missing argument " + name
+		}
+	}
+	return ""
+}
+
+// registerOAIRoutes mounts the OAI-PMH provider at /oai, taking GET and
+// POST requests.
+func registerOAIRoutes(e *echo.Echo, coll *mongo.Collection, adminEmail string) {
+	e.Match([]string{http.MethodGet, http.MethodPost}, "/oai", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		base := handlers.BaseURL(c)
+		host := c.Request().Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		idPrefix := "oai:" + host + ":"
+		identifier := func(book store.Book) string {
+			return idPrefix + url.PathEscape(book.ID)
+		}
+
+		res := oaiResponse{
+			XSI:            "http://www.w3.org/2001/XMLSchema-instance",
+			SchemaLocation: "http://www.openarchives.org/OAI/2.0/ http://www.openarchives.org/OAI/2.0/OAI-PMH.xsd",
+			ResponseDate:   time.Now().UTC().Format(oaiTimeFormat),
+			Request:        oaiRequest{URL: base + "/oai"},
+		}
+		fail := func(code, message string) error {
+			res.Errors = append(res.Errors, oaiError{Code: code, Message: message})
+			return writeOAI(c, res)
+		}
+
+		// POST requests send the arguments form encoded
+		args, err := c.FormParams()
+		if err != nil {
+			return fail("badArgument", "Unreadable arguments")
+		}
+		verb := args.Get("verb")
+		if _, ok := oaiArguments[verb]; !ok || len(args["verb"]) > 1 {
+			return fail("badVerb", "Illegal or missing verb")
+		}
+		if msg := checkOAIArguments(verb, args); msg != "" {
+			return fail("badArgument", msg)
+		}
+		res.Request = oaiRequest{
+			URL:             base + "/oai",
+			Verb:            verb,
+			Identifier:      args.Get("identifier"),
+			MetadataPrefix:  args.Get("metadataPrefix"),
+			From:            args.Get("from"),
+			Until:           args.Get("until"),
+			Set:             args.Get("set"),
+			ResumptionToken: args.Get("resumptionToken"),
+		}
+
+		// byIdentifier returns the book identified, or a nil book when
+		// there is none.
+		byIdentifier := func(id string) (*store.Book, error) {
+			escaped, ok := strings.CutPrefix(id, idPrefix)
+			if !ok {
+				return nil, nil
+			}
+			local, err := url.PathUnescape(escaped)
+			if err != nil {
+				return nil, nil
+			}
+			var book store.Book
+			err = coll.FindOne(ctx, bson.M{"ID": local}, store.FindOneOpts(ctx)).Decode(&book)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, nil
+			}
+			return &book, err
+		}
+
+		switch verb {
+		case "Identify":
+			earliest := time.Now()
+			var first store.Book
+			err := coll.FindOne(ctx, bson.M{}, store.FindOneOpts(ctx).SetSort(bson.M{"_id": 1})).Decode(&first)
+			if err == nil {
+				earliest = first.AddedAt()
+			} else if !errors.Is(err, mongo.ErrNoDocuments) {
+				return handlers.ServerError(c, err, "Database error")
+			}
+			res.Identify = &oaiIdentify{
+				RepositoryName:    "Book Store",
+				BaseURL:           base + "/oai",
+				ProtocolVersion:   "2.0",
+				AdminEmail:        adminEmail,
+				EarliestDatestamp: earliest.UTC().Format(oaiTimeFormat),
+				DeletedRecord:     "no",
+				Granularity:       oaiGranularity,
+			}
+
+		case "ListMetadataFormats":
+			if id := args.Get("identifier"); id != "" {
+				book, err := byIdentifier(id)
+				if err != nil {
+					return handlers.ServerError(c, err, "Database error")
+				}
+				if book == nil {
+					return fail("idDoesNotExist", "No record "+id)
+				}
+			}
+			res.ListMetadataFormats = &oaiMetadataFormats{Formats: []oaiMetadataFormat{oaiDCFormat}}
+
+		case "ListSets":
+			return fail("noSetHierarchy", "The catalog has no sets")
+
+		case "GetRecord":
+			if args.Get("metadataPrefix") != oaiDCPrefix {
+				return fail("cannotDisseminateFormat", "Records are only available as "+oaiDCPrefix)
+			}
+			book, err := byIdentifier(args.Get("identifier"))
+			if err != nil {
+				return handlers.ServerError(c, err, "Database error")
+			}
+			if book == nil {
+				return fail("idDoesNotExist", "No record "+args.Get("identifier"))
+			}
+			res.GetRecord = &oaiRecordList{Records: []oaiRecord{oaiRecordOf(*book, identifier(*book), base)}}
+
+		case "ListIdentifiers", "ListRecords":
+			token := args.Get("resumptionToken")
+			list, err := parseOAIList(args.Get("from"), args.Get("until"), token)
+			if token != "" && err != nil {
+				return fail("badResumptionToken", "Invalid or expired resumption token")
+			}
+			if err != nil {
+				return fail("badArgument", err.Error())
+			}
+			if token == "" {
+				if args.Get("metadataPrefix") != oaiDCPrefix {
+					return fail("cannotDisseminateFormat", "Records are only available as "+oaiDCPrefix)
+				}
+				if args.Has("set") {
+					return fail("noSetHierarchy", "The catalog has no sets")
+				}
+			}
+			books, more, err := list.page(ctx, coll)
+			if err != nil {
+				return handlers.ServerError(c, err, "Database error")
+			}
+			if len(books) == 0 {
+				return fail("noRecordsMatch", "No records match")
+			}
+			var next *oaiToken
+			switch {
+			case more:
+				next = &oaiToken{Value: list.token(books[len(books)-1].MongoID)}
+			case token != "":
+				next = &oaiToken{}
+			}
+			if verb == "ListIdentifiers" {
+				ids := &oaiIdentifierList{Token: next}
+				for _, book := range books {
+					ids.Headers = append(ids.Headers, oaiHeader{Identifier: identifier(book), Datestamp: oaiDatestamp(book)})
+				}
+				res.ListIdentifiers = ids
+			} else {
+				records := &oaiRecordList{Token: next}
+				for _, book := range books {
+					records.Records = append(records.Records, oaiRecordOf(book, identifier(book), base))
+				}
+				res.ListRecords = records
+			}
+		}
+		return writeOAI(c, res)
+	})
+}
+
+// writeOAI writes the response. OAI-PMH errors are answered with 200 too,
+// the harvesters reading the error elements.
+func writeOAI(c echo.Context, res oaiResponse) error {
+	out, err := xml.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return handlers.ServerError(c, err, "Could not write the response")
+	}
+	return c.Blob(http.StatusOK, "text/xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
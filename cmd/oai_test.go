@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseOAIList(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse(oaiDayFormat, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	second := func(s string) time.Time {
+		d, err := time.Parse(oaiTimeFormat, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		from, until string
+		want        oaiList
+		err         string
+	}{
+		{"", "", oaiList{}, ""},
+		{"2024-01-01", "", oaiList{From: day("2024-01-01")}, ""},
+		// The whole day, or second, of until is included
+		{"", "2024-01-31", oaiList{Until: day("2024-02-01")}, ""},
+		{"2024-01-01T10:00:00Z", "2024-01-01T10:00:00Z", oaiList{From: second("2024-01-01T10:00:00Z"), Until: second("2024-01-01T10:00:01Z")}, ""},
+		{"2024-01-01", "2024-01-01", oaiList{From: day("2024-01-01"), Until: day("2024-01-02")}, ""},
+		{"yesterday", "", oaiList{}, "from is not a date"},
+		{"", "2024-13-01", oaiList{}, "until is not a date"},
+		{"2024-01-01T10:00:00+01:00", "", oaiList{}, "from is not a date"},
+		{"2024-01-01", "2024-01-31T00:00:00Z", oaiList{}, "different granularities"},
+		{"2024-02-01", "2024-01-01", oaiList{}, "from is after until"},
+	}
+	for _, tt := range tests {
+		l, err := parseOAIList(tt.from, tt.until, "")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("from %q until %q: got %v, want %q", tt.from, tt.until, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("from %q until %q: %v", tt.from, tt.until, err)
+			continue
+		}
+		if !l.From.Equal(tt.want.From) || !l.Until.Equal(tt.want.Until) || !l.After.IsZero() {
+			t.Errorf("from %q until %q: got %+v, want %+v", tt.from, tt.until, l, tt.want)
+		}
+	}
+}
+
+func TestOAIResumptionToken(t *testing.T) {
+	l, err := parseOAIList("2024-01-01", "2024-06-30", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := primitive.NewObjectID()
+	next, err := parseOAIList("", "", l.token(last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.After != last || !next.From.Equal(l.From) || !next.Until.Equal(l.Until) {
+		t.Errorf("got %+v, want %+v after %s", next, l, last.Hex())
+	}
+
+	for _, token := range []string{"!!!", "YWZ0ZXI9eHl6", "%zz"} {
+		if _, err := parseOAIList("", "", token); err == nil {
+			t.Errorf("%q: no error", token)
+		}
+	}
+}
+
+func TestCheckOAIArguments(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"verb=Identify", ""},
+		{"verb=Identify&metadataPrefix=oai_dc", "Illegal argument metadataPrefix"},
+		{"verb=GetRecord&identifier=x&metadataPrefix=oai_dc", ""},
+		{"verb=GetRecord&identifier=x", "Missing argument metadataPrefix"},
+		{"verb=ListRecords&metadataPrefix=oai_dc&from=2024-01-01", ""},
+		{"verb=ListRecords&metadataPrefix=oai_dc&from=2024-01-01&from=2024-02-01", "Repeated argument from"},
+		{"verb=ListRecords", "Missing argument metadataPrefix"},
+		{"verb=ListRecords&resumptionToken=abc", ""},
+		{"verb=ListIdentifiers&resumptionToken=abc&metadataPrefix=oai_dc", "resumptionToken is an exclusive argument"},
+		{"verb=ListMetadataFormats", ""},
+		{"verb=ListSets&set=x", "Illegal argument set"},
+	}
+	for _, tt := range tests {
+		args, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkOAIArguments(args.Get("verb"), args); got != tt.err {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.err)
+		}
+	}
+}
+
+func TestOAIRecordOf(t *testing.T) {
+	updated := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+	book := store.Book{
+		ID:           "frankenstein",
+		BookName:     "Frankenstein",
+		BookAuthor:   "Mary Shelley",
+		BookEdition:  "978-0-486-28211-4",
+		BookPages:    "166",
+		BookYear:     "1818",
+		BookTitles:   map[string]string{"fr": "Frankenstein ou le Prométhée moderne", "de": "Frankenstein oder Der moderne Prometheus"},
+		BookSubjects: []string{"Monsters"},
+		BookTags:     []string{"horror"},
+		UpdatedAt:    &updated,
+	}
+	record := oaiRecordOf(book, "oai:example.com:frankenstein", "https://example.com")
+	if record.Header.Identifier != "oai:example.com:frankenstein" || record.Header.Datestamp != "2024-03-15T10:30:00Z" {
+		t.Errorf("header: %+v", record.Header)
+	}
+	dc := record.Metadata.DC
+	wantTitles := []oaiDCTitle{
+		{Title: "Frankenstein"},
+		{Lang: "de", Title: "Frankenstein oder Der moderne Prometheus"},
+		{Lang: "fr", Title: "Frankenstein ou le Prométhée moderne"},
+	}
+	if !reflect.DeepEqual(dc.Titles, wantTitles) {
+		t.Errorf("titles: got %+v, want %+v", dc.Titles, wantTitles)
+	}
+	if want := []string{"https://example.com/books/frankenstein", "urn:isbn:9780486282114"}; !reflect.DeepEqual(dc.Identifiers, want) {
+		t.Errorf("identifiers: got %v, want %v", dc.Identifiers, want)
+	}
+	if want := []string{"Monsters", "horror"}; !reflect.DeepEqual(dc.Subjects, want) {
+		t.Errorf("subjects: got %v, want %v", dc.Subjects, want)
+	}
+	if dc.Creator != "Mary Shelley" || dc.Date != "1818" || dc.Format != "166 pages" || dc.Type != "Text" {
+		t.Errorf("got %+v", dc)
+	}
+
+	// Titles and names are escaped in the XML
+	book.BookName = "<script>&</script>"
+	out, err := xml.Marshal(oaiRecordOf(book, "x", "https://example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "<dc:title>&lt;script&gt;&amp;&lt;/script&gt;</dc:title>") {
+		t.Errorf("title not escaped: %s", out)
+	}
+}
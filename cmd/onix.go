@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// Publishers deliver their catalogs in ONIX for Books 3.0, an XML message
+// with one <Product> per edition. Importing one maps each product to a
+// book: the record reference (or the ISBN) is its ID, the ISBN its
+// edition, and the title, first author, page count, publication year,
+// subjects and keywords fill the other fields. Imprints, publishers and
+// prices are left out: the catalog has no place for them. Both the
+// reference names (<Product>, <TitleText>) and the short tags (<product>,
+// <b203>) are read.
+
+// onixShortTags are the short tags of the elements read, by reference name.
+var onixShortTags = map[string]string{
+	"Product":                 "product",
+	"NotificationType":        "a002",
+	"RecordReference":         "a001",
+	"ProductIdentifier":       "productidentifier",
+	"ProductIDType":           "b221",
+	"IDValue":                 "b244",
+	"DescriptiveDetail":       "descriptivedetail",
+	"TitleDetail":             "titledetail",
+	"TitleType":               "b202",
+	"TitleElement":            "titleelement",
+	"TitleElementLevel":       "x409",
+	"TitleText":               "b203",
+	"TitlePrefix":             "b030",
+	"TitleWithoutPrefix":      "b031",
+	"Subtitle":                "b029",
+	"Contributor":             "contributor",
+	"ContributorRole":         "b035",
+	"PersonName":              "b036",
+	"NamesBeforeKey":          "b039",
+	"KeyNames":                "b040",
+	"CorporateName":           "b047",
+	"Extent":                  "extent",
+	"ExtentType":              "b218",
+	"ExtentValue":             "b219",
+	"ExtentUnit":              "b220",
+	"Subject":                 "subject",
+	"SubjectSchemeIdentifier": "b067",
+	"SubjectHeadingText":      "b070",
+	"PublishingDetail":        "publishingdetail",
+	"PublishingDate":          "publishingdate",
+	"PublishingDateRole":      "x448",
+	"Date":                    "b306",
+}
+
+// onixNode is an element of a product, whichever its tags.
+type onixNode struct {
+	XMLName xml.Name
+	Text    string     `xml:",chardata"`
+	Nodes   []onixNode `xml:",any"`
+}
+
+// all returns the children named name, by reference name or short tag.
+func (n onixNode) all(name string) []onixNode {
+	var nodes []onixNode
+	for _, child := range n.Nodes {
+		if child.XMLName.Local == name || child.XMLName.Local == onixShortTags[name] {
+			nodes = append(nodes, child)
+		}
+	}
+	return nodes
+}
+
+// get follows the path of names from n, returning the first node found.
+func (n onixNode) get(path ...string) (onixNode, bool) {
+	for _, name := range path {
+		nodes := n.all(name)
+		if len(nodes) == 0 {
+			return onixNode{}, false
+		}
+		n = nodes[0]
+	}
+	return n, true
+}
+
+// text returns the text at the path from n.
+func (n onixNode) text(path ...string) string {
+	node, _ := n.get(path...)
+	return strings.TrimSpace(node.Text)
+}
+
+// isONIX tells an ONIX message from other XML, e.g. MARCXML, by its root
+// element, from the start of a file.
+func isONIX(head []byte) bool {
+	return bytes.Contains(head, []byte("<ONIXMessage")) || bytes.Contains(head, []byte("<ONIXmessage"))
+}
+
+// readONIX calls fn for every product of an ONIX message, streaming so
+// large catalogs don't need to fit in memory. Deletion notices are skipped.
+func readONIX(r io.Reader, fn func(onixNode) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "Product" && start.Name.Local != "product") {
+			continue
+		}
+		var product onixNode
+		if err := dec.DecodeElement(&product, &start); err != nil {
+			return err
+		}
+		// 05: delete
+		if product.text("NotificationType") == "05" {
+			continue
+		}
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+}
+
+// onixPageExtents are the extent types giving the page count, by
+// preference: main content, content, total numbered, production and print
+// counterpart page counts.
+var onixPageExtents = []string{"00", "11", "07", "08", "10"}
+
+func bookFromONIX(p onixNode) store.Book {
+	detail, _ := p.get("DescriptiveDetail")
+	book := store.Book{ID: p.text("RecordReference")}
+
+	// ISBN-13, ISBN-10, or a GTIN-13 that is an ISBN
+	ids := map[string]string{}
+	for _, id := range p.all("ProductIdentifier") {
+		ids[id.text("ProductIDType")] = id.text("IDValue")
+	}
+	if gtin := ids["03"]; !strings.HasPrefix(gtin, "978") && !strings.HasPrefix(gtin, "979") {
+		delete(ids, "03")
+	}
+	for _, isbn := range []string{ids["15"], ids["02"], ids["03"]} {
+		if isbn = normalizeISBN(isbn); isbn != "" {
+			book.BookEdition = isbn
+			break
+		}
+	}
+	if book.ID == "" {
+		book.ID = book.BookEdition
+	}
+
+	// The distinctive title, at the level of the product
+	for _, title := range detail.all("TitleDetail") {
+		if title.text("TitleType") != "01" {
+			continue
+		}
+		for _, element := range title.all("TitleElement") {
+			if level := element.text("TitleElementLevel"); level != "" && level != "01" {
+				continue
+			}
+			book.BookName = element.text("TitleText")
+			if book.BookName == "" {
+				book.BookName = strings.TrimSpace(element.text("TitlePrefix") + " " + element.text("TitleWithoutPrefix"))
+			}
+			if subtitle := element.text("Subtitle"); subtitle != "" {
+				book.BookName += ": " + subtitle
+			}
+			break
+		}
+		break
+	}
+
+	// The first author (A01), contributors coming in sequence
+	for _, contributor := range detail.all("Contributor") {
+		if !slices.ContainsFunc(contributor.all("ContributorRole"), func(role onixNode) bool {
+			return strings.TrimSpace(role.Text) == "A01"
+		}) {
+			continue
+		}
+		book.BookAuthor = contributor.text("PersonName")
+		if book.BookAuthor == "" {
+			book.BookAuthor = strings.TrimSpace(contributor.text("NamesBeforeKey") + " " + contributor.text("KeyNames"))
+		}
+		if book.BookAuthor == "" {
+			book.BookAuthor = contributor.text("CorporateName")
+		}
+		break
+	}
+
+	// 03: pages
+	pages := map[string]string{}
+	for _, extent := range detail.all("Extent") {
+		if extent.text("ExtentUnit") == "03" {
+			pages[extent.text("ExtentType")] = extent.text("ExtentValue")
+		}
+	}
+	for _, extentType := range onixPageExtents {
+		if n := pages[extentType]; n != "" {
+			book.BookPages = n
+			break
+		}
+	}
+
+	// 01: publication date, e.g. 20190315 or 2019
+	for _, date := range p.all("PublishingDetail") {
+		for _, d := range date.all("PublishingDate") {
+			if d.text("PublishingDateRole") == "01" {
+				book.BookYear = marcYearPattern.FindString(d.text("Date"))
+			}
+		}
+	}
+
+	// Keywords (scheme 20) become tags, the headings of the other schemes
+	// subjects
+	for _, subject := range detail.all("Subject") {
+		heading := subject.text("SubjectHeadingText")
+		if heading == "" {
+			continue
+		}
+		if subject.text("SubjectSchemeIdentifier") == "20" {
+			book.BookTags = appendList(book.BookTags, strings.ReplaceAll(heading, ";", ","))
+		} else {
+			book.BookSubjects = appendList(book.BookSubjects, heading)
+		}
+	}
+	return book
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+func TestReadONIX(t *testing.T) {
+	const message = `<?xml version="1.0" encoding="UTF-8"?>
+<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">
+  <Header><Sender><SenderName>Publisher</SenderName></Sender></Header>
+  <Product>
+    <RecordReference>com.example.frankenstein</RecordReference>
+    <NotificationType>03</NotificationType>
+    <ProductIdentifier><ProductIDType>03</ProductIDType><IDValue>9780486282114</IDValue></ProductIdentifier>
+    <ProductIdentifier><ProductIDType>02</ProductIDType><IDValue>0486282112</IDValue></ProductIdentifier>
+    <DescriptiveDetail>
+      <TitleDetail>
+        <TitleType>01</TitleType>
+        <TitleElement>
+          <TitleElementLevel>02</TitleElementLevel>
+          <TitleText>Dover Thrift Editions</TitleText>
+        </TitleElement>
+        <TitleElement>
+          <TitleElementLevel>01</TitleElementLevel>
+          <TitleText>Frankenstein</TitleText>
+          <Subtitle>The Modern Prometheus</Subtitle>
+        </TitleElement>
+      </TitleDetail>
+      <Contributor><ContributorRole>B01</ContributorRole><PersonName>Some Editor</PersonName></Contributor>
+      <Contributor><ContributorRole>A01</ContributorRole><NamesBeforeKey>Mary</NamesBeforeKey><KeyNames>Shelley</KeyNames></Contributor>
+      <Extent><ExtentType>08</ExtentType><ExtentValue>176</ExtentValue><ExtentUnit>03</ExtentUnit></Extent>
+      <Extent><ExtentType>00</ExtentType><ExtentValue>166</ExtentValue><ExtentUnit>03</ExtentUnit></Extent>
+      <Extent><ExtentType>22</ExtentType><ExtentValue>300</ExtentValue><ExtentUnit>17</ExtentUnit></Extent>
+      <Subject><SubjectSchemeIdentifier>10</SubjectSchemeIdentifier><SubjectHeadingText>FICTION / Horror</SubjectHeadingText></Subject>
+      <Subject><SubjectSchemeIdentifier>20</SubjectSchemeIdentifier><SubjectHeadingText>monsters; gothic</SubjectHeadingText></Subject>
+    </DescriptiveDetail>
+    <PublishingDetail>
+      <PublishingDate><PublishingDateRole>19</PublishingDateRole><Date>20200101</Date></PublishingDate>
+      <PublishingDate><PublishingDateRole>01</PublishingDateRole><Date>19940315</Date></PublishingDate>
+    </PublishingDetail>
+  </Product>
+  <Product>
+    <RecordReference>com.example.deleted</RecordReference>
+    <NotificationType>05</NotificationType>
+  </Product>
+</ONIXMessage>`
+	const short = `<ONIXmessage release="3.0">
+  <product>
+    <a002>03</a002>
+    <productidentifier><b221>03</b221><b244>4006381333931</b244></productidentifier>
+    <productidentifier><b221>15</b221><b244>978-0-14-143951-8</b244></productidentifier>
+    <descriptivedetail>
+      <titledetail><b202>01</b202><titleelement><x409>01</x409><b030>The</b030><b031>Raven</b031></titleelement></titledetail>
+      <contributor><b035>A01</b035><b036>Edgar Allan Poe</b036></contributor>
+    </descriptivedetail>
+  </product>
+</ONIXmessage>`
+	tests := []struct {
+		name    string
+		message string
+		books   []store.Book
+	}{
+		{"reference names", message, []store.Book{{
+			ID:         "com.example.frankenstein",
+			BookName:   "Frankenstein: The Modern Prometheus",
+			BookAuthor: "Mary Shelley",
+			// The ISBN-10 rather than the GTIN-13
+			BookEdition:  "0486282112",
+			BookPages:    "166",
+			BookYear:     "1994",
+			BookSubjects: []string{"FICTION / Horror"},
+			BookTags:     []string{"monsters", "gothic"},
+		}}},
+		// A GTIN-13 that isn't an ISBN is left out, and the ISBN is the ID
+		{"short tags", short, []store.Book{{
+			ID:          "9780141439518",
+			BookName:    "The Raven",
+			BookAuthor:  "Edgar Allan Poe",
+			BookEdition: "9780141439518",
+		}}},
+	}
+	for _, tt := range tests {
+		if !isONIX([]byte(tt.message)) {
+			t.Errorf("%s: not recognized as ONIX", tt.name)
+		}
+		var books []store.Book
+		err := readONIX(strings.NewReader(tt.message), func(p onixNode) error {
+			books = append(books, bookFromONIX(p))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(books, tt.books) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, books, tt.books)
+		}
+	}
+}
+
+func TestIsONIX(t *testing.T) {
+	marcXML := []byte(`<?xml version="1.0"?><collection xmlns="http://www.loc.gov/MARC21/slim"><record>`)
+	if isONIX(marcXML) {
+		t.Errorf("MARCXML read as ONIX")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A tiny PDF writer, just enough for our text-only reports: A4 pages and the
+// Helvetica fonts every PDF reader ships with, so nothing has to be embedded.
+// See the PDF 1.4 reference for the meaning of each object.
+
+const (
+	pdfPageWidth  = 595.0 // A4 in points
+	pdfPageHeight = 842.0
+)
+
+type pdfDocument struct {
+	pages []*bytes.Buffer
+}
+
+// AddPage starts a new page; subsequent calls to Text draw on it.
+func (d *pdfDocument) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+// PageCount returns the number of pages added so far.
+func (d *pdfDocument) PageCount() int {
+	return len(d.pages)
+}
+
+// Text draws s on the given page, with (x, y) measured in points from the
+// top-left corner of the page.
+func (d *pdfDocument) Text(page int, x float64, y float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.pages[page], "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, pdfPageHeight-y, pdfEscape(s))
+}
+
+// Line draws a horizontal line on the given page.
+func (d *pdfDocument) Line(page int, x1 float64, x2 float64, y float64) {
+	fmt.Fprintf(d.pages[page], "0.5 w %.2f %.2f m %.2f %.2f l S\n",
+		x1, pdfPageHeight-y, x2, pdfPageHeight-y)
+}
+
+// Bytes serializes the document.
+func (d *pdfDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-4 are fixed, then every page takes two objects: the page
+	// itself and its content stream.
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape encodes s for a PDF string literal. The standard fonts use
+// WinAnsiEncoding, which matches Latin-1 for accented letters; anything
+// outside of it is replaced by "?".
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteByte(' ')
+		case r < 0x80:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// pdfTruncate shortens s so it fits in width points at the given font size.
+// Helvetica has no fixed width; 0.55em per character is a safe average.
+func pdfTruncate(s string, width float64, size float64) string {
+	max := int(width / (size * 0.55))
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	return string(runes[:max-3]) + "..."
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/books/popular and the Popular page list the books viewed the
+// most over all the usage analytics kept, i.e. the last maxTrendingDays
+// days (see analytics.go). The views are counted like the others, so not
+// for the visitors opting out, nor at all with ANALYTICS=false.
+const (
+	defaultPopularLimit = 10
+	maxPopularLimit     = 50
+)
+
+// registerPopularRoutes mounts GET /api/books/popular?limit= and the
+// Popular page at /popular.
+func registerPopularRoutes(e *echo.Echo, r *usageRecorder, books guardedBooks) {
+	popular := func(c echo.Context) ([]ViewCount, error) {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxPopularLimit {
+			limit = defaultPopularLimit
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		return r.mostViewed(c.Request().Context(), books, today.AddDate(0, 0, 1-maxTrendingDays), limit)
+	}
+
+	e.GET("/api/books/popular", func(c echo.Context) error {
+		books, err := popular(c)
+		if err != nil {
+			return handlers.Error(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, books)
+	})
+
+	e.GET("/popular", func(c echo.Context) error {
+		books, err := popular(c)
+		if err != nil {
+			return handlers.Error(c, err, "Database error")
+		}
+		return render.Page(c, http.StatusOK, "popular", books)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimiter counts the requests of each client in fixed windows, in the
+// shared store so the limit holds across instances.
+type rateLimiter struct {
+	store  sharedStore
+	limit  int64
+	window time.Duration
+}
+
+// hit counts a request of the client, and returns its count in the
+// current window and when the window ends.
+func (r *rateLimiter) hit(identifier string) (int64, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now().Truncate(r.window)
+	key := "ratelimit:" + identifier + ":" + strconv.FormatInt(start.Unix(), 10)
+	count, err := r.store.Incr(ctx, key, r.window)
+	return count, start.Add(r.window), err
+}
+
+// rateLimit limits the requests each client IP can make to the API. It is
+// off unless RATE_LIMIT is set. Every answer of the API tells the client
+// where it stands, in X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (when the window ends, in Unix time). The requests
+// with an API key are left to the quotas of the key (see apikeys.go).
+func rateLimit(cfg config.RateLimitConfig, store sharedStore) echo.MiddlewareFunc {
+	limiter := &rateLimiter{store: store, limit: int64(cfg.Requests), window: cfg.Window}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !strings.HasPrefix(c.Request().URL.Path, "/api/") || c.Get(apiKeyContextKey) != nil {
+				return next(c)
+			}
+			count, reset, err := limiter.hit(c.RealIP())
+			if err != nil {
+				// If the store is unreachable we'd rather serve than lock
+				// everybody out
+				slog.Warn("rate limit store unavailable, letting the request through", "error", err)
+				return next(c)
+			}
+			h := c.Response().Header()
+			h.Set("X-RateLimit-Limit", strconv.FormatInt(limiter.limit, 10))
+			h.Set("X-RateLimit-Remaining", strconv.FormatInt(max(limiter.limit-count, 0), 10))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if count > limiter.limit {
+				h.Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// A mirror serves the catalog of another deployment and must never change
+// it. With READ_ONLY=true, or once an admin switches it on in the
+// dashboard, the requests that would change something answer 403 and the
+// pages hide their forms. The switch only holds for this instance, until
+// it restarts.
+
+// readOnlyMode tells if changes are refused.
+type readOnlyMode struct {
+	on atomic.Bool
+}
+
+func newReadOnlyMode(on bool) *readOnlyMode {
+	m := &readOnlyMode{}
+	m.on.Store(on)
+	return m
+}
+
+func (m *readOnlyMode) enabled() bool {
+	return m.on.Load()
+}
+
+// changesNothing tells the requests that don't change the catalog, which
+// are let through in read-only mode, from the others.
+func changesNothing(path string) bool {
+	switch path {
+	case "/api/isbn/validate", "/admin/bulk/preview", "/admin/read-only", "/oai":
+		return true
+	}
+	// The exports are in the file storage, the catalog being left alone
+	return path == "/api/exports" || strings.HasPrefix(path, "/api/exports/") || strings.HasPrefix(path, "/debug/")
+}
+
+// rejectWrites answers 403 to the requests changing something while the
+// mode is on.
+func rejectWrites(mode *readOnlyMode) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			if !mode.enabled() || changesNothing(c.Request().URL.Path) {
+				return next(c)
+			}
+			return handlers.JSONError(c, http.StatusForbidden, "The catalog is read-only")
+		}
+	}
+}
+
+// registerReadOnlyRoutes mounts POST /admin/read-only, switching the mode
+// with enabled=true or false, on the admin group.
+func registerReadOnlyRoutes(admin *echo.Group, mode *readOnlyMode) {
+	admin.POST("/read-only", func(c echo.Context) error {
+		enabled, err := strconv.ParseBool(c.FormValue("enabled"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusBadRequest, "enabled must be true or false")
+		}
+		if mode.on.Swap(enabled) != enabled {
+			slog.Warn("read-only mode switched", "enabled", enabled, "actor", store.ActorFromContext(c.Request().Context()))
+		}
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusOK, "read-only", enabled)
+		}
+		return c.JSON(http.StatusOK, map[string]bool{"readOnly": enabled})
+	})
+}
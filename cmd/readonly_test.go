@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRejectWrites(t *testing.T) {
+	e := echo.New()
+	e.Use(rejectWrites(newReadOnlyMode(true)))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/api/export", ok)
+	e.POST("/api/exports", ok)
+	e.POST("/api/books", ok)
+	e.PUT("/api/books/:id", ok)
+
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/api/export", http.StatusOK},
+		{http.MethodPost, "/api/exports", http.StatusOK},
+		{http.MethodPost, "/api/books", http.StatusForbidden},
+		{http.MethodPut, "/api/books/example1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, httptest.NewRequest(tt.method, tt.path, nil))
+		if res.Code != tt.code {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, res.Code, tt.code)
+		}
+	}
+}
+
+func TestReadOnlySkipsWritingTasks(t *testing.T) {
+	// Without a runs collection: a task claimed would panic
+	s := &scheduler{readOnly: newReadOnlyMode(true), ctx: context.Background()}
+	ran := false
+	s.runTask(&task{name: "demo-reset", writes: true, run: func(context.Context) (string, error) {
+		ran = true
+		return "", nil
+	}}, time.Now())
+	if ran {
+		t.Error("a task changing the catalog ran in read-only mode")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// POST /api/books/:id/cover takes the URL of a cover rather than the image,
+// e.g. one found by a metadata provider, and the server fetches it. The
+// image is decoded and encoded again before it is stored, so what lands in
+// the file storage is a plain picture whatever the remote file held, be it
+// metadata or a script disguised as an image. Remote covers may only be
+// JPEG, PNG or GIF, the standard library not decoding WebP. The fetch only
+// reaches public addresses, so the URL can't point the server at itself or
+// at the internal network.
+const (
+	maxRemoteCoverSize = 10 << 20
+	// Decoding a small file may take a lot of memory, e.g. a huge plain
+	// PNG
+	maxCoverPixels        = 40_000_000
+	remoteCoverTimeout    = 15 * time.Second
+	maxCoverRedirects     = 3
+	reencodedCoverQuality = 90
+)
+
+var (
+	errCoverURL      = errors.New("the cover URL must be an http or https URL")
+	errCoverAddress  = errors.New("the cover URL must point to a public address")
+	errCoverTooLarge = fmt.Errorf("the cover must be at most %d MB and %d megapixels", maxRemoteCoverSize>>20, maxCoverPixels/1_000_000)
+	errCoverType     = errors.New("the cover must be a JPEG, PNG or GIF image")
+)
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA registries
+// (RFC 6890 and its updates) which aren't on the public internet, or lead
+// back to the local network through a translator, e.g. NAT64 or 6to4.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"), // 6to4 relays
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/127"),
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local NAT64
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"), // including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"), // 6to4
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// publicAddressesOnly refuses the connections to loopback, private,
+// link-local and the other non public addresses. It checks the address
+// connected to, after DNS resolution and on every redirect.
+func publicAddressesOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return errCoverAddress
+	}
+	// IPv4 addresses mapped in IPv6 are checked as IPv4, and the prefixes
+	// never contain an address with a zone
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return errCoverAddress
+		}
+	}
+	return nil
+}
+
+// checkCoverRedirect follows a few redirects, to http and https URLs only.
+func checkCoverRedirect(req *http.Request, via []*http.Request) error {
+	// via holds the requests made so far, the first one included
+	if len(via) > maxCoverRedirects {
+		return errors.New("too many redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errCoverURL
+	}
+	return nil
+}
+
+var remoteCoverClient = &http.Client{
+	Timeout: remoteCoverTimeout,
+	// No proxy either: it could be on the internal network
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddressesOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: checkCoverRedirect,
+}
+
+// fetchCover downloads the image at rawURL and encodes it again, returning
+// the new image and its content type.
+func fetchCover(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", errCoverURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", errCoverURL
+	}
+	req.Header.Set("User-Agent", "bookstore/"+buildInfo.Version)
+	req.Header.Set("Accept", "image/jpeg, image/png, image/gif")
+	resp, err := remoteCoverClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching the cover: %s", resp.Status)
+	}
+	// Checked first to spare downloading pages or videos, the content
+	// telling in the end
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "image/jpeg" && mediaType != "image/png" && mediaType != "image/gif" {
+		return nil, "", errCoverType
+	}
+	if resp.ContentLength > maxRemoteCoverSize {
+		return nil, "", errCoverTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteCoverSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching the cover: %w", err)
+	}
+	if len(data) > maxRemoteCoverSize {
+		return nil, "", errCoverTooLarge
+	}
+	return reencodeCover(data)
+}
+
+// reencodeCover decodes the image and encodes it again. JPEGs stay JPEGs,
+// the others become PNGs, keeping their transparency; of animated GIFs,
+// the first frame is kept.
+func reencodeCover(data []byte) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png" && format != "gif") {
+		return nil, "", errCoverType
+	}
+	if cfg.Width*cfg.Height > maxCoverPixels {
+		return nil, "", errCoverTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errCoverType
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: reencodedCoverQuality}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestPublicAddressesOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:80", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"8.8.8.8:443", true},
+		{"127.0.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"192.0.0.170:80", false},
+		{"198.18.0.1:80", false},
+		{"198.19.255.255:80", false},
+		{"192.0.2.1:80", false},
+		{"224.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[::1]:80", false},
+		{"[::]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:10.0.0.1]:80", false},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[64:ff9b::5db8:d822]:80", false},
+		{"[2002:7f00:1::]:80", false},
+		{"[2001:0:4136:e378::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1%eth0]:80", false},
+		{"[ff02::1]:80", false},
+		{"localhost:80", false},
+	}
+	for _, tt := range tests {
+		err := publicAddressesOnly("tcp", tt.address, nil)
+		if tt.public && err != nil {
+			t.Errorf("%s: %v", tt.address, err)
+		}
+		if !tt.public && !errors.Is(err, errCoverAddress) {
+			t.Errorf("%s: got %v, want %v", tt.address, err, errCoverAddress)
+		}
+	}
+}
+
+func TestFetchCoverRefusesLocalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the server was reached")
+	}))
+	defer srv.Close()
+	if _, _, err := fetchCover(context.Background(), srv.URL+"/cover.png"); !errors.Is(err, errCoverAddress) {
+		t.Errorf("got %v, want %v", err, errCoverAddress)
+	}
+}
+
+func TestFetchCoverURL(t *testing.T) {
+	for _, u := range []string{"", "ftp://example.com/cover.png", "file:///etc/passwd", "javascript:alert(1)", "http://", "/cover.png"} {
+		if _, _, err := fetchCover(context.Background(), u); !errors.Is(err, errCoverURL) {
+			t.Errorf("%q: got %v, want %v", u, err, errCoverURL)
+		}
+	}
+}
+
+// encodeImage returns a w×h image in format.
+func encodeImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withLocalCovers lets fetchCover reach the test servers, which listen on
+// the loopback.
+func withLocalCovers(t *testing.T) {
+	t.Helper()
+	client := remoteCoverClient
+	remoteCoverClient = &http.Client{CheckRedirect: checkCoverRedirect}
+	t.Cleanup(func() { remoteCoverClient = client })
+}
+
+func TestFetchCover(t *testing.T) {
+	withLocalCovers(t)
+	pngCover := encodeImage(t, "png", 4, 4)
+	mux := http.NewServeMux()
+	serve := func(path, contentType string, body []byte) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write(body)
+		})
+	}
+	serve("/cover.png", "image/png", pngCover)
+	serve("/cover.jpg", "image/jpeg", encodeImage(t, "jpeg", 4, 4))
+	serve("/cover.gif", "image/gif; charset=binary", encodeImage(t, "gif", 4, 4))
+	serve("/page.html", "text/html", []byte("<html></html>"))
+	serve("/script.png", "image/png", []byte("<script>alert(1)</script>"))
+	serve("/huge.png", "image/png", bytes.Repeat([]byte{0}, maxRemoteCoverSize+1))
+	mux.HandleFunc("/announced.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(maxRemoteCoverSize+1))
+	})
+	mux.HandleFunc("/missing.png", http.NotFound)
+	for i := 0; i < maxCoverRedirects; i++ {
+		mux.Handle("/redirect/"+strconv.Itoa(i), http.RedirectHandler("/redirect/"+strconv.Itoa(i+1), http.StatusFound))
+	}
+	mux.Handle("/redirect/"+strconv.Itoa(maxCoverRedirects), http.RedirectHandler("/cover.png", http.StatusFound))
+	mux.Handle("/to-file", http.RedirectHandler("file:///etc/passwd", http.StatusFound))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path        string
+		contentType string
+		err         error
+	}{
+		{"/cover.png", "image/png", nil},
+		{"/cover.jpg", "image/jpeg", nil},
+		{"/cover.gif", "image/png", nil},
+		{"/page.html", "", errCoverType},
+		{"/script.png", "", errCoverType},
+		{"/huge.png", "", errCoverTooLarge},
+		{"/announced.png", "", errCoverTooLarge},
+		{"/missing.png", "", errors.New("404")},
+		// Followed up to maxCoverRedirects times
+		{"/redirect/1", "image/png", nil},
+		{"/redirect/0", "", errors.New("too many redirects")},
+		{"/to-file", "", errCoverURL},
+	}
+	for _, tt := range tests {
+		data, contentType, err := fetchCover(context.Background(), srv.URL+tt.path)
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("%s: %v", tt.path, err)
+		case tt.err == nil && contentType != tt.contentType:
+			t.Errorf("%s: content type %q, want %q", tt.path, contentType, tt.contentType)
+		case tt.err == nil:
+			if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("%s: the cover doesn't decode: %v", tt.path, err)
+			}
+		case err == nil:
+			t.Errorf("%s: got no error, want %v", tt.path, tt.err)
+		case !errors.Is(err, tt.err) && !bytes.Contains([]byte(err.Error()), []byte(tt.err.Error())):
+			t.Errorf("%s: got %v, want %v", tt.path, err, tt.err)
+		}
+	}
+}
+
+// gifHeader returns the header of a w×h GIF, enough for image.DecodeConfig.
+func gifHeader(w, h uint16) []byte {
+	header := []byte("GIF89a")
+	header = binary.LittleEndian.AppendUint16(header, w)
+	header = binary.LittleEndian.AppendUint16(header, h)
+	return append(header, 0, 0, 0)
+}
+
+func TestReencodeCover(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		err         error
+	}{
+		{"jpeg", encodeImage(t, "jpeg", 8, 8), "image/jpeg", nil},
+		{"png", encodeImage(t, "png", 8, 8), "image/png", nil},
+		{"gif", encodeImage(t, "gif", 8, 8), "image/png", nil},
+		{"too many pixels", gifHeader(8000, 8000), "", errCoverTooLarge},
+		{"too many pixels, one row", gifHeader(65535, 1000), "", errCoverTooLarge},
+		{"empty", nil, "", errCoverType},
+		{"text", []byte("not an image"), "", errCoverType},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), "", errCoverType},
+		{"truncated", encodeImage(t, "png", 8, 8)[:40], "", errCoverType},
+	}
+	for _, tt := range tests {
+		data, contentType, err := reencodeCover(tt.data)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if contentType != tt.contentType {
+			t.Errorf("%s: content type %q, want %q", tt.name, contentType, tt.contentType)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%s: the cover doesn't decode: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// findBooksForReport retrieves the matching books sorted by author and title,
+// the order librarians expect on an inventory sheet.
+func findBooksForReport(ctx context.Context, repo guardedBooks, filter store.ReportFilter) ([]store.Book, error) {
+	return guardedQuery(ctx, repo, func(coll *mongo.Collection) ([]store.Book, error) {
+		opts := store.FindOpts(ctx).
+			SetSort(bson.D{{Key: "BookAuthor", Value: 1}, {Key: "BookName", Value: 1}}).
+			SetCollation(&options.Collation{Locale: "en"})
+		cursor, err := coll.Find(ctx, filter.Filter(), opts)
+		if err != nil {
+			return nil, err
+		}
+		var results []store.Book
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, err
+		}
+		return results, nil
+	})
+}
+
+// Column layout of the catalog report, in points from the left edge.
+var reportColumns = []struct {
+	title string
+	x     float64
+	width float64
+}{
+	{"Title", 40, 170},
+	{"Author", 215, 130},
+	{"Edition", 350, 110},
+	{"Pages", 465, 40},
+	{"Year", 510, 45},
+}
+
+const (
+	reportMarginTop    = 50.0
+	reportMarginBottom = 60.0
+	reportRowHeight    = 14.0
+	reportFontSize     = 9.0
+)
+
+// buildCatalogReport lays out the books as a table, repeating the header on
+// every page and numbering the pages in the footer.
+func buildCatalogReport(books []store.Book, filter store.ReportFilter, now time.Time) []byte {
+	doc := &pdfDocument{}
+	var y float64
+
+	newPage := func() {
+		doc.AddPage()
+		page := doc.PageCount() - 1
+		doc.Text(page, 40, reportMarginTop, 14, true, "Book Store - Catalog")
+		doc.Text(page, 40, reportMarginTop+16, reportFontSize, false,
+			fmt.Sprintf("Generated %s - %s - %d book(s)", now.UTC().Format("2006-01-02 15:04 MST"), filter, len(books)))
+		y = reportMarginTop + 40
+		for _, col := range reportColumns {
+			doc.Text(page, col.x, y, reportFontSize, true, col.title)
+		}
+		doc.Line(page, 40, pdfPageWidth-40, y+4)
+		y += reportRowHeight + 4
+	}
+
+	newPage()
+	for _, book := range books {
+		if y > pdfPageHeight-reportMarginBottom {
+			newPage()
+		}
+		page := doc.PageCount() - 1
+		values := []string{book.BookName, book.BookAuthor, book.BookEdition, book.BookPages, book.BookYear}
+		for i, col := range reportColumns {
+			doc.Text(page, col.x, y, reportFontSize, false, pdfTruncate(values[i], col.width, reportFontSize))
+		}
+		y += reportRowHeight
+	}
+	if len(books) == 0 {
+		doc.Text(0, 40, y, reportFontSize, false, "No books match this filter.")
+	}
+
+	// Page numbers go last, once we know how many pages there are.
+	for page := 0; page < doc.PageCount(); page++ {
+		doc.Text(page, pdfPageWidth/2-25, pdfPageHeight-30, reportFontSize, false,
+			fmt.Sprintf("Page %d of %d", page+1, doc.PageCount()))
+	}
+	return doc.Bytes()
+}
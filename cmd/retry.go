@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A replica set election or a dropped connection fails the calls in flight,
+// though the same call a moment later succeeds. The idempotent calls of the
+// repository of the books, the reads and the updates setting fields, are
+// tried again when the driver labels their error as transient, after a
+// jittered backoff. Retries are drawn from a budget refilled by the calls,
+// so an outage doesn't multiply the load on MongoDB: the circuit breaker
+// (see breaker.go) takes over then, a retried call counting once for it.
+
+// Calls retried, succeeding after a retry, failing after all of them, and
+// not retried for lack of budget, published in /debug/vars.
+var retryStats = expvar.NewMap("retries")
+
+const (
+	// Each call adds this much to the retry budget, a retry taking 1: about
+	// one call in ten can be retried in the long run.
+	retryBudgetRatio = 0.1
+	// The budget at most, and to begin with.
+	maxRetryBudget = 10
+)
+
+// The labels the driver puts on the errors a call can be tried again after.
+var transientLabels = []string{"NetworkError", "RetryableReadError", "RetryableWriteError", "TransientTransactionError"}
+
+// transientError tells if err is worth trying again.
+func transientError(err error) bool {
+	var le mongo.LabeledError
+	if !errors.As(err, &le) {
+		return false
+	}
+	for _, label := range transientLabels {
+		if le.HasErrorLabel(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrier tries the calls again. A nil *retrier never does.
+type retrier struct {
+	retries int
+	backoff time.Duration
+
+	mu     sync.Mutex
+	budget float64
+}
+
+func newRetrier(cfg config.DatabaseConfig) *retrier {
+	if cfg.Retries <= 0 {
+		return nil
+	}
+	return &retrier{retries: cfg.Retries, backoff: cfg.RetryBackoff, budget: maxRetryBudget}
+}
+
+// deposit adds a call to the budget.
+func (r *retrier) deposit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget = min(r.budget+retryBudgetRatio, maxRetryBudget)
+}
+
+// withdraw takes a retry from the budget, if there is one left.
+func (r *retrier) withdraw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.budget < 1 {
+		return false
+	}
+	r.budget--
+	return true
+}
+
+// wait sleeps before the retry attempt (from 1), a random time up to the
+// backoff doubled after each attempt, or until ctx is done.
+func (r *retrier) wait(ctx context.Context, attempt int) error {
+	delay := r.backoff << (attempt - 1)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(rand.N(delay) + 1)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retry runs call, then again while it fails on a transient error and
+// there are retries left.
+func retry[T any](ctx context.Context, r *retrier, call func() (T, error)) (T, error) {
+	value, err := call()
+	if r == nil {
+		return value, err
+	}
+	r.deposit()
+	for attempt := 1; err != nil && transientError(err); attempt++ {
+		if attempt > r.retries {
+			retryStats.Add("exhausted", 1)
+			return value, err
+		}
+		if !r.withdraw() {
+			retryStats.Add("overBudget", 1)
+			return value, err
+		}
+		if r.wait(ctx, attempt) != nil {
+			return value, err
+		}
+		retryStats.Add("retried", 1)
+		slog.Debug("retrying database call", "attempt", attempt, "error", err)
+		if value, err = call(); err == nil {
+			retryStats.Add("succeeded", 1)
+		}
+	}
+	return value, err
+}
+
+// retryingBooks is the repository of the books trying the idempotent calls
+// again. Inserts and deletes are not: one that went through before its
+// error would be a duplicate or not found the second time.
+type retryingBooks struct {
+	*store.Books
+	retrier *retrier
+}
+
+func (r retryingBooks) All(ctx context.Context) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.All(ctx) })
+}
+
+func (r retryingBooks) Find(ctx context.Context, filter interface{}) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.Find(ctx, filter) })
+}
+
+func (r retryingBooks) Authors(ctx context.Context) ([]string, error) {
+	return retry(ctx, r.retrier, func() ([]string, error) { return r.Books.Authors(ctx) })
+}
+
+func (r retryingBooks) ByID(ctx context.Context, id string) (store.Book, error) {
+	return retry(ctx, r.retrier, func() (store.Book, error) { return r.Books.ByID(ctx, id) })
+}
+
+func (r retryingBooks) Random(ctx context.Context) (store.Book, error) {
+	return retry(ctx, r.retrier, func() (store.Book, error) { return r.Books.Random(ctx) })
+}
+
+func (r retryingBooks) ByAuthor(ctx context.Context, author string, sortKey string, desc bool) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.ByAuthor(ctx, author, sortKey, desc) })
+}
+
+func (r retryingBooks) YearsByDecade(ctx context.Context) ([]store.DecadeGroup, error) {
+	return retry(ctx, r.retrier, func() ([]store.DecadeGroup, error) { return r.Books.YearsByDecade(ctx) })
+}
+
+func (r retryingBooks) ByYear(ctx context.Context, year string) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.ByYear(ctx, year) })
+}
+
+func (r retryingBooks) Shelves(ctx context.Context) ([]store.ShelfCount, error) {
+	return retry(ctx, r.retrier, func() ([]store.ShelfCount, error) { return r.Books.Shelves(ctx) })
+}
+
+func (r retryingBooks) ByShelf(ctx context.Context, shelf string) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.ByShelf(ctx, shelf) })
+}
+
+func (r retryingBooks) Recent(ctx context.Context, limit int64) ([]store.Book, error) {
+	return retry(ctx, r.retrier, func() ([]store.Book, error) { return r.Books.Recent(ctx, limit) })
+}
+
+func (r retryingBooks) Changes(ctx context.Context, since time.Time, limit int) (store.Changes, error) {
+	return retry(ctx, r.retrier, func() (store.Changes, error) { return r.Books.Changes(ctx, since, limit) })
+}
+
+func (r retryingBooks) LastModified(ctx context.Context) (time.Time, error) {
+	return retry(ctx, r.retrier, func() (time.Time, error) { return r.Books.LastModified(ctx) })
+}
+
+// Update sets the same fields again, which changes nothing more.
+func (r retryingBooks) Update(ctx context.Context, id string, fields bson.M) error {
+	_, err := retry(ctx, r.retrier, func() (struct{}, error) { return struct{}{}, r.Books.Update(ctx, id, fields) })
+	return err
+}
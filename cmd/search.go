@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// Search results below this score are dropped.
+const minSearchScore = 0.6
+
+// searchBooks ranks the books by how well their title and author match the
+// query, tolerating typos: "Frankenstien" still finds "Frankenstein".
+//
+// Every word of the query is compared to every word of the title and the
+// author, and gets the similarity of the closest one, based on the edit
+// distance (see wordSimilarity). The score of a book is the average over
+// the words of the query, title matches weighing a bit more than author
+// ones. The catalog is small enough to do this in memory, on the cached
+// list of books.
+func searchBooks(books []store.Book, query string, limit int) []store.SearchResult {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var results []store.SearchResult
+	for _, book := range books {
+		title := searchTerms(book.BookName)
+		author := searchTerms(book.BookAuthor)
+		total := 0.0
+		for _, term := range terms {
+			total += max(bestSimilarity(term, title), 0.9*bestSimilarity(term, author))
+		}
+		score := total / float64(len(terms))
+		if score >= minSearchScore {
+			results = append(results, store.SearchResult{Book: book, Score: roundScore(score)})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].BookName < results[j].BookName
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// searchTerms lowercases s and splits it into words.
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func bestSimilarity(term string, words []string) float64 {
+	best := 0.0
+	for _, word := range words {
+		best = max(best, wordSimilarity(term, word))
+	}
+	return best
+}
+
+// wordSimilarity is 1 for identical words, slightly less when term is a
+// prefix of word (so partial words match while typing), and otherwise
+// 1 - distance/length as long as the distance stays within what we accept
+// as typos: one edit for words up to 4 letters, two beyond.
+func wordSimilarity(term, word string) float64 {
+	if term == word {
+		return 1
+	}
+	t, w := []rune(term), []rune(word)
+	if len(t) >= 3 && len(t) < len(w) && strings.HasPrefix(word, term) {
+		return 0.95
+	}
+	allowed := 1
+	if len(t) > 4 {
+		allowed = 2
+	}
+	d := editDistance(t, w)
+	if d > allowed {
+		return 0
+	}
+	return 1 - float64(d)/float64(max(len(t), len(w)))
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// the number of insertions, deletions, substitutions and transpositions of
+// adjacent letters turning one into the other.
+func editDistance(a, b []rune) int {
+	// Three rows of the dynamic programming matrix are enough.
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func roundScore(score float64) float64 {
+	return float64(int(score*1000+0.5)) / 1000
+}
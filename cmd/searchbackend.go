@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// searchBackend powers GET /api/books/search and /api/books/suggest.
+// SEARCH_BACKEND picks the implementation:
+//
+//	memory  typo tolerant matching over the cached books (search.go)
+//	bleve   an embedded full-text index with stemming and highlighting
+//	        (bleve.go)
+//	atlas   MongoDB Atlas Search, with relevance tuning, typo tolerance and
+//	        highlighting (atlas.go)
+type searchBackend interface {
+	// Search returns every book matching query, best first.
+	Search(ctx context.Context, query string) ([]store.SearchResult, error)
+	Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error)
+
+	// Indexed and Removed keep the backend up to date after a write
+	// through the API.
+	Indexed(ctx context.Context, book store.Book)
+	Removed(ctx context.Context, id string)
+}
+
+func newSearchBackend(ctx context.Context, cfg config.SearchConfig, coll *mongo.Collection, books func(context.Context) ([]store.Book, error)) (searchBackend, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return &memorySearch{coll: coll, books: books}, nil
+	case "bleve":
+		return newBleveSearch(ctx, coll)
+	case "atlas":
+		return newAtlasSearch(ctx, coll, cfg.AtlasIndex)
+	}
+	return nil, fmt.Errorf("unknown search backend %q", cfg.Backend)
+}
+
+// memorySearch scores the cached list of books on every search, so it never
+// needs updating, and suggests from MongoDB directly.
+type memorySearch struct {
+	coll  *mongo.Collection
+	books func(context.Context) ([]store.Book, error)
+}
+
+func (s *memorySearch) Search(ctx context.Context, query string) ([]store.SearchResult, error) {
+	books, err := s.books(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return searchBooks(books, query, len(books)), nil
+}
+
+func (s *memorySearch) Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error) {
+	return findSuggestions(ctx, s.coll, prefix, limit)
+}
+
+func (s *memorySearch) Indexed(context.Context, store.Book) {}
+func (s *memorySearch) Removed(context.Context, string)     {}
+
+// reindexBook refreshes a book in the search backend after it was updated
+// in place, as the update itself only carries the changed fields.
+func reindexBook(ctx context.Context, searcher searchBackend, coll *mongo.Collection, id string) {
+	book, err := store.NewBooks(coll).ByID(ctx, id)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to reindex book", "id", id, "error", err)
+		return
+	}
+	searcher.Indexed(ctx, book)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// All our Redis keys start with this, so the database can be shared.
+const redisKeyPrefix = "bookstore:"
+
+// sharedStore holds the state that has to be the same on every instance
+// when several of them run behind a load balancer: cached pages and rate
+// limit counters. With a single instance it lives in memory; set
+// REDIS_URL to share it through Redis.
+type sharedStore interface {
+	// Get returns the value stored under key, or ok == false if there is
+	// none or it expired.
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// DeletePrefix removes every key starting with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// Incr adds one to the counter under key and returns the new value. A
+	// new counter expires after ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Close() error
+}
+
+// newSharedStore connects to Redis when configured, and otherwise returns
+// nil: each feature then falls back to its in-process implementation. A
+// configured but unreachable Redis is an error, as instances silently
+// keeping their own state would be hard to notice.
+func newSharedStore(cfg config.RedisConfig) (sharedStore, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	slog.Info("sharing cache and rate limits through Redis", "address", opts.Addr, "db", opts.DB)
+	return &redisStore{client: client}, nil
+}
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, redisKeyPrefix+key, value, ttl).Err()
+}
+
+func (s *redisStore) DeletePrefix(ctx context.Context, prefix string) error {
+	iter := s.client.Scan(ctx, 0, redisKeyPrefix+prefix+"*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil || len(keys) == 0 {
+		return err
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// incrScript sets the expiry of a new counter in the same step as the
+// increment, so a client going away in between can't leave a counter that
+// never expires.
+var incrScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count`)
+
+func (s *redisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(ctx, s.client, []string{redisKeyPrefix + key}, ttl.Milliseconds()).Int64()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// memoryStore is the in-process sharedStore, used for the rate limits when
+// Redis is not configured.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	sweep   time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	counter int64
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string]memoryEntry{}}
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) DeletePrefix(_ context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		entry = memoryEntry{expires: time.Now().Add(ttl)}
+	}
+	entry.counter++
+	s.entries[key] = entry
+	return entry.counter, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// expire drops the expired entries, at most once a minute so writes stay
+// cheap. The caller holds the lock.
+func (s *memoryStore) expire() {
+	now := time.Now()
+	if now.Before(s.sweep) {
+		return
+	}
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+	s.sweep = now.Add(time.Minute)
+}
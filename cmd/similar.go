@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	similarLimit = 5
+	// Books further apart than this many years don't count as close.
+	similarYearSpan = 10
+
+	similarAuthorWeight = 3.0
+	similarYearWeight   = 2.0
+)
+
+// findSimilarBooks recommends books close to the given one, scored in the
+// pipeline: 3 points for the same author, plus up to 2 points for the year,
+// decreasing linearly to 0 at similarYearSpan years apart. Years are
+// stored as strings, so they are converted on the fly and books without a
+// numeric year only score on the author.
+func findSimilarBooks(ctx context.Context, repo guardedBooks, book store.Book, limit int) ([]store.SimilarBook, error) {
+	toYear := func(field interface{}) bson.M {
+		return bson.M{"$convert": bson.M{"input": field, "to": "int", "onError": nil, "onNull": nil}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ID": bson.M{"$ne": book.ID}}}},
+		{{Key: "$addFields", Value: bson.M{
+			"yearGap": bson.M{"$abs": bson.M{"$subtract": bson.A{toYear("$BookYear"), toYear(store.Literal(book.BookYear))}}},
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"score": bson.M{"$add": bson.A{
+				bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$BookAuthor", store.Literal(book.BookAuthor)}}, similarAuthorWeight, 0}},
+				bson.M{"$cond": bson.A{
+					bson.M{"$lt": bson.A{bson.M{"$ifNull": bson.A{"$yearGap", similarYearSpan}}, similarYearSpan}},
+					bson.M{"$multiply": bson.A{similarYearWeight, bson.M{"$subtract": bson.A{1, bson.M{"$divide": bson.A{"$yearGap", similarYearSpan}}}}}},
+					0,
+				}},
+			}},
+		}}},
+		{{Key: "$match", Value: bson.M{"score": bson.M{"$gt": 0}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "BookName", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.M{"yearGap": 0}}},
+	}
+	return guardedQuery(ctx, repo, func(coll *mongo.Collection) ([]store.SimilarBook, error) {
+		cursor, err := coll.Aggregate(ctx, pipeline, store.AggregateOpts(ctx))
+		if err != nil {
+			return nil, err
+		}
+		similar := []store.SimilarBook{}
+		if err := cursor.All(ctx, &similar); err != nil {
+			return nil, err
+		}
+		return similar, nil
+	})
+}
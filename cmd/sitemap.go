@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A single sitemap may list at most 50,000 URLs (https://www.sitemaps.org/protocol.html)
+const sitemapMaxURLs = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// buildSitemap lists the index, the authors and years views, and every
+// author, year and book detail page. The lastmod of aggregated pages is the
+// latest change among the books they show.
+func buildSitemap(ctx context.Context, repo guardedBooks, base string) ([]byte, error) {
+	books, err := guardedQuery(ctx, repo, func(coll *mongo.Collection) ([]store.Book, error) {
+		opts := store.FindOpts(ctx).SetProjection(bson.M{
+			"ID": 1, "BookAuthor": 1, "BookYear": 1, "createdAt": 1, "updatedAt": 1,
+		})
+		cursor, err := coll.Find(ctx, bson.D{}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var books []store.Book
+		err = cursor.All(ctx, &books)
+		return books, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var latest time.Time
+	authors := map[string]time.Time{}
+	years := map[string]time.Time{}
+	var bookURLs []sitemapURL
+	for _, book := range books {
+		mod := book.LastModified()
+		if mod.After(latest) {
+			latest = mod
+		}
+		if mod.After(authors[book.BookAuthor]) {
+			authors[book.BookAuthor] = mod
+		}
+		if book.BookYear != "" && mod.After(years[book.BookYear]) {
+			years[book.BookYear] = mod
+		}
+		bookURLs = append(bookURLs, sitemapURL{
+			Loc:     base + "/books/" + url.PathEscape(book.ID),
+			LastMod: formatLastMod(mod),
+		})
+	}
+
+	set := sitemapURLSet{URLs: []sitemapURL{
+		{Loc: base + "/", LastMod: formatLastMod(latest)},
+		{Loc: base + "/authors", LastMod: formatLastMod(latest)},
+		{Loc: base + "/years", LastMod: formatLastMod(latest)},
+	}}
+	set.URLs = append(set.URLs, groupURLs(base+"/authors/", authors)...)
+	set.URLs = append(set.URLs, groupURLs(base+"/years/", years)...)
+	set.URLs = append(set.URLs, bookURLs...)
+	if len(set.URLs) > sitemapMaxURLs {
+		set.URLs = set.URLs[:sitemapMaxURLs]
+	}
+
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// groupURLs turns a name -> last modification map into sorted sitemap
+// entries below the given prefix.
+func groupURLs(prefix string, groups map[string]time.Time) []sitemapURL {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	urls := make([]sitemapURL, 0, len(names))
+	for _, name := range names {
+		urls = append(urls, sitemapURL{Loc: prefix + url.PathEscape(name), LastMod: formatLastMod(groups[name])})
+	}
+	return urls
+}
+
+func formatLastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// buildRobots renders robots.txt. Crawlers are kept away from the API and the
+// admin area; features.robotsDisallowAll keeps them away from everything
+// (e.g. on a staging deployment), and features.robotsDisallow lists extra
+// paths to exclude.
+func buildRobots(base string, features config.FeaturesConfig) string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if features.RobotsDisallowAll {
+		b.WriteString("Disallow: /\n")
+		return b.String()
+	}
+	disallow := append([]string{"/api/", "/admin", "/debug/"}, features.RobotsDisallow...)
+	for _, path := range disallow {
+		b.WriteString("Disallow: " + path + "\n")
+	}
+	b.WriteString("\nSitemap: " + base + "/sitemap.xml\n")
+	return b.String()
+}
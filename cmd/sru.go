@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sruClient searches the catalog of a library over SRU 1.1
+// (https://www.loc.gov/standards/sru/), e.g. the Library of Congress at
+// https://lx2.loc.gov:210/LCDB. The records are asked for as MARCXML and
+// mapped like the imported ones (see marc.go). The queries use the CQL
+// indexes of the Bath profile and Dublin Core, bath.isbn, dc.title and
+// dc.creator, which most servers know. Like OpenLibrary, library servers
+// are kept to one request every METADATA_INTERVAL.
+type sruClient struct {
+	baseURL string
+	client  *http.Client
+	limiter *rate.Limiter
+}
+
+func newSRU(baseURL string, interval time.Duration) *sruClient {
+	limit := rate.Inf
+	if interval > 0 {
+		limit = rate.Every(interval)
+	}
+	return &sruClient{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 15 * time.Second},
+		limiter: rate.NewLimiter(limit, 1),
+	}
+}
+
+// cqlTerm quotes a term of a CQL query.
+func cqlTerm(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// sruDiagnostic is an error reported by the server, in a 200 response.
+type sruDiagnostic struct {
+	Message string `xml:"message"`
+	Details string `xml:"details"`
+}
+
+func (s *sruClient) Lookup(ctx context.Context, isbn, title, author string) ([]LookupCandidate, error) {
+	var clauses []string
+	if isbn != "" {
+		clauses = append(clauses, "bath.isbn="+cqlTerm(isbn))
+	} else {
+		if title != "" {
+			clauses = append(clauses, "dc.title="+cqlTerm(title))
+		}
+		if author != "" {
+			clauses = append(clauses, "dc.creator="+cqlTerm(author))
+		}
+	}
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"version":        {"1.1"},
+		"operation":      {"searchRetrieve"},
+		"query":          {strings.Join(clauses, " and ")},
+		"maximumRecords": {strconv.Itoa(lookupLimit)},
+		"recordSchema":   {"marcxml"},
+		// As elements rather than escaped in a string
+		"recordPacking": {"xml"},
+	}
+	sep := "?"
+	if strings.Contains(s.baseURL, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+sep+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "bookstore/"+buildInfo.Version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sru: %s", resp.Status)
+	}
+
+	// The MARC records are wrapped in the <record> elements of SRU, told
+	// apart by their namespace
+	candidates := []LookupCandidate{}
+	dec := xml.NewDecoder(resp.Body)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return candidates, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sru: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case start.Name.Local == "diagnostic":
+			var d sruDiagnostic
+			if err := dec.DecodeElement(&d, &start); err != nil {
+				return nil, fmt.Errorf("sru: %w", err)
+			}
+			return nil, fmt.Errorf("sru: %s", strings.TrimSpace(d.Message+" "+d.Details))
+		case start.Name.Local == "record" && start.Name.Space == marcXMLNamespace:
+			var record marcRecord
+			if err := dec.DecodeElement(&record, &start); err != nil {
+				return nil, fmt.Errorf("sru: %w", err)
+			}
+			book := bookFromMARC(record)
+			candidates = append(candidates, LookupCandidate{
+				Title:    book.BookName,
+				Author:   book.BookAuthor,
+				Edition:  book.BookEdition,
+				Pages:    book.BookPages,
+				Year:     book.BookYear,
+				Subjects: book.BookSubjects,
+			})
+		}
+	}
+}
+
+// LookupISBN makes a library usable as a metadata provider too
+// (METADATA_PROVIDER=sru).
+func (s *sruClient) LookupISBN(ctx context.Context, isbn string) (BookMetadata, error) {
+	candidates, err := s.Lookup(ctx, isbn, "", "")
+	if err != nil {
+		return BookMetadata{}, err
+	}
+	if len(candidates) == 0 {
+		return BookMetadata{}, errMetadataNotFound
+	}
+	c := candidates[0]
+	return BookMetadata{Pages: c.Pages, Year: c.Year, Subjects: c.Subjects}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Shorter prefixes match too much to be useful.
+const minSuggestPrefix = 2
+
+// findSuggestions returns up to limit titles and authors starting with
+// prefix, ignoring case, titles first. The prefix is quoted, so it is
+// matched literally, and anchored so MongoDB only has to look at the start
+// of each field. Both lists are fetched in a single aggregation.
+func findSuggestions(ctx context.Context, coll *mongo.Collection, prefix string, limit int) ([]store.Suggestion, error) {
+	if len([]rune(prefix)) < minSuggestPrefix {
+		return []store.Suggestion{}, nil
+	}
+	cursor, err := coll.Aggregate(ctx, suggestPipeline(prefix, limit), store.AggregateOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var facets []struct {
+		Titles  []store.Suggestion `bson:"titles"`
+		Authors []store.Suggestion `bson:"authors"`
+	}
+	if err := cursor.All(ctx, &facets); err != nil {
+		return nil, err
+	}
+
+	suggestions := []store.Suggestion{}
+	if len(facets) == 0 {
+		return suggestions, nil
+	}
+	for _, s := range facets[0].Titles {
+		s.Type = "title"
+		suggestions = append(suggestions, s)
+	}
+	for _, s := range facets[0].Authors {
+		s.Type = "author"
+		suggestions = append(suggestions, s)
+	}
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// suggestPipeline is the aggregation behind findSuggestions.
+func suggestPipeline(prefix string, limit int) mongo.Pipeline {
+	pattern := store.HasPrefix(prefix)
+	return mongo.Pipeline{
+		{{Key: "$facet", Value: bson.M{
+			"titles": bson.A{
+				bson.M{"$match": bson.M{"BookName": pattern}},
+				bson.M{"$sort": bson.M{"BookName": 1}},
+				bson.M{"$limit": limit},
+				bson.M{"$project": bson.M{"_id": 0, "value": "$BookName", "id": "$ID"}},
+			},
+			"authors": bson.A{
+				bson.M{"$match": bson.M{"BookAuthor": pattern}},
+				bson.M{"$group": bson.M{"_id": "$BookAuthor"}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+				bson.M{"$limit": limit},
+				bson.M{"$project": bson.M{"_id": 0, "value": "$_id"}},
+			},
+		}}},
+	}
+}
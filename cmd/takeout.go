@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GET /api/users/me/export is the takeout of the user logged in: a zip of
+// everything the catalog keeps about them, their notes (see notes.go) and
+// reading lists (see lists.go), each in JSON and in CSV.
+
+// takeoutFile is a kind of data of the takeout, written as <name>.json and
+// <name>.csv.
+type takeoutFile struct {
+	name   string
+	header []string
+	// The documents for the JSON, and their rows for the CSV
+	data interface{}
+	rows [][]string
+}
+
+// takeoutFiles reads the data of user.
+func takeoutFiles(ctx context.Context, user string, n *bookNotes, l *readingLists, share func(token string) string) ([]takeoutFile, error) {
+	notes := []BookNote{}
+	cursor, err := n.notes.Find(ctx, bson.M{"owner": user}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &notes); err != nil {
+		return nil, err
+	}
+	lists := []ReadingList{}
+	cursor, err = l.lists.Find(ctx, bson.M{"owner": user}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &lists); err != nil {
+		return nil, err
+	}
+
+	noteFile := takeoutFile{name: "notes", header: []string{"id", "book", "text", "createdAt"}, data: notes}
+	for _, note := range notes {
+		noteFile.rows = append(noteFile.rows, []string{
+			note.ID.Hex(), note.Book, note.Text, note.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	listFile := takeoutFile{name: "lists", header: []string{"id", "name", "description", "books", "shareUrl", "createdAt", "updatedAt"}, data: lists}
+	for i, list := range lists {
+		lists[i].ShareURL = share(list.Token)
+		updated := ""
+		if list.UpdatedAt != nil {
+			updated = list.UpdatedAt.Format(time.RFC3339)
+		}
+		listFile.rows = append(listFile.rows, []string{
+			list.ID.Hex(), list.Name, list.Description, strings.Join(list.Books, ";"),
+			lists[i].ShareURL, list.CreatedAt.Format(time.RFC3339), updated,
+		})
+	}
+	return []takeoutFile{noteFile, listFile}, nil
+}
+
+// writeTakeout zips files.
+func writeTakeout(files []takeoutFile) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return nil, err
+		}
+
+		w, err = zw.Create(f.name + ".csv")
+		if err != nil {
+			return nil, err
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.Write(f.header); err != nil {
+			return nil, err
+		}
+		if err := cw.WriteAll(f.rows); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// registerTakeoutRoutes mounts the takeout, behind auth.
+func registerTakeoutRoutes(e *echo.Echo, auth echo.MiddlewareFunc, n *bookNotes, l *readingLists) {
+	if auth == nil {
+		return
+	}
+	e.GET("/api/users/me/export", func(c echo.Context) error {
+		share := func(token string) string { return shareURL(c, token) }
+		files, err := takeoutFiles(c.Request().Context(), c.Get(userKey).(string), n, l, share)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		data, err := writeTakeout(files)
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not write export")
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="takeout.zip"`)
+		return c.Blob(http.StatusOK, "application/zip", data)
+	}, auth)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The last run of every task, one document per task with its name as _id.
+// It also makes sure that a task scheduled on several instances only runs
+// on one of them.
+const taskRunsCollection = "task_runs"
+
+// A task still "running" after this long is considered dead, e.g. its
+// instance stopped, and may run again. It is also the time a run may take.
+const taskLease = time.Hour
+
+// task is a recurring job. run returns a summary of what it did, shown on
+// /admin/tasks.
+type task struct {
+	name        string
+	description string
+	schedule    string
+	// Run by every instance, e.g. to warm their own cache, instead of by a
+	// single one
+	local bool
+	// Changes the catalog, so it is skipped in read-only mode
+	writes bool
+	run    func(ctx context.Context) (string, error)
+
+	next    func() time.Time
+	running atomic.Bool
+}
+
+// TaskRun is the outcome of the last run of a task.
+type TaskRun struct {
+	Name string `bson:"_id" json:"-"`
+	// The schedule time the run was for, so each one runs once
+	Slot time.Time `bson:"slot" json:"-"`
+	// running, succeeded or failed
+	Status     string     `bson:"status" json:"status"`
+	StartedAt  time.Time  `bson:"startedAt" json:"startedAt"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	Result     string     `bson:"result,omitempty" json:"result,omitempty"`
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
+	Instance   string     `bson:"instance" json:"instance"`
+}
+
+// TaskStatus is a task as listed by GET /admin/tasks.
+type TaskStatus struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Schedule    string     `json:"schedule"`
+	Next        *time.Time `json:"next,omitempty"`
+	Last        *TaskRun   `json:"last,omitempty"`
+}
+
+// scheduler runs the tasks on their cron schedule, in the background.
+type scheduler struct {
+	cron     *cron.Cron
+	runs     *mongo.Collection
+	instance string
+	tasks    []*task
+	readOnly *readOnlyMode
+	// Cancelled on shutdown, which cancels the runs in progress
+	ctx context.Context
+}
+
+func newScheduler(ctx context.Context, db *mongo.Database, readOnly *readOnlyMode) *scheduler {
+	instance, _ := os.Hostname()
+	return &scheduler{
+		cron:     cron.New(),
+		runs:     db.Collection(taskRunsCollection),
+		instance: fmt.Sprintf("%s:%d", instance, os.Getpid()),
+		readOnly: readOnly,
+		ctx:      ctx,
+	}
+}
+
+// Add schedules a task. Tasks with an empty schedule, or "off", are left
+// out.
+func (s *scheduler) Add(t *task) error {
+	if t.schedule == "" || t.schedule == "off" {
+		return nil
+	}
+	id, err := s.cron.AddFunc(t.schedule, func() {
+		s.runTask(t, time.Now().UTC().Truncate(time.Minute))
+	})
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q of task %s: %w", t.schedule, t.name, err)
+	}
+	t.next = func() time.Time { return s.cron.Entry(id).Next }
+	s.tasks = append(s.tasks, t)
+	return nil
+}
+
+// Run runs the tasks on schedule until the context of the scheduler is
+// cancelled, and waits for the runs in progress to stop.
+func (s *scheduler) Run() {
+	s.cron.Start()
+	<-s.ctx.Done()
+	<-s.cron.Stop().Done()
+}
+
+func (s *scheduler) find(name string) *task {
+	for _, t := range s.tasks {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// claim records the start of a run. For tasks that are not local it fails
+// when another instance has claimed this slot, or is still running it.
+func (s *scheduler) claim(ctx context.Context, t *task, slot time.Time) (bool, error) {
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set":   bson.M{"slot": slot, "status": "running", "startedAt": now, "instance": s.instance},
+		"$unset": bson.M{"finishedAt": "", "result": "", "error": ""},
+	}
+	filter := bson.M{"_id": t.name}
+	if !t.local {
+		filter["slot"] = bson.M{"$lt": slot}
+		filter["$or"] = bson.A{
+			bson.M{"status": bson.M{"$ne": "running"}},
+			bson.M{"startedAt": bson.M{"$lt": now.Add(-taskLease)}},
+		}
+	}
+	// When the filter doesn't match, the upsert tries to insert a second
+	// document with the same _id: someone else has the run
+	_, err := s.runs.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runTask runs the task for the given slot, unless it is already running
+// here or another instance took it. Tasks changing the catalog are left to
+// the other instances while this one is read-only.
+func (s *scheduler) runTask(t *task, slot time.Time) {
+	if !t.running.CompareAndSwap(false, true) {
+		slog.Info("task still running, skipping this run", "task", t.name)
+		return
+	}
+	defer t.running.Store(false)
+	if t.writes && s.readOnly.enabled() {
+		slog.Info("catalog is read-only, skipping task", "task", t.name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, taskLease)
+	defer cancel()
+	claimed, err := s.claim(ctx, t, slot)
+	if err != nil {
+		slog.Warn("could not start task", "task", t.name, "error", err)
+		return
+	}
+	if !claimed {
+		slog.Debug("task run by another instance", "task", t.name)
+		return
+	}
+
+	start := time.Now()
+	result, err := t.run(ctx)
+	set := bson.M{"status": "succeeded", "finishedAt": time.Now().UTC(), "result": result}
+	if err != nil {
+		set["status"] = "failed"
+		set["error"] = err.Error()
+		slog.Error("task failed", "task", t.name, "error", err)
+	} else {
+		slog.Info("task done", "task", t.name, "result", result, "duration", time.Since(start))
+	}
+	// With a context of its own, to record runs cut short by a shutdown
+	saveCtx, cancelSave := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelSave()
+	if _, err := s.runs.UpdateByID(saveCtx, t.name, bson.M{"$set": set}); err != nil {
+		slog.Warn("could not record task run", "task", t.name, "error", err)
+	}
+}
+
+// Status lists the tasks with their next and last runs.
+func (s *scheduler) Status(ctx context.Context) ([]TaskStatus, error) {
+	cursor, err := s.runs.Find(ctx, bson.D{}, store.FindOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var runs []TaskRun
+	if err := cursor.All(ctx, &runs); err != nil {
+		return nil, err
+	}
+	last := make(map[string]TaskRun, len(runs))
+	for _, run := range runs {
+		last[run.Name] = run
+	}
+
+	statuses := make([]TaskStatus, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		status := TaskStatus{Name: t.name, Description: t.description, Schedule: t.schedule}
+		// Zero until the scheduler is started
+		if next := t.next(); !next.IsZero() {
+			status.Next = &next
+		}
+		if run, ok := last[t.name]; ok {
+			status.Last = &run
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// addCatalogTasks schedules the recurring jobs of the app. warm loads the
+// hot entries of the catalog cache (see warmup.go).
+func addCatalogTasks(sched *scheduler, cfg config.TasksConfig, coll *mongo.Collection, files fileStore, hooks *webhooks, warm cacheLoads) error {
+	if _, ok := exportContentTypes[cfg.BackupFormat]; !ok {
+		return fmt.Errorf("invalid backup format %q, expected one of %s", cfg.BackupFormat, strings.Join(exportFormats(), ", "))
+	}
+	tasks := []*task{
+		{
+			name:        "backup",
+			description: "Exports the catalog to the file storage and deletes the old exports",
+			schedule:    cfg.Backup,
+			run: func(ctx context.Context) (string, error) {
+				name, count, err := storeExport(ctx, coll, files, cfg.BackupFormat)
+				if err != nil {
+					return "", err
+				}
+				result := fmt.Sprintf("Exported %d books to %s", count, filesPrefix+name)
+				if cfg.BackupRetention > 0 {
+					deleted, err := purgeExports(ctx, files, cfg.BackupRetention)
+					if err != nil {
+						return result, fmt.Errorf("could not delete old exports: %w", err)
+					}
+					result += fmt.Sprintf(", deleted %d old exports", deleted)
+				}
+				return result, nil
+			},
+		},
+		{
+			name:        "cache-warmup",
+			description: "Loads the book list, authors, years and stats into the cache when they expired, so no visitor waits for them",
+			schedule:    cfg.CacheWarmup,
+			local:       true,
+			run: func(ctx context.Context) (string, error) {
+				n, err := warm.warm(ctx)
+				return fmt.Sprintf("%d cache entries loaded", n), err
+			},
+		},
+		{
+			name:        "webhook-sweep",
+			description: "Tries again the webhook deliveries that failed in the last day",
+			schedule:    cfg.WebhookSweep,
+			run: func(ctx context.Context) (string, error) {
+				n, err := hooks.RetryFailed(ctx)
+				return fmt.Sprintf("%d deliveries queued again", n), err
+			},
+		},
+	}
+	for _, t := range tasks {
+		if err := sched.Add(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerTaskRoutes mounts GET /admin/tasks, which lists the scheduled
+// tasks with their last run, and POST /admin/tasks/:name/run, which runs
+// one in the background right away.
+func registerTaskRoutes(admin *echo.Group, sched *scheduler) {
+	admin.GET("/tasks", func(c echo.Context) error {
+		statuses, err := sched.Status(c.Request().Context())
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if render.WantsHTML(c) {
+			return render.Page(c, http.StatusOK, "tasks", statuses)
+		}
+		return c.JSON(http.StatusOK, statuses)
+	})
+
+	admin.POST("/tasks/:name/run", func(c echo.Context) error {
+		t := sched.find(c.Param("name"))
+		if t == nil {
+			return handlers.JSONError(c, http.StatusNotFound, "Task not found")
+		}
+		if t.running.Load() {
+			return handlers.JSONError(c, http.StatusConflict, "Task is already running")
+		}
+		// Any slot later than the scheduled ones
+		go sched.runTask(t, time.Now().UTC())
+		if render.IsBrowserSubmission(c) {
+			return c.Render(http.StatusAccepted, "task-started", t.name)
+		}
+		return c.JSON(http.StatusAccepted, map[string]string{"status": "Task started"})
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// telegramSearchLimit is the number of results /search replies with.
+const telegramSearchLimit = 5
+
+// telegramPollTimeout is how long a getUpdates call waits for messages.
+const telegramPollTimeout = 30 * time.Second
+
+const telegramHelp = `Commands:
+/search <words> finds books by title or author
+/book <id> shows a book
+/add <id> | <title> | <author> | <edition> | <pages> | <year> adds a book (edition, pages and year are optional)`
+
+// telegramBot answers the commands sent to the bot, from the same
+// repository and search backend as the API. It polls the Bot API with
+// getUpdates, so it needs no public URL.
+type telegramBot struct {
+	apiURL   string // https://api.telegram.org/bot<token>
+	client   *http.Client
+	books    handlers.BookRepository
+	catalog  *ttlCache
+	searcher searchBackend
+	// Chats allowed to /add, from TELEGRAM_ADD_CHATS. Anyone can read.
+	addChats map[int64]bool
+	// No chat may /add while it is on
+	readOnly *readOnlyMode
+}
+
+func newTelegramBot(cfg config.TelegramConfig, books handlers.BookRepository, readOnly *readOnlyMode, catalog *ttlCache, searcher searchBackend) (*telegramBot, error) {
+	addChats := map[int64]bool{}
+	for _, chat := range cfg.AddChats {
+		id, err := strconv.ParseInt(chat, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID %q in TELEGRAM_ADD_CHATS", chat)
+		}
+		addChats[id] = true
+	}
+	return &telegramBot{
+		apiURL:   strings.TrimSuffix(cfg.APIURL, "/") + "/bot" + cfg.Token,
+		client:   &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+		books:    books,
+		catalog:  catalog,
+		searcher: searcher,
+		addChats: addChats,
+		readOnly: readOnly,
+	}, nil
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// call sends a Bot API method and decodes its result into out.
+func (b *telegramBot) call(ctx context.Context, method string, params interface{}, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The error holds the URL, and with it the token
+		return fmt.Errorf("telegram %s: %w", method, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, resp.Status)
+	}
+	if !res.OK {
+		return fmt.Errorf("telegram %s: %s", method, res.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
+
+// Run polls for messages until ctx is cancelled. Messages are answered one
+// at a time.
+func (b *telegramBot) Run(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := b.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout / time.Second),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("could not get Telegram updates", "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message == nil || update.Message.Text == "" {
+				continue
+			}
+			chat := update.Message.Chat.ID
+			reply := b.handle(ctx, chat, update.Message.Text)
+			if err := b.call(ctx, "sendMessage", map[string]interface{}{"chat_id": chat, "text": reply}, nil); err != nil {
+				slog.Warn("could not answer on Telegram", "chat", chat, "error", err)
+			}
+		}
+	}
+}
+
+// handle runs a command and returns the reply.
+func (b *telegramBot) handle(ctx context.Context, chat int64, text string) string {
+	command, args, _ := strings.Cut(strings.TrimSpace(text), " ")
+	// In groups commands may be addressed as /search@name_of_the_bot
+	command, _, _ = strings.Cut(command, "@")
+	args = strings.TrimSpace(args)
+
+	ctx, cancel := context.WithTimeout(store.WithActor(ctx, fmt.Sprintf("telegram:%d", chat)), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "/search":
+		if args == "" {
+			return "Usage: /search <words>"
+		}
+		results, err := b.searcher.Search(ctx, args)
+		if err != nil {
+			slog.ErrorContext(ctx, "telegram search failed", "error", err)
+			return "Search is unavailable, try again later."
+		}
+		if len(results) == 0 {
+			return "No books found."
+		}
+		lines := make([]string, 0, telegramSearchLimit+1)
+		for _, r := range results[:min(len(results), telegramSearchLimit)] {
+			lines = append(lines, fmt.Sprintf("%s by %s (/book %s)", r.BookName, r.BookAuthor, r.ID))
+		}
+		if len(results) > telegramSearchLimit {
+			lines = append(lines, fmt.Sprintf("and %d more.", len(results)-telegramSearchLimit))
+		}
+		return strings.Join(lines, "\n")
+
+	case "/book":
+		if args == "" {
+			return "Usage: /book <id>"
+		}
+		book, err := b.books.ByID(ctx, args)
+		if errors.Is(err, store.ErrNotFound) {
+			return "Book not found."
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "telegram book lookup failed", "id", args, "error", err)
+			return "The catalog is unavailable, try again later."
+		}
+		return formatTelegramBook(book)
+
+	case "/add":
+		if !b.addChats[chat] {
+			return fmt.Sprintf("This chat may not add books. Add its ID (%d) to TELEGRAM_ADD_CHATS.", chat)
+		}
+		if b.readOnly.enabled() {
+			return "The catalog is read-only."
+		}
+		return b.add(ctx, args)
+
+	case "/start", "/help":
+		return telegramHelp
+	}
+	return "Unknown command.\n\n" + telegramHelp
+}
+
+// add inserts the book described by "id | title | author | edition |
+// pages | year" through the same repository, and with the same checks, as
+// POST /api/books.
+func (b *telegramBot) add(ctx context.Context, args string) string {
+	fields := strings.Split(args, "|")
+	get := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	book := store.Book{
+		ID:          get(0),
+		BookName:    get(1),
+		BookAuthor:  get(2),
+		BookEdition: get(3),
+		BookPages:   get(4),
+		BookYear:    get(5),
+	}
+	now := time.Now().UTC()
+	book.CreatedAt = &now
+	book.UpdatedBy = store.ActorFromContext(ctx)
+	err := b.books.Insert(ctx, book)
+	var ve *store.ValidationError
+	switch {
+	case errors.As(err, &ve):
+		msgs := make([]string, 0, len(ve.Fields))
+		for _, msg := range ve.Fields {
+			msgs = append(msgs, msg)
+		}
+		slices.Sort(msgs)
+		return strings.Join(msgs, "\n") + "\n\nUsage: /add <id> | <title> | <author> | <edition> | <pages> | <year>"
+	case errors.Is(err, store.ErrDuplicate):
+		return "Book already exists."
+	case errors.Is(err, store.ErrUnavailable):
+		slog.ErrorContext(ctx, "telegram insert failed", "error", err)
+		return "The catalog is unavailable, try again later."
+	case err != nil:
+		slog.ErrorContext(ctx, "telegram insert failed", "error", err)
+		return "Could not add the book."
+	}
+	b.catalog.invalidate()
+	b.searcher.Indexed(ctx, book)
+	return "Book created: /book " + book.ID
+}
+
+func formatTelegramBook(book store.Book) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\nby %s\n", book.BookName, book.BookAuthor)
+	row := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sb, "\n%s: %s", name, value)
+		}
+	}
+	row("ID", book.ID)
+	row("Edition", book.BookEdition)
+	row("Pages", book.BookPages)
+	row("Year", book.BookYear)
+	row("Subjects", strings.Join(book.BookSubjects, ", "))
+	return sb.String()
+}
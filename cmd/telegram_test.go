@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+// telegramBooks is a catalog for the bot, the methods it doesn't use
+// panicking on the nil repository.
+type telegramBooks struct {
+	handlers.BookRepository
+	books map[string]store.Book
+	err   error
+}
+
+func (r *telegramBooks) ByID(_ context.Context, id string) (store.Book, error) {
+	if r.err != nil {
+		return store.Book{}, r.err
+	}
+	book, ok := r.books[id]
+	if !ok {
+		return store.Book{}, store.ErrNotFound
+	}
+	return book, nil
+}
+
+// Insert fails like store.Books.Insert, the title being the only check.
+func (r *telegramBooks) Insert(_ context.Context, book store.Book) error {
+	if r.err != nil {
+		return r.err
+	}
+	if book.BookName == "" {
+		return &store.ValidationError{Fields: store.FieldErrors{"BookName": "Title is required"}}
+	}
+	if _, ok := r.books[book.ID]; ok {
+		return store.ErrDuplicate
+	}
+	r.books[book.ID] = book
+	return nil
+}
+
+func TestTelegramBook(t *testing.T) {
+	books := map[string]store.Book{
+		"example1": {ID: "example1", BookName: "Frankenstein", BookAuthor: "Mary Shelley"},
+	}
+	down := fmt.Errorf("find: %w", store.ErrUnavailable)
+	tests := []struct {
+		name, text string
+		err        error
+		want       string
+	}{
+		{"found", "/book example1", nil, "Frankenstein\nby Mary Shelley\n"},
+		{"not found", "/book missing", nil, "Book not found."},
+		{"unavailable", "/book example1", down, "The catalog is unavailable"},
+		{"no ID", "/book", nil, "Usage: /book <id>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &telegramBot{books: &telegramBooks{books: books, err: tt.err}}
+			if got := b.handle(context.Background(), 1, tt.text); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want it to start with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelegramAddReadOnly(t *testing.T) {
+	// Without a catalog: a book added would panic
+	b := &telegramBot{addChats: map[int64]bool{1: true}, readOnly: newReadOnlyMode(true)}
+	got := b.handle(context.Background(), 1, "/add example9 | Dracula | Bram Stoker")
+	if got != "The catalog is read-only." {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTelegramAdd(t *testing.T) {
+	down := fmt.Errorf("insert: %w", store.ErrUnavailable)
+	tests := []struct {
+		name, text string
+		err        error
+		want       string
+	}{
+		{"added", "/add example9 | Dracula | Bram Stoker", nil, "Book created: /book example9"},
+		{"invalid", "/add example9 | | Bram Stoker", nil, "Title is required\n\nUsage: /add"},
+		{"duplicate", "/add example1 | Frankenstein | Mary Shelley", nil, "Book already exists."},
+		{"unavailable", "/add example9 | Dracula | Bram Stoker", down, "The catalog is unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &telegramBooks{books: map[string]store.Book{"example1": {ID: "example1"}}, err: tt.err}
+			b := &telegramBot{
+				books:    repo,
+				catalog:  newTTLCache(time.Minute, nil),
+				searcher: &memorySearch{},
+				addChats: map[int64]bool{1: true},
+				readOnly: newReadOnlyMode(false),
+			}
+			if got := b.handle(context.Background(), 1, tt.text); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want it to start with %q", got, tt.want)
+			}
+		})
+	}
+	// Stamped like the books added through the API
+	repo := &telegramBooks{books: map[string]store.Book{}}
+	b := &telegramBot{books: repo, catalog: newTTLCache(time.Minute, nil), searcher: &memorySearch{}, addChats: map[int64]bool{1: true}, readOnly: newReadOnlyMode(false)}
+	b.handle(context.Background(), 1, "/add example9 | Dracula | Bram Stoker")
+	if book := repo.books["example9"]; book.CreatedAt == nil || book.UpdatedBy != "telegram:1" {
+		t.Errorf("got createdAt %v and updatedBy %q", book.CreatedAt, book.UpdatedBy)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Uploaded covers get smaller variants, covers/<hash>-<size>.jpg next to
+// covers/<hash>.<ext>, which /files/ serves for ?size= (see files.go): the
+// book table shows the small one rather than downloading every full size
+// cover. Variants are JPEG, the standard library having no WebP encoder,
+// and WebP uploads get none since it can't decode them either; they are
+// served the original instead, as are the covers narrower than a size.
+
+// coverSizes are the widths of the variants, by name.
+var coverSizes = []struct {
+	name  string
+	width int
+}{
+	{"small", 80},
+	{"medium", 240},
+	{"large", 480},
+}
+
+const thumbnailQuality = 85
+
+// coverVariant returns the name of the variant of a cover for size. ok is
+// false for an unknown size; files which aren't covers stored by content
+// have no variants, and are returned as is.
+func coverVariant(name, size string) (variant string, ok bool) {
+	for _, s := range coverSizes {
+		if s.name != size {
+			continue
+		}
+		if !contentAddressedCover.MatchString(name) {
+			return name, true
+		}
+		return strings.TrimSuffix(name, path.Ext(name)) + "-" + size + ".jpg", true
+	}
+	return "", false
+}
+
+// coverSizeURL links to the variant of a stored cover for size, the
+// "coverSize" template function. Other links, e.g. to the covers of
+// Open Library, are left as they are.
+func coverSizeURL(link, size string) string {
+	if !strings.HasPrefix(link, filesPrefix) {
+		return link
+	}
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
+	}
+	return link + sep + "size=" + url.QueryEscape(size)
+}
+
+// coverVariants are the names of all the variants of a cover.
+func coverVariants(name string) []string {
+	if !contentAddressedCover.MatchString(name) {
+		return nil
+	}
+	variants := make([]string, 0, len(coverSizes))
+	for _, s := range coverSizes {
+		variant, _ := coverVariant(name, s.name)
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+// storeThumbnails stores the variants of the cover name narrower than the
+// image. Images which can't be decoded get none.
+func storeThumbnails(ctx context.Context, files fileStore, name string, data []byte) error {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	for _, s := range coverSizes {
+		if src.Bounds().Dx() <= s.width {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeImage(src, s.width), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+		variant, _ := coverVariant(name, s.name)
+		if err := files.Put(ctx, variant, "image/jpeg", &buf, int64(buf.Len())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeImage scales src down to width, keeping its aspect ratio. Each
+// pixel is the average of the pixels of src it covers, which keeps the
+// details of covers sharper than sampling. Transparent areas turn white,
+// JPEG having no alpha.
+func resizeImage(src image.Image, width int) *image.RGBA {
+	b := src.Bounds()
+	height := max(b.Dy()*width/b.Dx(), 1)
+
+	// Flattened first, so the averages are plain sums
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*b.Dy()/height, max((y+1)*b.Dy()/height, y*b.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*b.Dx()/width, max((x+1)*b.Dx()/width, x*b.Dx()/width+1)
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					p := flat.RGBAAt(sx, sy)
+					r, g, bl, n = r+uint32(p.R), g+uint32(p.G), bl+uint32(p.B), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/jmespath/go-jmespath"
+	"github.com/labstack/echo/v4"
+)
+
+// Any JSON answer of the API can be reshaped with ?transform=, a JMESPath
+// expression (https://jmespath.org) applied to it before it is sent, e.g.
+//
+//	GET /api/books?transform=[].{title: title, author: author}
+//	GET /api/stats?transform=topAuthors[:3].author
+//
+// so integrators get the fields they need without a proxy of their own.
+// Errors and other kinds of answers are sent as they are. Expressions are
+// bounded in length, which bounds how deep the parser recurses.
+const maxTransformLength = 1024
+
+// compileTransform parses expr, telling where it is invalid, as a byte
+// offset.
+func compileTransform(expr string) (*jmespath.JMESPath, int, error) {
+	if len(expr) > maxTransformLength {
+		return nil, maxTransformLength, fmt.Errorf("longer than %d bytes", maxTransformLength)
+	}
+	compiled, err := jmespath.Compile(expr)
+	if err != nil {
+		var syntax jmespath.SyntaxError
+		if errors.As(err, &syntax) {
+			return nil, syntax.Offset, err
+		}
+		return nil, 0, err
+	}
+	return compiled, 0, nil
+}
+
+// transformResponses applies ?transform= to the successful JSON answers of
+// /api/. An expression that doesn't parse is a 400 telling where, before
+// the request is handled.
+func transformResponses() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			expr := c.QueryParam("transform")
+			if expr == "" || req.Method == http.MethodHead || !strings.HasPrefix(req.URL.Path, "/api/") {
+				return next(c)
+			}
+			compiled, pos, err := compileTransform(expr)
+			if err != nil {
+				body := handlers.ErrorBody(c, fmt.Sprintf("invalid transform at position %d: %s", pos, err))
+				body["position"] = pos
+				return c.JSON(http.StatusBadRequest, body)
+			}
+
+			res := c.Response()
+			w := &transformWriter{ResponseWriter: res.Writer}
+			res.Writer = w
+			err = next(c)
+			res.Writer = w.ResponseWriter
+			if err != nil || !w.buffering {
+				return err
+			}
+			return w.send(c, compiled)
+		}
+	}
+}
+
+// transformWriter holds back the body of the successful JSON answers, to
+// transform it. The others go through.
+type transformWriter struct {
+	http.ResponseWriter
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (w *transformWriter) WriteHeader(code int) {
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get(echo.HeaderContentType))
+	if code >= 200 && code < 300 && mediaType == echo.MIMEApplicationJSON {
+		w.status, w.buffering = code, true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *transformWriter) Write(b []byte) (int, error) {
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// send writes the transformed body. A transform failing on the answer,
+// e.g. calling sum() on strings, is the client's fault: a 400.
+func (w *transformWriter) send(c echo.Context, expr *jmespath.JMESPath) error {
+	status := w.status
+	var data interface{}
+	err := json.Unmarshal(w.body.Bytes(), &data)
+	if err == nil {
+		data, err = expr.Search(data)
+	}
+	var out []byte
+	if err == nil {
+		out, err = json.Marshal(data)
+	}
+	if err != nil {
+		status = http.StatusBadRequest
+		out, _ = json.Marshal(handlers.ErrorBody(c, "Could not transform the response: "+err.Error()))
+	}
+	h := w.Header()
+	// The validator of the original body doesn't match this one
+	h.Del("ETag")
+	h.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	h.Set(echo.HeaderContentLength, strconv.Itoa(len(out)+1))
+	w.ResponseWriter.WriteHeader(status)
+	c.Response().Status = status
+	_, err = w.ResponseWriter.Write(append(out, '\n'))
+	return err
+}
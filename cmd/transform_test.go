@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestTransformResponses(t *testing.T) {
+	e := echo.New()
+	e.Use(transformResponses())
+	books := []map[string]interface{}{
+		{"id": "frankenstein", "title": "Frankenstein", "author": "Mary Shelley", "year": 1818},
+		{"id": "dracula", "title": "Dracula", "author": "Bram Stoker", "year": 1897},
+	}
+	e.GET("/api/books", func(c echo.Context) error { return c.JSON(http.StatusOK, books) })
+	e.GET("/api/missing", func(c echo.Context) error {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Not found"})
+	})
+	e.GET("/books", func(c echo.Context) error { return c.JSON(http.StatusOK, books) })
+
+	tests := []struct {
+		path      string
+		transform string
+		status    int
+		body      string
+	}{
+		{"/api/books", "[].title", http.StatusOK, `["Frankenstein","Dracula"]`},
+		{"/api/books", "[?year > `1850`].{t: title, by: author}", http.StatusOK, `[{"by":"Bram Stoker","t":"Dracula"}]`},
+		{"/api/books", "sort_by(@, &year)[-1].id", http.StatusOK, `"dracula"`},
+		{"/api/books", "length(@)", http.StatusOK, `2`},
+		// Only the successful answers of the API
+		{"/api/missing", "error", http.StatusNotFound, `{"error":"Not found"}`},
+		{"/books", "[].title", http.StatusOK, `[{"author":"Mary Shelley","id":"frankenstein","title":"Frankenstein","year":1818},{"author":"Bram Stoker","id":"dracula","title":"Dracula","year":1897}]`},
+		// Failing on the answer
+		{"/api/books", "sum([].title)", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path+"?transform="+url.QueryEscape(tt.transform), nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.transform, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if tt.body != "" && strings.TrimSpace(rec.Body.String()) != tt.body {
+			t.Errorf("%s: got %s, want %s", tt.transform, rec.Body, tt.body)
+		}
+	}
+}
+
+func TestTransformInvalid(t *testing.T) {
+	e := echo.New()
+	e.Use(transformResponses())
+	e.GET("/api/books", func(c echo.Context) error {
+		t.Errorf("handled despite an invalid transform")
+		return c.NoContent(http.StatusOK)
+	})
+	tests := []struct {
+		transform string
+		position  int
+	}{
+		{"[].{title: }", 11},
+		{"foo[", 4},
+		{"`not json", 9},
+		{strings.Repeat("a.", maxTransformLength), maxTransformLength},
+		{strings.Repeat("[", maxTransformLength), 1024},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/books?transform="+url.QueryEscape(tt.transform), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%.20s: status %d, want 400", tt.transform, rec.Code)
+			continue
+		}
+		var body struct {
+			Position int `json:"position"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%.20s: %v", tt.transform, err)
+		} else if body.Position != tt.position {
+			t.Errorf("%.20s: position %d, want %d", tt.transform, body.Position, tt.position)
+		}
+	}
+}
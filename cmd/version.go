@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)" ./cmd
+//
+// When left empty, we fall back to what the Go toolchain recorded in the
+// binary (module version and VCS information).
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// BuildInfo is the body of GET /api/version.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// buildInfo is computed once, it can't change while running.
+var buildInfo = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// versionHeader adds X-App-Version to every response, so it is easy to tell
+// which deployment answered.
+func versionHeader() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set("X-App-Version", buildInfo.Version)
+			return next(c)
+		}
+	}
+}
+
+func versionHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, buildInfo)
+}
+
+// runVersion prints the build information as JSON.
+func runVersion(cfg config.Config, logger *slog.Logger, args []string) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(buildInfo)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Right after a deploy the catalog cache is empty, and the first visitors
+// would wait for the full-collection reads. The hot entries are loaded in
+// the background on startup instead, and GET /readyz answers 503 until
+// they are, so a load balancer checking it sends no traffic to a cold
+// instance. The cache-warmup task (see tasks.go) loads the same entries.
+
+// How long startup waits for the warm-up before reporting ready anyway.
+const warmupTimeout = 30 * time.Second
+
+// cacheLoads are the reads of the hot entries of the catalog cache, by key.
+type cacheLoads map[string]func(context.Context) error
+
+// cacheLoad adapts a cached read to cacheLoads.
+func cacheLoad[T any](load func(context.Context) (T, error)) func(context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := load(ctx)
+		return err
+	}
+}
+
+// warm runs the loads at once, each in its goroutine, and returns how
+// many succeeded. A failed load only leaves its entry cold.
+func (loads cacheLoads) warm(ctx context.Context) (int, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for key, load := range loads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := load(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return len(loads) - len(errs), errors.Join(errs...)
+}
+
+// readiness is the gate of GET /readyz.
+type readiness struct {
+	ready atomic.Bool
+}
+
+// warmOnStartup warms the cache in the background and opens the gate once
+// it is done, or after warmupTimeout. Failures are logged, a cold cache
+// only being slower.
+func warmOnStartup(ctx context.Context, loads cacheLoads) *readiness {
+	r := &readiness{}
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+		defer cancel()
+		start := time.Now()
+		n, err := loads.warm(ctx)
+		if err != nil {
+			slog.Warn("cache warm-up incomplete", "loaded", n, "error", err)
+		} else {
+			slog.Info("cache warmed up", "loaded", n, "duration", time.Since(start))
+		}
+		r.ready.Store(true)
+	}()
+	return r
+}
+
+func (r *readiness) handler(c echo.Context) error {
+	if !r.ready.Load() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "warming up"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhooks POST the events of events.go to the URLs subscribed by the
+// admins. Like emails (see mail.go), deliveries are queued in MongoDB and
+// sent in the background, retried with a growing delay, and each one is
+// claimed by a single instance. Every attempt is logged on its delivery.
+const (
+	webhookSubscriptionsCollection = "webhook_subscriptions"
+	webhookDeliveriesCollection    = "webhook_deliveries"
+)
+
+const (
+	maxWebhookAttempts  = 5
+	webhookClaimTimeout = time.Minute
+	webhookPollInterval = 10 * time.Second
+	webhookTimeout      = 10 * time.Second
+	// Only the start of the response is kept in the log
+	maxWebhookResponse = 1024
+
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// WebhookSubscription sends the events of the given types (all of them
+// when empty) to URL, signed with Secret.
+type WebhookSubscription struct {
+	ID  primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL string             `bson:"url" json:"url"`
+	// Only returned when the subscription is created or the secret changed
+	Secret    string     `bson:"secret" json:"secret,omitempty"`
+	Events    []string   `bson:"events" json:"events"`
+	Active    bool       `bson:"active" json:"active"`
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// WebhookDelivery is an event to send to a subscription, with the log of
+// the attempts so far.
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SubscriptionID primitive.ObjectID `bson:"subscriptionId" json:"subscriptionId"`
+	// The change stream resume token of the change, so the instances all
+	// watching the collection queue a single delivery
+	ChangeID  string `bson:"changeId" json:"-"`
+	EventID   string `bson:"eventId" json:"eventId"`
+	EventType string `bson:"eventType" json:"eventType"`
+	Payload   string `bson:"payload" json:"payload"`
+	// pending, succeeded or failed (after maxWebhookAttempts)
+	Status        string           `bson:"status" json:"status"`
+	Attempts      []WebhookAttempt `bson:"attempts" json:"attempts"`
+	CreatedAt     time.Time        `bson:"createdAt" json:"createdAt"`
+	NextAttemptAt time.Time        `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	DeliveredAt   *time.Time       `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+	// Set when RetryFailed queued it again
+	Swept bool `bson:"swept,omitempty" json:"swept,omitempty"`
+}
+
+// WebhookAttempt is one POST of a delivery. StatusCode is 0 when no
+// response came back, Error says why.
+type WebhookAttempt struct {
+	At         time.Time `bson:"at" json:"at"`
+	StatusCode int       `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Response   string    `bson:"response,omitempty" json:"response,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	DurationMs int64     `bson:"durationMs" json:"durationMs"`
+}
+
+type webhooks struct {
+	subs       *mongo.Collection
+	deliveries *mongo.Collection
+	client     *http.Client
+	// Wakes the sender up when a delivery is queued
+	wake chan struct{}
+}
+
+func newWebhooks(db *mongo.Database) *webhooks {
+	return &webhooks{
+		subs:       db.Collection(webhookSubscriptionsCollection),
+		deliveries: db.Collection(webhookDeliveriesCollection),
+		client:     &http.Client{Timeout: webhookTimeout},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (w *webhooks) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Queue is the change feed subscriber queueing a delivery of the change for
+// every matching subscription.
+func (w *webhooks) Queue(ctx context.Context, change bookChange) {
+	event, ok := bookEventFromChange(change)
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("could not encode event", "error", err)
+		return
+	}
+	filter := bson.M{"active": true, "$or": bson.A{
+		bson.M{"events": bson.M{"$size": 0}},
+		bson.M{"events": event.Type},
+	}}
+	cursor, err := w.subs.Find(ctx, filter, store.FindOpts(ctx).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		slog.Warn("could not read webhook subscriptions", "error", err)
+		return
+	}
+	var subs []WebhookSubscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		slog.Warn("could not read webhook subscriptions", "error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, sub := range subs {
+		_, err := w.deliveries.InsertOne(ctx, WebhookDelivery{
+			SubscriptionID: sub.ID,
+			ChangeID:       change.Token.Data,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        string(payload),
+			Status:         "pending",
+			Attempts:       []WebhookAttempt{},
+			CreatedAt:      now,
+			NextAttemptAt:  now,
+		}, store.InsertOneOpts(ctx))
+		// Another instance queued it already
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("could not queue webhook delivery", "subscription", sub.ID.Hex(), "error", err)
+		}
+	}
+	if len(subs) > 0 {
+		w.notify()
+	}
+}
+
+// RunSender delivers the queued events until ctx is cancelled.
+func (w *webhooks) RunSender(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		for w.sendNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// sendNext claims and sends one due delivery, and tells if there was one.
+func (w *webhooks) sendNext(ctx context.Context) bool {
+	now := time.Now().UTC()
+	var delivery WebhookDelivery
+	err := w.deliveries.FindOneAndUpdate(ctx,
+		bson.M{"status": "pending", "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(webhookClaimTimeout)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After),
+	).Decode(&delivery)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			slog.Warn("could not read the webhook deliveries", "error", err)
+		}
+		return false
+	}
+
+	var sub WebhookSubscription
+	err = w.subs.FindOne(ctx, bson.M{"_id": delivery.SubscriptionID}).Decode(&sub)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// The subscription was deleted in the meantime
+		w.deliveries.DeleteOne(ctx, bson.M{"_id": delivery.ID})
+		return true
+	}
+	if err != nil {
+		slog.Warn("could not read webhook subscription", "error", err)
+		return true
+	}
+
+	attempt := w.send(ctx, sub, delivery)
+	set := bson.M{}
+	switch {
+	case attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		set["status"] = "succeeded"
+		set["deliveredAt"] = attempt.At
+	case len(delivery.Attempts)+1 >= maxWebhookAttempts:
+		set["status"] = "failed"
+		slog.Warn("giving up webhook delivery", "url", sub.URL, "event", delivery.EventType,
+			"status", attempt.StatusCode, "error", attempt.Error)
+	default:
+		// 1, 2, 4, 8 minutes between attempts
+		set["nextAttemptAt"] = time.Now().UTC().Add(time.Minute << len(delivery.Attempts))
+	}
+	update := bson.M{"$set": set, "$push": bson.M{"attempts": attempt}}
+	if _, err := w.deliveries.UpdateByID(ctx, delivery.ID, update); err != nil {
+		slog.Warn("could not update the webhook delivery", "error", err)
+	}
+	return true
+}
+
+// RetryFailed queues the deliveries of the active subscriptions that
+// failed in the last day for one more attempt, e.g. once their receiver is
+// back up, and returns how many. Each delivery is retried this way once.
+func (w *webhooks) RetryFailed(ctx context.Context) (int, error) {
+	cursor, err := w.subs.Find(ctx, bson.M{"active": true}, store.FindOpts(ctx).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var subs []WebhookSubscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return 0, err
+	}
+	ids := make(bson.A, 0, len(subs))
+	for _, sub := range subs {
+		ids = append(ids, sub.ID)
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"subscriptionId": bson.M{"$in": ids},
+		"status":         "failed",
+		"swept":          bson.M{"$ne": true},
+		"createdAt":      bson.M{"$gte": now.Add(-24 * time.Hour)},
+	}
+	update := bson.M{"$set": bson.M{"status": "pending", "nextAttemptAt": now, "swept": true}}
+	res, err := w.deliveries.UpdateMany(ctx, filter, update, store.UpdateOpts(ctx))
+	if err != nil {
+		return 0, err
+	}
+	if res.ModifiedCount > 0 {
+		w.notify()
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// send POSTs the event. The body is signed with HMAC-SHA256 and the secret
+// of the subscription, in the X-Bookstore-Signature header, so receivers
+// can check it comes from us.
+func (w *webhooks) send(ctx context.Context, sub WebhookSubscription, delivery WebhookDelivery) (attempt WebhookAttempt) {
+	attempt.At = time.Now().UTC()
+	defer func() { attempt.DurationMs = time.Since(attempt.At).Milliseconds() }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	mac := hmac.New(sha256.New, []byte(sub.Secret))
+	mac.Write([]byte(delivery.Payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bookstore/"+buildInfo.Version)
+	req.Header.Set("X-Bookstore-Event", delivery.EventType)
+	req.Header.Set("X-Bookstore-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Bookstore-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(body)
+	return attempt
+}
+
+// webhookEventTypes are the values accepted in the event filter.
+var webhookEventTypes = []string{"book.created", "book.updated", "book.deleted"}
+
+// webhookInput is the body of POST and PUT /admin/webhooks. Active
+// defaults to true; an empty secret is generated on creation and kept on
+// updates.
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+func (in webhookInput) validate() string {
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url must be an http or https URL"
+	}
+	for _, event := range in.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			return fmt.Sprintf("Unknown event %q, expected book.created, book.updated or book.deleted", event)
+		}
+	}
+	return ""
+}
+
+// registerWebhookRoutes mounts the management of the subscriptions and
+// their delivery logs on the admin group.
+func registerWebhookRoutes(admin *echo.Group, w *webhooks) {
+	// findSubscription answers 404 itself when the ID is unknown.
+	findSubscription := func(c echo.Context) (WebhookSubscription, bool, error) {
+		var sub WebhookSubscription
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return sub, false, handlers.JSONError(c, http.StatusNotFound, "Webhook not found")
+		}
+		ctx := c.Request().Context()
+		err = w.subs.FindOne(ctx, bson.M{"_id": id}, store.FindOneOpts(ctx)).Decode(&sub)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return sub, false, handlers.JSONError(c, http.StatusNotFound, "Webhook not found")
+		}
+		if err != nil {
+			return sub, false, handlers.ServerError(c, err, "Database error")
+		}
+		return sub, true, nil
+	}
+
+	admin.GET("/webhooks", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		cursor, err := w.subs.Find(ctx, bson.D{}, store.FindOpts(ctx).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		subs := []WebhookSubscription{}
+		if err := cursor.All(ctx, &subs); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		return c.JSON(http.StatusOK, subs)
+	})
+
+	admin.POST("/webhooks", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var in webhookInput
+		if err := c.Bind(&in); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		if msg := in.validate(); msg != "" {
+			return handlers.JSONError(c, http.StatusBadRequest, msg)
+		}
+		sub := WebhookSubscription{
+			URL:       in.URL,
+			Secret:    in.Secret,
+			Events:    append([]string{}, in.Events...),
+			Active:    in.Active == nil || *in.Active,
+			CreatedAt: time.Now().UTC(),
+		}
+		if sub.Secret == "" {
+			sub.Secret = newToken()
+		}
+		res, err := w.subs.InsertOne(ctx, sub, store.InsertOneOpts(ctx))
+		if err != nil {
+			return handlers.ServerError(c, err, "Could not save webhook")
+		}
+		sub.ID = res.InsertedID.(primitive.ObjectID)
+		return c.JSON(http.StatusCreated, sub)
+	})
+
+	admin.GET("/webhooks/:id", func(c echo.Context) error {
+		sub, ok, err := findSubscription(c)
+		if !ok {
+			return err
+		}
+		sub.Secret = ""
+		return c.JSON(http.StatusOK, sub)
+	})
+
+	admin.PUT("/webhooks/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		sub, ok, err := findSubscription(c)
+		if !ok {
+			return err
+		}
+		var in webhookInput
+		if err := c.Bind(&in); err != nil {
+			return handlers.InvalidBody(c, err, "Invalid request body")
+		}
+		if msg := in.validate(); msg != "" {
+			return handlers.JSONError(c, http.StatusBadRequest, msg)
+		}
+		now := time.Now().UTC()
+		set := bson.M{
+			"url":       in.URL,
+			"events":    append([]string{}, in.Events...),
+			"active":    in.Active == nil || *in.Active,
+			"updatedAt": now,
+		}
+		if in.Secret != "" {
+			set["secret"] = in.Secret
+		}
+		if _, err := w.subs.UpdateByID(ctx, sub.ID, bson.M{"$set": set}, store.UpdateOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Could not save webhook")
+		}
+		sub.URL, sub.Events, sub.Active, sub.UpdatedAt = in.URL, set["events"].([]string), set["active"].(bool), &now
+		sub.Secret = in.Secret
+		return c.JSON(http.StatusOK, sub)
+	})
+
+	// DELETE /admin/webhooks/:id drops the subscription and its deliveries.
+	admin.DELETE("/webhooks/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		sub, ok, err := findSubscription(c)
+		if !ok {
+			return err
+		}
+		if _, err := w.subs.DeleteOne(ctx, bson.M{"_id": sub.ID}, store.DeleteOpts(ctx)); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		if _, err := w.deliveries.DeleteMany(ctx, bson.M{"subscriptionId": sub.ID}); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// GET /admin/webhooks/:id/deliveries?status=failed lists the latest
+	// deliveries, with their attempts.
+	admin.GET("/webhooks/:id/deliveries", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		sub, ok, err := findSubscription(c)
+		if !ok {
+			return err
+		}
+		filter := bson.M{"subscriptionId": sub.ID}
+		if status := c.QueryParam("status"); status != "" {
+			filter["status"] = status
+		}
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxDeliveriesLimit {
+			limit = defaultDeliveriesLimit
+		}
+		opts := store.FindOpts(ctx).SetSort(bson.M{"_id": -1}).SetLimit(int64(limit))
+		cursor, err := w.deliveries.Find(ctx, filter, opts)
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		deliveries := []WebhookDelivery{}
+		if err := cursor.All(ctx, &deliveries); err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, deliveries)
+	})
+
+	// POST /admin/webhooks/deliveries/:id/redeliver sends a delivery again,
+	// e.g. once the receiver is fixed. The attempt is added to its log; a
+	// delivery that already used up its attempts gets a single one.
+	admin.POST("/webhooks/deliveries/:id/redeliver", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return handlers.JSONError(c, http.StatusNotFound, "Delivery not found")
+		}
+		var delivery WebhookDelivery
+		err = w.deliveries.FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "status": bson.M{"$ne": "pending"}},
+			bson.M{"$set": bson.M{"status": "pending", "nextAttemptAt": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&delivery)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			if n, _ := w.deliveries.CountDocuments(ctx, bson.M{"_id": id}); n > 0 {
+				return handlers.JSONError(c, http.StatusConflict, "Delivery is already pending")
+			}
+			return handlers.JSONError(c, http.StatusNotFound, "Delivery not found")
+		}
+		if err != nil {
+			return handlers.ServerError(c, err, "Database error")
+		}
+		w.notify()
+		return c.JSON(http.StatusAccepted, delivery)
+	})
+}
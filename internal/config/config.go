@@ -0,0 +1,671 @@
+// Package config gathers every setting of the application in one place.
+//
+// Settings are layered, each layer overriding the previous one:
+//
+//  1. built-in defaults (see Default)
+//  2. a YAML file, given with --config or CONFIG_FILE
+//  3. environment variables (e.g. DATABASE_URI)
+//  4. command line flags (e.g. --db-uri)
+//
+// Run the server with --print-config to see the effective settings.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the root of the configuration tree. The yaml tags define the
+// layout of the config file.
+type Config struct {
+	Database DatabaseConfig `yaml:"database"`
+	Server   ServerConfig   `yaml:"server"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Features FeaturesConfig `yaml:"features"`
+
+	Static        StaticConfig        `yaml:"static"`
+	Cache         CacheConfig         `yaml:"cache"`
+	Search        SearchConfig        `yaml:"search"`
+	Metadata      MetadataConfig      `yaml:"metadata"`
+	RateLimit     RateLimitConfig     `yaml:"rateLimit"`
+	Redis         RedisConfig         `yaml:"redis"`
+	AccessLog     AccessLogConfig     `yaml:"accessLog"`
+	Events        EventsConfig        `yaml:"events"`
+	Mail          MailConfig          `yaml:"mail"`
+	Files         FilesConfig         `yaml:"files"`
+	Telegram      TelegramConfig      `yaml:"telegram"`
+	Tasks         TasksConfig         `yaml:"tasks"`
+	ErrorTracking ErrorTrackingConfig `yaml:"errorTracking"`
+}
+
+type DatabaseConfig struct {
+	URI        string `yaml:"uri"`
+	Name       string `yaml:"name"`
+	Collection string `yaml:"collection"`
+	// After BreakerFailures timeouts or network errors in a row, the
+	// catalog stops calling MongoDB for BreakerCooldown; 0 disables it.
+	BreakerFailures int           `yaml:"breakerFailures"`
+	BreakerCooldown time.Duration `yaml:"breakerCooldown"`
+	// The reads failing on a transient error are tried again up to
+	// Retries times, waiting about RetryBackoff, then twice as long.
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+}
+
+type ServerConfig struct {
+	// host:port, unix:/path/to/socket or systemd (socket activation)
+	Address string `yaml:"address"`
+	// Permissions of the Unix socket, in octal.
+	SocketMode     string        `yaml:"socketMode"`
+	BodyLimit      string        `yaml:"bodyLimit"`
+	ReadTimeout    time.Duration `yaml:"readTimeout"`
+	WriteTimeout   time.Duration `yaml:"writeTimeout"`
+	IdleTimeout    time.Duration `yaml:"idleTimeout"`
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	// Addresses or CIDR ranges of the reverse proxies trusted to set
+	// X-Forwarded-For. Without any, the client is the address connected
+	// from.
+	TrustedProxies []string  `yaml:"trustedProxies"`
+	TLS            TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig decides how the server speaks HTTPS. With neither certificate
+// files nor autocert hosts, the server runs plain HTTP.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// Hostnames for which certificates are obtained from Let's Encrypt.
+	// Certificates are cached in AutocertCache so restarts don't hit the
+	// rate limits.
+	AutocertHosts []string `yaml:"autocertHosts"`
+	AutocertCache string   `yaml:"autocertCache"`
+	AutocertEmail string   `yaml:"autocertEmail"`
+
+	// When set (e.g. ":80"), a second listener redirects plain HTTP requests
+	// to HTTPS. With autocert it also answers the ACME HTTP-01 challenges.
+	RedirectAddr string `yaml:"redirectAddr"`
+}
+
+// Enabled reports whether the server should use HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.Autocert() || (t.CertFile != "" && t.KeyFile != "")
+}
+
+// Autocert reports whether certificates are obtained automatically.
+func (t TLSConfig) Autocert() bool {
+	return len(t.AutocertHosts) > 0
+}
+
+// AuthConfig holds the credentials of the admin area. With the local
+// provider and no password the admin area is disabled.
+type AuthConfig struct {
+	// "local" (default) for the single admin account below, or "ldap"
+	Provider      string     `yaml:"provider"`
+	AdminUser     string     `yaml:"adminUser"`
+	AdminPassword string     `yaml:"adminPassword"`
+	LDAP          LDAPConfig `yaml:"ldap"`
+}
+
+// LDAPConfig checks the credentials against an LDAP or Active Directory
+// server. Users are found with the service account (BindDN), and get the
+// roles mapped to their groups.
+type LDAPConfig struct {
+	URL          string `yaml:"url"` // ldap://host:389 or ldaps://host:636
+	StartTLS     bool   `yaml:"startTLS"`
+	BindDN       string `yaml:"bindDN"`
+	BindPassword string `yaml:"bindPassword"`
+	BaseDN       string `yaml:"baseDN"`
+	// %s is replaced by the user name, e.g. (sAMAccountName=%s) for AD
+	UserFilter     string `yaml:"userFilter"`
+	GroupAttribute string `yaml:"groupAttribute"`
+	// "role=group DN" entries separated by ';' (DNs have commas), e.g.
+	// admin=cn=admins,ou=groups,dc=example,dc=org
+	GroupRoles string `yaml:"groupRoles"`
+	// How long a successful login is remembered
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+type LoggingConfig struct {
+	// One of debug, info, warn or error
+	Level string `yaml:"level"`
+}
+
+// StaticConfig controls how browsers cache the stylesheets.
+type StaticConfig struct {
+	// Cache-Control max-age of files requested by their plain name.
+	MaxAge time.Duration `yaml:"maxAge"`
+	// Link to names carrying a content hash (index.1a2b3c4d.css), which
+	// are cached for a year.
+	HashFilenames bool `yaml:"hashFilenames"`
+}
+
+// CacheConfig controls the in-process cache of the catalog pages.
+type CacheConfig struct {
+	// How long /books, /api/books, /authors and /years are served from
+	// memory; 0 disables the cache.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// SearchConfig picks what answers the search and suggest endpoints.
+type SearchConfig struct {
+	// "memory" (default), "bleve" for an embedded full-text index or
+	// "atlas" for MongoDB Atlas Search
+	Backend string `yaml:"backend"`
+	// Name of the Atlas Search index, created if missing.
+	AtlasIndex string `yaml:"atlasIndex"`
+}
+
+// MetadataConfig picks where missing book details are looked up by ISBN.
+type MetadataConfig struct {
+	// "openlibrary" (default), "google" or "sru"
+	Provider       string `yaml:"provider"`
+	OpenLibraryURL string `yaml:"openLibraryURL"`
+	// Google Books also answers GET /api/lookup, whatever the provider.
+	GoogleBooksURL string `yaml:"googleBooksURL"`
+	GoogleBooksKey string `yaml:"googleBooksKey"`
+	// SRU endpoint of a library catalog, searched by GET /admin/lookup,
+	// e.g. https://lx2.loc.gov:210/LCDB
+	SRUURL string `yaml:"sruURL"`
+	// Minimum time between two requests to the provider, to stay within
+	// its usage policy.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RateLimitConfig caps the API requests a client IP can make.
+type RateLimitConfig struct {
+	// Requests allowed per Window; 0 disables the limit.
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+}
+
+// RedisConfig points to the Redis server sharing the cache and the rate
+// limit counters between instances. Without it, each instance keeps its own
+// in memory.
+type RedisConfig struct {
+	// e.g. redis://:password@localhost:6379/0
+	URL string `yaml:"url"`
+}
+
+// AccessLogConfig controls the line logged for every request.
+type AccessLogConfig struct {
+	// "json" (default) or "combined" for the Apache combined format
+	Format string `yaml:"format"`
+
+	// Also log the request headers, and the first KBs of JSON and form
+	// bodies, with the sensitive ones masked.
+	LogHeaders    bool     `yaml:"logHeaders"`
+	LogBody       bool     `yaml:"logBody"`
+	RedactHeaders []string `yaml:"redactHeaders"`
+	RedactFields  []string `yaml:"redactFields"`
+
+	// "route=rate" pairs: only that fraction of successful requests on the
+	// route is logged, e.g. "/api/books=0.1".
+	Sampling []string `yaml:"sampling"`
+}
+
+// EventsConfig publishes an event to a message bus for every write to the
+// catalog, for downstream consumers.
+type EventsConfig struct {
+	// "kafka", "nats" or empty to disable
+	Backend      string   `yaml:"backend"`
+	KafkaBrokers []string `yaml:"kafkaBrokers"`
+	KafkaTopic   string   `yaml:"kafkaTopic"`
+	NATSURL      string   `yaml:"natsURL"`
+	// Events go to <subject>.created, .updated and .deleted
+	NATSSubject string `yaml:"natsSubject"`
+}
+
+// MailConfig sets up the SMTP server notification emails are sent
+// through. Notifications are disabled without SMTPHost.
+type MailConfig struct {
+	SMTPHost string `yaml:"smtpHost"`
+	SMTPPort int    `yaml:"smtpPort"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	// Public address of the site, for the links in the emails, e.g.
+	// https://books.example.com
+	BaseURL string `yaml:"baseURL"`
+}
+
+// FilesConfig picks where uploaded covers and stored exports are kept.
+type FilesConfig struct {
+	// "gridfs" (default) stores them in MongoDB, "s3" in an S3
+	// compatible object storage (AWS S3, MinIO...)
+	Backend     string `yaml:"backend"`
+	S3Endpoint  string `yaml:"s3Endpoint"` // e.g. s3.amazonaws.com or localhost:9000
+	S3Region    string `yaml:"s3Region"`
+	S3Bucket    string `yaml:"s3Bucket"`
+	S3Prefix    string `yaml:"s3Prefix"`
+	S3AccessKey string `yaml:"s3AccessKey"`
+	S3SecretKey string `yaml:"s3SecretKey"`
+	S3UseSSL    bool   `yaml:"s3UseSSL"`
+	// How long the presigned download URLs are valid
+	PresignExpiry time.Duration `yaml:"presignExpiry"`
+	// When set, files are only served to the links the server signed
+	// with it, which are valid for signedURLTTL at least
+	SigningKey   string        `yaml:"signingKey"`
+	SignedURLTTL time.Duration `yaml:"signedURLTTL"`
+	// How long the exports asked through POST /api/exports are kept
+	ExportTTL time.Duration `yaml:"exportTTL"`
+}
+
+// TelegramConfig runs a Telegram bot answering questions about the
+// catalog. Without a token the bot is disabled.
+type TelegramConfig struct {
+	Token string `yaml:"token"` // from @BotFather
+	// IDs of the chats allowed to add books
+	AddChats []string `yaml:"addChats"`
+	APIURL   string   `yaml:"apiURL"`
+}
+
+// TasksConfig schedules the recurring jobs, with cron expressions such as
+// "0 3 * * *" or descriptors such as "@hourly". An empty schedule, or
+// "off", disables the job.
+type TasksConfig struct {
+	// Export of the catalog to the file storage
+	Backup          string        `yaml:"backup"`
+	BackupFormat    string        `yaml:"backupFormat"`
+	BackupRetention time.Duration `yaml:"backupRetention"` // older exports are deleted
+	// Reload of the cached catalog, so no visitor waits for it
+	CacheWarmup string `yaml:"cacheWarmup"`
+	// New attempt of the webhook deliveries that failed
+	WebhookSweep string `yaml:"webhookSweep"`
+	// Reset of the catalog to the demo books, in demo mode only
+	DemoReset string `yaml:"demoReset"`
+}
+
+// ErrorTrackingConfig enables reporting errors and panics to Sentry, or a
+// compatible service, when a DSN is given.
+type ErrorTrackingConfig struct {
+	DSN         string `yaml:"dsn"`
+	Environment string `yaml:"environment"`
+}
+
+// FeaturesConfig toggles optional parts of the application.
+type FeaturesConfig struct {
+	DebugEndpoints    bool     `yaml:"debugEndpoints"`
+	RobotsDisallowAll bool     `yaml:"robotsDisallowAll"`
+	RobotsDisallow    []string `yaml:"robotsDisallow"`
+	// Public demo: the demo catalog is seeded, and restored on the
+	// demoReset schedule of the tasks
+	Demo bool `yaml:"demo"`
+	// Mirror of another deployment: every change to the catalog is
+	// refused, and the forms are hidden
+	ReadOnly bool `yaml:"readOnly"`
+	// Anonymous counts of the requests, searches and book views, for the
+	// Trending page
+	Analytics bool `yaml:"analytics"`
+	// Keys the hashes of the search terms counted. Without it the
+	// instances share a random key through the database.
+	AnalyticsKey string `yaml:"analyticsKey"`
+	// Contact of the OAI-PMH provider at /oai, which is off without one
+	OAIAdminEmail string `yaml:"oaiAdminEmail"`
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Name:            "exercise-2",
+			Collection:      "information",
+			BreakerFailures: 5,
+			BreakerCooldown: 30 * time.Second,
+			Retries:         2,
+			RetryBackoff:    100 * time.Millisecond,
+		},
+		Features: FeaturesConfig{
+			Analytics: true,
+		},
+		Server: ServerConfig{
+			Address:        ":3030",
+			SocketMode:     "0660",
+			BodyLimit:      "1M",
+			ReadTimeout:    15 * time.Second,
+			WriteTimeout:   60 * time.Second,
+			IdleTimeout:    120 * time.Second,
+			RequestTimeout: 10 * time.Second,
+			TLS: TLSConfig{
+				AutocertCache: "certs",
+			},
+		},
+		Auth: AuthConfig{
+			Provider:  "local",
+			AdminUser: "admin",
+			LDAP: LDAPConfig{
+				UserFilter:     "(uid=%s)",
+				GroupAttribute: "memberOf",
+				CacheTTL:       time.Minute,
+			},
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+		Static: StaticConfig{
+			MaxAge: time.Hour,
+		},
+		Cache: CacheConfig{
+			TTL: 30 * time.Second,
+		},
+		Search: SearchConfig{
+			Backend:    "memory",
+			AtlasIndex: "books",
+		},
+		Metadata: MetadataConfig{
+			Provider:       "openlibrary",
+			OpenLibraryURL: "https://openlibrary.org",
+			GoogleBooksURL: "https://www.googleapis.com",
+			Interval:       time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			Window: time.Minute,
+		},
+		AccessLog: AccessLogConfig{
+			Format:        "json",
+			RedactHeaders: []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Proxy-Authorization"},
+			RedactFields:  []string{"password", "secret", "token", "api_key", "apiKey", "access_token", "signature"},
+		},
+		Mail: MailConfig{
+			SMTPPort: 587,
+			From:     "Book Store <bookstore@localhost>",
+			BaseURL:  "http://localhost:3030",
+		},
+		Files: FilesConfig{
+			Backend:       "gridfs",
+			S3UseSSL:      true,
+			PresignExpiry: 15 * time.Minute,
+			SignedURLTTL:  24 * time.Hour,
+			ExportTTL:     24 * time.Hour,
+		},
+		Telegram: TelegramConfig{
+			APIURL: "https://api.telegram.org",
+		},
+		Tasks: TasksConfig{
+			Backup:          "0 3 * * *",
+			BackupFormat:    "json",
+			BackupRetention: 30 * 24 * time.Hour,
+			WebhookSweep:    "@hourly",
+			DemoReset:       "@hourly",
+		},
+		Events: EventsConfig{
+			KafkaTopic:  "bookstore.books",
+			NATSURL:     "nats://localhost:4222",
+			NATSSubject: "bookstore.books",
+		},
+	}
+}
+
+// setting binds one field of Config to its environment variable and flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	ptr   interface{} // *string, *bool, *int, *time.Duration or *[]string
+}
+
+// settings lists everything that can be overridden from the environment or
+// the command line. Keep it in sync with Config.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"DATABASE_URI", "db-uri", "MongoDB connection string", &c.Database.URI},
+		{"DATABASE_NAME", "db-name", "MongoDB database", &c.Database.Name},
+		{"DATABASE_COLLECTION", "db-collection", "MongoDB collection holding the books", &c.Database.Collection},
+		{"DATABASE_BREAKER_FAILURES", "db-breaker-failures", "MongoDB failures in a row after which calls fail fast, 0 to disable", &c.Database.BreakerFailures},
+		{"DATABASE_BREAKER_COOLDOWN", "db-breaker-cooldown", "how long calls fail fast before MongoDB is tried again", &c.Database.BreakerCooldown},
+		{"DATABASE_RETRIES", "db-retries", "how many times a read failing on a transient MongoDB error is retried, 0 to disable", &c.Database.Retries},
+		{"DATABASE_RETRY_BACKOFF", "db-retry-backoff", "how long to wait before the first retry, doubling after each", &c.Database.RetryBackoff},
+		{"SERVER_ADDRESS", "addr", "address to listen on: host:port, unix:/path/to/socket or systemd", &c.Server.Address},
+		{"SERVER_SOCKET_MODE", "socket-mode", "permissions of the Unix socket, in octal", &c.Server.SocketMode},
+		{"BODY_LIMIT", "body-limit", "maximum request body size, e.g. 1M", &c.Server.BodyLimit},
+		{"SERVER_READ_TIMEOUT", "read-timeout", "timeout to read a whole request", &c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", "write-timeout", "timeout to write a response", &c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", "idle-timeout", "how long keep-alive connections stay open", &c.Server.IdleTimeout},
+		{"REQUEST_TIMEOUT", "request-timeout", "deadline to handle a request", &c.Server.RequestTimeout},
+		{"TRUSTED_PROXIES", "trusted-proxies", "comma separated addresses or CIDR ranges of the proxies trusted to set X-Forwarded-For", &c.Server.TrustedProxies},
+		{"TLS_CERT_FILE", "tls-cert", "TLS certificate file", &c.Server.TLS.CertFile},
+		{"TLS_KEY_FILE", "tls-key", "TLS key file", &c.Server.TLS.KeyFile},
+		{"TLS_AUTOCERT_HOSTS", "tls-autocert-hosts", "comma separated hosts to get Let's Encrypt certificates for", &c.Server.TLS.AutocertHosts},
+		{"TLS_AUTOCERT_CACHE", "tls-autocert-cache", "directory to cache certificates in", &c.Server.TLS.AutocertCache},
+		{"TLS_AUTOCERT_EMAIL", "tls-autocert-email", "contact email for Let's Encrypt", &c.Server.TLS.AutocertEmail},
+		{"TLS_REDIRECT_ADDR", "tls-redirect-addr", "address of the HTTP to HTTPS redirect listener", &c.Server.TLS.RedirectAddr},
+		{"ADMIN_USER", "admin-user", "user of the admin area", &c.Auth.AdminUser},
+		{"ADMIN_PASSWORD", "admin-password", "password of the admin area (empty disables it)", &c.Auth.AdminPassword},
+		{"AUTH_PROVIDER", "auth-provider", "who checks the admin credentials: local or ldap", &c.Auth.Provider},
+		{"AUTH_LDAP_URL", "auth-ldap-url", "LDAP server, ldap://host:389 or ldaps://host:636", &c.Auth.LDAP.URL},
+		{"AUTH_LDAP_START_TLS", "auth-ldap-start-tls", "upgrade ldap:// connections with StartTLS", &c.Auth.LDAP.StartTLS},
+		{"AUTH_LDAP_BIND_DN", "auth-ldap-bind-dn", "DN of the service account looking users up", &c.Auth.LDAP.BindDN},
+		{"AUTH_LDAP_BIND_PASSWORD", "auth-ldap-bind-password", "password of the service account", &c.Auth.LDAP.BindPassword},
+		{"AUTH_LDAP_BASE_DN", "auth-ldap-base-dn", "DN under which users are searched", &c.Auth.LDAP.BaseDN},
+		{"AUTH_LDAP_USER_FILTER", "auth-ldap-user-filter", "filter finding a user, %s is the user name", &c.Auth.LDAP.UserFilter},
+		{"AUTH_LDAP_GROUP_ATTRIBUTE", "auth-ldap-group-attribute", "attribute of users listing their groups", &c.Auth.LDAP.GroupAttribute},
+		{"AUTH_LDAP_GROUP_ROLES", "auth-ldap-group-roles", "roles of group members, as role=group DN entries separated by ;", &c.Auth.LDAP.GroupRoles},
+		{"AUTH_LDAP_CACHE_TTL", "auth-ldap-cache-ttl", "how long a successful LDAP login is remembered", &c.Auth.LDAP.CacheTTL},
+		{"LOG_LEVEL", "log-level", "debug, info, warn or error", &c.Logging.Level},
+		{"STATIC_MAX_AGE", "static-max-age", "how long browsers cache stylesheets", &c.Static.MaxAge},
+		{"STATIC_HASH_FILENAMES", "static-hash-filenames", "link to content hashed stylesheet names, cached for a year", &c.Static.HashFilenames},
+		{"CACHE_TTL", "cache-ttl", "how long catalog pages are cached, 0 to disable", &c.Cache.TTL},
+		{"SEARCH_BACKEND", "search-backend", "search backend: memory, bleve or atlas", &c.Search.Backend},
+		{"SEARCH_ATLAS_INDEX", "search-atlas-index", "name of the Atlas Search index", &c.Search.AtlasIndex},
+		{"METADATA_PROVIDER", "metadata-provider", "where book details are looked up by ISBN: openlibrary, google or sru", &c.Metadata.Provider},
+		{"METADATA_OPENLIBRARY_URL", "metadata-openlibrary-url", "base URL of the OpenLibrary API", &c.Metadata.OpenLibraryURL},
+		{"METADATA_GOOGLE_BOOKS_URL", "metadata-google-books-url", "base URL of the Google Books API", &c.Metadata.GoogleBooksURL},
+		{"METADATA_SRU_URL", "metadata-sru-url", "SRU endpoint of a library catalog, for the admin lookup (empty disables it)", &c.Metadata.SRUURL},
+		{"GOOGLE_BOOKS_API_KEY", "google-books-api-key", "Google Books API key (optional, raises the quota)", &c.Metadata.GoogleBooksKey},
+		{"METADATA_INTERVAL", "metadata-interval", "minimum time between two requests to the metadata provider", &c.Metadata.Interval},
+		{"RATE_LIMIT", "rate-limit", "API requests allowed per client IP and window, 0 to disable", &c.RateLimit.Requests},
+		{"RATE_LIMIT_WINDOW", "rate-limit-window", "window of the rate limit", &c.RateLimit.Window},
+		{"REDIS_URL", "redis-url", "Redis shared by all instances for cache and rate limits (empty keeps them in memory)", &c.Redis.URL},
+		{"ACCESS_LOG_FORMAT", "access-log-format", "access log format: json or combined", &c.AccessLog.Format},
+		{"ACCESS_LOG_HEADERS", "access-log-headers", "log request headers (redacted)", &c.AccessLog.LogHeaders},
+		{"ACCESS_LOG_BODY", "access-log-body", "log request bodies (redacted)", &c.AccessLog.LogBody},
+		{"ACCESS_LOG_REDACT_HEADERS", "access-log-redact-headers", "comma separated headers to mask", &c.AccessLog.RedactHeaders},
+		{"ACCESS_LOG_REDACT_FIELDS", "access-log-redact-fields", "comma separated query and body fields to mask", &c.AccessLog.RedactFields},
+		{"ACCESS_LOG_SAMPLING", "access-log-sampling", "comma separated route=rate pairs, e.g. /api/books=0.1", &c.AccessLog.Sampling},
+		{"EVENTS_BACKEND", "events-backend", "message bus to publish book events to: kafka or nats (empty disables it)", &c.Events.Backend},
+		{"EVENTS_KAFKA_BROKERS", "events-kafka-brokers", "comma separated Kafka brokers, e.g. localhost:9092", &c.Events.KafkaBrokers},
+		{"EVENTS_KAFKA_TOPIC", "events-kafka-topic", "Kafka topic of the book events", &c.Events.KafkaTopic},
+		{"EVENTS_NATS_URL", "events-nats-url", "NATS server URL", &c.Events.NATSURL},
+		{"EVENTS_NATS_SUBJECT", "events-nats-subject", "prefix of the NATS subjects of the book events", &c.Events.NATSSubject},
+		{"SMTP_HOST", "smtp-host", "SMTP server for notification emails (empty disables them)", &c.Mail.SMTPHost},
+		{"SMTP_PORT", "smtp-port", "SMTP server port", &c.Mail.SMTPPort},
+		{"SMTP_USERNAME", "smtp-username", "SMTP user", &c.Mail.Username},
+		{"SMTP_PASSWORD", "smtp-password", "SMTP password", &c.Mail.Password},
+		{"MAIL_FROM", "mail-from", "sender of the notification emails", &c.Mail.From},
+		{"MAIL_BASE_URL", "mail-base-url", "public URL of the site, for links in emails", &c.Mail.BaseURL},
+		{"FILES_BACKEND", "files-backend", "where covers and exports are stored: gridfs or s3", &c.Files.Backend},
+		{"FILES_S3_ENDPOINT", "files-s3-endpoint", "S3 endpoint, e.g. s3.amazonaws.com or localhost:9000", &c.Files.S3Endpoint},
+		{"FILES_S3_REGION", "files-s3-region", "S3 region", &c.Files.S3Region},
+		{"FILES_S3_BUCKET", "files-s3-bucket", "S3 bucket", &c.Files.S3Bucket},
+		{"FILES_S3_PREFIX", "files-s3-prefix", "prefix of the object names in the bucket", &c.Files.S3Prefix},
+		{"FILES_S3_ACCESS_KEY", "files-s3-access-key", "S3 access key", &c.Files.S3AccessKey},
+		{"FILES_S3_SECRET_KEY", "files-s3-secret-key", "S3 secret key", &c.Files.S3SecretKey},
+		{"FILES_S3_USE_SSL", "files-s3-use-ssl", "connect to the S3 endpoint over HTTPS", &c.Files.S3UseSSL},
+		{"FILES_PRESIGN_EXPIRY", "files-presign-expiry", "validity of presigned download URLs", &c.Files.PresignExpiry},
+		{"FILES_SIGNING_KEY", "files-signing-key", "secret signing the links to covers and exports, which then expire (empty serves files to anyone)", &c.Files.SigningKey},
+		{"FILES_SIGNED_URL_TTL", "files-signed-url-ttl", "minimum validity of the signed links", &c.Files.SignedURLTTL},
+		{"FILES_EXPORT_TTL", "files-export-ttl", "how long the exports asked through the API are kept", &c.Files.ExportTTL},
+		{"TELEGRAM_BOT_TOKEN", "telegram-bot-token", "token of the Telegram bot (empty disables it)", &c.Telegram.Token},
+		{"TELEGRAM_ADD_CHATS", "telegram-add-chats", "IDs of the Telegram chats allowed to add books", &c.Telegram.AddChats},
+		{"TELEGRAM_API_URL", "telegram-api-url", "base URL of the Telegram Bot API", &c.Telegram.APIURL},
+		{"TASKS_BACKUP", "tasks-backup", "schedule of the catalog backup, e.g. \"0 3 * * *\" (off disables it)", &c.Tasks.Backup},
+		{"TASKS_BACKUP_FORMAT", "tasks-backup-format", "export format of the backups", &c.Tasks.BackupFormat},
+		{"TASKS_BACKUP_RETENTION", "tasks-backup-retention", "how long backups are kept", &c.Tasks.BackupRetention},
+		{"TASKS_CACHE_WARMUP", "tasks-cache-warmup", "schedule of the catalog cache warm-up, e.g. \"@every 1m\" (off disables it)", &c.Tasks.CacheWarmup},
+		{"TASKS_WEBHOOK_SWEEP", "tasks-webhook-sweep", "schedule of the retry of the failed webhook deliveries (off disables it)", &c.Tasks.WebhookSweep},
+		{"TASKS_DEMO_RESET", "tasks-demo-reset", "schedule of the reset of the demo catalog, e.g. \"@every 30m\" (off disables it)", &c.Tasks.DemoReset},
+		{"SENTRY_DSN", "sentry-dsn", "DSN of the Sentry compatible error tracker (empty disables it)", &c.ErrorTracking.DSN},
+		{"SENTRY_ENVIRONMENT", "sentry-environment", "environment reported to the error tracker, e.g. production", &c.ErrorTracking.Environment},
+		{"DEBUG_ENDPOINTS", "debug-endpoints", "mount pprof and runtime stats under /debug", &c.Features.DebugEndpoints},
+		{"ROBOTS_DISALLOW_ALL", "robots-disallow-all", "ask crawlers to stay away from the whole site", &c.Features.RobotsDisallowAll},
+		{"ROBOTS_DISALLOW", "robots-disallow", "comma separated extra paths crawlers should skip", &c.Features.RobotsDisallow},
+		{"DEMO", "demo", "public demo: seed the demo catalog and reset it on TASKS_DEMO_RESET", &c.Features.Demo},
+		{"READ_ONLY", "read-only", "refuse every change to the catalog, e.g. on a mirror", &c.Features.ReadOnly},
+		{"ANALYTICS", "analytics", "count the requests, searches and book views anonymously, for the Trending page", &c.Features.Analytics},
+		{"ANALYTICS_KEY", "analytics-key", "secret keying the hashes of the search terms counted (empty keeps a random one in the database)", &c.Features.AnalyticsKey},
+		{"OAI_ADMIN_EMAIL", "oai-admin-email", "contact given to OAI-PMH harvesters (empty disables /oai)", &c.Features.OAIAdminEmail},
+	}
+}
+
+// set parses value into the field the setting points to.
+func (s setting) set(value string) error {
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.flag, err)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.flag, err)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.flag, err)
+		}
+		*p = d
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported setting type %T", s.flag, s.ptr)
+	}
+	return nil
+}
+
+// rawFlag keeps the flag value as given, so flags can be applied after the
+// file and the environment regardless of the order they were parsed in.
+type rawFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *rawFlag) String() string     { return f.value }
+func (f *rawFlag) Set(v string) error { f.value = v; return nil }
+func (f *rawFlag) IsBoolFlag() bool   { return f.isBool }
+
+// Options are the flags that control how the configuration is loaded,
+// rather than the configuration itself.
+type Options struct {
+	File        string
+	PrintConfig bool
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and the given command line arguments (without the program
+// name). It returns the remaining non-flag arguments.
+func Load(name string, args []string) (Config, Options, []string, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var opts Options
+	fs.StringVar(&opts.File, "config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	flags := make(map[string]*rawFlag, len(settings))
+	for _, s := range settings {
+		_, isBool := s.ptr.(*bool)
+		flags[s.flag] = &rawFlag{isBool: isBool}
+		fs.Var(flags[s.flag], s.flag, s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, opts, nil, err
+	}
+
+	if opts.File != "" {
+		if err := loadFile(&cfg, opts.File); err != nil {
+			return cfg, opts, nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := s.set(value); err != nil {
+				return cfg, opts, nil, fmt.Errorf("$%s: %w", s.env, err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(flags[s.flag].value)
+			}
+		}
+	})
+	return cfg, opts, fs.Args(), err
+}
+
+func loadFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML, with secrets masked, so it can be
+// shared when debugging a deployment.
+func (c Config) Print(w io.Writer) error {
+	c.Auth.AdminPassword = mask(c.Auth.AdminPassword)
+	c.Auth.LDAP.BindPassword = mask(c.Auth.LDAP.BindPassword)
+	c.Database.URI = redactURI(c.Database.URI)
+	c.ErrorTracking.DSN = redactURI(c.ErrorTracking.DSN)
+	c.Redis.URL = redactURI(c.Redis.URL)
+	c.Metadata.GoogleBooksKey = mask(c.Metadata.GoogleBooksKey)
+	c.Events.NATSURL = redactURI(c.Events.NATSURL)
+	c.Mail.Password = mask(c.Mail.Password)
+	c.Files.S3SecretKey = mask(c.Files.S3SecretKey)
+	c.Files.SigningKey = mask(c.Files.SigningKey)
+	c.Features.AnalyticsKey = mask(c.Features.AnalyticsKey)
+	c.Telegram.Token = mask(c.Telegram.Token)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+// redactURI hides the password of a connection string.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Binder binds the requests of the server. JSON bodies are decoded
+// strictly: a field the handler doesn't know of, like a misspelt "auther",
+// or a value of the wrong type is an error rather than silently dropped.
+// Other bodies, such as the forms of the pages, are bound by echo.
+type Binder struct {
+	echo.DefaultBinder
+}
+
+// BodyError tells which fields of a JSON body are at fault, by name.
+type BodyError struct {
+	Fields map[string]string
+}
+
+func (e *BodyError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "invalid fields in request body: " + strings.Join(names, ", ")
+}
+
+// Bind implements echo.Binder.
+func (b *Binder) Bind(i interface{}, c echo.Context) error {
+	req := c.Request()
+	ctype := req.Header.Get(echo.HeaderContentType)
+	if req.ContentLength == 0 || !strings.HasPrefix(ctype, echo.MIMEApplicationJSON) {
+		return b.DefaultBinder.Bind(i, c)
+	}
+	if err := b.BindPathParams(c, i); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(data, i)
+}
+
+// decodeStrict decodes data into v, a pointer. All the unknown fields are
+// reported at once, then the values of the wrong type.
+func decodeStrict(data []byte, v interface{}) error {
+	if known := jsonFields(reflect.TypeOf(v)); known != nil {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) == nil {
+			fields := map[string]string{}
+			for name := range object {
+				if !knownField(known, name) {
+					fields[name] = "Unknown field"
+				}
+			}
+			if len(fields) > 0 {
+				return &BodyError{Fields: fields}
+			}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) && te.Field != "" {
+		return &BodyError{Fields: map[string]string{
+			te.Field: fmt.Sprintf("Must be %s, not %s", jsonKind(te.Type), te.Value),
+		}}
+	}
+	return err
+}
+
+// jsonFields returns the names of the JSON fields of the struct t points
+// to, or nil when t isn't a pointer to a struct.
+func jsonFields(t reflect.Type) []string {
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			switch {
+			case name == "-":
+			case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+				collect(f.Type)
+			case !f.IsExported():
+			case name == "":
+				names = append(names, f.Name)
+			default:
+				names = append(names, name)
+			}
+		}
+	}
+	collect(t.Elem())
+	return names
+}
+
+// knownField matches a name like encoding/json does, ignoring case.
+func knownField(known []string, name string) bool {
+	for _, k := range known {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonKind names the JSON values a Go type is decoded from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+// InvalidBody answers 400 to a request whose body couldn't be bound, with
+// msg and the fields at fault when they are known.
+func InvalidBody(c echo.Context, err error, msg string) error {
+	body := ErrorBody(c, msg)
+	var be *BodyError
+	if errors.As(err, &be) {
+		body["fields"] = be.Fields
+	}
+	return c.JSON(http.StatusBadRequest, body)
+}
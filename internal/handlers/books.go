@@ -0,0 +1,557 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BookRepository is what the book handlers need from the data layer. It is
+// implemented by store.Books; tests hand the handlers a fake instead. The
+// errors are those of the store, e.g. store.ErrNotFound.
+type BookRepository interface {
+	All(ctx context.Context) ([]store.Book, error)
+	Find(ctx context.Context, filter interface{}) ([]store.Book, error)
+	Authors(ctx context.Context) ([]string, error)
+	ByID(ctx context.Context, id string) (store.Book, error)
+	Random(ctx context.Context) (store.Book, error)
+	ByAuthor(ctx context.Context, author string, sortKey string, desc bool) ([]store.Book, error)
+	YearsByDecade(ctx context.Context) ([]store.DecadeGroup, error)
+	ByYear(ctx context.Context, year string) ([]store.Book, error)
+	Shelves(ctx context.Context) ([]store.ShelfCount, error)
+	ByShelf(ctx context.Context, shelf string) ([]store.Book, error)
+	Insert(ctx context.Context, book store.Book) error
+	Update(ctx context.Context, id string, fields bson.M) error
+	Delete(ctx context.Context, id string) error
+	Changes(ctx context.Context, since time.Time, limit int) (store.Changes, error)
+}
+
+// Loader reads a part of the catalog, usually through the cache.
+type Loader[T any] func(ctx context.Context) (T, error)
+
+// Index is kept up to date after every write through the API, e.g. the
+// search backend.
+type Index interface {
+	Indexed(ctx context.Context, book store.Book)
+	Removed(ctx context.Context, id string)
+}
+
+// Hooks are called once a write through the API succeeded: Invalidate drops
+// the cached reads and Index gets the new state of the book. Deleted, when
+// set, gets the books deleted, e.g. to let go of their stored covers.
+type Hooks struct {
+	Invalidate func()
+	Index      Index
+	Deleted    func(ctx context.Context, book store.Book)
+}
+
+// nopIndex is the Index of a handler without search backend.
+type nopIndex struct{}
+
+func (nopIndex) Indexed(context.Context, store.Book) {}
+func (nopIndex) Removed(context.Context, string)     {}
+
+// BookHandler serves the pages and the API routes of the books themselves:
+// browsing the catalog and adding, changing and removing books.
+type BookHandler struct {
+	repo   BookRepository
+	logger *slog.Logger
+	cfg    config.Config
+
+	// The reads of the whole catalog, which the caller may cache. They
+	// default to reading the repository every time.
+	Books   Loader[[]store.Book]
+	Authors Loader[[]string]
+	Years   Loader[[]store.DecadeGroup]
+
+	// LastModified is when the catalog last changed, for the
+	// Last-Modified of the book list and its 304s. Without it the list
+	// has no Last-Modified.
+	LastModified Loader[time.Time]
+
+	// Enrich fills in the missing details of a book and returns the
+	// fields it set, by their database names, for POST
+	// /api/books?enrich=true and POST /api/books/:id/enrich. It fails with
+	// ErrNoISBN or ErrNoMetadata when there is nothing to fill them in
+	// with. Without it the parameter is ignored and the route isn't
+	// mounted.
+	Enrich func(ctx context.Context, book *store.Book) (bson.M, error)
+
+	// Dated turns when a book last changed into the Last-Modified of its
+	// page, e.g. a later time when the links rewritten by Links change
+	// over time. By default they are the same.
+	Dated func(t time.Time) time.Time
+
+	// Links rewrites the links of the books served by the API and the
+	// book table, e.g. to sign those to stored covers. It must not modify
+	// the books given, which may be those of the cache.
+	Links func(books []store.Book) []store.Book
+
+	// Covers stores the covers uploaded or fetched, for PUT and POST
+	// /api/books/:id/cover. Without it those routes aren't mounted.
+	Covers Covers
+
+	// Exports are the formats of GET /api/books/:id/export, by name.
+	// Without them the route isn't mounted.
+	Exports map[string]ExportFormat
+
+	// Similar returns the books to recommend along a book, on its page
+	// and from GET /api/books/:id/similar. Without it the page has none
+	// and the route isn't mounted.
+	Similar func(ctx context.Context, book store.Book) ([]store.SimilarBook, error)
+
+	// JSONLD describes a book for search engines on its page, its links
+	// pointing back to base.
+	JSONLD func(book store.Book, base string) template.JS
+
+	// Notes tells the book pages that users can log in to keep notes.
+	Notes bool
+
+	// Search serves /search/results, GET /api/books/search and GET
+	// /api/books/suggest, and Facets the counts per author and year of
+	// the books found, by the IDs of all those matching. Without Search
+	// the routes aren't mounted, without Facets there are no counts.
+	Search Searcher
+	Facets func(ctx context.Context, ids []string) (map[string][]store.FacetCount, error)
+
+	// Feed, Sitemap, Report and Stats serve /feed.xml, /sitemap.xml,
+	// /reports/catalog.pdf and GET /api/stats. Each route is only mounted
+	// when set.
+	Feed    Document
+	Sitemap Document
+	Report  func(ctx context.Context, filter store.ReportFilter) ([]byte, error)
+	Stats   Loader[store.CatalogStats]
+
+	// Hooks are called after every write; they do nothing by default.
+	Hooks Hooks
+}
+
+// NewBookHandler returns the handler of the books stored in repo.
+func NewBookHandler(repo BookRepository, logger *slog.Logger, cfg config.Config) *BookHandler {
+	return &BookHandler{
+		repo:    repo,
+		logger:  logger,
+		cfg:     cfg,
+		Books:   repo.All,
+		Authors: repo.Authors,
+		Years:   repo.YearsByDecade,
+		Hooks:   Hooks{Invalidate: func() {}, Index: nopIndex{}},
+	}
+}
+
+// RegisterRoutes adds the routes of the handler to e.
+func (h *BookHandler) RegisterRoutes(e *echo.Echo) {
+	e.GET("/books", h.BookTable)
+	e.GET("/authors", h.AuthorList)
+	e.GET("/authors/:name", h.AuthorBooks)
+	e.GET("/years", h.YearList)
+	e.GET("/years/:year", h.YearBooks)
+	e.GET("/shelves", h.ShelfList)
+	e.GET("/shelves/:shelf", h.ShelfBooks)
+	e.GET("/surprise", h.Surprise)
+	e.GET("/create", h.CreateForm)
+	e.GET("/recent", h.RecentBooksList)
+	e.GET("/books/:id", h.BookPage)
+
+	e.GET("/api/books", h.ListBooks)
+	e.GET("/api/books/random", h.RandomBook)
+	e.GET("/api/books/recent", h.RecentChanges)
+	e.GET("/api/shelves", h.ListShelves)
+	e.POST("/api/books", h.CreateBook)
+	e.PUT("/api/books/:id", h.UpdateBook)
+	e.DELETE("/api/books/:id", h.DeleteBook)
+	if h.Enrich != nil {
+		e.POST("/api/books/:id/enrich", h.EnrichBook)
+	}
+	if h.Covers != nil {
+		e.PUT("/api/books/:id/cover", h.UploadCover)
+		e.POST("/api/books/:id/cover", h.FetchCover)
+	}
+	if h.Exports != nil {
+		e.GET("/api/books/:id/export", h.ExportBook)
+	}
+	if h.Similar != nil {
+		e.GET("/api/books/:id/similar", h.SimilarBooks)
+	}
+	if h.Search != nil {
+		e.GET("/search/results", h.SearchResults)
+		e.GET("/api/books/search", h.SearchBooks)
+		e.GET("/api/books/suggest", h.SuggestBooks)
+	}
+	if h.Feed != nil {
+		e.GET("/feed.xml", h.AtomFeed)
+	}
+	if h.Sitemap != nil {
+		e.GET("/sitemap.xml", h.SitemapXML)
+	}
+	if h.Report != nil {
+		e.GET("/reports/catalog.pdf", h.CatalogReport)
+	}
+	if h.Stats != nil {
+		e.GET("/api/stats", h.CatalogStats)
+	}
+}
+
+// BookForm is the data passed to the "create-form" block. Values holds what
+// the user typed so a rejected submission doesn't lose their input.
+type BookForm struct {
+	Values  store.Book
+	Errors  store.FieldErrors
+	Message string
+}
+
+// BookUpdate is the body of PUT /api/books/:id. The fields left out are
+// not changed.
+type BookUpdate struct {
+	Title   *string `json:"title"`
+	Author  *string `json:"author"`
+	Edition *string `json:"edition"`
+	Pages   *string `json:"pages"`
+	Year    *string `json:"year"`
+	Shelf   *string `json:"shelf"`
+	// Replaces all the alternate titles, {} removing them
+	Titles *map[string]string `json:"titles"`
+}
+
+// AuthorPage is the data passed to the "author-books" block.
+type AuthorPage struct {
+	Author string
+	Books  []store.Book
+	Count  int
+	Sort   string
+	Order  string
+}
+
+// YearPage is the data passed to the "year-books" block.
+type YearPage struct {
+	Year  string
+	Books []store.Book
+	Count int
+}
+
+// ShelfPage is the data passed to the "shelf-books" block.
+type ShelfPage struct {
+	Shelf string
+	Books []store.Book
+	Count int
+}
+
+// BookTable serves the table of every book.
+func (h *BookHandler) BookTable(c echo.Context) error {
+	books, err := h.Books(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(200, "book-table", h.links(localized(c, books)))
+}
+
+// AuthorList serves the list of the authors.
+func (h *BookHandler) AuthorList(c echo.Context) error {
+	authors, err := h.Authors(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(http.StatusOK, "authors", authors)
+}
+
+// AuthorBooks serves the books of an author, e.g.
+// /authors/Mary%20Shelley?sort=year&order=desc
+func (h *BookHandler) AuthorBooks(c echo.Context) error {
+	name, err := url.PathUnescape(c.Param("name"))
+	if err != nil {
+		name = c.Param("name")
+	}
+	sortKey := c.QueryParam("sort")
+	if _, ok := store.SortFields[sortKey]; !ok {
+		sortKey = "title"
+	}
+	order := strings.ToLower(c.QueryParam("order"))
+	if order != "desc" {
+		order = "asc"
+	}
+
+	books, err := h.repo.ByAuthor(c.Request().Context(), name, sortKey, order == "desc")
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	if len(books) == 0 {
+		return JSONError(c, http.StatusNotFound, "Author not found")
+	}
+	return render.Page(c, http.StatusOK, "author-books", AuthorPage{
+		Author: name,
+		Books:  localized(c, books),
+		Count:  len(books),
+		Sort:   sortKey,
+		Order:  order,
+	})
+}
+
+// YearList serves the publication years, grouped by decade.
+func (h *BookHandler) YearList(c echo.Context) error {
+	decades, err := h.Years(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(http.StatusOK, "years", decades)
+}
+
+// YearBooks serves the books published in a year, e.g. /years/1843
+func (h *BookHandler) YearBooks(c echo.Context) error {
+	year := c.Param("year")
+	books, err := h.repo.ByYear(c.Request().Context(), year)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	if len(books) == 0 {
+		return JSONError(c, http.StatusNotFound, "No books found for this year")
+	}
+	return render.Page(c, http.StatusOK, "year-books", YearPage{
+		Year:  year,
+		Books: localized(c, books),
+		Count: len(books),
+	})
+}
+
+// ShelfList serves the shelves with the number of books on each.
+func (h *BookHandler) ShelfList(c echo.Context) error {
+	shelves, err := h.repo.Shelves(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(http.StatusOK, "shelves", shelves)
+}
+
+// ShelfBooks serves the books on a shelf, e.g. /shelves/B3, or those
+// without a shelf at /shelves/- (store.Unshelved).
+func (h *BookHandler) ShelfBooks(c echo.Context) error {
+	shelf, err := url.PathUnescape(c.Param("shelf"))
+	if err != nil {
+		shelf = c.Param("shelf")
+	}
+	books, err := h.repo.ByShelf(c.Request().Context(), shelf)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	if len(books) == 0 {
+		return JSONError(c, http.StatusNotFound, "No books found on this shelf")
+	}
+	return render.Page(c, http.StatusOK, "shelf-books", ShelfPage{
+		Shelf: shelf,
+		Books: localized(c, books),
+		Count: len(books),
+	})
+}
+
+// ListShelves answers with the shelves and the number of books on each,
+// as in ShelfList.
+func (h *BookHandler) ListShelves(c echo.Context) error {
+	shelves, err := h.repo.Shelves(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, shelves)
+}
+
+// RandomBook answers with a book picked at random.
+func (h *BookHandler) RandomBook(c echo.Context) error {
+	book, err := h.repo.Random(c.Request().Context())
+	if errors.Is(err, store.ErrNotFound) {
+		return JSONError(c, http.StatusNotFound, "No books yet")
+	} else if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, h.links([]store.Book{book})[0])
+}
+
+// Surprise sends the "Surprise me" button to the detail page of a book
+// picked at random.
+func (h *BookHandler) Surprise(c echo.Context) error {
+	book, err := h.repo.Random(c.Request().Context())
+	if errors.Is(err, store.ErrNotFound) {
+		return JSONError(c, http.StatusNotFound, "No books yet")
+	} else if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	target := "/books/" + url.PathEscape(book.ID)
+	if c.Request().Header.Get("HX-Request") == "true" {
+		// Let HTMX load the detail view and push its URL, so the
+		// address bar shows the book rather than /surprise
+		location, _ := json.Marshal(map[string]string{"path": target, "target": "#page-content"})
+		c.Response().Header().Set("HX-Location", string(location))
+		return c.NoContent(http.StatusOK)
+	}
+	return c.Redirect(http.StatusFound, target)
+}
+
+// CreateForm serves the empty form adding a book.
+func (h *BookHandler) CreateForm(c echo.Context) error {
+	return c.Render(http.StatusOK, "create-form", BookForm{})
+}
+
+// ListBooks answers with every book. ?q= filters them with the query
+// language described in store/query.go. Filtered lists come straight from
+// the database, not the cache. Both are dated by LastModified, and not
+// sent again to clients having them already.
+func (h *BookHandler) ListBooks(c echo.Context) error {
+	ctx := c.Request().Context()
+	if h.LastModified != nil {
+		modified, err := h.LastModified(ctx)
+		if err != nil {
+			return ServerError(c, err, "Database error")
+		}
+		if NotModified(c, modified) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	if q := c.QueryParam("q"); q != "" {
+		filter, err := store.ParseQuery(q)
+		if err != nil {
+			return Error(c, err, "Invalid query")
+		}
+		books, err := h.repo.Find(ctx, filter)
+		if err != nil {
+			return ServerError(c, err, "Database error")
+		}
+		return c.JSON(http.StatusOK, h.links(books))
+	}
+
+	books, err := h.Books(ctx)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, h.links(books))
+}
+
+// localized returns the books with their titles in the languages of the
+// request (see store/titles.go), for the pages.
+func localized(c echo.Context, books []store.Book) []store.Book {
+	c.Response().Header().Add("Vary", "Accept-Language")
+	return store.LocalizeBooks(books, render.Languages(c))
+}
+
+// links applies Links, when set.
+func (h *BookHandler) links(books []store.Book) []store.Book {
+	if h.Links == nil {
+		return books
+	}
+	return h.Links(books)
+}
+
+// CreateBook adds the book posted by the create form or an API client.
+// ?enrich=true fills in the missing details with Enrich first; the book is
+// created anyway if it fails.
+func (h *BookHandler) CreateBook(c echo.Context) error {
+	ctx := c.Request().Context()
+	var newBook store.Book
+	if err := c.Bind(&newBook); err != nil {
+		return InvalidBody(c, err, "Invalid request body")
+	}
+	browser := render.IsBrowserSubmission(c)
+
+	if c.QueryParam("enrich") == "true" && h.Enrich != nil {
+		if _, err := h.Enrich(ctx, &newBook); err != nil && !errors.Is(err, ErrNoISBN) {
+			h.logger.WarnContext(ctx, "could not enrich new book", "id", newBook.ID, "error", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	newBook.CreatedAt = &now
+	newBook.UpdatedAt = nil
+	newBook.UpdatedBy = store.ActorFromContext(ctx)
+	err := h.repo.Insert(ctx, newBook)
+	// Browsers get the form back with the errors next to the fields. The
+	// 422 status is allowed to swap by the handler in the index page.
+	var ve *store.ValidationError
+	switch {
+	case browser && errors.As(err, &ve):
+		return c.Render(http.StatusUnprocessableEntity, "create-form", BookForm{Values: newBook, Errors: ve.Fields})
+	case browser && errors.Is(err, store.ErrDuplicate):
+		return c.Render(http.StatusUnprocessableEntity, "create-form", BookForm{Values: newBook, Message: "Book already exists"})
+	case err != nil:
+		return Error(c, err, "Could not insert book")
+	}
+	h.Hooks.Invalidate()
+	h.Hooks.Index.Indexed(ctx, newBook)
+	if browser {
+		return c.Render(http.StatusCreated, "create-form", BookForm{Message: "Book created"})
+	}
+	return c.JSON(http.StatusCreated, map[string]string{"status": "Book created"})
+}
+
+// UpdateBook changes the fields of a book given in the JSON body.
+func (h *BookHandler) UpdateBook(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	var data BookUpdate
+	if err := c.Bind(&data); err != nil {
+		return InvalidBody(c, err, "Invalid update data")
+	}
+
+	// Build BSON update document from the fields sent
+	updateFields := bson.M{}
+	for field, v := range map[string]*string{
+		"BookName":    data.Title,
+		"BookAuthor":  data.Author,
+		"BookEdition": data.Edition,
+		"BookPages":   data.Pages,
+		"BookYear":    data.Year,
+		"BookShelf":   data.Shelf,
+	} {
+		if v != nil {
+			updateFields[field] = *v
+		}
+	}
+	if data.Titles != nil {
+		updateFields["BookTitles"] = *data.Titles
+	}
+	if len(updateFields) == 0 {
+		return JSONError(c, http.StatusBadRequest, "No valid fields to update")
+	}
+	updateFields["updatedAt"] = time.Now().UTC()
+	updateFields["updatedBy"] = store.ActorFromContext(ctx)
+
+	if err := h.repo.Update(ctx, id, updateFields); err != nil {
+		return Error(c, err, "Could not update book")
+	}
+	h.Hooks.Invalidate()
+	// The update only carries the changed fields, the index gets the
+	// whole book
+	if book, err := h.repo.ByID(ctx, id); err != nil {
+		h.logger.WarnContext(ctx, "failed to reindex book", "id", id, "error", err)
+	} else {
+		h.Hooks.Index.Indexed(ctx, book)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "Book updated"})
+}
+
+// DeleteBook removes a book.
+func (h *BookHandler) DeleteBook(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	// What the book linked to, for the Deleted hook
+	book, err := h.repo.ByID(ctx, id)
+	if err != nil {
+		return Error(c, err, "Could not delete book")
+	}
+	if err := h.repo.Delete(ctx, id); err != nil {
+		return Error(c, err, "Could not delete book")
+	}
+	h.Hooks.Invalidate()
+	h.Hooks.Index.Removed(ctx, id)
+	if h.Hooks.Deleted != nil {
+		h.Hooks.Deleted(ctx, book)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "Book deleted"})
+}
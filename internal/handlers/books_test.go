@@ -0,0 +1,580 @@
+package handlers_test
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/openapitest"
+	"github.com/CAPS-Cloud/exercises/internal/server"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryRepo is an in-memory BookRepository returning the errors of the
+// store. Find can't run MongoDB filters, it records the filter and returns
+// every book.
+type memoryRepo struct {
+	books  []store.Book
+	err    error // returned by every call when set
+	filter interface{}
+}
+
+func (r *memoryRepo) All(ctx context.Context) ([]store.Book, error) {
+	return slices.Clone(r.books), r.err
+}
+
+func (r *memoryRepo) Find(ctx context.Context, filter interface{}) ([]store.Book, error) {
+	r.filter = filter
+	return r.All(ctx)
+}
+
+func (r *memoryRepo) Authors(ctx context.Context) ([]string, error) {
+	var authors []string
+	for _, b := range r.books {
+		if !slices.Contains(authors, b.BookAuthor) {
+			authors = append(authors, b.BookAuthor)
+		}
+	}
+	return authors, r.err
+}
+
+func (r *memoryRepo) index(id string) int {
+	return slices.IndexFunc(r.books, func(b store.Book) bool { return b.ID == id })
+}
+
+func (r *memoryRepo) ByID(ctx context.Context, id string) (store.Book, error) {
+	if r.err != nil {
+		return store.Book{}, r.err
+	}
+	if i := r.index(id); i >= 0 {
+		return r.books[i], nil
+	}
+	return store.Book{}, store.ErrNotFound
+}
+
+func (r *memoryRepo) Random(ctx context.Context) (store.Book, error) {
+	if r.err == nil && len(r.books) == 0 {
+		return store.Book{}, store.ErrNotFound
+	}
+	if r.err != nil {
+		return store.Book{}, r.err
+	}
+	return r.books[0], nil
+}
+
+func (r *memoryRepo) ByAuthor(ctx context.Context, author string, sortKey string, desc bool) ([]store.Book, error) {
+	var books []store.Book
+	for _, b := range r.books {
+		if b.BookAuthor == author {
+			books = append(books, b)
+		}
+	}
+	return books, r.err
+}
+
+func (r *memoryRepo) YearsByDecade(ctx context.Context) ([]store.DecadeGroup, error) {
+	return nil, r.err
+}
+
+func (r *memoryRepo) ByYear(ctx context.Context, year string) ([]store.Book, error) {
+	var books []store.Book
+	for _, b := range r.books {
+		if b.BookYear == year {
+			books = append(books, b)
+		}
+	}
+	return books, r.err
+}
+
+func (r *memoryRepo) Shelves(ctx context.Context) ([]store.ShelfCount, error) {
+	shelves := []store.ShelfCount{}
+	for _, b := range r.books {
+		shelf := cmp.Or(b.BookShelf, store.Unshelved)
+		i := slices.IndexFunc(shelves, func(s store.ShelfCount) bool { return s.Shelf == shelf })
+		if i < 0 {
+			shelves = append(shelves, store.ShelfCount{Shelf: shelf})
+			i = len(shelves) - 1
+		}
+		shelves[i].Count++
+	}
+	return shelves, r.err
+}
+
+func (r *memoryRepo) ByShelf(ctx context.Context, shelf string) ([]store.Book, error) {
+	var books []store.Book
+	for _, b := range r.books {
+		if cmp.Or(b.BookShelf, store.Unshelved) == shelf {
+			books = append(books, b)
+		}
+	}
+	return books, r.err
+}
+
+func (r *memoryRepo) Insert(ctx context.Context, book store.Book) error {
+	if errs := store.ValidateBook(book); len(errs) > 0 {
+		return &store.ValidationError{Fields: errs}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.index(book.ID) >= 0 {
+		return store.ErrDuplicate
+	}
+	r.books = append(r.books, book)
+	return nil
+}
+
+func (r *memoryRepo) Update(ctx context.Context, id string, fields bson.M) error {
+	errs := store.FieldErrors{}
+	for field, value := range fields {
+		switch value := value.(type) {
+		case string:
+			if msg := store.ValidateBookField(field, value); msg != "" {
+				errs[field] = msg
+			}
+		case map[string]string:
+			if msg := store.ValidateTitles(value); msg != "" {
+				errs[field] = msg
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &store.ValidationError{Fields: errs}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	i := r.index(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	b := &r.books[i]
+	for field, value := range fields {
+		switch field {
+		case "BookName":
+			b.BookName = value.(string)
+		case "BookAuthor":
+			b.BookAuthor = value.(string)
+		case "BookEdition":
+			b.BookEdition = value.(string)
+		case "BookPages":
+			b.BookPages = value.(string)
+		case "BookYear":
+			b.BookYear = value.(string)
+		case "BookShelf":
+			b.BookShelf = value.(string)
+		case "BookTitles":
+			b.BookTitles = value.(map[string]string)
+		case "BookCover":
+			b.BookCover = value.(string)
+		case "BookSubjects":
+			b.BookSubjects = value.([]string)
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepo) Delete(ctx context.Context, id string) error {
+	if r.err != nil {
+		return r.err
+	}
+	i := r.index(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	r.books = slices.Delete(r.books, i, i+1)
+	return nil
+}
+
+func (r *memoryRepo) Changes(ctx context.Context, since time.Time, limit int) (store.Changes, error) {
+	changes := store.Changes{Added: []store.Book{}, Updated: []store.Book{}}
+	for _, b := range r.books {
+		switch {
+		case b.CreatedAt != nil && !b.CreatedAt.Before(since):
+			changes.Added = append(changes.Added, b)
+		case b.UpdatedAt != nil && !b.UpdatedAt.Before(since):
+			changes.Updated = append(changes.Updated, b)
+		}
+	}
+	changes.Added = changes.Added[:min(limit, len(changes.Added))]
+	changes.Updated = changes.Updated[:min(limit, len(changes.Updated))]
+	return changes, r.err
+}
+
+// recorder is the search index of the tests, and counts the cache
+// invalidations.
+type recorder struct {
+	indexed, removed []string
+	deleted          []store.Book
+	invalidated      int
+}
+
+func (r *recorder) Indexed(ctx context.Context, book store.Book) {
+	r.indexed = append(r.indexed, book.ID)
+}
+func (r *recorder) Removed(ctx context.Context, id string) { r.removed = append(r.removed, id) }
+
+func exampleBooks() []store.Book {
+	return []store.Book{
+		{ID: "example1", BookName: "The Vortex", BookAuthor: "José Eustasio Rivera", BookPages: "292", BookYear: "1924", BookShelf: "B3"},
+		{ID: "example2", BookName: "Frankenstein", BookAuthor: "Mary Shelley", BookPages: "280", BookYear: "1818"},
+	}
+}
+
+// pngHeader is enough of a PNG image for http.DetectContentType.
+const pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+// memoryCovers links the books to covers named after them, refusing all
+// but PNG images. Fetch only finds https://example.com/cover.png.
+type memoryCovers struct {
+	repo *memoryRepo
+}
+
+func (mc memoryCovers) Set(ctx context.Context, book store.Book, image []byte, contentType string) (store.Book, error) {
+	if contentType != "image/png" {
+		return book, &handlers.CoverError{Status: http.StatusUnsupportedMediaType, Msg: "The cover must be a PNG image"}
+	}
+	book.BookCover = "/files/covers/" + book.ID + ".png"
+	return book, mc.repo.Update(ctx, book.ID, bson.M{"BookCover": book.BookCover})
+}
+
+func (mc memoryCovers) Fetch(ctx context.Context, url string) ([]byte, string, error) {
+	switch url {
+	case "https://example.com/cover.png":
+		return []byte(pngHeader), "image/png", nil
+	case "http://localhost/cover.png":
+		return nil, "", &handlers.CoverError{Status: http.StatusBadRequest, Msg: "Invalid cover URL"}
+	}
+	return nil, "", errors.New("connection refused")
+}
+
+// withActions mounts the routes of h backed by the hooks main sets: the
+// enrichment, the covers and the exports. Enrich only knows of example2.
+func withActions(h *handlers.BookHandler, repo *memoryRepo) {
+	h.Enrich = func(ctx context.Context, book *store.Book) (bson.M, error) {
+		if book.ID != "example2" {
+			return nil, handlers.ErrNoISBN
+		}
+		book.BookSubjects = []string{"Monsters"}
+		return bson.M{"BookSubjects": book.BookSubjects}, nil
+	}
+	h.Covers = memoryCovers{repo}
+	h.Exports = map[string]handlers.ExportFormat{
+		"json": {ContentType: "application/json", Ext: ".json", Write: func(w io.Writer, book store.Book) error {
+			return json.NewEncoder(w).Encode([]store.Book{book})
+		}},
+		"bibtex": {ContentType: "application/x-bibtex; charset=utf-8", Ext: ".bib", Write: func(w io.Writer, book store.Book) error {
+			_, err := fmt.Fprintf(w, "@book{%s,\n  title = {%s}\n}\n", book.ID, book.BookName)
+			return err
+		}},
+	}
+}
+
+// specPath is the OpenAPI document the answers of TestBookAPI are checked
+// against (see internal/openapitest).
+const specPath = "../../api/openapi.yaml"
+
+func loadSpec(t *testing.T) *openapitest.Spec {
+	t.Helper()
+	spec, err := openapitest.Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestBookAPI(t *testing.T) {
+	dbErr := errors.New("connection refused")
+	unavailable := &store.UnavailableError{RetryAfter: 20 * time.Second}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		ctype  string // of the body, JSON by default
+		err    error
+		empty  bool
+		code   int
+		want   string
+		check  func(t *testing.T, repo *memoryRepo, rec *recorder)
+	}{
+		{name: "list", method: http.MethodGet, path: "/api/books", code: http.StatusOK, want: `"id":"example2"`},
+		{name: "list with database error", method: http.MethodGet, path: "/api/books", err: dbErr, code: http.StatusInternalServerError, want: "Database error"},
+		{name: "list with database unavailable", method: http.MethodGet, path: "/api/books", err: unavailable, code: http.StatusServiceUnavailable, want: "Database unavailable"},
+		{
+			name: "filter", method: http.MethodGet, path: "/api/books?q=author:shelley", code: http.StatusOK,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if repo.filter == nil {
+					t.Error("the filter did not reach the repository")
+				}
+			},
+		},
+		{
+			name: "filter with an operator", method: http.MethodGet, path: "/api/books?q=id%3D%24ne", code: http.StatusOK,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if filter, ok := repo.filter.(bson.M); !ok || filter["ID"] != "$ne" {
+					t.Errorf("got filter %v, want the ID compared to the text $ne", repo.filter)
+				}
+			},
+		},
+		{name: "invalid filter", method: http.MethodGet, path: "/api/books?q=title:%22open", code: http.StatusBadRequest, want: `"position"`},
+		{name: "shelves", method: http.MethodGet, path: "/api/shelves", code: http.StatusOK, want: `[{"shelf":"B3","count":1},{"shelf":"-","count":1}]`},
+		{name: "shelves with database error", method: http.MethodGet, path: "/api/shelves", err: dbErr, code: http.StatusInternalServerError},
+		{name: "random", method: http.MethodGet, path: "/api/books/random", code: http.StatusOK, want: `"id":"example1"`},
+		{name: "random without books", method: http.MethodGet, path: "/api/books/random", empty: true, code: http.StatusNotFound, want: "No books yet"},
+		{name: "random with database error", method: http.MethodGet, path: "/api/books/random", err: dbErr, code: http.StatusInternalServerError},
+		{
+			name: "create", method: http.MethodPost, path: "/api/books",
+			body: `{"id":"dracula","title":"Dracula","author":"Bram Stoker","pages":"488","year":"1897"}`,
+			code: http.StatusCreated, want: "Book created",
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				book, err := repo.ByID(context.Background(), "dracula")
+				if err != nil || book.BookName != "Dracula" || book.CreatedAt == nil {
+					t.Errorf("stored %+v, %v", book, err)
+				}
+				if !slices.Equal(rec.indexed, []string{"dracula"}) || rec.invalidated != 1 {
+					t.Errorf("indexed %v and invalidated %d times", rec.indexed, rec.invalidated)
+				}
+			},
+		},
+		{name: "create invalid", method: http.MethodPost, path: "/api/books", body: `{"id":"a b","title":"Untitled","pages":"many"}`, code: http.StatusBadRequest, want: `"pages":"Pages must be a positive number"`},
+		{name: "create with a typo", method: http.MethodPost, path: "/api/books", body: `{"id":"dracula","title":"Dracula","auther":"Bram Stoker"}`, code: http.StatusBadRequest, want: `"auther":"Unknown field"`},
+		{name: "create with a wrong type", method: http.MethodPost, path: "/api/books", body: `{"id":"dracula","title":"Dracula","author":"Bram Stoker","pages":488}`, code: http.StatusBadRequest, want: `"pages":"Must be a string, not number"`},
+		{name: "create malformed", method: http.MethodPost, path: "/api/books", body: `{"id":`, code: http.StatusBadRequest, want: "Invalid request body"},
+		{
+			name: "create duplicate", method: http.MethodPost, path: "/api/books",
+			body: `{"id":"example2","title":"Frankenstein","author":"Mary Shelley","pages":"280","year":"1818"}`,
+			code: http.StatusConflict, want: "Book already exists",
+		},
+		{name: "create with database error", method: http.MethodPost, path: "/api/books", body: `{"id":"dracula","title":"Dracula","author":"Bram Stoker"}`, err: dbErr, code: http.StatusInternalServerError},
+		{
+			name: "update", method: http.MethodPut, path: "/api/books/example1", body: `{"title":"La vorágine","year":"1924"}`,
+			code: http.StatusOK, want: "Book updated",
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if book, _ := repo.ByID(context.Background(), "example1"); book.BookName != "La vorágine" {
+					t.Errorf("stored %+v", book)
+				}
+				if !slices.Equal(rec.indexed, []string{"example1"}) || rec.invalidated != 1 {
+					t.Errorf("indexed %v and invalidated %d times", rec.indexed, rec.invalidated)
+				}
+			},
+		},
+		{name: "update unknown book", method: http.MethodPut, path: "/api/books/nope", body: `{"title":"Nope"}`, code: http.StatusNotFound, want: "Book not found"},
+		{name: "update without fields", method: http.MethodPut, path: "/api/books/example1", body: `{}`, code: http.StatusBadRequest, want: "No valid fields to update"},
+		{name: "update with unknown fields", method: http.MethodPut, path: "/api/books/example1", body: `{"title":"Vortex","rating":"5","auther":"Rivera"}`, code: http.StatusBadRequest, want: `"fields":{"auther":"Unknown field","rating":"Unknown field"}`},
+		{
+			name: "update shelf", method: http.MethodPut, path: "/api/books/example2", body: `{"shelf":"A1"}`, code: http.StatusOK,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if book, _ := repo.ByID(context.Background(), "example2"); book.BookShelf != "A1" {
+					t.Errorf("stored %+v", book)
+				}
+			},
+		},
+		{
+			name: "update titles", method: http.MethodPut, path: "/api/books/example1", body: `{"titles":{"en":"The Vortex"}}`, code: http.StatusOK,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if book, _ := repo.ByID(context.Background(), "example1"); book.BookTitles["en"] != "The Vortex" {
+					t.Errorf("stored %+v", book)
+				}
+			},
+		},
+		{name: "update titles with a name for a language", method: http.MethodPut, path: "/api/books/example1", body: `{"titles":{"English":"The Vortex"}}`, code: http.StatusBadRequest, want: `"titles"`},
+		{name: "update with the shelf of no shelf", method: http.MethodPut, path: "/api/books/example2", body: `{"shelf":"-"}`, code: http.StatusBadRequest, want: `"shelf"`},
+		{name: "update with an operator", method: http.MethodPut, path: "/api/books/example1", body: `{"title":{"$ne":null}}`, code: http.StatusBadRequest, want: `"title":"Must be a string, not object"`},
+		{name: "update invalid", method: http.MethodPut, path: "/api/books/example1", body: `{"year":"19th"}`, code: http.StatusBadRequest, want: `"year"`},
+		{name: "update with database error", method: http.MethodPut, path: "/api/books/example1", body: `{"title":"Nope"}`, err: dbErr, code: http.StatusInternalServerError},
+		{name: "update with database unavailable", method: http.MethodPut, path: "/api/books/example1", body: `{"title":"Nope"}`, err: unavailable, code: http.StatusServiceUnavailable},
+		{
+			name: "delete", method: http.MethodDelete, path: "/api/books/example1", code: http.StatusOK, want: "Book deleted",
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if len(repo.books) != 1 || !slices.Equal(rec.removed, []string{"example1"}) {
+					t.Errorf("left %d books, removed %v from the index", len(repo.books), rec.removed)
+				}
+				if len(rec.deleted) != 1 || rec.deleted[0].BookName != "The Vortex" {
+					t.Errorf("deleted hook got %+v", rec.deleted)
+				}
+			},
+		},
+		{name: "recent", method: http.MethodGet, path: "/api/books/recent", code: http.StatusOK, want: `"window":"7d"`},
+		{name: "recent in a window", method: http.MethodGet, path: "/api/books/recent?window=24h", code: http.StatusOK, want: `"window":"24h"`},
+		{name: "recent in an invalid window", method: http.MethodGet, path: "/api/books/recent?window=2y", code: http.StatusBadRequest, want: "invalid window"},
+		{name: "recent in a window too long", method: http.MethodGet, path: "/api/books/recent?window=400d", code: http.StatusBadRequest, want: "between 0 and 365d"},
+		{name: "recent with database error", method: http.MethodGet, path: "/api/books/recent", err: dbErr, code: http.StatusInternalServerError, want: "Database error"},
+		{
+			name: "enrich", method: http.MethodPost, path: "/api/books/example2/enrich", code: http.StatusOK, want: `"filled":["subjects"]`,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if book, _ := repo.ByID(context.Background(), "example2"); !slices.Equal(book.BookSubjects, []string{"Monsters"}) {
+					t.Errorf("stored %+v", book)
+				}
+				if !slices.Equal(rec.indexed, []string{"example2"}) || rec.invalidated != 1 {
+					t.Errorf("indexed %v and invalidated %d times", rec.indexed, rec.invalidated)
+				}
+			},
+		},
+		{name: "enrich without ISBN", method: http.MethodPost, path: "/api/books/example1/enrich", code: http.StatusUnprocessableEntity, want: "not an ISBN"},
+		{name: "enrich unknown book", method: http.MethodPost, path: "/api/books/nope/enrich", code: http.StatusNotFound, want: "Book not found"},
+		{
+			name: "upload cover", method: http.MethodPut, path: "/api/books/example1/cover", body: pngHeader, ctype: "image/png", code: http.StatusOK, want: `"cover":"/files/covers/example1.png"`,
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if book, _ := repo.ByID(context.Background(), "example1"); book.BookCover != "/files/covers/example1.png" {
+					t.Errorf("stored %+v", book)
+				}
+				if !slices.Equal(rec.indexed, []string{"example1"}) || rec.invalidated != 1 {
+					t.Errorf("indexed %v and invalidated %d times", rec.indexed, rec.invalidated)
+				}
+			},
+		},
+		{name: "upload a cover that isn't an image", method: http.MethodPut, path: "/api/books/example1/cover", body: "not an image", ctype: "image/png", code: http.StatusUnsupportedMediaType},
+		{name: "upload the cover of an unknown book", method: http.MethodPut, path: "/api/books/nope/cover", body: pngHeader, ctype: "image/png", code: http.StatusNotFound, want: "Book not found"},
+		{name: "fetch cover", method: http.MethodPost, path: "/api/books/example2/cover", body: `{"url":"https://example.com/cover.png"}`, code: http.StatusOK, want: `"cover":"/files/covers/example2.png"`},
+		{name: "fetch cover without URL", method: http.MethodPost, path: "/api/books/example2/cover", body: `{}`, code: http.StatusBadRequest, want: "Give the url"},
+		{name: "fetch cover refused", method: http.MethodPost, path: "/api/books/example2/cover", body: `{"url":"http://localhost/cover.png"}`, code: http.StatusBadRequest, want: "Invalid cover URL"},
+		{name: "fetch cover failing", method: http.MethodPost, path: "/api/books/example2/cover", body: `{"url":"https://example.com/gone.png"}`, code: http.StatusBadGateway, want: "Could not fetch the cover"},
+		{name: "export", method: http.MethodGet, path: "/api/books/example1/export", code: http.StatusOK, want: `"id":"example1"`},
+		{name: "export as bibtex", method: http.MethodGet, path: "/api/books/example1/export?format=bibtex", code: http.StatusOK, want: "@book{example1"},
+		{name: "export in an unknown format", method: http.MethodGet, path: "/api/books/example1/export?format=pdf", code: http.StatusBadRequest, want: "expected one of bibtex, json"},
+		{name: "export unknown book", method: http.MethodGet, path: "/api/books/nope/export", code: http.StatusNotFound, want: "Book not found"},
+		{
+			name: "delete unknown book", method: http.MethodDelete, path: "/api/books/nope", code: http.StatusNotFound, want: "Book not found",
+			check: func(t *testing.T, repo *memoryRepo, rec *recorder) {
+				if len(rec.deleted) != 0 {
+					t.Errorf("deleted hook got %+v", rec.deleted)
+				}
+			},
+		},
+	}
+
+	spec := loadSpec(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &memoryRepo{books: exampleBooks(), err: tt.err}
+			if tt.empty {
+				repo.books = nil
+			}
+			rec := &recorder{}
+			h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+			h.Hooks = handlers.Hooks{
+				Invalidate: func() { rec.invalidated++ },
+				Index:      rec,
+				Deleted:    func(ctx context.Context, book store.Book) { rec.deleted = append(rec.deleted, book) },
+			}
+			withActions(h, repo)
+			e := server.New(nil)
+			h.RegisterRoutes(e)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", cmp.Or(tt.ctype, "application/json"))
+			}
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Errorf("got status %d, want %d: %s", res.Code, tt.code, res.Body)
+			}
+			if !strings.Contains(res.Body.String(), tt.want) {
+				t.Errorf("%q not found in %s", tt.want, res.Body)
+			}
+			if tt.check != nil {
+				tt.check(t, repo, rec)
+			}
+			spec.Check(t, req, tt.body, res)
+		})
+	}
+}
+
+func TestBookLinks(t *testing.T) {
+	repo := &memoryRepo{books: exampleBooks()}
+	repo.books[0].BookCover = "/files/covers/example1.jpg"
+	h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+	h.Links = func(books []store.Book) []store.Book {
+		signed := slices.Clone(books)
+		for i := range signed {
+			signed[i].BookCover += "?signature=x"
+		}
+		return signed
+	}
+	e := server.New(nil)
+	h.RegisterRoutes(e)
+
+	for _, path := range []string{"/api/books", "/api/books?q=author:rivera", "/api/books/random"} {
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if !strings.Contains(res.Body.String(), `"cover":"/files/covers/example1.jpg?signature=x"`) {
+			t.Errorf("%s: the cover link was not rewritten: %s", path, res.Body)
+		}
+	}
+	if repo.books[0].BookCover != "/files/covers/example1.jpg" {
+		t.Errorf("the stored book was modified: %+v", repo.books[0])
+	}
+}
+
+func TestBookListLastModified(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 30, 15, 500, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		code    int
+	}{
+		{name: "unconditional", code: http.StatusOK},
+		{name: "modified since", headers: map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 12:30:14 GMT"}, code: http.StatusOK},
+		{name: "not modified", headers: map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 12:30:15 GMT"}, code: http.StatusNotModified},
+		{name: "later date", headers: map[string]string{"If-Modified-Since": "Sat, 02 Mar 2024 00:00:00 GMT"}, code: http.StatusNotModified},
+		{name: "invalid date", headers: map[string]string{"If-Modified-Since": "yesterday"}, code: http.StatusOK},
+		{
+			name:    "if-none-match first",
+			headers: map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 12:30:15 GMT", "If-None-Match": `"abc"`},
+			code:    http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlers.NewBookHandler(&memoryRepo{books: exampleBooks()}, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+			h.LastModified = func(context.Context) (time.Time, error) { return modified, nil }
+			e := server.New(nil)
+			h.RegisterRoutes(e)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Errorf("got status %d, want %d", res.Code, tt.code)
+			}
+			if got := res.Header().Get("Last-Modified"); got != "Fri, 01 Mar 2024 12:30:15 GMT" {
+				t.Errorf("got Last-Modified %q", got)
+			}
+		})
+	}
+}
+
+func TestPageLink(t *testing.T) {
+	e := server.New(nil)
+	req := httptest.NewRequest(http.MethodGet, "/api/activity?before=b1&limit=5", nil)
+	res := httptest.NewRecorder()
+	c := e.NewContext(req, res)
+
+	handlers.PageLink(c, "first", map[string]string{"before": ""})
+	handlers.PageLink(c, "next", map[string]string{"before": "b2"})
+
+	want := []string{`</api/activity?limit=5>; rel="first"`, `</api/activity?before=b2&limit=5>; rel="next"`}
+	if got := res.Header().Values("Link"); !slices.Equal(got, want) {
+		t.Errorf("got Link %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// Document builds a file about the whole catalog, e.g. a feed, with its
+// links pointing back to base.
+type Document func(ctx context.Context, base string) ([]byte, error)
+
+// BaseURL returns the scheme and host the client used to reach us, so the
+// links we hand out (feeds, sitemaps) point back to the right place.
+func BaseURL(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// AtomFeed serves the Atom feed of the latest additions.
+func (h *BookHandler) AtomFeed(c echo.Context) error {
+	feed, err := h.Feed(c.Request().Context(), BaseURL(c))
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Blob(http.StatusOK, "application/atom+xml; charset=utf-8", feed)
+}
+
+// SitemapXML serves the sitemap for search engines.
+func (h *BookHandler) SitemapXML(c echo.Context) error {
+	sitemap, err := h.Sitemap(c.Request().Context(), BaseURL(c))
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Blob(http.StatusOK, "application/xml; charset=utf-8", sitemap)
+}
+
+// CatalogReport serves the printable catalog, e.g.
+// /reports/catalog.pdf?author=Mary%20Shelley.
+func (h *BookHandler) CatalogReport(c echo.Context) error {
+	filter := store.ReportFilter{
+		Author: c.QueryParam("author"),
+		Year:   c.QueryParam("year"),
+		Query:  c.QueryParam("q"),
+	}
+	report, err := h.Report(c.Request().Context(), filter)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `inline; filename="catalog.pdf"`)
+	return c.Blob(http.StatusOK, "application/pdf", report)
+}
+
+// CatalogStats returns the figures of the admin dashboard, e.g. for
+// external reporting.
+func (h *BookHandler) CatalogStats(c echo.Context) error {
+	stats, err := h.Stats(c.Request().Context())
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,236 @@
+package handlers_test
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/server"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// pageRenderer records the block rendered and its data.
+type pageRenderer struct {
+	name string
+	data interface{}
+}
+
+func (r *pageRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	r.name, r.data = name, data
+	_, err := io.WriteString(w, name)
+	return err
+}
+
+// memorySearch finds the books whose title contains the query, and
+// suggests their titles.
+type memorySearch struct {
+	repo *memoryRepo
+}
+
+func (s memorySearch) Search(ctx context.Context, query string) ([]store.SearchResult, error) {
+	var results []store.SearchResult
+	for _, b := range s.repo.books {
+		if strings.Contains(strings.ToLower(b.BookName), strings.ToLower(query)) {
+			results = append(results, store.SearchResult{Book: b, Score: 1})
+		}
+	}
+	return results, s.repo.err
+}
+
+func (s memorySearch) Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error) {
+	var suggestions []store.Suggestion
+	for _, b := range s.repo.books {
+		if strings.HasPrefix(strings.ToLower(b.BookName), strings.ToLower(prefix)) && len(suggestions) < limit {
+			suggestions = append(suggestions, store.Suggestion{Value: b.BookName, Type: "title", ID: b.ID})
+		}
+	}
+	return suggestions, s.repo.err
+}
+
+// withCatalog mounts the routes of h about the whole catalog, the way main
+// does: every other book is similar, and the documents name the books.
+func withCatalog(h *handlers.BookHandler, repo *memoryRepo) {
+	h.Similar = func(ctx context.Context, book store.Book) ([]store.SimilarBook, error) {
+		var similar []store.SimilarBook
+		for _, b := range repo.books {
+			if b.ID != book.ID {
+				similar = append(similar, store.SimilarBook{Book: b, Score: 1})
+			}
+		}
+		return similar, repo.err
+	}
+	h.JSONLD = func(book store.Book, base string) template.JS {
+		return template.JS(`{"url":"` + base + "/books/" + book.ID + `"}`)
+	}
+	h.Search = memorySearch{repo}
+	h.Facets = func(ctx context.Context, ids []string) (map[string][]store.FacetCount, error) {
+		return map[string][]store.FacetCount{"author": {{Value: "Mary Shelley", Count: len(ids)}}}, nil
+	}
+	document := func(ctx context.Context, base string) ([]byte, error) {
+		names := []string{base}
+		for _, b := range repo.books {
+			names = append(names, b.BookName)
+		}
+		return []byte(strings.Join(names, "\n")), repo.err
+	}
+	h.Feed = document
+	h.Sitemap = document
+	h.Report = func(ctx context.Context, filter store.ReportFilter) ([]byte, error) {
+		return []byte("%PDF " + filter.String()), repo.err
+	}
+	h.Stats = func(ctx context.Context) (store.CatalogStats, error) {
+		return store.CatalogStats{TotalBooks: len(repo.books)}, repo.err
+	}
+}
+
+func TestCatalogRoutes(t *testing.T) {
+	dbErr := &store.UnavailableError{RetryAfter: time.Second}
+	tests := []struct {
+		name  string
+		path  string
+		err   error
+		code  int
+		ctype string
+		want  string
+	}{
+		{name: "similar", path: "/api/books/example2/similar", code: http.StatusOK, ctype: echo.MIMEApplicationJSON, want: `"id":"example1"`},
+		{name: "similar not found", path: "/api/books/missing/similar", code: http.StatusNotFound},
+		{name: "search", path: "/api/books/search?q=frank", code: http.StatusOK, ctype: echo.MIMEApplicationJSON, want: `"facets":{"author":[{"value":"Mary Shelley","count":1}]}`},
+		{name: "search narrowed", path: "/api/books/search?q=frank&year=1900", code: http.StatusOK, want: `"results":[]`},
+		{name: "search unavailable", path: "/api/books/search?q=frank", err: dbErr, code: http.StatusServiceUnavailable},
+		{name: "suggest", path: "/api/books/suggest?q=fr", code: http.StatusOK, want: `{"query":"fr","suggestions":[{"value":"Frankenstein","type":"title","id":"example2"}]}`},
+		{name: "feed", path: "/feed.xml", code: http.StatusOK, ctype: "application/atom+xml; charset=utf-8", want: "http://example.com\nThe Vortex"},
+		{name: "sitemap", path: "/sitemap.xml", code: http.StatusOK, ctype: "application/xml; charset=utf-8", want: "Frankenstein"},
+		{name: "report", path: "/reports/catalog.pdf?author=Mary%20Shelley", code: http.StatusOK, ctype: "application/pdf", want: "%PDF author: Mary Shelley"},
+		{name: "report unavailable", path: "/reports/catalog.pdf", err: dbErr, code: http.StatusServiceUnavailable},
+		{name: "stats", path: "/api/stats", code: http.StatusOK, want: `"totalBooks":2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &memoryRepo{books: exampleBooks()}
+			h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+			withCatalog(h, repo)
+			e := server.New(nil)
+			h.RegisterRoutes(e)
+			repo.err = tt.err
+
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if res.Code != tt.code {
+				t.Fatalf("got status %d, want %d: %s", res.Code, tt.code, res.Body)
+			}
+			if tt.ctype != "" && !strings.HasPrefix(res.Header().Get(echo.HeaderContentType), tt.ctype) {
+				t.Errorf("got Content-Type %q, want %q", res.Header().Get(echo.HeaderContentType), tt.ctype)
+			}
+			if !strings.Contains(res.Body.String(), tt.want) {
+				t.Errorf("got %s, want it to contain %s", res.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogRoutesOptional(t *testing.T) {
+	repo := &memoryRepo{books: exampleBooks()}
+	h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+	e := server.New(nil)
+	h.RegisterRoutes(e)
+	for _, path := range []string{"/api/books/example2/similar", "/api/books/search?q=frank", "/feed.xml", "/sitemap.xml", "/reports/catalog.pdf", "/api/stats"} {
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		// 405 where other methods are routed, e.g. PUT /api/books/:id
+		if res.Code != http.StatusNotFound && res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: got status %d, want the route not mounted", path, res.Code)
+		}
+	}
+}
+
+func TestBookPage(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	repo := &memoryRepo{books: exampleBooks()}
+	repo.books[1].UpdatedAt = &modified
+	repo.books[1].BookCover = "/files/covers/example2.jpg"
+	h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+	withCatalog(h, repo)
+	h.Notes = true
+	h.Links = func(books []store.Book) []store.Book {
+		signed := slices.Clone(books)
+		signed[0].BookCover += "?signature=x"
+		return signed
+	}
+	h.Dated = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	views := &pageRenderer{}
+	e := server.New(views)
+	h.RegisterRoutes(e)
+
+	req := httptest.NewRequest(http.MethodGet, "/books/example2", nil)
+	req.Header.Set("HX-Request", "true")
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || views.name != "book-detail" {
+		t.Fatalf("got status %d and block %q", res.Code, views.name)
+	}
+	if got := res.Header().Get("Last-Modified"); got != "Fri, 01 Mar 2024 13:00:00 GMT" {
+		t.Errorf("got Last-Modified %q", got)
+	}
+	detail := views.data.(handlers.BookDetail)
+	if detail.ID != "example2" || detail.DisplayTitle != "Frankenstein" || !detail.Notes {
+		t.Errorf("got %+v", detail)
+	}
+	if detail.BookCover != "/files/covers/example2.jpg?signature=x" {
+		t.Errorf("the cover link was not rewritten: %q", detail.BookCover)
+	}
+	if detail.JSONLD != `{"url":"http://example.com/books/example2"}` {
+		t.Errorf("got JSON-LD %s", detail.JSONLD)
+	}
+	if len(detail.Similar) != 1 || detail.Similar[0].ID != "example1" {
+		t.Errorf("got similar books %+v", detail.Similar)
+	}
+
+	req.Header.Set(echo.HeaderIfModifiedSince, "Fri, 01 Mar 2024 13:00:00 GMT")
+	res = httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+	if res.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", res.Code, http.StatusNotModified)
+	}
+
+	res = httptest.NewRecorder()
+	e.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/books/missing", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing book", res.Code)
+	}
+}
+
+func TestSearchResults(t *testing.T) {
+	repo := &memoryRepo{books: exampleBooks()}
+	h := handlers.NewBookHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)), config.Default())
+	withCatalog(h, repo)
+	views := &pageRenderer{}
+	e := server.New(views)
+	h.RegisterRoutes(e)
+
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/search/results?q=e&author=Mary%20Shelley&limit=1", nil))
+	if res.Code != http.StatusOK || views.name != "search-results" {
+		t.Fatalf("got status %d and block %q", res.Code, views.name)
+	}
+	page := views.data.(handlers.SearchPage)
+	if len(page.Results) != 1 || page.Results[0].ID != "example2" {
+		t.Errorf("got results %+v", page.Results)
+	}
+	if got := page.Facets["author"]; len(got) != 1 || got[0].Count != 2 {
+		t.Errorf("got facets %+v, want the count of every match", page.Facets)
+	}
+	if got := page.FilterURL("author", ""); got != "/search/results?q=e" {
+		t.Errorf("got filter URL %q", got)
+	}
+}
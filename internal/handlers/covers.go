@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// CoverError refuses a cover, the client's fault: the answer is Status,
+// with Msg telling why.
+type CoverError struct {
+	Status int
+	Msg    string
+}
+
+func (e *CoverError) Error() string { return e.Msg }
+
+// Covers stores the covers of the books, e.g. in the file storage.
+type Covers interface {
+	// Set stores image as the cover of book and links the book to it,
+	// letting go of its previous cover, and returns the book updated. It
+	// fails with a *CoverError for the types of images not accepted.
+	Set(ctx context.Context, book store.Book, image []byte, contentType string) (store.Book, error)
+	// Fetch downloads the cover at url and returns it with its type. It
+	// fails with a *CoverError for the covers that can't be used.
+	Fetch(ctx context.Context, url string) ([]byte, string, error)
+}
+
+// UploadCover sets the cover of the book to the raw image in the body, e.g.
+// PUT /api/books/:id/cover.
+func (h *BookHandler) UploadCover(c echo.Context) error {
+	image, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return JSONError(c, http.StatusBadRequest, "Could not read the image")
+	}
+	book, err := h.repo.ByID(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+	return h.setCover(c, book, image, http.DetectContentType(image))
+}
+
+// FetchCover sets the cover of the book to the image at the URL given,
+// {"url": "https://..."}, e.g. one found by a metadata provider: POST
+// /api/books/:id/cover.
+func (h *BookHandler) FetchCover(c echo.Context) error {
+	ctx := c.Request().Context()
+	var body struct {
+		URL string `json:"url" form:"url"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return InvalidBody(c, err, "Invalid request body")
+	}
+	if body.URL == "" {
+		return JSONError(c, http.StatusBadRequest, "Give the url of the cover")
+	}
+	book, err := h.repo.ByID(ctx, c.Param("id"))
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+
+	image, contentType, err := h.Covers.Fetch(ctx, body.URL)
+	var ce *CoverError
+	switch {
+	case errors.As(err, &ce):
+		return JSONError(c, ce.Status, ce.Msg)
+	case err != nil:
+		h.logger.WarnContext(ctx, "could not fetch the cover", "id", book.ID, "url", body.URL, "error", err)
+		return JSONError(c, http.StatusBadGateway, "Could not fetch the cover")
+	}
+	return h.setCover(c, book, image, contentType)
+}
+
+// setCover stores the image as the cover of the book, and answers with the
+// book.
+func (h *BookHandler) setCover(c echo.Context, book store.Book, image []byte, contentType string) error {
+	ctx := c.Request().Context()
+	book, err := h.Covers.Set(ctx, book, image, contentType)
+	if err != nil {
+		return Error(c, err, "Could not store the cover")
+	}
+	h.Hooks.Invalidate()
+	h.Hooks.Index.Indexed(ctx, book)
+	return c.JSON(http.StatusOK, h.links([]store.Book{book})[0])
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// BookDetail is the data passed to the "book-detail" block.
+type BookDetail struct {
+	store.Book
+	// The title in the languages of the reader, BookName being shown as
+	// the original title when it differs
+	DisplayTitle string
+	JSONLD       template.JS
+	Similar      []store.SimilarBook
+	// Whether users can log in to keep notes on the book
+	Notes bool
+}
+
+// BookPage serves the detail page of a book, with the books similar to it
+// when Similar is set.
+func (h *BookHandler) BookPage(c echo.Context) error {
+	ctx := c.Request().Context()
+	book, err := h.repo.ByID(ctx, c.Param("id"))
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+	// Dated by the book itself, the similar books being an aside
+	if NotModified(c, h.dated(book.LastModified())) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	book = h.links([]store.Book{book})[0]
+	detail := BookDetail{
+		Book:         book,
+		DisplayTitle: book.Title(render.Languages(c)),
+		Notes:        h.Notes,
+	}
+	if h.JSONLD != nil {
+		detail.JSONLD = h.JSONLD(book, BaseURL(c))
+	}
+	if h.Similar != nil {
+		if detail.Similar, err = h.Similar(ctx, book); err != nil {
+			return ServerError(c, err, "Database error")
+		}
+	}
+	c.Response().Header().Add("Vary", "Accept-Language")
+	return render.Page(c, http.StatusOK, "book-detail", detail)
+}
+
+// SimilarBooks returns the recommendations for a book, e.g. GET
+// /api/books/example2/similar.
+func (h *BookHandler) SimilarBooks(c echo.Context) error {
+	ctx := c.Request().Context()
+	book, err := h.repo.ByID(ctx, c.Param("id"))
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+	similar, err := h.Similar(ctx, book)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, similar)
+}
+
+// dated applies Dated, when set.
+func (h *BookHandler) dated(t time.Time) time.Time {
+	if h.Dated == nil {
+		return t
+	}
+	return h.Dated(t)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// ErrNoISBN is returned by Enrich for a book whose edition is not an
+	// ISBN, leaving nothing to look up.
+	ErrNoISBN = errors.New("the edition of the book is not an ISBN")
+	// ErrNoMetadata is returned by Enrich when nothing is known of the
+	// ISBN.
+	ErrNoMetadata = errors.New("no metadata found for this ISBN")
+)
+
+// EnrichBook fills in the details the book is missing with Enrich, from the
+// ISBN in its edition, e.g. POST /api/books/:id/enrich. Fields already set
+// are left alone.
+func (h *BookHandler) EnrichBook(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	book, err := h.repo.ByID(ctx, id)
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+
+	filled, err := h.Enrich(ctx, &book)
+	switch {
+	case errors.Is(err, ErrNoISBN):
+		return JSONError(c, http.StatusUnprocessableEntity, "The edition of the book is not an ISBN")
+	case errors.Is(err, ErrNoMetadata):
+		return JSONError(c, http.StatusNotFound, "No metadata found for this ISBN")
+	case err != nil:
+		h.logger.WarnContext(ctx, "metadata lookup failed", "id", id, "error", err)
+		return JSONError(c, http.StatusBadGateway, "Metadata provider unavailable")
+	}
+
+	fields := make([]string, 0, len(filled))
+	if len(filled) > 0 {
+		for field := range filled {
+			fields = append(fields, store.JSONFields[field])
+		}
+		slices.Sort(fields)
+		now := time.Now().UTC()
+		filled["updatedAt"] = now
+		filled["updatedBy"] = store.ActorFromContext(ctx)
+		book.UpdatedAt = &now
+		if err := h.repo.Update(ctx, id, filled); err != nil {
+			return Error(c, err, "Could not update book")
+		}
+		h.Hooks.Invalidate()
+		h.Hooks.Index.Indexed(ctx, book)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"book": h.links([]store.Book{book})[0], "filled": fields})
+}
@@ -0,0 +1,132 @@
+// Package handlers serves the pages and the JSON API of the catalog.
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/CAPS-Cloud/exercises/internal/requestid"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+)
+
+// JSONError answers with the usual {"error": "..."} body, plus the request
+// ID so users can quote it when reporting a problem.
+func JSONError(c echo.Context, code int, msg string) error {
+	return c.JSON(code, ErrorBody(c, msg))
+}
+
+// ErrorBody builds the body of an error response; handlers needing extra
+// keys (e.g. validation details) add them to the returned map.
+func ErrorBody(c echo.Context, msg string) map[string]interface{} {
+	body := map[string]interface{}{"error": msg}
+	if id := requestid.FromContext(c.Request().Context()); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
+
+// CaptureError reports err to the error tracker, if enabled, using the hub
+// of the request found in ctx.
+func CaptureError(ctx context.Context, err error) {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	hub.CaptureException(err)
+}
+
+// ServerError logs and reports err, then answers with a 500 and msg. The
+// client only gets msg, the details stay in our logs.
+//
+// While the database is unavailable the answer is a 503 instead, the
+// client being welcome to try again later.
+func ServerError(c echo.Context, err error, msg string) error {
+	ctx := c.Request().Context()
+	var ue *store.UnavailableError
+	if errors.As(err, &ue) {
+		slog.WarnContext(ctx, msg, "error", err, "route", c.Path())
+		c.Response().Header().Set("Retry-After", strconv.Itoa(max(int(ue.RetryAfter.Seconds()), 1)))
+		return JSONError(c, http.StatusServiceUnavailable, "Database unavailable, please try again later")
+	}
+	if err == nil {
+		err = errors.New(msg)
+	}
+	slog.ErrorContext(ctx, msg, "error", err, "route", c.Path())
+	CaptureError(ctx, err)
+	return JSONError(c, http.StatusInternalServerError, msg)
+}
+
+// Error answers with the status matching err. The errors of the store and
+// of the binder are the client's fault: an unknown book is a 404, a
+// duplicate a 409, and an invalid book, query or request body a 400
+// telling what is wrong. A *CoverError has its own status. Anything else
+// is a 500 with msg, see ServerError.
+func Error(c echo.Context, err error, msg string) error {
+	var ve *store.ValidationError
+	var qe *store.QueryError
+	var be *BodyError
+	var ce *CoverError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return JSONError(c, http.StatusNotFound, "Book not found")
+	case errors.Is(err, store.ErrDuplicate):
+		return JSONError(c, http.StatusConflict, "Book already exists")
+	case errors.As(err, &ve):
+		body := ErrorBody(c, "Invalid book")
+		body["fields"] = ve.Fields.JSON()
+		return c.JSON(http.StatusBadRequest, body)
+	case errors.As(err, &qe):
+		body := ErrorBody(c, qe.Error())
+		body["position"] = qe.Pos
+		return c.JSON(http.StatusBadRequest, body)
+	case errors.As(err, &be):
+		return InvalidBody(c, be, "Invalid request body")
+	case errors.As(err, &ce):
+		return JSONError(c, ce.Status, ce.Msg)
+	}
+	return ServerError(c, err, msg)
+}
+
+// HTTPErrorHandler replaces echo's default error handler so errors raised
+// by echo itself (unknown routes, failed auth, ...) carry the request ID too.
+// Other errors returned by the handlers are answered by Error.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	var he *echo.HTTPError
+	if !errors.As(err, &he) && c.Request().Method != http.MethodHead {
+		if err := Error(c, err, http.StatusText(http.StatusInternalServerError)); err != nil {
+			slog.ErrorContext(c.Request().Context(), "failed to send error response", "error", err)
+		}
+		return
+	}
+
+	code := http.StatusInternalServerError
+	msg := http.StatusText(code)
+	if he != nil {
+		code = he.Code
+		if m, ok := he.Message.(string); ok {
+			msg = m
+		} else {
+			msg = http.StatusText(code)
+		}
+	}
+	if code >= 500 {
+		slog.ErrorContext(c.Request().Context(), "unhandled error", "error", err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = JSONError(c, code, msg)
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request().Context(), "failed to send error response", "error", err)
+	}
+}
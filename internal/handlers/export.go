@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// ExportFormat is a format a single book can be downloaded in.
+type ExportFormat struct {
+	ContentType string
+	// Extension of the file, with its dot
+	Ext   string
+	Write func(w io.Writer, book store.Book) error
+}
+
+// unsafeFilename matches what can't be in the name of the file downloaded.
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_:.-]+`)
+
+// ExportBook downloads a single book in one of the Exports (JSON by
+// default), e.g. GET /api/books/:id/export?format=bibtex to cite it from
+// LaTeX.
+func (h *BookHandler) ExportBook(c echo.Context) error {
+	name := c.QueryParam("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := h.Exports[name]
+	if !ok {
+		names := make([]string, 0, len(h.Exports))
+		for name := range h.Exports {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return JSONError(c, http.StatusBadRequest, "Unknown format, expected one of "+strings.Join(names, ", "))
+	}
+	book, err := h.repo.ByID(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return Error(c, err, "Database error")
+	}
+
+	var buf bytes.Buffer
+	if err := format.Write(&buf, book); err != nil {
+		return ServerError(c, err, "Could not export book")
+	}
+	filename := unsafeFilename.ReplaceAllString(book.ID, "-") + format.Ext
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	return c.Blob(http.StatusOK, format.ContentType, buf.Bytes())
+}
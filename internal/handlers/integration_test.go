@@ -0,0 +1,284 @@
+//go:build integration
+
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/CAPS-Cloud/exercises/internal/mongotest"
+	"github.com/CAPS-Cloud/exercises/internal/render"
+	"github.com/CAPS-Cloud/exercises/internal/server"
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The integration tests run the book pages and API against a real MongoDB,
+// through the same server, middleware and templates as in production:
+//
+//	go test -tags integration ./internal/handlers/
+//
+// A throwaway MongoDB container is started with the docker CLI, and removed
+// once the tests are done, unless MONGODB_TEST_URI is set (see
+// internal/mongotest). Every test gets a database of its own, dropped at
+// the end.
+
+var client *mongo.Client
+
+func TestMain(m *testing.M) {
+	uri, stop, err := mongotest.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to start MongoDB:", err)
+		os.Exit(1)
+	}
+	code := func() int {
+		defer stop()
+		client, err = mongotest.Connect(uri)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to connect to MongoDB:", err)
+			return 1
+		}
+		defer client.Disconnect(context.Background())
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+// newTestServer serves the book handler over a fresh database, seeded with
+// the example books.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dbName := mongotest.DatabaseName()
+	coll, err := store.Prepare(client, dbName, "information")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Database(dbName).Drop(context.Background()) })
+	repo := store.NewBooks(coll)
+	if _, err := repo.Seed(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer := render.New("../../views/*.html", template.FuncMap{
+		"asset":         func(url string) string { return url },
+		"coverSize":     func(url, size string) string { return url },
+		"readOnly":      func() bool { return false },
+		"libraryLookup": func() bool { return false },
+	})
+	e := server.New(renderer)
+	e.Use(server.RequestID())
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handlers.NewBookHandler(repo, logger, config.Default()).RegisterRoutes(e)
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// call sends a JSON request and decodes the JSON answer into out, unless
+// out is nil. It returns the status code.
+func call(t *testing.T, srv *httptest.Server, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding the answer: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+func findBook(books []store.Book, id string) (store.Book, bool) {
+	for _, b := range books {
+		if b.ID == id {
+			return b, true
+		}
+	}
+	return store.Book{}, false
+}
+
+func TestBookLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	book := map[string]string{
+		"id":      "dracula",
+		"title":   "Dracula",
+		"author":  "Bram Stoker",
+		"edition": "978-0-14-143984-6",
+		"pages":   "488",
+		"year":    "1897",
+	}
+
+	if code := call(t, srv, http.MethodPost, "/api/books", book, nil); code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := call(t, srv, http.MethodPost, "/api/books", book, nil); code != http.StatusConflict {
+		t.Fatalf("create twice: got status %d, want %d", code, http.StatusConflict)
+	}
+
+	var books []store.Book
+	if code := call(t, srv, http.MethodGet, "/api/books", nil, &books); code != http.StatusOK {
+		t.Fatalf("list: got status %d", code)
+	}
+	got, ok := findBook(books, "dracula")
+	if !ok {
+		t.Fatalf("list: the new book is missing from %d books", len(books))
+	}
+	if got.BookName != "Dracula" || got.CreatedAt == nil {
+		t.Errorf("list: got %+v", got)
+	}
+
+	update := map[string]string{"title": "Dracula (annotated)", "pages": "512"}
+	if code := call(t, srv, http.MethodPut, "/api/books/dracula", update, nil); code != http.StatusOK {
+		t.Fatalf("update: got status %d", code)
+	}
+	call(t, srv, http.MethodGet, "/api/books?q=id=dracula", nil, &books)
+	if len(books) != 1 || books[0].BookName != "Dracula (annotated)" || books[0].BookPages != "512" || books[0].UpdatedAt == nil {
+		t.Errorf("after update: got %+v", books)
+	}
+
+	if code := call(t, srv, http.MethodDelete, "/api/books/dracula", nil, nil); code != http.StatusOK {
+		t.Fatalf("delete: got status %d", code)
+	}
+	if code := call(t, srv, http.MethodDelete, "/api/books/dracula", nil, nil); code != http.StatusNotFound {
+		t.Errorf("delete twice: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := call(t, srv, http.MethodPut, "/api/books/dracula", update, nil); code != http.StatusNotFound {
+		t.Errorf("update deleted: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestInvalidBooks(t *testing.T) {
+	srv := newTestServer(t)
+
+	type errorBody struct {
+		Error  string            `json:"error"`
+		Fields map[string]string `json:"fields"`
+	}
+	var created errorBody
+	code := call(t, srv, http.MethodPost, "/api/books", map[string]string{"id": "no spaces", "title": "Untitled", "year": "19th"}, &created)
+	if code != http.StatusBadRequest {
+		t.Fatalf("create: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	for _, field := range []string{"id", "author", "year"} {
+		if created.Fields[field] == "" {
+			t.Errorf("create: no error for %q in %v", field, created.Fields)
+		}
+	}
+
+	var updated errorBody
+	code = call(t, srv, http.MethodPut, "/api/books/example1", map[string]string{"pages": "many"}, &updated)
+	if code != http.StatusBadRequest || updated.Fields["pages"] == "" {
+		t.Errorf("update: got status %d and fields %v", code, updated.Fields)
+	}
+	if code := call(t, srv, http.MethodPut, "/api/books/example1", map[string]string{"rating": "5"}, nil); code != http.StatusBadRequest {
+		t.Errorf("update without known fields: got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestSearchBooks(t *testing.T) {
+	srv := newTestServer(t)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"author:shelley", []string{"example2"}},
+		{"year<1900", []string{"example2", "example3"}},
+		{"-author:poe pages=280", []string{"example2"}},
+		{"vortex", []string{"example1"}},
+		{"author:nobody", nil},
+	}
+	for _, tt := range tests {
+		var books []store.Book
+		code := call(t, srv, http.MethodGet, "/api/books?q="+url.QueryEscape(tt.query), nil, &books)
+		if code != http.StatusOK {
+			t.Errorf("%q: got status %d", tt.query, code)
+			continue
+		}
+		var ids []string
+		for _, b := range books {
+			ids = append(ids, b.ID)
+		}
+		slices.Sort(ids)
+		if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: got %v, want %v", tt.query, ids, tt.want)
+		}
+	}
+
+	var body struct {
+		Position *int `json:"position"`
+	}
+	code := call(t, srv, http.MethodGet, "/api/books?q="+url.QueryEscape(`title:"open`), nil, &body)
+	if code != http.StatusBadRequest || body.Position == nil {
+		t.Errorf("invalid query: got status %d and position %v, want %d", code, body.Position, http.StatusBadRequest)
+	}
+}
+
+func TestBrowsePages(t *testing.T) {
+	srv := newTestServer(t)
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/books", http.StatusOK, "Frankenstein"},
+		{"/authors", http.StatusOK, "Edgar Allan Poe"},
+		{"/authors/Mary%20Shelley?sort=year&order=desc", http.StatusOK, "Frankenstein"},
+		{"/authors/Nobody", http.StatusNotFound, "Author not found"},
+		{"/years", http.StatusOK, "1843"},
+		{"/years/1924", http.StatusOK, "The Vortex"},
+		{"/years/3000", http.StatusNotFound, "No books found"},
+		{"/shelves", http.StatusOK, "Not shelved"},
+		{"/shelves/-", http.StatusOK, "Frankenstein"},
+		{"/shelves/Z9", http.StatusNotFound, "No books found"},
+		{"/api/books/random", http.StatusOK, `"id":"example`},
+	}
+	for _, tt := range tests {
+		res, err := srv.Client().Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.path, res.StatusCode, tt.code)
+		}
+		if !strings.Contains(string(body), tt.want) {
+			t.Errorf("%s: %q not found in the page", tt.path, tt.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NotModified sets Last-Modified to t and tells if the client has the
+// response as of t already, from its If-Modified-Since, in which case the
+// caller answers 304 Not Modified. A zero t is unknown: no header is set.
+func NotModified(c echo.Context, t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+	// HTTP dates have no fractions of seconds
+	t = t.UTC().Truncate(time.Second)
+	c.Response().Header().Set(echo.HeaderLastModified, t.Format(http.TimeFormat))
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	// If-None-Match takes precedence, and we have no ETags to match it to
+	if req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince))
+	return err == nil && !t.After(since)
+}
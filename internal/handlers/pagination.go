@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PageLink adds a Link header (RFC 8288) to another page of the collection
+// the request is for, e.g. rel "next": the same URL with the query
+// parameters in set changed, those set to "" being dropped. Generic
+// clients and crawlers walk the collection by following them.
+func PageLink(c echo.Context, rel string, set map[string]string) {
+	req := c.Request()
+	q := req.URL.Query()
+	for name, value := range set {
+		if value == "" {
+			q.Del(name)
+		} else {
+			q.Set(name, value)
+		}
+	}
+	u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	c.Response().Header().Add("Link", "<"+u.String()+`>; rel="`+rel+`"`)
+}
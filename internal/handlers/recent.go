@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRecentWindow = "7d"
+	maxRecentWindow     = 365 * 24 * time.Hour
+	recentLimit         = 50
+	// How many new arrivals the index page shows
+	homeRecentLimit = 5
+)
+
+// RecentBooks is the body of GET /api/books/recent: the books added, and
+// those updated (but added earlier), within the window, newest first.
+type RecentBooks struct {
+	Window string    `json:"window"`
+	Since  time.Time `json:"since"`
+	store.Changes
+}
+
+// parseWindow reads a duration like time.ParseDuration does, also accepting
+// days ("7d"), up to a year.
+func parseWindow(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+	}
+	if d <= 0 || d > maxRecentWindow {
+		return 0, fmt.Errorf("window must be between 0 and 365d")
+	}
+	return d, nil
+}
+
+// RecentChanges answers with what changed lately, e.g. GET
+// /api/books/recent?window=24h, within the last week by default.
+func (h *BookHandler) RecentChanges(c echo.Context) error {
+	window := c.QueryParam("window")
+	if window == "" {
+		window = defaultRecentWindow
+	}
+	d, err := parseWindow(window)
+	if err != nil {
+		return JSONError(c, http.StatusBadRequest, err.Error())
+	}
+	recent := RecentBooks{Window: window, Since: time.Now().UTC().Add(-d)}
+	if recent.Changes, err = h.repo.Changes(c.Request().Context(), recent.Since, recentLimit); err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	recent.Added = h.links(recent.Added)
+	recent.Updated = h.links(recent.Updated)
+	return c.JSON(http.StatusOK, recent)
+}
+
+// RecentBooksList serves the new arrivals of the last week shown on the
+// index page.
+func (h *BookHandler) RecentBooksList(c echo.Context) error {
+	d, _ := parseWindow(defaultRecentWindow)
+	changes, err := h.repo.Changes(c.Request().Context(), time.Now().UTC().Add(-d), homeRecentLimit)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(http.StatusOK, "recent-books", h.links(changes.Added))
+}
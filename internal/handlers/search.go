@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 100
+	defaultSuggestLimit = 8
+	maxSuggestLimit     = 20
+)
+
+// Searcher finds the books for the search bar, e.g. the search backend.
+type Searcher interface {
+	// Search returns every book matching query, best first.
+	Search(ctx context.Context, query string) ([]store.SearchResult, error)
+	Suggest(ctx context.Context, prefix string, limit int) ([]store.Suggestion, error)
+}
+
+// SearchPage is what the search-results view renders, and the body of GET
+// /api/books/search. Facets count all the books matching the query, while
+// Results are narrowed down by the selected author and year.
+type SearchPage struct {
+	Query   string                        `json:"query"`
+	Author  string                        `json:"author,omitempty"`
+	Year    string                        `json:"year,omitempty"`
+	Results []store.SearchResult          `json:"results"`
+	Facets  map[string][]store.FacetCount `json:"facets"`
+}
+
+// FilterURL links to the same search with the facet name set to value (or
+// removed if value is empty), keeping the other filters.
+func (p SearchPage) FilterURL(name, value string) string {
+	query := url.Values{"q": {p.Query}}
+	filters := map[string]string{"author": p.Author, "year": p.Year}
+	filters[name] = value
+	for k, v := range filters {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	return "/search/results?" + query.Encode()
+}
+
+// Selected tells whether the facet name is currently set to value.
+func (p SearchPage) Selected(name, value string) bool {
+	return (name == "author" && p.Author == value) || (name == "year" && p.Year == value)
+}
+
+// filterResults keeps the results by the given author and from the given
+// year, when set.
+func filterResults(results []store.SearchResult, author, year string) []store.SearchResult {
+	filtered := []store.SearchResult{}
+	for _, r := range results {
+		if (author == "" || r.BookAuthor == author) && (year == "" || r.BookYear == year) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// SuggestLimit reads the ?limit= of GET /api/books/suggest, falling back
+// to the default when it is missing or out of range.
+func SuggestLimit(c echo.Context) int {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > maxSuggestLimit {
+		return defaultSuggestLimit
+	}
+	return limit
+}
+
+// search runs the query of the request with Search, with the counts per
+// author and year from Facets to narrow it down.
+func (h *BookHandler) search(c echo.Context) (SearchPage, error) {
+	ctx := c.Request().Context()
+	page := SearchPage{
+		Query:  c.QueryParam("q"),
+		Author: c.QueryParam("author"),
+		Year:   c.QueryParam("year"),
+		Facets: map[string][]store.FacetCount{},
+	}
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > maxSearchLimit {
+		limit = defaultSearchLimit
+	}
+	matches, err := h.Search.Search(ctx, page.Query)
+	if err != nil {
+		return page, err
+	}
+	if h.Facets != nil {
+		ids := make([]string, len(matches))
+		for i, m := range matches {
+			ids[i] = m.ID
+		}
+		if page.Facets, err = h.Facets(ctx, ids); err != nil {
+			return page, err
+		}
+	}
+	page.Results = filterResults(matches, page.Author, page.Year)
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+	}
+	return page, nil
+}
+
+// SearchResults serves the results below the search bar.
+func (h *BookHandler) SearchResults(c echo.Context) error {
+	page, err := h.search(c)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.Render(http.StatusOK, "search-results", page)
+}
+
+// SearchBooks serves GET
+// /api/books/search?q=frankenstien&author=Mary%20Shelley&limit=20.
+func (h *BookHandler) SearchBooks(c echo.Context) error {
+	page, err := h.search(c)
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	books := make([]store.Book, len(page.Results))
+	for i, r := range page.Results {
+		books[i] = r.Book
+	}
+	for i, book := range h.links(books) {
+		page.Results[i].Book = book
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// SuggestBooks serves the completions for the search bar, e.g. GET
+// /api/books/suggest?q=fra.
+func (h *BookHandler) SuggestBooks(c echo.Context) error {
+	suggestions, err := h.Search.Suggest(c.Request().Context(), c.QueryParam("q"), SuggestLimit(c))
+	if err != nil {
+		return ServerError(c, err, "Database error")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"query":       c.QueryParam("q"),
+		"suggestions": suggestions,
+	})
+}
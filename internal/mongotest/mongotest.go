@@ -0,0 +1,73 @@
+// Package mongotest gives the integration tests a MongoDB server to run
+// against: a throwaway container started with the docker CLI, or the
+// server in MONGODB_TEST_URI, e.g. a service container in CI.
+package mongotest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const image = "mongo:7"
+
+// Start returns the URI of the server to test against, and a function
+// removing the container started for it, if any.
+func Start() (string, func(), error) {
+	if uri := os.Getenv("MONGODB_TEST_URI"); uri != "" {
+		return uri, func() {}, nil
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::27017", image).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("docker run: %w", err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() { exec.Command("docker", "rm", "-f", id).Run() }
+	out, err = exec.Command("docker", "port", id, "27017/tcp").Output()
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("docker port: %w", err)
+	}
+	// e.g. "127.0.0.1:49153", one line per address family
+	addr, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return "mongodb://" + addr, stop, nil
+}
+
+// Connect waits for the server to accept connections, as a fresh
+// container takes a few seconds to start.
+func Connect(uri string) (*mongo.Client, error) {
+	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(time.Minute)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = c.Ping(ctx, nil)
+		cancel()
+		if err == nil {
+			return c, nil
+		}
+		if time.Now().After(deadline) {
+			c.Disconnect(context.Background())
+			return nil, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// DatabaseName returns a name no other test uses, for a database of its
+// own.
+func DatabaseName() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "test_" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,295 @@
+// Package openapitest checks the API against its OpenAPI document in the
+// tests: every request the server accepts must match the spec, and so must
+// every answer, whatever its status. Only the parts of OpenAPI the document
+// uses are supported.
+package openapitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+type node = map[string]interface{}
+
+// Spec is an OpenAPI document, as decoded from YAML.
+type Spec struct {
+	root node
+	// The operations Check got an exchange of, as Operations lists them
+	checked map[string]bool
+}
+
+// Load reads the document at path.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Spec{root: root, checked: map[string]bool{}}, nil
+}
+
+// resolve follows $ref, which can only point into the document itself.
+func (s *Spec) resolve(n node) node {
+	for n != nil {
+		ref, ok := n["$ref"].(string)
+		if !ok {
+			return n
+		}
+		var target interface{} = s.root
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			m, _ := target.(node)
+			target = m[part]
+		}
+		n, _ = target.(node)
+	}
+	return nil
+}
+
+// Operations lists the documented operations as "METHOD /path/{param}".
+func (s *Spec) Operations() []string {
+	var ops []string
+	paths, _ := s.root["paths"].(node)
+	for path, item := range paths {
+		for method := range item.(node) {
+			if method != "parameters" {
+				ops = append(ops, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// Unchecked lists the documented operations Check got no exchange of, as
+// Operations does.
+func (s *Spec) Unchecked() []string {
+	var ops []string
+	for _, op := range s.Operations() {
+		if !s.checked[op] {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// operation finds the operation serving method and path, and its name as
+// Operations lists it. Literal segments win over parameters, so
+// /api/books/random isn't /api/books/{id}.
+func (s *Spec) operation(method, path string) (node, string, bool) {
+	paths, _ := s.root["paths"].(node)
+	var best node
+	var name string
+	bestParams := -1
+	segments := strings.Split(path, "/")
+	for template, item := range paths {
+		parts := strings.Split(template, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		params := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") {
+				params++
+			} else if part != segments[i] {
+				params = -1
+				break
+			}
+		}
+		op, ok := item.(node)[strings.ToLower(method)].(node)
+		if params >= 0 && ok && (best == nil || params < bestParams) {
+			best, bestParams = op, params
+			name = strings.ToUpper(method) + " " + template
+		}
+	}
+	return best, name, best != nil
+}
+
+// Check validates an exchange with the server against the spec.
+func (s *Spec) Check(t testing.TB, req *http.Request, body string, res *httptest.ResponseRecorder) {
+	t.Helper()
+	op, name, ok := s.operation(req.Method, req.URL.Path)
+	if !ok {
+		t.Errorf("contract: %s %s isn't documented", req.Method, req.URL.Path)
+		return
+	}
+	s.checked[name] = true
+
+	if res.Code < 400 && body != "" {
+		reqBody, _ := op["requestBody"].(node)
+		content, _ := s.resolve(reqBody)["content"].(node)
+		ctype := mediaType(req.Header)
+		media, ok := content[ctype].(node)
+		if !ok {
+			t.Errorf("contract: %s %s accepted a %s body, which isn't documented", req.Method, req.URL.Path, ctype)
+			return
+		}
+		if isJSON(ctype) {
+			for _, problem := range s.validateJSON(s.resolve(media["schema"].(node)), body) {
+				t.Errorf("contract: %s %s was accepted with a body the spec rejects: %s", req.Method, req.URL.Path, problem)
+			}
+		}
+	}
+
+	responses, _ := op["responses"].(node)
+	response, ok := responses[strconv.Itoa(res.Code)].(node)
+	if !ok {
+		t.Errorf("contract: %s %s answered %d, which isn't documented", req.Method, req.URL.Path, res.Code)
+		return
+	}
+	content, _ := s.resolve(response)["content"].(node)
+	if len(content) == 0 {
+		return
+	}
+	ctype := mediaType(res.Header())
+	media, ok := content[ctype].(node)
+	if !ok {
+		t.Errorf("contract: %s %s answered %d with %s, which isn't documented", req.Method, req.URL.Path, res.Code, ctype)
+		return
+	}
+	if !isJSON(ctype) {
+		return
+	}
+	for _, problem := range s.validateJSON(s.resolve(media["schema"].(node)), res.Body.String()) {
+		t.Errorf("contract: %s %s answered %d with a body the spec rejects: %s", req.Method, req.URL.Path, res.Code, problem)
+	}
+}
+
+// mediaType is the Content-Type of h without its parameters.
+func mediaType(h http.Header) string {
+	ctype, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return ctype
+}
+
+// isJSON tells if the media type is JSON, e.g. application/json or
+// application/vnd.citationstyles.csl+json.
+func isJSON(ctype string) bool {
+	return ctype == "application/json" || strings.HasSuffix(ctype, "+json")
+}
+
+func (s *Spec) validateJSON(schema node, data string) []string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return []string{err.Error()}
+	}
+	return s.validate(schema, v, "body")
+}
+
+// validate returns what is wrong with v according to schema, at being
+// where v is in the document.
+func (s *Spec) validate(schema node, v interface{}, at string) []string {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	if v == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable {
+			return []string{at + " is null"}
+		}
+		return nil
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !slices.Contains(enum, v) {
+		return []string{fmt.Sprintf("%s is %v, not one of %v", at, v, enum)}
+	}
+
+	var problems []string
+	wrongType := func(want string) []string {
+		return []string{fmt.Sprintf("%s is %T, not %s", at, v, want)}
+	}
+	switch typ, _ := schema["type"].(string); typ {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return wrongType(typ)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is missing", at, name))
+			}
+		}
+		props, _ := schema["properties"].(node)
+		for name, value := range obj {
+			if prop, ok := props[name].(node); ok {
+				problems = append(problems, s.validate(prop, value, at+"."+name)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					problems = append(problems, fmt.Sprintf("%s.%s isn't in the spec", at, name))
+				}
+			case node:
+				problems = append(problems, s.validate(extra, value, at+"."+name)...)
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return wrongType(typ)
+		}
+		items, _ := schema["items"].(node)
+		for i, item := range arr {
+			problems = append(problems, s.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return wrongType(typ)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				problems = append(problems, fmt.Sprintf("%s is %q, not a date-time", at, str))
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			return wrongType(typ)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return wrongType(typ)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return wrongType(typ)
+		}
+	}
+	return problems
+}
+
+// Routes lists the routes of e under /api, as Operations does, leaving out
+// the catch-alls echo adds for the middleware of a group.
+func Routes(e *echo.Echo) []string {
+	var routes []string
+	for _, r := range e.Routes() {
+		if !strings.HasPrefix(r.Path, "/api/") || r.Method == echo.RouteNotFound {
+			continue
+		}
+		// echo's :id is OpenAPI's {id}
+		parts := strings.Split(r.Path, "/")
+		for i, part := range parts {
+			if strings.HasPrefix(part, ":") {
+				parts[i] = "{" + part[1:] + "}"
+			}
+		}
+		routes = append(routes, r.Method+" "+strings.Join(parts, "/"))
+	}
+	sort.Strings(routes)
+	return routes
+}
@@ -0,0 +1,127 @@
+// Package render turns the views into HTML: the templates, and the helpers
+// telling whether a request comes from one of our pages or from an API
+// client.
+package render
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Wraps the "Template" struct to associate a necessary method
+// to determine the rendering procedure
+type Template struct {
+	tmpl *template.Template
+}
+
+// Preload the available templates for the view folder.
+// This builds a local "database" of all available "blocks"
+// to render upon request, i.e., replace the respective
+// variable or expression.
+// For more on templating, visit https://jinja.palletsprojects.com/en/3.0.x/templates/
+// to get to know more about templating
+// You can also read Golang's documentation on their templating
+// https://pkg.go.dev/text/template
+//
+// funcs adds template functions to the built-in pathEscape, e.g. the
+// "asset" function linking to the stylesheets.
+func New(pattern string, funcs template.FuncMap) *Template {
+	all := template.FuncMap{"pathEscape": url.PathEscape}
+	for name, fn := range funcs {
+		all[name] = fn
+	}
+	return &Template{
+		tmpl: template.Must(template.New("views").Funcs(all).ParseGlob(pattern)),
+	}
+}
+
+// Method definition of the required "Render" to be passed for the Rendering
+// engine.
+// Contraire to method declaration, such syntax defines methods for a given
+// struct. "Interfaces" and "structs" can have methods associated with it.
+// The difference lies that interfaces declare methods whether struct only
+// implement them, i.e., only define them. Such differentiation is important
+// for a compiler to ensure types provide implementations of such methods.
+func (t *Template) Render(w io.Writer, name string, data interface{}, ctx echo.Context) error {
+	return t.tmpl.ExecuteTemplate(w, name, data)
+}
+
+// PageData is handed to the "index" block whenever a view is requested
+// directly by the browser (i.e., not through HTMX), so the fragment is
+// embedded in the full page layout instead of being served on its own.
+type PageData struct {
+	Content template.HTML
+}
+
+// Page renders the given block as a fragment for HTMX requests, and
+// wrapped in the index layout otherwise. This way links such as
+// /authors/:name can be bookmarked or opened in a new tab.
+func Page(c echo.Context, code int, name string, data interface{}) error {
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.Render(code, name, data)
+	}
+	var buf bytes.Buffer
+	if err := c.Echo().Renderer.Render(&buf, name, data, c); err != nil {
+		return err
+	}
+	return c.Render(code, "index", PageData{Content: template.HTML(buf.String())})
+}
+
+// IsBrowserSubmission tells apart form posts coming from our own pages
+// (through HTMX or a plain HTML form) from JSON API calls, so we can answer
+// with HTML or JSON respectively. API clients posting forms, e.g. to upload
+// a file, ask for JSON with their Accept header.
+func IsBrowserSubmission(c echo.Context) bool {
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return true
+	}
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return false
+	}
+	ctype := c.Request().Header.Get(echo.HeaderContentType)
+	return strings.HasPrefix(ctype, echo.MIMEApplicationForm) ||
+		strings.HasPrefix(ctype, echo.MIMEMultipartForm)
+}
+
+// WantsHTML tells if a GET comes from a browser, which gets a page, rather
+// than from an API client, which gets JSON.
+func WantsHTML(c echo.Context) bool {
+	return c.Request().Header.Get("HX-Request") == "true" ||
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// Languages returns the languages of the request's Accept-Language, most
+// preferred first, e.g. [fr-CH fr en] for "fr-CH, fr;q=0.9, en;q=0.8".
+func Languages(c echo.Context) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(c.Request().Header.Get("Accept-Language"), ",") {
+		lang, params, _ := strings.Cut(part, ";")
+		lang = strings.TrimSpace(lang)
+		q := 1.0
+		if key, value, _ := strings.Cut(strings.TrimSpace(params), "="); key == "q" {
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				q = v
+			}
+		}
+		if lang != "" && lang != "*" && q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	out := make([]string, len(langs))
+	for i, l := range langs {
+		out[i] = l.lang
+	}
+	return out
+}
@@ -0,0 +1,19 @@
+// Package requestid carries the ID of the HTTP request through the context,
+// down to the logs and the database queries made for it.
+package requestid
+
+import "context"
+
+type key struct{}
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// FromContext returns the request ID stored by NewContext, or an empty
+// string outside of a request.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
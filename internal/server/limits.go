@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ApplyLimits caps how much a single client can take from the server: it
+// sets the timeouts on both the HTTP and HTTPS servers and installs the body
+// limit and request timeout middleware.
+func ApplyLimits(e *echo.Echo, l config.ServerConfig) {
+	for _, s := range []*http.Server{e.Server, e.TLSServer} {
+		s.ReadTimeout = l.ReadTimeout
+		s.WriteTimeout = l.WriteTimeout
+		s.IdleTimeout = l.IdleTimeout
+	}
+
+	e.Use(middleware.BodyLimit(l.BodyLimit))
+
+	// The deadline travels with the request context down to the MongoDB
+	// driver, which gives up as soon as it expires. Profiling endpoints are
+	// long by design and are skipped.
+	if l.RequestTimeout > 0 {
+		e.Use(middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+			Timeout: l.RequestTimeout,
+			Skipper: func(c echo.Context) bool {
+				return strings.HasPrefix(c.Request().URL.Path, "/debug/pprof/")
+			},
+		}))
+	}
+}
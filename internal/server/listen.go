@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by systemd socket activation, after
+// stdin, stdout and stderr.
+const systemdFirstFD = 3
+
+// listen opens the listener for a SERVER_ADDRESS value:
+//
+//	host:port or :port    TCP (returns nil, echo opens it itself)
+//	unix:/path/to/socket  a Unix domain socket, e.g. behind nginx
+//	systemd               the socket passed by systemd socket activation
+func listen(addr string, socketMode string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return systemdListener()
+	case strings.HasPrefix(addr, "unix:"):
+		return unixListener(strings.TrimPrefix(addr, "unix:"), socketMode)
+	}
+	return nil, nil
+}
+
+// unixListener listens on path, replacing the socket a previous run may have
+// left behind, and sets its permissions so the reverse proxy can connect.
+func unixListener(path, socketMode string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", socketMode, err)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListener takes over the socket systemd opened for us, see
+// sd_listen_fds(3). Only the first socket is used.
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, errors.New("no socket passed by systemd (LISTEN_PID/LISTEN_FDS not set for this process)")
+	}
+	// Don't let child processes think the sockets are theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TrustProxies decides where c.RealIP() comes from, used by the rate limit
+// and the access log. With no proxies, it is the address connected from,
+// the forwarded headers being easily made up. Behind a reverse proxy,
+// proxies lists the addresses or CIDR ranges of the proxies, which are
+// trusted to set X-Forwarded-For.
+func TrustProxies(e *echo.Echo, proxies []string) error {
+	if len(proxies) == 0 {
+		e.IPExtractor = echo.ExtractIPDirect()
+		return nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	return nil
+}
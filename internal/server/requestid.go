@@ -0,0 +1,19 @@
+package server
+
+import (
+	"github.com/CAPS-Cloud/exercises/internal/requestid"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// RequestID accepts the X-Request-ID sent by the client (or a proxy in front
+// of us) or generates a new one, echoes it back in the response and stores
+// it in the request context, so everything downstream can pick it up.
+func RequestID() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			ctx := requestid.NewContext(c.Request().Context(), id)
+			c.SetRequest(c.Request().WithContext(ctx))
+		},
+	})
+}
@@ -0,0 +1,21 @@
+// Package server wires the HTTP server: the echo instance, the middleware
+// every request goes through and the listeners it is served on.
+package server
+
+import (
+	"github.com/CAPS-Cloud/exercises/internal/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+// New returns the echo instance serving the catalog, rendering the views
+// with renderer, binding JSON bodies strictly and answering errors in the
+// format of the API.
+func New(renderer echo.Renderer) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.HTTPErrorHandler = handlers.HTTPErrorHandler
+	e.Binder = &handlers.Binder{}
+	e.Renderer = renderer
+	return e
+}
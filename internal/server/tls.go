@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Start starts echo on the configured address, with HTTPS if
+// configured. It blocks until the server stops, like e.Start.
+func Start(e *echo.Echo, server config.ServerConfig) error {
+	addr, s := server.Address, server.TLS
+
+	l, err := listen(addr, server.SocketMode)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		// echo serves on a listener set beforehand instead of opening one,
+		// but only for plain HTTP: HTTPS is left to the reverse proxy.
+		if s.Enabled() {
+			l.Close()
+			return fmt.Errorf("TLS is not supported when listening on %q", addr)
+		}
+		e.Listener = l
+	}
+
+	if !s.Enabled() {
+		return e.Start(addr)
+	}
+
+	var challenge func(http.Handler) http.Handler
+	if s.Autocert() {
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(s.AutocertHosts...)
+		e.AutoTLSManager.Cache = autocert.DirCache(s.AutocertCache)
+		e.AutoTLSManager.Email = s.AutocertEmail
+		challenge = e.AutoTLSManager.HTTPHandler
+	}
+
+	if s.RedirectAddr != "" {
+		handler := httpsRedirect(addr)
+		if challenge != nil {
+			handler = challenge(handler)
+		}
+		redirect := &http.Server{
+			Addr:              s.RedirectAddr,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "address", s.RedirectAddr)
+			if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP redirect server stopped", "error", err)
+			}
+		}()
+	}
+
+	if s.Autocert() {
+		slog.Info("serving HTTPS with Let's Encrypt certificates", "hosts", s.AutocertHosts)
+		return e.StartAutoTLS(addr)
+	}
+	slog.Info("serving HTTPS", "cert", s.CertFile)
+	return e.StartTLS(addr, s.CertFile, s.KeyFile)
+}
+
+// httpsRedirect sends every request to the same host and path over HTTPS,
+// on the port the TLS server listens on (omitted when it is 443).
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,19 @@
+package store
+
+import "context"
+
+type actorKey struct{}
+
+// WithActor tells who makes the changes done with ctx, e.g. "admin:alice",
+// "api" or "cli". Writes store it in the updatedBy field of the book, where
+// the audit log picks it up.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor stored by WithActor, or an empty
+// string when it is unknown.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
@@ -0,0 +1,102 @@
+// Package store is the data layer of the catalog: the book model and the
+// queries the pages and the API run against MongoDB.
+package store
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Defines a "model" that we can use to communicate with the
+// frontend or the database
+// More on these "tags" like `bson:"_id,omitempty"`: https://go.dev/wiki/Well-known-struct-tags
+// Book represents a book record in MongoDB and in JSON API responses.
+type Book struct {
+	MongoID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ID          string             `bson:"ID" form:"ID" json:"id"`
+	BookName    string             `bson:"BookName" form:"BookName" json:"title"`
+	BookAuthor  string             `bson:"BookAuthor" form:"BookAuthor" json:"author"`
+	BookEdition string             `bson:"BookEdition,omitempty" form:"BookEdition" json:"edition,omitempty"`
+	BookPages   string             `bson:"BookPages,omitempty" form:"BookPages" json:"pages,omitempty"`
+	BookYear    string             `bson:"BookYear,omitempty" form:"BookYear" json:"year,omitempty"`
+	// Alternate titles by language, e.g. translations (see titles.go)
+	BookTitles map[string]string `bson:"BookTitles,omitempty" form:"-" json:"titles,omitempty"`
+	// Filled in from the ISBN by the metadata provider
+	BookCover    string   `bson:"BookCover,omitempty" form:"-" json:"cover,omitempty"`
+	BookSubjects []string `bson:"BookSubjects,omitempty" form:"-" json:"subjects,omitempty"`
+	// Shelves of a Goodreads import
+	BookTags []string `bson:"BookTags,omitempty" form:"-" json:"tags,omitempty"`
+	// Where the book stands in the library, e.g. "B3"
+	BookShelf string     `bson:"BookShelf,omitempty" form:"BookShelf" json:"shelf,omitempty"`
+	CreatedAt *time.Time `bson:"createdAt,omitempty" form:"-" json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty" form:"-" json:"updatedAt,omitempty"`
+	// Who made the last change, for the audit log
+	UpdatedBy string `bson:"updatedBy,omitempty" form:"-" json:"-"`
+}
+
+// AddedAt returns when the book was added to the catalog. Records created
+// before we started storing timestamps fall back to the creation time
+// encoded in their ObjectID.
+func (b Book) AddedAt() time.Time {
+	if b.CreatedAt != nil {
+		return *b.CreatedAt
+	}
+	return b.MongoID.Timestamp()
+}
+
+// LastModified returns the last time the book was changed.
+func (b Book) LastModified() time.Time {
+	if b.UpdatedAt != nil {
+		return *b.UpdatedAt
+	}
+	return b.AddedAt()
+}
+
+// DuplicateFilter matches the books identical to the given one, i.e. with
+// the same values in every field except the MongoID and the timestamps.
+func DuplicateFilter(book Book) bson.M {
+	return bson.M{
+		"ID":          book.ID,
+		"BookName":    book.BookName,
+		"BookAuthor":  book.BookAuthor,
+		"BookEdition": book.BookEdition,
+		"BookPages":   book.BookPages,
+		"BookYear":    book.BookYear,
+	}
+}
+
+// Maps the accepted values of the ?sort= query parameter to the document
+// fields we sort on.
+var SortFields = map[string]string{
+	"title": "BookName",
+	"year":  "BookYear",
+	"pages": "BookPages",
+}
+
+// YearCount is a publication year together with the number of books
+// published in it.
+type YearCount struct {
+	Year  string `bson:"year" json:"year"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Unshelved stands for the books without a shelf, which no shelf can be
+// named after.
+const Unshelved = "-"
+
+// ShelfCount is a shelf together with the number of books on it. Shelf is
+// Unshelved for the books not put on a shelf yet.
+type ShelfCount struct {
+	Shelf string `bson:"_id" json:"shelf"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// DecadeGroup bundles the years of one decade. Decade is nil for years that
+// are not numeric (e.g. "unknown" or "c. 1600").
+type DecadeGroup struct {
+	Decade *int        `bson:"_id"`
+	Count  int         `bson:"count"`
+	Years  []YearCount `bson:"years"`
+}
@@ -0,0 +1,450 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Books is the repository of the books: every read of the catalog done by
+// the pages and the API goes through it.
+type Books struct {
+	coll *mongo.Collection
+}
+
+// NewBooks returns the repository of the books stored in coll.
+func NewBooks(coll *mongo.Collection) *Books {
+	return &Books{coll: coll}
+}
+
+// Collection returns the collection behind the repository, for the
+// features that still query it directly.
+func (b *Books) Collection() *mongo.Collection {
+	return b.coll
+}
+
+// Here we make sure the connection to the database is correct and initial
+// configurations exists. Otherwise, we create the proper database and collection
+// we will store the data.
+// To ensure correct management of the collection, we create a return a
+// reference to the collection to always be used. Make sure if you create other
+// files, that you pass the proper value to ensure communication with the
+// database
+// More on what bson means: https://www.mongodb.com/docs/drivers/go/current/fundamentals/bson/
+func Prepare(client *mongo.Client, dbName string, collecName string) (*mongo.Collection, error) {
+	db := client.Database(dbName)
+
+	names, err := db.ListCollectionNames(context.TODO(), bson.D{{}})
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, collecName) {
+		cmd := bson.D{{Key: "create", Value: collecName}}
+		var result bson.M
+		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
+			return nil, err
+		}
+	}
+
+	coll := db.Collection(collecName)
+	return coll, nil
+}
+
+// SeedSummary reports what Seed did.
+type SeedSummary struct {
+	Inserted int `json:"inserted"`
+	Existing int `json:"existing"`
+}
+
+// exampleBooks are the books Seed inserts.
+var exampleBooks = []Book{
+	{
+		ID:          "example1",
+		BookName:    "The Vortex",
+		BookAuthor:  "José Eustasio Rivera",
+		BookEdition: "958-30-0804-4",
+		BookPages:   "292",
+		BookYear:    "1924",
+	},
+	{
+		ID:          "example2",
+		BookName:    "Frankenstein",
+		BookAuthor:  "Mary Shelley",
+		BookEdition: "978-3-649-64609-9",
+		BookPages:   "280",
+		BookYear:    "1818",
+	},
+	{
+		ID:          "example3",
+		BookName:    "The Black Cat",
+		BookAuthor:  "Edgar Allan Poe",
+		BookEdition: "978-3-99168-238-7",
+		BookPages:   "280",
+		BookYear:    "1843",
+	},
+}
+
+// Here we prepare some fictional data and we insert it into the database
+// the first time we connect to it. Books that already exist (by ID) are left
+// untouched, so it is safe to run on every startup.
+func (b *Books) Seed(ctx context.Context) (SeedSummary, error) {
+	return b.SeedBooks(ctx, exampleBooks)
+}
+
+// SeedBooks inserts the given books like Seed does, skipping those whose
+// ID exists already.
+func (b *Books) SeedBooks(ctx context.Context, startData []Book) (SeedSummary, error) {
+	// A single round trip: one upsert per book, keyed by ID. $setOnInsert
+	// only writes the fields when the book is new, so edits made since the
+	// last seed are kept.
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(startData))
+	for _, book := range startData {
+		book.CreatedAt = &now
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"ID": book.ID}).
+			SetUpdate(bson.M{"$setOnInsert": book}).
+			SetUpsert(true))
+	}
+	res, err := b.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return SeedSummary{}, err
+	}
+	return SeedSummary{
+		Inserted: int(res.UpsertedCount),
+		Existing: int(res.MatchedCount),
+	}, nil
+}
+
+// Generic method to perform "SELECT * FROM BOOKS" (if this was SQL, which
+// it is not :D ), and then we convert it into an array of map. In Golang, you
+// define a map by writing map[<key type>]<value type>{<key>:<value>}.
+// interface{} is a special type in Golang, basically a wildcard...
+// All retrieves all books from the collection.
+func (b *Books) All(ctx context.Context) ([]Book, error) {
+	return b.Find(ctx, bson.D{{}})
+}
+
+// Find returns the books matching filter.
+func (b *Books) Find(ctx context.Context, filter interface{}) ([]Book, error) {
+	return b.find(ctx, filter, FindOpts(ctx))
+}
+
+func (b *Books) find(ctx context.Context, filter interface{}, opts *options.FindOptions) ([]Book, error) {
+	cursor, err := b.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Book
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Authors lists every author once, in the order their first book was
+// added.
+func (b *Books) Authors(ctx context.Context) ([]string, error) {
+	results, err := b.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	authorsMap := make(map[string]bool)
+	var authors []string
+	for _, book := range results {
+		if !authorsMap[book.BookAuthor] {
+			authorsMap[book.BookAuthor] = true
+			authors = append(authors, book.BookAuthor)
+		}
+	}
+	return authors, nil
+}
+
+// ByID retrieves a single book by its ID (not the MongoID). It returns
+// ErrNotFound when there is no such book.
+func (b *Books) ByID(ctx context.Context, id string) (Book, error) {
+	var book Book
+	err := b.coll.FindOne(ctx, bson.M{"ID": id}, FindOneOpts(ctx)).Decode(&book)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Book{}, ErrNotFound
+	}
+	return book, err
+}
+
+// Exists tells if a book identical to the given one is stored already (see
+// DuplicateFilter).
+func (b *Books) Exists(ctx context.Context, book Book) (bool, error) {
+	err := b.coll.FindOne(ctx, DuplicateFilter(book), FindOneOpts(ctx)).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Random picks a book at random with $sample. It returns ErrNotFound when
+// the catalog is empty.
+func (b *Books) Random(ctx context.Context) (Book, error) {
+	pipeline := mongo.Pipeline{{{Key: "$sample", Value: bson.M{"size": 1}}}}
+	cursor, err := b.coll.Aggregate(ctx, pipeline, AggregateOpts(ctx))
+	if err != nil {
+		return Book{}, err
+	}
+	var books []Book
+	if err := cursor.All(ctx, &books); err != nil {
+		return Book{}, err
+	}
+	if len(books) == 0 {
+		return Book{}, ErrNotFound
+	}
+	return books[0], nil
+}
+
+// NumericCollation sorts strings holding numbers by their value. Pages and
+// years are stored as strings, so we use it to sort "280" after "50".
+var NumericCollation = &options.Collation{Locale: "en", NumericOrdering: true}
+
+// ByAuthor retrieves the books written by the given author, sorted by one
+// of the keys in SortFields.
+func (b *Books) ByAuthor(ctx context.Context, author string, sortKey string, desc bool) ([]Book, error) {
+	field, ok := SortFields[sortKey]
+	if !ok {
+		field = SortFields["title"]
+	}
+	direction := 1
+	if desc {
+		direction = -1
+	}
+	opts := FindOpts(ctx).
+		SetSort(bson.D{{Key: field, Value: direction}}).
+		SetCollation(NumericCollation)
+	return b.find(ctx, bson.M{"BookAuthor": author}, opts)
+}
+
+// YearsByDecade lets MongoDB do the heavy-lifting: first we count the
+// books per year, then we fold the years into decades. Years are stored as
+// strings, so we convert them on the fly and keep the non-numeric ones in a
+// separate bucket (decade null) instead of failing the whole pipeline.
+func (b *Books) YearsByDecade(ctx context.Context) ([]DecadeGroup, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"BookYear": bson.M{"$nin": bson.A{"", nil}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$BookYear",
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"yearNum": bson.M{"$convert": bson.M{
+				"input":   "$_id",
+				"to":      "int",
+				"onError": nil,
+				"onNull":  nil,
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "yearNum", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$subtract": bson.A{"$yearNum", bson.M{"$mod": bson.A{"$yearNum", 10}}}},
+			"count": bson.M{"$sum": "$count"},
+			"years": bson.M{"$push": bson.M{"year": "$_id", "count": "$count"}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+
+	cursor, err := b.coll.Aggregate(ctx, pipeline, AggregateOpts(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var results []DecadeGroup
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ByYear retrieves the books published in the given year, sorted by title.
+func (b *Books) ByYear(ctx context.Context, year string) ([]Book, error) {
+	opts := FindOpts(ctx).SetSort(bson.D{{Key: "BookName", Value: 1}})
+	return b.find(ctx, bson.M{"BookYear": year}, opts)
+}
+
+// Shelves counts the books on each shelf, in the order of the shelves
+// ("B2" before "B10"). The books without a shelf are counted too, under
+// Unshelved, so none goes amiss when the library is audited.
+func (b *Books) Shelves(ctx context.Context) ([]ShelfCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$BookShelf", ""}}, ""}},
+				Unshelved,
+				"$BookShelf",
+			}},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := b.coll.Aggregate(ctx, pipeline, AggregateOpts(ctx).SetCollation(NumericCollation))
+	if err != nil {
+		return nil, err
+	}
+	results := []ShelfCount{}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ByShelf retrieves the books on the given shelf, or without a shelf for
+// Unshelved, sorted by title.
+func (b *Books) ByShelf(ctx context.Context, shelf string) ([]Book, error) {
+	filter := bson.M{"BookShelf": shelf}
+	if shelf == Unshelved {
+		filter = bson.M{"BookShelf": bson.M{"$in": bson.A{"", nil}}}
+	}
+	opts := FindOpts(ctx).SetSort(bson.D{{Key: "BookName", Value: 1}})
+	return b.find(ctx, filter, opts)
+}
+
+// Recent retrieves the newest books. ObjectIDs start with their creation
+// time, so sorting by _id gives us insertion order for free, even for
+// records that have no createdAt field.
+func (b *Books) Recent(ctx context.Context, limit int64) ([]Book, error) {
+	opts := FindOpts(ctx).SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+	return b.find(ctx, bson.D{}, opts)
+}
+
+// Changes are the books added, and those updated (but added earlier),
+// since a given time, newest first.
+type Changes struct {
+	Added   []Book `bson:"added" json:"added"`
+	Updated []Book `bson:"updated" json:"updated"`
+}
+
+// Changes lists the books added or updated since the given time, at most
+// limit of each. The first $match can use the createdAt and updatedAt
+// indexes; the $facet then splits the few books left into additions and
+// updates.
+func (b *Books) Changes(ctx context.Context, since time.Time, limit int) (Changes, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"createdAt": bson.M{"$gte": since}},
+			bson.M{"updatedAt": bson.M{"$gte": since}},
+		}}}},
+		{{Key: "$facet", Value: bson.M{
+			"added": bson.A{
+				bson.M{"$match": bson.M{"createdAt": bson.M{"$gte": since}}},
+				bson.M{"$sort": bson.M{"createdAt": -1}},
+				bson.M{"$limit": limit},
+			},
+			"updated": bson.A{
+				bson.M{"$match": bson.M{"createdAt": bson.M{"$not": bson.M{"$gte": since}}}},
+				bson.M{"$sort": bson.M{"updatedAt": -1}},
+				bson.M{"$limit": limit},
+			},
+		}}},
+	}
+	changes := Changes{Added: []Book{}, Updated: []Book{}}
+	cursor, err := b.coll.Aggregate(ctx, pipeline, AggregateOpts(ctx))
+	if err != nil {
+		return changes, err
+	}
+	var facets []Changes
+	if err := cursor.All(ctx, &facets); err != nil {
+		return changes, err
+	}
+	if len(facets) > 0 {
+		changes.Added = append(changes.Added, facets[0].Added...)
+		changes.Updated = append(changes.Updated, facets[0].Updated...)
+	}
+	return changes, nil
+}
+
+// LastModified returns the last time a book was added or changed, the zero
+// time when there are none. Deleting a book doesn't change it.
+func (b *Books) LastModified(ctx context.Context) (time.Time, error) {
+	var latest time.Time
+	// The latest change is the last updated book, or the last one added
+	// since; books from before the timestamps only have their _id.
+	for _, key := range []string{"updatedAt", "createdAt", "_id"} {
+		var book Book
+		opts := FindOneOpts(ctx).SetSort(bson.D{{Key: key, Value: -1}})
+		err := b.coll.FindOne(ctx, bson.D{}, opts).Decode(&book)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return latest, nil
+		}
+		if err != nil {
+			return latest, err
+		}
+		if at := book.LastModified(); at.After(latest) {
+			latest = at
+		}
+	}
+	return latest, nil
+}
+
+// Insert adds a new book. It returns a *ValidationError when the book is
+// invalid, and ErrDuplicate when an identical one is stored already.
+func (b *Books) Insert(ctx context.Context, book Book) error {
+	if errs := ValidateBook(book); len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	exists, err := b.Exists(ctx, book)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrDuplicate
+	}
+	_, err = b.coll.InsertOne(ctx, book, InsertOneOpts(ctx))
+	return err
+}
+
+// Update sets the given fields of the book with the given ID. The book
+// fields are validated first, a *ValidationError telling what is wrong,
+// and so are the keys, which must not be operators (see CheckKeys). It
+// returns ErrNotFound when there is no such book.
+func (b *Books) Update(ctx context.Context, id string, fields bson.M) error {
+	if err := CheckKeys(fields); err != nil {
+		return err
+	}
+	errs := FieldErrors{}
+	for field, value := range fields {
+		switch value := value.(type) {
+		case string:
+			if msg := ValidateBookField(field, value); msg != "" {
+				errs[field] = msg
+			}
+		case map[string]string:
+			if msg := ValidateTitles(value); msg != "" {
+				errs[field] = msg
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	res, err := b.coll.UpdateOne(ctx, bson.M{"ID": id}, bson.M{"$set": fields}, UpdateOpts(ctx))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the book with the given ID. It returns ErrNotFound when
+// there was no such book.
+func (b *Books) Delete(ctx context.Context, id string) error {
+	res, err := b.coll.DeleteOne(ctx, bson.M{"ID": id}, DeleteOpts(ctx))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
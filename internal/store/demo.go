@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// demoBooks extend the example books with enough classics to try the
+// browsing, the shelves, the search and the facets on a demo instance.
+var demoBooks = []Book{
+	{ID: "pride-and-prejudice", BookName: "Pride and Prejudice", BookAuthor: "Jane Austen", BookPages: "432", BookYear: "1813", BookShelf: "A1", BookTags: []string{"classic", "romance"}},
+	{ID: "moby-dick", BookName: "Moby-Dick", BookAuthor: "Herman Melville", BookPages: "635", BookYear: "1851", BookShelf: "A1", BookTags: []string{"classic", "adventure"}},
+	{ID: "dracula", BookName: "Dracula", BookAuthor: "Bram Stoker", BookPages: "418", BookYear: "1897", BookShelf: "B2", BookTags: []string{"gothic", "horror"}},
+	{ID: "the-time-machine", BookName: "The Time Machine", BookAuthor: "H. G. Wells", BookPages: "118", BookYear: "1895", BookShelf: "C1", BookTags: []string{"science-fiction"}},
+	{ID: "alice-in-wonderland", BookName: "Alice's Adventures in Wonderland", BookAuthor: "Lewis Carroll", BookPages: "192", BookYear: "1865", BookShelf: "C2", BookTags: []string{"fantasy", "children"}},
+	{ID: "dorian-gray", BookName: "The Picture of Dorian Gray", BookAuthor: "Oscar Wilde", BookPages: "254", BookYear: "1890", BookShelf: "B2", BookTags: []string{"gothic", "classic"}},
+	{ID: "great-expectations", BookName: "Great Expectations", BookAuthor: "Charles Dickens", BookPages: "544", BookYear: "1861", BookShelf: "A1", BookTags: []string{"classic"}},
+	{ID: "jane-eyre", BookName: "Jane Eyre", BookAuthor: "Charlotte Brontë", BookPages: "532", BookYear: "1847", BookShelf: "A2", BookTags: []string{"classic", "romance"}},
+	{ID: "wuthering-heights", BookName: "Wuthering Heights", BookAuthor: "Emily Brontë", BookPages: "416", BookYear: "1847", BookShelf: "A2", BookTags: []string{"classic", "gothic"}},
+	{ID: "sherlock-holmes", BookName: "The Adventures of Sherlock Holmes", BookAuthor: "Arthur Conan Doyle", BookPages: "307", BookYear: "1892", BookShelf: "B1", BookTags: []string{"mystery"}},
+	{ID: "crime-and-punishment", BookName: "Crime and Punishment", BookAuthor: "Fyodor Dostoevsky", BookPages: "671", BookYear: "1866", BookShelf: "A3", BookTags: []string{"classic"}},
+	{ID: "don-quixote", BookName: "Don Quixote", BookAuthor: "Miguel de Cervantes", BookPages: "1072", BookYear: "1605", BookShelf: "A3", BookTags: []string{"classic", "adventure"}},
+	{ID: "monte-cristo", BookName: "The Count of Monte Cristo", BookAuthor: "Alexandre Dumas", BookPages: "1276", BookYear: "1844", BookShelf: "A3", BookTags: []string{"adventure"}},
+	{ID: "twenty-thousand-leagues", BookName: "Twenty Thousand Leagues Under the Seas", BookAuthor: "Jules Verne", BookPages: "426", BookYear: "1870", BookShelf: "C1", BookTags: []string{"science-fiction", "adventure"}},
+	{ID: "house-of-usher", BookName: "The Fall of the House of Usher", BookAuthor: "Edgar Allan Poe", BookPages: "32", BookYear: "1839", BookShelf: "B2", BookTags: []string{"gothic", "horror"}},
+	{ID: "the-last-man", BookName: "The Last Man", BookAuthor: "Mary Shelley", BookPages: "479", BookYear: "1826", BookShelf: "C1", BookTags: []string{"science-fiction"}},
+	{ID: "maria", BookName: "María", BookAuthor: "Jorge Isaacs", BookPages: "336", BookYear: "1867", BookShelf: "A2", BookTags: []string{"romance"}},
+	{ID: "les-miserables", BookName: "Les Misérables", BookAuthor: "Victor Hugo", BookPages: "1463", BookYear: "1862", BookTags: []string{"classic"}},
+}
+
+// DemoBooks returns the catalog of a demo instance: the example books and
+// some twenty classics.
+func DemoBooks() []Book {
+	books := make([]Book, 0, len(exampleBooks)+len(demoBooks))
+	books = append(books, exampleBooks...)
+	return append(books, demoBooks...)
+}
+
+// Reset replaces the whole catalog with the given books, e.g. to undo
+// what visitors did to a demo instance. It returns how many books were
+// deleted.
+func (b *Books) Reset(ctx context.Context, books []Book) (int64, error) {
+	res, err := b.coll.DeleteMany(ctx, bson.D{}, DeleteOpts(ctx))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	docs := make([]interface{}, len(books))
+	for i, book := range books {
+		book.CreatedAt = &now
+		docs[i] = book
+	}
+	if len(docs) > 0 {
+		if _, err := b.coll.InsertMany(ctx, docs); err != nil {
+			return res.DeletedCount, err
+		}
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The errors of the repository. Callers tell them apart with errors.Is and
+// errors.As; the handlers map them to HTTP statuses.
+var (
+	ErrNotFound    = errors.New("book not found")
+	ErrDuplicate   = errors.New("book already exists")
+	ErrValidation  = errors.New("invalid book")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// ValidationError tells what is wrong with a book, field by field. It
+// matches ErrValidation.
+type ValidationError struct {
+	Fields FieldErrors
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, msg := range e.Fields {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	return ErrValidation.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// UnavailableError is returned instead of calling the database while it is
+// known to be down, see the circuit breaker of the server. It matches
+// ErrUnavailable.
+type UnavailableError struct {
+	// When the database will be tried again
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return ErrUnavailable.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return ErrUnavailable
+}
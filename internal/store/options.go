@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+
+	"github.com/CAPS-Cloud/exercises/internal/requestid"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The helpers below tag MongoDB operations with the request ID as a comment.
+// It then shows up in the database profiler, currentOp and the server logs,
+// next to our own log lines.
+
+func comment(ctx context.Context) string {
+	if id := requestid.FromContext(ctx); id != "" {
+		return "request_id=" + id
+	}
+	return ""
+}
+
+func FindOpts(ctx context.Context) *options.FindOptions {
+	opts := options.Find()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func FindOneOpts(ctx context.Context) *options.FindOneOptions {
+	opts := options.FindOne()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func AggregateOpts(ctx context.Context) *options.AggregateOptions {
+	opts := options.Aggregate()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func InsertOneOpts(ctx context.Context) *options.InsertOneOptions {
+	opts := options.InsertOne()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func UpdateOpts(ctx context.Context) *options.UpdateOptions {
+	opts := options.Update()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func DeleteOpts(ctx context.Context) *options.DeleteOptions {
+	opts := options.Delete()
+	if comment := comment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The q parameter of GET /api/books filters the books with a small query
+// language:
+//
+//	query      = term { term }
+//	term       = [ "-" ] ( field operator value | value )
+//	field      = "id" | "title" | "author" | "edition" | "pages" | "year" | "tag"
+//	           | "shelf"
+//	operator   = ":" | "=" | ">" | ">=" | "<" | "<="
+//	value      = word | '"' { any character but '"' } '"'
+//
+// Terms are separated by spaces and must all match; a leading "-" negates a
+// term. "field:value" matches when the field contains value, ignoring
+// case; "field=value" when it is exactly value. The comparisons only apply
+// to the numeric fields, pages and year. A value on its own is looked for
+// in the title and the author. For example:
+//
+//	author:"Poe" year>=1800 -tag:horror
+//	frankenstein pages<300
+var queryFields = map[string]string{
+	"id":      "ID",
+	"title":   "BookName",
+	"author":  "BookAuthor",
+	"edition": "BookEdition",
+	"pages":   "BookPages",
+	"year":    "BookYear",
+	"tag":     "BookTags",
+	"shelf":   "BookShelf",
+}
+
+var numericQueryFields = map[string]bool{"pages": true, "year": true}
+
+// Longest first, so ">=" isn't read as ">" followed by "=value".
+var queryOperators = []string{">=", "<=", ":", "=", ">", "<"}
+
+// QueryError tells what is wrong with a query and where, Pos being the byte
+// offset in the query.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseQuery turns a query into a MongoDB filter. An empty query matches
+// every book.
+func ParseQuery(q string) (bson.M, error) {
+	var conds bson.A
+	pos := 0
+	for {
+		for pos < len(q) && q[pos] == ' ' {
+			pos++
+		}
+		if pos == len(q) {
+			break
+		}
+		cond, next, err := parseTerm(q, pos)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+		pos = next
+	}
+	switch len(conds) {
+	case 0:
+		return bson.M{}, nil
+	case 1:
+		return conds[0].(bson.M), nil
+	}
+	return bson.M{"$and": conds}, nil
+}
+
+// parseTerm reads the term starting at pos and returns its filter and the
+// position right after it.
+func parseTerm(q string, pos int) (bson.M, int, error) {
+	start := pos
+	negate := false
+	if q[pos] == '-' {
+		negate = true
+		pos++
+	}
+
+	// A field name is followed by an operator; anything else is a value
+	field, op := "", ""
+	if name := leadingWord(q[pos:]); name != "" {
+		for _, o := range queryOperators {
+			if strings.HasPrefix(q[pos+len(name):], o) {
+				field, op = strings.ToLower(name), o
+				pos += len(name) + len(o)
+				break
+			}
+		}
+	}
+
+	value, next, err := parseValue(q, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var cond bson.M
+	if field == "" {
+		pattern := Contains(value)
+		cond = bson.M{"$or": bson.A{bson.M{"BookName": pattern}, bson.M{"BookAuthor": pattern}}}
+	} else {
+		cond, err = fieldCondition(field, op, value)
+		if err != nil {
+			return nil, 0, &QueryError{Pos: start, Msg: err.Error()}
+		}
+	}
+	if negate {
+		cond = bson.M{"$nor": bson.A{cond}}
+	}
+	return cond, next, nil
+}
+
+func fieldCondition(field, op, value string) (bson.M, error) {
+	key, ok := queryFields[field]
+	if !ok {
+		known := make([]string, 0, len(queryFields))
+		for name := range queryFields {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(known, ", "))
+	}
+
+	switch op {
+	case ":":
+		return bson.M{key: Contains(value)}, nil
+	case "=":
+		return bson.M{key: value}, nil
+	}
+
+	if !numericQueryFields[field] {
+		return nil, fmt.Errorf("%s can't be compared with %s, only pages and year can", field, op)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s%s needs a whole number, got %q", field, op, value)
+	}
+	// Numbers are stored as strings: convert them for the comparison.
+	// Books without a numeric value never match.
+	number := bson.M{"$convert": bson.M{"input": "$" + key, "to": "int", "onError": nil, "onNull": nil}}
+	cmp := map[string]string{">": "$gt", ">=": "$gte", "<": "$lt", "<=": "$lte"}[op]
+	return bson.M{"$expr": bson.M{"$and": bson.A{
+		bson.M{"$ne": bson.A{number, nil}},
+		bson.M{cmp: bson.A{number, n}},
+	}}}, nil
+}
+
+// parseValue reads a word or a quoted string starting at pos.
+func parseValue(q string, pos int) (string, int, error) {
+	if pos == len(q) || q[pos] == ' ' {
+		return "", 0, &QueryError{Pos: pos, Msg: "missing value"}
+	}
+	if q[pos] != '"' {
+		end := strings.IndexByte(q[pos:], ' ')
+		if end < 0 {
+			end = len(q) - pos
+		}
+		value := q[pos : pos+end]
+		if strings.Contains(value, `"`) {
+			return "", 0, &QueryError{Pos: pos, Msg: `unexpected " in value`}
+		}
+		return value, pos + end, nil
+	}
+	end := strings.IndexByte(q[pos+1:], '"')
+	if end < 0 {
+		return "", 0, &QueryError{Pos: pos, Msg: "unterminated quoted value"}
+	}
+	next := pos + 1 + end + 1
+	if next < len(q) && q[next] != ' ' {
+		return "", 0, &QueryError{Pos: next, Msg: "missing space after quoted value"}
+	}
+	return q[pos+1 : pos+1+end], next, nil
+}
+
+// leadingWord returns the letters s starts with.
+func leadingWord(s string) string {
+	end := 0
+	for end < len(s) && (s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z') {
+		end++
+	}
+	return s[:end]
+}
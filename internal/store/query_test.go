@@ -0,0 +1,87 @@
+package store_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// numberCondition is the filter of a comparison of a numeric field.
+func numberCondition(key, cmp string, n int) bson.M {
+	number := bson.M{"$convert": bson.M{"input": "$" + key, "to": "int", "onError": nil, "onNull": nil}}
+	return bson.M{"$expr": bson.M{"$and": bson.A{
+		bson.M{"$ne": bson.A{number, nil}},
+		bson.M{cmp: bson.A{number, n}},
+	}}}
+}
+
+func TestParseQuery(t *testing.T) {
+	anywhere := func(s string) bson.M {
+		return bson.M{"$or": bson.A{bson.M{"BookName": store.Contains(s)}, bson.M{"BookAuthor": store.Contains(s)}}}
+	}
+	tests := []struct {
+		query  string
+		filter bson.M
+	}{
+		{"", bson.M{}},
+		{"   ", bson.M{}},
+		{"frankenstein", anywhere("frankenstein")},
+		{`"mary shelley"`, anywhere("mary shelley")},
+		{"title:dracula", bson.M{"BookName": store.Contains("dracula")}},
+		{"Title:dracula", bson.M{"BookName": store.Contains("dracula")}},
+		{`author:"Edgar Allan Poe"`, bson.M{"BookAuthor": store.Contains("Edgar Allan Poe")}},
+		{"id=example1", bson.M{"ID": "example1"}},
+		{"tag=horror", bson.M{"BookTags": "horror"}},
+		{"shelf:fiction", bson.M{"BookShelf": store.Contains("fiction")}},
+		{"year>=1800", numberCondition("BookYear", "$gte", 1800)},
+		{"year>1800", numberCondition("BookYear", "$gt", 1800)},
+		{"pages<300", numberCondition("BookPages", "$lt", 300)},
+		{"pages<=300", numberCondition("BookPages", "$lte", 300)},
+		{"-tag:horror", bson.M{"$nor": bson.A{bson.M{"BookTags": store.Contains("horror")}}}},
+		{"frankenstein  pages<300", bson.M{"$and": bson.A{anywhere("frankenstein"), numberCondition("BookPages", "$lt", 300)}}},
+		// Not a known operator after the word, so a value
+		{"sci-fi", anywhere("sci-fi")},
+		{"title:a:b", bson.M{"BookName": store.Contains("a:b")}},
+	}
+	for _, tt := range tests {
+		filter, err := store.ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(filter, tt.filter) {
+			t.Errorf("%q: got %v, want %v", tt.query, filter, tt.filter)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{"title:", 6},
+		{"title: dracula", 6},
+		{`title:"dracula`, 6},
+		{`title:"dracula"poe`, 15},
+		{`dra"cula`, 0},
+		{"isbn:123", 0},
+		{"poe title>dracula", 4},
+		{"year>=eighteen", 0},
+		{"-", 1},
+	}
+	for _, tt := range tests {
+		_, err := store.ParseQuery(tt.query)
+		var qerr *store.QueryError
+		if !errors.As(err, &qerr) {
+			t.Errorf("%q: got %v, want a QueryError", tt.query, err)
+			continue
+		}
+		if qerr.Pos != tt.pos {
+			t.Errorf("%q: error at %d, want %d: %v", tt.query, qerr.Pos, tt.pos, err)
+		}
+	}
+}
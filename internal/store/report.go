@@ -0,0 +1,53 @@
+package store
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReportFilter narrows down the books included in a report. Empty fields
+// are ignored.
+type ReportFilter struct {
+	Author string
+	Year   string
+	Query  string // matched against title and author, case insensitive
+}
+
+// Filter turns the filter into a MongoDB query. The free text is quoted so
+// it is matched literally rather than interpreted as a regular expression.
+func (f ReportFilter) Filter() bson.M {
+	filter := bson.M{}
+	if f.Author != "" {
+		filter["BookAuthor"] = f.Author
+	}
+	if f.Year != "" {
+		filter["BookYear"] = f.Year
+	}
+	if f.Query != "" {
+		pattern := Contains(f.Query)
+		filter["$or"] = bson.A{
+			bson.M{"BookName": pattern},
+			bson.M{"BookAuthor": pattern},
+		}
+	}
+	return filter
+}
+
+// String describes the filter for the report header.
+func (f ReportFilter) String() string {
+	var parts []string
+	if f.Author != "" {
+		parts = append(parts, "author: "+f.Author)
+	}
+	if f.Year != "" {
+		parts = append(parts, "year: "+f.Year)
+	}
+	if f.Query != "" {
+		parts = append(parts, "search: "+f.Query)
+	}
+	if len(parts) == 0 {
+		return "all books"
+	}
+	return strings.Join(parts, ", ")
+}
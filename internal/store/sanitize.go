@@ -0,0 +1,67 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Values coming from users (search terms, filters, IDs) must only ever end
+// up in value positions of a query. The helpers below are the way to put
+// them there: regular expressions are built from the quoted text, values in
+// aggregation expressions are wrapped in $literal, and documents whose keys
+// come from outside are checked for operators.
+
+// Contains matches the fields containing s, ignoring case. The regular
+// expression metacharacters in s are matched literally.
+func Contains(s string) primitive.Regex {
+	return primitive.Regex{Pattern: regexp.QuoteMeta(s), Options: "i"}
+}
+
+// HasPrefix matches the fields starting with s, ignoring case, like
+// Contains.
+func HasPrefix(s string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(s), Options: "i"}
+}
+
+// Literal wraps a value used in an aggregation expression, where a string
+// starting with "$" would otherwise be read as a field path, e.g. an author
+// named "$BookName".
+func Literal(v interface{}) bson.M {
+	return bson.M{"$literal": v}
+}
+
+// CheckKeys rejects the documents with keys that MongoDB would take for an
+// operator ("$gt") or a path into another field ("a.b"), at any depth. The
+// error is a *ValidationError naming the keys at fault.
+func CheckKeys(doc bson.M) error {
+	errs := FieldErrors{}
+	checkKeys(doc, "", errs)
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+func checkKeys(v interface{}, prefix string, errs FieldErrors) {
+	switch v := v.(type) {
+	case bson.M:
+		for key, value := range v {
+			if strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+				errs[prefix+key] = "Field names can't start with $ or contain a dot"
+				continue
+			}
+			checkKeys(value, prefix+key+".", errs)
+		}
+	case map[string]interface{}:
+		checkKeys(bson.M(v), prefix, errs)
+	case bson.A:
+		for _, value := range v {
+			checkKeys(value, prefix, errs)
+		}
+	case []interface{}:
+		checkKeys(bson.A(v), prefix, errs)
+	}
+}
@@ -0,0 +1,140 @@
+package store_test
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// operatorKeys lists the "$" keys of a filter, at any depth.
+func operatorKeys(v interface{}) []string {
+	var keys []string
+	switch v := v.(type) {
+	case bson.M:
+		for key, value := range v {
+			if strings.HasPrefix(key, "$") {
+				keys = append(keys, key)
+			}
+			keys = append(keys, operatorKeys(value)...)
+		}
+	case bson.A:
+		for _, value := range v {
+			keys = append(keys, operatorKeys(value)...)
+		}
+	}
+	return keys
+}
+
+// regexes lists the regular expressions of a filter, at any depth.
+func regexes(v interface{}) []primitive.Regex {
+	var found []primitive.Regex
+	switch v := v.(type) {
+	case primitive.Regex:
+		found = append(found, v)
+	case bson.M:
+		for _, value := range v {
+			found = append(found, regexes(value)...)
+		}
+	case bson.A:
+		for _, value := range v {
+			found = append(found, regexes(value)...)
+		}
+	}
+	return found
+}
+
+func TestParseQueryInjection(t *testing.T) {
+	tests := []struct {
+		query string
+		// The operators the query may produce, the others coming from
+		// the user
+		allowed string
+	}{
+		{`.*`, "$or"},
+		{`title:.*`, ""},
+		{`author:"^(a+)+$"`, ""},
+		{`id=$ne`, ""},
+		{`title:{"$gt":""}`, ""},
+		{`"$where" sleep(1000)`, "$or $and"},
+		{`id=example1 -author:$regex`, "$and $nor"},
+	}
+	for _, tt := range tests {
+		filter, err := store.ParseQuery(tt.query)
+		if err != nil {
+			// Rejecting the query is just as safe
+			continue
+		}
+		for _, key := range operatorKeys(filter) {
+			if !strings.Contains(tt.allowed, key) {
+				t.Errorf("%q: unexpected operator %s in %v", tt.query, key, filter)
+			}
+		}
+		for _, re := range regexes(filter) {
+			// Quoted, none of the patterns matches any title
+			if regexp.MustCompile(re.Pattern).MatchString("Frankenstein") {
+				t.Errorf("%q: pattern %q isn't matched literally", tt.query, re.Pattern)
+			}
+		}
+	}
+}
+
+func TestContainsIsLiteral(t *testing.T) {
+	for _, s := range []string{".*", "^(a+)+$", "a|b", `\d`, "[x]"} {
+		re := regexp.MustCompile("(?i)" + store.Contains(s).Pattern)
+		if !re.MatchString("<" + s + ">") {
+			t.Errorf("%q: %q doesn't match the text itself", s, re)
+		}
+		if re.MatchString("anything else") {
+			t.Errorf("%q: %q matches other text", s, re)
+		}
+	}
+	if re := regexp.MustCompile(store.HasPrefix("a.").Pattern); re.MatchString("ab") || !re.MatchString("a.b") {
+		t.Errorf("HasPrefix(%q) = %q", "a.", re)
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	tests := []struct {
+		doc     bson.M
+		invalid []string
+	}{
+		{bson.M{"BookName": "Dracula", "BookYear": "1897"}, nil},
+		{bson.M{"BookName": "$where"}, nil},
+		{bson.M{"$where": "sleep(1000)"}, []string{"$where"}},
+		{bson.M{"BookName": bson.M{"$ne": nil}}, []string{"BookName.$ne"}},
+		{bson.M{"tags": bson.A{bson.M{"$gt": ""}}}, []string{"tags.$gt"}},
+		{bson.M{"BookName.first": "x"}, []string{"BookName.first"}},
+		{bson.M{"BookName": map[string]interface{}{"$regex": ".*"}}, []string{"BookName.$regex"}},
+	}
+	for _, tt := range tests {
+		err := store.CheckKeys(tt.doc)
+		if tt.invalid == nil {
+			if err != nil {
+				t.Errorf("%v: %v", tt.doc, err)
+			}
+			continue
+		}
+		var ve *store.ValidationError
+		if !errors.As(err, &ve) || !errors.Is(err, store.ErrValidation) {
+			t.Errorf("%v: got %v, want a validation error", tt.doc, err)
+			continue
+		}
+		for _, key := range tt.invalid {
+			if ve.Fields[key] == "" {
+				t.Errorf("%v: %q not reported in %v", tt.doc, key, ve.Fields)
+			}
+		}
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	got := store.Literal("$BookName")
+	if len(got) != 1 || got["$literal"] != "$BookName" {
+		t.Errorf("Literal = %v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import "html/template"
+
+// SearchResult is a book matching a search, with its relevance between 0
+// and 1 (1 being an exact match).
+type SearchResult struct {
+	Book
+	Score float64 `json:"score"`
+	// The matching words of "title" and "author" wrapped in <mark>, when
+	// the backend supports it.
+	Highlights map[string]template.HTML `json:"highlights,omitempty"`
+}
+
+// Title is the title to show in the search results, highlighted if
+// possible.
+func (r SearchResult) Title() template.HTML {
+	if h, ok := r.Highlights["title"]; ok {
+		return h
+	}
+	return template.HTML(template.HTMLEscapeString(r.BookName))
+}
+
+// Author is the author to show, highlighted if possible.
+func (r SearchResult) Author() template.HTML {
+	if h, ok := r.Highlights["author"]; ok {
+		return h
+	}
+	return template.HTML(template.HTMLEscapeString(r.BookAuthor))
+}
+
+// Percent is the score as shown in the search results.
+func (r SearchResult) Percent() int {
+	return int(r.Score*100 + 0.5)
+}
+
+// FacetCount is one value of a facet and how many results have it.
+type FacetCount struct {
+	Value string `bson:"_id" json:"value"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Suggestion completes what was typed in the search bar: a title (with the
+// ID of the book) or an author.
+type Suggestion struct {
+	Value string `json:"value"`
+	Type  string `json:"type"` // "title" or "author"
+	ID    string `json:"id,omitempty"`
+}
+
+// SimilarBook is a recommendation with the score it got.
+type SimilarBook struct {
+	Book  `bson:",inline"`
+	Score float64 `bson:"score" json:"score"`
+}
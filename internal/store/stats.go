@@ -0,0 +1,41 @@
+package store
+
+// MonthCount is the number of books added to the catalog in a given month
+// (formatted as YYYY-MM).
+type MonthCount struct {
+	Month string `bson:"_id" json:"month"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// GrowthPoint is the size of the catalog at the end of a month (formatted
+// as YYYY-MM), and how many books were added that month.
+type GrowthPoint struct {
+	Month string `json:"month"`
+	Added int    `json:"added"`
+	Total int    `json:"total"`
+}
+
+// AuthorCount is an author together with the number of books they have in
+// the catalog.
+type AuthorCount struct {
+	Author string `bson:"_id" json:"author"`
+	Count  int    `bson:"count" json:"count"`
+}
+
+// CatalogStats is the data passed to the "admin" block, and returned by
+// GET /api/stats.
+type CatalogStats struct {
+	TotalBooks   int `json:"totalBooks"`
+	TotalAuthors int `json:"totalAuthors"`
+	FirstYear    int `json:"firstYear,omitempty"`
+	LastYear     int `json:"lastYear,omitempty"`
+	// Over the books with a page count
+	AveragePages float64 `json:"averagePages"`
+	// Publication years, oldest first
+	PerYear []YearCount `json:"perYear"`
+	// The last 12 months with additions, latest first
+	PerMonth   []MonthCount  `json:"perMonth"`
+	TopAuthors []AuthorCount `json:"topAuthors"`
+	// Every month with additions, oldest first
+	Growth []GrowthPoint `json:"growth"`
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Books may have alternate titles, by language or script, e.g. the
+// translations of the title or its transliteration:
+//
+//	"titles": {"es": "Frankenstein o el moderno Prometeo", "ru-Latn": "Frankenshtein"}
+//
+// BookName stays the title of the book, usually the original one. The
+// pages show the title matching the languages of the reader (see
+// Localized).
+
+// languageTagPattern matches BCP 47 language tags such as en, es-419 or
+// sr-Latn, loosely.
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{1,8})*$`)
+
+// ValidateTitles checks the alternate titles of a book and returns an
+// empty string when they are acceptable.
+func ValidateTitles(titles map[string]string) string {
+	for lang, title := range titles {
+		if !languageTagPattern.MatchString(lang) {
+			return "Titles must be keyed by language, e.g. \"es\" or \"sr-Latn\", not \"" + lang + "\""
+		}
+		if strings.TrimSpace(title) == "" {
+			return "The title in \"" + lang + "\" is empty"
+		}
+	}
+	return ""
+}
+
+// Title returns the title of the book for the first of langs it has one
+// in, or BookName. A language matches the titles in the same language
+// with or without a region or script, e.g. es-MX matches es and es
+// matches es-419, after the exact matches.
+func (b Book) Title(langs []string) string {
+	if len(b.BookTitles) == 0 {
+		return b.BookName
+	}
+	for _, lang := range langs {
+		// The first of the close ones, so the same one is always picked
+		var closest string
+		for tag, title := range b.BookTitles {
+			if strings.EqualFold(tag, lang) {
+				return title
+			}
+			if (hasSubtag(lang, tag) || hasSubtag(tag, lang)) && (closest == "" || tag < closest) {
+				closest = tag
+			}
+		}
+		if closest != "" {
+			return b.BookTitles[closest]
+		}
+	}
+	return b.BookName
+}
+
+// hasSubtag tells if tag is prefix followed by more subtags, e.g. es-MX
+// and es.
+func hasSubtag(tag, prefix string) bool {
+	return len(tag) > len(prefix) && tag[len(prefix)] == '-' && strings.EqualFold(tag[:len(prefix)], prefix)
+}
+
+// Localized returns the book with the title for langs as BookName.
+func (b Book) Localized(langs []string) Book {
+	b.BookName = b.Title(langs)
+	return b
+}
+
+// LocalizeBooks returns the books with the titles for langs. The books
+// given, which may be shared with a cache, are left alone.
+func LocalizeBooks(books []Book, langs []string) []Book {
+	var localized []Book
+	for i, b := range books {
+		title := b.Title(langs)
+		if title == b.BookName {
+			continue
+		}
+		if localized == nil {
+			localized = append([]Book(nil), books...)
+		}
+		localized[i].BookName = title
+	}
+	if localized == nil {
+		return books
+	}
+	return localized
+}
@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/store"
+)
+
+func TestTitle(t *testing.T) {
+	book := store.Book{
+		BookName: "La vorágine",
+		BookTitles: map[string]string{
+			"en":      "The Vortex",
+			"es-419":  "La vorágine (edición latinoamericana)",
+			"es-ES":   "La vorágine (edición española)",
+			"sr-Cyrl": "Вртлог",
+		},
+	}
+	tests := []struct {
+		langs []string
+		want  string
+	}{
+		{nil, "La vorágine"},
+		{[]string{"en"}, "The Vortex"},
+		{[]string{"en-GB"}, "The Vortex"},
+		{[]string{"EN-us"}, "The Vortex"},
+		{[]string{"fr", "en"}, "The Vortex"},
+		{[]string{"es-ES", "en"}, "La vorágine (edición española)"},
+		// The close ones in the order of their tags
+		{[]string{"es"}, "La vorágine (edición latinoamericana)"},
+		{[]string{"sr"}, "Вртлог"},
+		{[]string{"fr", "de"}, "La vorágine"},
+	}
+	for _, tt := range tests {
+		if got := book.Title(tt.langs); got != tt.want {
+			t.Errorf("Title(%q) = %q, want %q", tt.langs, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizeBooks(t *testing.T) {
+	books := []store.Book{
+		{ID: "a", BookName: "Frankenstein"},
+		{ID: "b", BookName: "La vorágine", BookTitles: map[string]string{"en": "The Vortex"}},
+	}
+	if got := store.LocalizeBooks(books, []string{"de"}); &got[0] != &books[0] {
+		t.Error("the books were copied without any title to change")
+	}
+	got := store.LocalizeBooks(books, []string{"en"})
+	if got[1].BookName != "The Vortex" || got[0].BookName != "Frankenstein" {
+		t.Errorf("got %+v", got)
+	}
+	if books[1].BookName != "La vorágine" {
+		t.Errorf("the books given were changed: %+v", books)
+	}
+}
+
+func TestValidateTitles(t *testing.T) {
+	tests := []struct {
+		titles map[string]string
+		valid  bool
+	}{
+		{map[string]string{"en": "The Vortex", "sr-Latn": "Vrtlog", "es-419": "La vorágine"}, true},
+		{map[string]string{"english": "The Vortex"}, false},
+		{map[string]string{"$set": "x"}, false},
+		{map[string]string{"en.x": "x"}, false},
+		{map[string]string{"en": " "}, false},
+	}
+	for _, tt := range tests {
+		if got := store.ValidateTitles(tt.titles) == ""; got != tt.valid {
+			t.Errorf("ValidateTitles(%v) valid = %v, want %v", tt.titles, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+)
+
+// FieldErrors maps a form field name (e.g. "BookName") to a human readable
+// message. It is rendered inline next to the inputs of the create form, or
+// returned as JSON to API clients.
+type FieldErrors map[string]string
+
+// The same rules are declared as `pattern` attributes in the templates. Keep
+// both sides in sync: the browser check is only a convenience, this one is
+// the one that counts.
+var (
+	idPattern     = regexp.MustCompile(`^[^\s/]+$`)
+	numberPattern = regexp.MustCompile(`^[0-9]+$`)
+	yearPattern   = regexp.MustCompile(`^[0-9]{1,4}$`)
+)
+
+// Maps the form field names to the keys used in the JSON API.
+var JSONFields = map[string]string{
+	"ID":           "id",
+	"BookName":     "title",
+	"BookTitles":   "titles",
+	"BookAuthor":   "author",
+	"BookEdition":  "edition",
+	"BookPages":    "pages",
+	"BookYear":     "year",
+	"BookCover":    "cover",
+	"BookSubjects": "subjects",
+	"BookShelf":    "shelf",
+}
+
+// ValidateBookField checks a single field and returns an empty string when
+// the value is acceptable.
+func ValidateBookField(field string, value string) string {
+	value = strings.TrimSpace(value)
+	switch field {
+	case "ID":
+		if value == "" {
+			return "ID is required"
+		}
+		if !idPattern.MatchString(value) {
+			return "ID must not contain spaces or slashes"
+		}
+	case "BookName":
+		if value == "" {
+			return "Title is required"
+		}
+	case "BookAuthor":
+		if value == "" {
+			return "Author is required"
+		}
+	case "BookPages":
+		if value != "" && !numberPattern.MatchString(value) {
+			return "Pages must be a positive number"
+		}
+	case "BookYear":
+		if value != "" && !yearPattern.MatchString(value) {
+			return "Year must have at most 4 digits"
+		}
+	case "BookShelf":
+		if value == Unshelved {
+			return "Shelf can't be " + Unshelved + ", which stands for no shelf"
+		}
+	}
+	return ""
+}
+
+// ValidateBook checks a complete book, as received on creation.
+func ValidateBook(book Book) FieldErrors {
+	values := map[string]string{
+		"ID":          book.ID,
+		"BookName":    book.BookName,
+		"BookAuthor":  book.BookAuthor,
+		"BookEdition": book.BookEdition,
+		"BookPages":   book.BookPages,
+		"BookYear":    book.BookYear,
+		"BookShelf":   book.BookShelf,
+	}
+	errs := FieldErrors{}
+	for field, value := range values {
+		if msg := ValidateBookField(field, value); msg != "" {
+			errs[field] = msg
+		}
+	}
+	if msg := ValidateTitles(book.BookTitles); msg != "" {
+		errs["BookTitles"] = msg
+	}
+	return errs
+}
+
+// JSON converts the errors to the field names used by the JSON API.
+func (errs FieldErrors) JSON() map[string]string {
+	out := make(map[string]string, len(errs))
+	for field, msg := range errs {
+		if key, ok := JSONFields[field]; ok {
+			field = key
+		}
+		out[field] = msg
+	}
+	return out
+}